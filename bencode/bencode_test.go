@@ -0,0 +1,170 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testInfo struct {
+	Name        string   `bencode:"name"`
+	PieceLength int64    `bencode:"piece length"`
+	Private     bool     `bencode:"private,omitempty"`
+	Hash        [4]byte  `bencode:"hash"`
+	Tags        []string `bencode:"tags,omitempty"`
+	Ignored     string   `bencode:"-"`
+}
+
+type testFile struct {
+	Announce string     `bencode:"announce"`
+	Info     RawMessage `bencode:"info"`
+	Extra    map[string]interface{}
+}
+
+func Test_MarshalUnmarshal(t *testing.T) {
+	in := testInfo{
+		Name:        "file",
+		PieceLength: 16384,
+		Private:     true,
+		Hash:        [4]byte{'a', 'b', 'c', 'd'},
+		Ignored:     "x",
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "d4:hash4:abcd4:name4:file12:piece lengthi16384e7:privatei1ee"
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+
+	var out testInfo
+	if err := UnmarshalStrict(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Ignored = ""
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %v, got %v", in, out)
+	}
+}
+
+func Test_RawMessage(t *testing.T) {
+	data := []byte("d8:announce3:url4:infod4:name1:a1:zi1e6:lengthi3ee5:Extrad1:ki-2eee")
+
+	var f testFile
+	if err := Unmarshal(data, &f); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Info) != "d4:name1:a1:zi1e6:lengthi3ee" {
+		t.Errorf("Unexpected raw info %s", f.Info)
+	}
+	if f.Extra["k"] != int64(-2) {
+		t.Errorf("Expected -2, got %v", f.Extra["k"])
+	}
+
+	out, err := Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, f.Info) {
+		t.Errorf("Raw message not written as is: %s", out)
+	}
+}
+
+func Test_Strict(t *testing.T) {
+	var v interface{}
+	for _, data := range []string{"i03e", "i-0e", "03:abc", "d1:bi1e1:ai2ee", "d1:ai1e1:ai2ee"} {
+		if err := Unmarshal([]byte(data), &v); err != nil {
+			t.Errorf("Unexpected error in lenient mode for %s: %s", data, err)
+		}
+		if err := UnmarshalStrict([]byte(data), &v); err == nil {
+			t.Errorf("Expected error in strict mode for %s", data)
+		}
+	}
+}
+
+func Test_Invalid(t *testing.T) {
+	var v interface{}
+	for _, data := range []string{"", "i", "ie", "i1x2e", "5:abc", "l", "d1:a", "di1ei2ee", "x", "i1ei2e", "i99999999999999999999e"} {
+		if err := Unmarshal([]byte(data), &v); err == nil {
+			t.Errorf("Expected error for %q", data)
+		}
+	}
+
+	var info testInfo
+	if err := Unmarshal([]byte("d4:name3:abce"), &[]string{}); err == nil {
+		t.Errorf("Expected type error")
+	}
+	if err := Unmarshal([]byte("d4:namei3ee"), &info); err == nil {
+		t.Errorf("Expected type error")
+	}
+}
+
+func Test_Limits(t *testing.T) {
+	deep := strings.Repeat("l", 100) + strings.Repeat("e", 100)
+	var v interface{}
+	if err := Unmarshal([]byte(deep), &v); err == nil {
+		t.Errorf("Expected depth error")
+	}
+
+	d := NewDecoder(strings.NewReader("10:abcdefghij"))
+	d.MaxSize = 8
+	if err := d.Decode(&v); err == nil {
+		t.Errorf("Expected size error")
+	}
+
+	d = NewDecoder(strings.NewReader("999999999999:abc"))
+	if err := d.Decode(&v); err == nil {
+		t.Errorf("Expected size error")
+	}
+}
+
+func Test_Stream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e3:abcle"))
+	var n int
+	var s string
+	var l []int
+	if err := d.Decode(&n); err != nil || n != 1 {
+		t.Errorf("Expected 1, got %d (%v)", n, err)
+	}
+	if err := d.Decode(&s); err != nil || s != "abc" {
+		t.Errorf("Expected abc, got %s (%v)", s, err)
+	}
+	if err := d.Decode(&l); err != nil || l == nil || len(l) != 0 {
+		t.Errorf("Expected empty list, got %v (%v)", l, err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{"i42e", "4:spam", "l4:spami42ee", "d3:bar4:spam3:fooi42ee", "d4:infod6:lengthi3eee"} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var v interface{}
+		if err := UnmarshalStrict(data, &v); err != nil {
+			return
+		}
+		// canonical input must encode back to the same bytes
+		out, err := Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("Round trip mismatch: %q -> %q", data, out)
+		}
+
+		var raw RawMessage
+		if err := Unmarshal(data, &raw); err != nil || !bytes.Equal(raw, data) {
+			t.Errorf("RawMessage mismatch: %q -> %q (%v)", data, raw, err)
+		}
+	})
+}
+
+func FuzzDecodeStruct(f *testing.F) {
+	f.Add([]byte("d4:hash4:abcd4:name4:file12:piece lengthi16384ee"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var info testInfo
+		Unmarshal(data, &info)
+	})
+}
@@ -0,0 +1,536 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// DefaultMaxDepth is the maximum nesting of lists and dictionaries
+	DefaultMaxDepth = 64
+	// DefaultMaxSize is the maximum length in bytes of a decoded value
+	DefaultMaxSize = 64 * 1024 * 1024
+)
+
+// RawMessage is a raw encoded bencode value. It can be used to delay decoding
+// or to keep the exact bytes of a value, as needed for the info dictionary.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage{})
+
+// SyntaxError describes malformed or, in strict mode, non canonical input
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// UnmarshalTypeError describes a value that doesn't fit in the Go type
+type UnmarshalTypeError struct {
+	Value string
+	Type  reflect.Type
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
+}
+
+// Decoder reads bencoded values from a stream
+type Decoder struct {
+	r *bufio.Reader
+
+	// MaxDepth limits the nesting of lists and dictionaries
+	MaxDepth int
+	// MaxSize limits the number of bytes read for a single value
+	MaxSize int64
+	// Strict rejects unsorted or duplicated keys and integers or string
+	// lengths with leading zeros
+	Strict bool
+
+	offset    int64
+	start     int64
+	depth     int
+	record    *bytes.Buffer
+	typeError error
+}
+
+// NewDecoder returns a decoder reading from r with the default limits
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:        bufio.NewReader(r),
+		MaxDepth: DefaultMaxDepth,
+		MaxSize:  DefaultMaxSize,
+	}
+}
+
+// Unmarshal decodes the bencoded data into the value pointed by v
+func Unmarshal(data []byte, v interface{}) error {
+	return unmarshal(data, v, false)
+}
+
+// UnmarshalStrict is like Unmarshal but only accepts canonical bencode
+func UnmarshalStrict(data []byte, v interface{}) error {
+	return unmarshal(data, v, true)
+}
+
+func unmarshal(data []byte, v interface{}, strict bool) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.Strict = strict
+	err := d.Decode(v)
+	if err != nil {
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{d.offset, "trailing data"}
+	}
+	return nil
+}
+
+// Decode reads the next bencoded value and stores it in the value pointed by v
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("bencode: Decode needs a non nil pointer")
+	}
+
+	d.start = d.offset
+	d.depth = 0
+	d.typeError = nil
+	err := d.value(rv.Elem())
+	if err == io.EOF && d.offset > d.start {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	return d.typeError
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{d.offset, msg}
+}
+
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	if d.MaxSize > 0 && d.offset-d.start >= d.MaxSize {
+		return 0, d.syntaxError("value exceeds maximum size")
+	}
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	if d.record != nil {
+		d.record.WriteByte(b)
+	}
+	return b, nil
+}
+
+// readUntil reads the digits of an integer or string length up to delim
+func (d *Decoder) readUntil(delim byte) (string, error) {
+	var buf []byte
+	for {
+		b, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if b == delim {
+			return string(buf), nil
+		}
+		if len(buf) > 20 {
+			return "", d.syntaxError("number too long")
+		}
+		buf = append(buf, b)
+	}
+}
+
+// integer reads an integer. overflow is set when it doesn't fit in an int64,
+// in which case the caller can still parse s as an uint64.
+func (d *Decoder) integer() (n int64, s string, overflow bool, err error) {
+	d.readByte() // 'i'
+	s, err = d.readUntil('e')
+	if err != nil {
+		return 0, "", false, err
+	}
+	digits := s
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, "", false, d.syntaxError("invalid integer")
+	}
+	for _, c := range []byte(digits) {
+		if c < '0' || c > '9' {
+			return 0, "", false, d.syntaxError("invalid integer")
+		}
+	}
+	if d.Strict && ((digits[0] == '0' && len(digits) > 1) || s == "-0") {
+		return 0, "", false, d.syntaxError("non canonical integer")
+	}
+	n, err = strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, s, true, nil
+	}
+	return n, s, false, nil
+}
+
+func (d *Decoder) str() ([]byte, error) {
+	s, err := d.readUntil(':')
+	if err != nil {
+		return nil, err
+	}
+	if len(s) == 0 {
+		return nil, d.syntaxError("invalid string length")
+	}
+	if d.Strict && s[0] == '0' && len(s) > 1 {
+		return nil, d.syntaxError("non canonical string length")
+	}
+	length, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || length < 0 {
+		return nil, d.syntaxError("invalid string length")
+	}
+	if d.MaxSize > 0 && d.offset-d.start+length > d.MaxSize {
+		return nil, d.syntaxError("value exceeds maximum size")
+	}
+
+	// copy instead of allocating the announced length, which could be huge
+	buf := bytes.Buffer{}
+	n, err := io.CopyN(&buf, d.r, length)
+	d.offset += n
+	if d.record != nil {
+		d.record.Write(buf.Bytes())
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// raw reads the next value and returns its exact bytes
+func (d *Decoder) raw() ([]byte, error) {
+	parent := d.record
+	d.record = &bytes.Buffer{}
+	_, err := d.generic()
+	data := d.record.Bytes()
+	d.record = parent
+	if parent != nil {
+		parent.Write(data)
+	}
+	return data, err
+}
+
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.MaxDepth > 0 && d.depth > d.MaxDepth {
+		return d.syntaxError("maximum nesting depth exceeded")
+	}
+	return nil
+}
+
+// dictKey reads the next key of a dictionary, checking its order in strict mode
+func (d *Decoder) dictKey(previous []byte, first bool) ([]byte, error) {
+	key, err := d.str()
+	if err != nil {
+		return nil, err
+	}
+	if d.Strict && !first && bytes.Compare(previous, key) >= 0 {
+		return nil, d.syntaxError("unsorted or duplicated dictionary key")
+	}
+	return key, nil
+}
+
+// generic decodes the next value into int64, string, []interface{} or
+// map[string]interface{}
+func (d *Decoder) generic() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		n, _, overflow, err := d.integer()
+		if err != nil {
+			return nil, err
+		}
+		if overflow {
+			return nil, d.syntaxError("integer overflow")
+		}
+		return n, nil
+	case c >= '0' && c <= '9':
+		s, err := d.str()
+		return string(s), err
+	case c == 'l':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		d.readByte()
+		list := []interface{}{}
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				d.depth--
+				return list, nil
+			}
+			item, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+	case c == 'd':
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		d.readByte()
+		dict := map[string]interface{}{}
+		var key []byte
+		for first := true; ; first = false {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				d.depth--
+				return dict, nil
+			}
+			key, err = d.dictKey(key, first)
+			if err != nil {
+				return nil, err
+			}
+			item, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			dict[string(key)] = item
+		}
+	}
+	return nil, d.syntaxError("invalid value")
+}
+
+func (d *Decoder) skip(kind string, t reflect.Type) error {
+	if d.typeError == nil {
+		d.typeError = &UnmarshalTypeError{kind, t}
+	}
+	_, err := d.generic()
+	return err
+}
+
+func (d *Decoder) value(v reflect.Value) error {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Type() == rawMessageType {
+		data, err := d.raw()
+		if err != nil {
+			return err
+		}
+		v.SetBytes(append([]byte(nil), data...))
+		return nil
+	}
+
+	if v.Kind() == reflect.Interface && v.NumMethod() == 0 {
+		item, err := d.generic()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(item))
+		return nil
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		return d.integerValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	}
+	return d.syntaxError("invalid value")
+}
+
+func (d *Decoder) integerValue(v reflect.Value) error {
+	n, s, overflow, err := d.integer()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if overflow || v.OverflowInt(n) {
+			return d.setTypeError("number "+s, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(u) {
+			return d.setTypeError("number "+s, v.Type())
+		}
+		v.SetUint(u)
+	case reflect.Bool:
+		v.SetBool(n != 0)
+	default:
+		return d.setTypeError("number", v.Type())
+	}
+	return nil
+}
+
+func (d *Decoder) setTypeError(kind string, t reflect.Type) error {
+	if d.typeError == nil {
+		d.typeError = &UnmarshalTypeError{kind, t}
+	}
+	return nil
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	s, err := d.str()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case v.Kind() == reflect.String:
+		v.SetString(string(s))
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+		v.SetBytes(s)
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() == reflect.Uint8:
+		if len(s) != v.Len() {
+			return d.setTypeError("string", v.Type())
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		return d.setTypeError("string", v.Type())
+	}
+	return nil
+}
+
+func (d *Decoder) listValue(v reflect.Value) error {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return d.skip("list", v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	d.readByte()
+
+	i := 0
+	for ; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		if v.Kind() == reflect.Slice {
+			if i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+		} else if i >= v.Len() {
+			if err := d.skip("list", v.Type()); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.value(v.Index(i)); err != nil {
+			return err
+		}
+	}
+	d.readByte()
+	d.depth--
+
+	if v.Kind() == reflect.Slice {
+		if i == 0 {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		} else {
+			v.SetLen(i)
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) dictValue(v reflect.Value) error {
+	var fields map[string]field
+	switch {
+	case v.Kind() == reflect.Struct:
+		fields = cachedFields(v.Type())
+	case v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	default:
+		return d.skip("dictionary", v.Type())
+	}
+	if err := d.enter(); err != nil {
+		return err
+	}
+	d.readByte()
+
+	var key []byte
+	for first := true; ; first = false {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			break
+		}
+		key, err = d.dictKey(key, first)
+		if err != nil {
+			return err
+		}
+
+		if fields == nil {
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(item); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), item)
+			continue
+		}
+
+		f, ok := fields[string(key)]
+		if !ok {
+			if _, err := d.generic(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := d.value(v.FieldByIndex(f.index)); err != nil {
+			return err
+		}
+	}
+	d.readByte()
+	d.depth--
+	return nil
+}
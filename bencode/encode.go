@@ -0,0 +1,210 @@
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// UnsupportedTypeError is returned when marshalling a value that has no
+// bencode representation
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return "bencode: unsupported type: " + e.Type.String()
+}
+
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map
+
+// cachedFields returns the bencode fields of a struct type by key. Fields are
+// named by their `bencode:"name,omitempty"` tag, or by the field name if the
+// tag is missing. Fields tagged "-" and unexported fields are ignored.
+func cachedFields(t reflect.Type) map[string]field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.(map[string]field)
+	}
+
+	fields := map[string]field{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if idx := strings.Index(tag, ","); idx >= 0 {
+			name, opts = tag[:idx], tag[idx+1:]
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields[name] = field{
+			name:      name,
+			index:     sf.Index,
+			omitEmpty: opts == "omitempty",
+		}
+	}
+	fieldCache.Store(t, fields)
+	return fields
+}
+
+// Marshal returns the bencode encoding of v. Dictionary keys are written
+// sorted, so the output is canonical.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	err := encodeValue(&buf, reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the bencode encoding of v
+func (e *Encoder) Encode(v interface{}) error {
+	data, err := Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func writeString(buf *bytes.Buffer, s []byte) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.Write(s)
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return errors.New("bencode: can't marshal nil value")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return errors.New("bencode: empty RawMessage")
+		}
+		buf.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return errors.New("bencode: can't marshal nil value")
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, []byte(v.String()))
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			data := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(data), v)
+			writeString(buf, data)
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{v.Type()}
+		}
+		keys := make([]string, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			writeString(buf, []byte(k))
+			key := reflect.ValueOf(k).Convert(v.Type().Key())
+			if err := encodeValue(buf, v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		keys := make([]string, 0, len(fields))
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			f := fields[k]
+			fv := v.FieldByIndex(f.index)
+			if f.omitEmpty && isEmptyValue(fv) {
+				continue
+			}
+			writeString(buf, []byte(k))
+			if err := encodeValue(buf, fv); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
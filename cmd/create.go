@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+// listFlag collects the values of a flag that can be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func createCommand(args []string) {
+	var trackers, webSeeds listFlag
+
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+	flags.Var(&trackers, "a", "Tracker tier, comma separated URLs (can be repeated)")
+	flags.Var(&webSeeds, "webseed", "Web seed URL (can be repeated)")
+	output := flags.String("o", "", "Output file (default <name>.torrent)")
+	pieceLength := flags.Int("piece-length", 0, "Piece length in bytes (default automatic)")
+	comment := flags.String("comment", "", "Comment")
+	private := flags.Bool("private", false, "Set the private flag")
+	source := flags.String("source", "", "Source tag")
+	noDate := flags.Bool("no-date", false, "Don't write the creation date")
+	workers := flags.Int("w", 0, "Number of hashing workers (default one per CPU)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	opts := torrentfile.CreateOptions{
+		Path:        flags.Arg(0),
+		PieceLength: *pieceLength,
+		Comment:     *comment,
+		CreatedBy:   "MiniTorrent V1.0",
+		Private:     *private,
+		WebSeeds:    webSeeds,
+		Source:      *source,
+		Workers:     *workers,
+	}
+	for _, tier := range trackers {
+		opts.AnnounceList = append(opts.AnnounceList, strings.Split(tier, ","))
+	}
+	if !*noDate {
+		opts.CreationDate = time.Now()
+	}
+
+	data, err := torrentfile.Create(opts)
+	if err != nil {
+		log.Fatalf("Error creating torrent: %s", err)
+	}
+
+	if *output == "" {
+		*output = filepath.Base(filepath.Clean(opts.Path)) + ".torrent"
+	}
+	err = ioutil.WriteFile(*output, data, 0644)
+	if err != nil {
+		log.Fatalf("Error writing torrent: %s", err)
+	}
+	log.Printf("Torrent written to %s\n", *output)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+
+	"github.com/vaguilera/MiniTorrent/daemon"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+func daemonCommand(args []string) {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:9080", "HTTP API listen address")
+	socket := flags.String("socket", "", "Listen on this Unix socket instead of -addr")
+	token := flags.String("token", os.Getenv("MINITORRENT_TOKEN"), "API token, read from the state directory or created if empty")
+	stateDir := flags.String("state", "", "Directory of the daemon state (<dir>/.minitorrent by default)")
+	port := flags.Int("port", 25771, "Listen port shared by all the torrents")
+	dir := flags.String("dir", "download", "Download directory")
+	maxActive := flags.Int("max-active", 3, "Max active downloads (0 for no limit)")
+	maxSeeds := flags.Int("max-seeds", 3, "Max active seeds (0 for no limit)")
+	maxConns := flags.Int("max-conns", 200, "Max peer connections (0 for no limit)")
+	maxTorrentConns := flags.Int("max-conns-per-torrent", 50, "Max peer connections of each torrent")
+	maxHalfOpen := flags.Int("max-half-open", 8, "Max peer connections being set up at once")
+	workers := flags.Int("w", 4, "Number of workers per torrent")
+	verbose := flags.Int("v", 1, "Log level: 0 errors, 1 progress, 2 every peer message")
+	jsonLogs := flags.Bool("log-json", false, "Write the logs as JSON")
+	metricsAddr := flags.String("metrics", "", "Serve Prometheus metrics on http://<address>/metrics")
+	rates := addRateFlags(flags)
+	encryption := flags.String("encryption", "prefer", "Peer connection encryption: prefer, require or disable")
+	transport := flags.String("transport", "utp-first", "Peer connections: utp-first, tcp-first, tcp or utp")
+	flags.Parse(args)
+	logger := newLogger(os.Stderr, *verbose, *jsonLogs)
+
+	if flags.NArg() != 0 {
+		printHelp()
+		os.Exit(2)
+	}
+	if *stateDir == "" {
+		*stateDir = filepath.Join(*dir, ".minitorrent")
+	}
+	if *token == "" {
+		var err error
+		*token, err = daemon.LoadToken(*stateDir)
+		if err != nil {
+			log.Fatalf("Error loading the API token: %s", err)
+		}
+		log.Printf("API token in %s", filepath.Join(*stateDir, "token"))
+	}
+
+	config := torrentp2p.SessionConfig{
+		ListenAddr:         ":" + strconv.Itoa(*port),
+		DownloadDir:        *dir,
+		MaxConnections:     *maxConns,
+		MaxActiveDownloads: *maxActive,
+		MaxActiveSeeds:     *maxSeeds,
+		WorkersPerTorrent:  *workers,
+		MaxConnsPerTorrent: *maxTorrentConns,
+		MaxHalfOpen:        *maxHalfOpen,
+		Encryption:         encryptionMode(*encryption),
+		Transport:          transportPolicy(*transport),
+		Logger:             logger,
+	}
+	rates.apply(&config)
+	session, err := torrentp2p.NewSession(config)
+	if err != nil {
+		log.Fatalf("Error starting session: %s", err)
+	}
+	serveMetrics(*metricsAddr)
+
+	api, err := daemon.New(session, daemon.Config{Token: *token, StateDir: *stateDir, Logger: logger})
+	if err != nil {
+		session.Close()
+		log.Fatalf("Error loading the daemon state: %s", err)
+	}
+
+	var listener net.Listener
+	if *socket != "" {
+		os.Remove(*socket) // left by a daemon that didn't stop cleanly
+		listener, err = net.Listen("unix", *socket)
+		if err == nil {
+			err = os.Chmod(*socket, 0600)
+		}
+	} else {
+		listener, err = net.Listen("tcp", *addr)
+	}
+	if err != nil {
+		session.Close()
+		log.Fatalf("Error listening for API requests: %s", err)
+	}
+	log.Printf("API listening on %s", listener.Addr())
+	mux := http.NewServeMux()
+	mux.Handle("/transmission/rpc", api.RPC())
+	mux.Handle("/", api)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	log.Println("Stopping...")
+	server.Close()
+	session.Close()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+type infoFile struct {
+	Path       string `json:"path"`
+	Length     uint64 `json:"length"`
+	Attributes string `json:"attributes,omitempty"`
+}
+
+type torrentInfo struct {
+	Name         string     `json:"name"`
+	InfoHash     string     `json:"info_hash,omitempty"`
+	InfoHashV2   string     `json:"info_hash_v2,omitempty"`
+	Length       uint64     `json:"length"`
+	PieceCount   int        `json:"piece_count"`
+	PieceLength  int        `json:"piece_length"`
+	Private      bool       `json:"private"`
+	CreatedBy    string     `json:"created_by,omitempty"`
+	CreationDate *time.Time `json:"creation_date,omitempty"`
+	Comment      string     `json:"comment,omitempty"`
+	Trackers     [][]string `json:"trackers"`
+	WebSeeds     []string   `json:"web_seeds"`
+	Files        []infoFile `json:"files"`
+}
+
+func newTorrentInfo(t *torrentfile.Torrent) torrentInfo {
+	info := torrentInfo{
+		Name:        t.Name,
+		Length:      t.Length,
+		PieceCount:  t.NumPieces(),
+		PieceLength: t.PieceLength,
+		Private:     t.Private,
+		CreatedBy:   t.CreatedBy,
+		Comment:     t.Comment,
+		Trackers:    t.Tiers,
+		WebSeeds:    append(append([]string{}, t.WebSeeds...), t.HTTPSeeds...),
+	}
+	if !t.IsV2() || t.IsHybrid() {
+		info.InfoHash = hex.EncodeToString(t.InfoHash[:])
+	}
+	if t.IsV2() {
+		info.InfoHashV2 = hex.EncodeToString(t.InfoHashV2[:])
+	}
+	if !t.CreationDate.IsZero() {
+		info.CreationDate = &t.CreationDate
+	}
+	if info.Trackers == nil {
+		info.Trackers = [][]string{}
+	}
+	for _, f := range t.FileList() {
+		if f.IsPadding() {
+			continue
+		}
+		info.Files = append(info.Files, infoFile{
+			Path:       strings.Join(f.Path, "/"),
+			Length:     f.Length,
+			Attributes: f.Attr,
+		})
+	}
+	return info
+}
+
+func formatSize(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.2f %s", value, units[unit])
+}
+
+// printTree prints the files as a tree, with the size of every directory
+func printTree(files []infoFile) {
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	var previous []string
+	for i, f := range files {
+		parts := strings.Split(f.Path, "/")
+		common := 0
+		for common < len(previous)-1 && common < len(parts)-1 && previous[common] == parts[common] {
+			common++
+		}
+		for depth := common; depth < len(parts)-1; depth++ {
+			dir := strings.Join(parts[:depth+1], "/") + "/"
+			var size uint64
+			for _, other := range files[i:] {
+				if strings.HasPrefix(other.Path, dir) {
+					size += other.Length
+				}
+			}
+			fmt.Printf("  %s%s/ (%s)\n", strings.Repeat("  ", depth), parts[depth], formatSize(size))
+		}
+		fmt.Printf("  %s%s (%s)\n", strings.Repeat("  ", len(parts)-1), parts[len(parts)-1], formatSize(f.Length))
+		previous = parts
+	}
+}
+
+func printInfo(info torrentInfo) {
+	fmt.Printf("Name:          %s\n", info.Name)
+	if info.InfoHash != "" {
+		fmt.Printf("Info hash:     %s\n", info.InfoHash)
+	}
+	if info.InfoHashV2 != "" {
+		fmt.Printf("Info hash v2:  %s\n", info.InfoHashV2)
+	}
+	fmt.Printf("Size:          %s (%d bytes)\n", formatSize(info.Length), info.Length)
+	fmt.Printf("Pieces:        %d x %s\n", info.PieceCount, formatSize(uint64(info.PieceLength)))
+	fmt.Printf("Private:       %t\n", info.Private)
+	if info.CreatedBy != "" {
+		fmt.Printf("Created by:    %s\n", info.CreatedBy)
+	}
+	if info.CreationDate != nil {
+		fmt.Printf("Creation date: %s\n", info.CreationDate.Format(time.RFC3339))
+	}
+	if info.Comment != "" {
+		fmt.Printf("Comment:       %s\n", info.Comment)
+	}
+	if len(info.Trackers) > 0 {
+		fmt.Printf("Trackers:\n")
+		for i, tier := range info.Trackers {
+			fmt.Printf("  tier %d: %s\n", i+1, strings.Join(tier, ", "))
+		}
+	}
+	if len(info.WebSeeds) > 0 {
+		fmt.Printf("Web seeds:\n")
+		for _, seed := range info.WebSeeds {
+			fmt.Printf("  %s\n", seed)
+		}
+	}
+	fmt.Printf("Files:\n")
+	printTree(info.Files)
+}
+
+func infoCommand(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "Print the information as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	torrentFile, err := torrentfile.TorrentFromFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error while opening file: %s", err)
+	}
+
+	info := newTorrentInfo(torrentFile)
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(info)
+		return
+	}
+	printInfo(info)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+func magnetCommand(args []string) {
+	flags := flag.NewFlagSet("magnet", flag.ExitOnError)
+	files := flags.String("so", "", "Comma separated indices of the files to select")
+	noTrackers := flags.Bool("no-trackers", false, "Don't include the trackers")
+	noWebSeeds := flags.Bool("no-webseeds", false, "Don't include the web seeds")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	torrentFile, err := torrentfile.TorrentFromFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error while opening file: %s", err)
+	}
+
+	opts := torrentfile.MagnetOptions{
+		NoTrackers: *noTrackers,
+		NoWebSeeds: *noWebSeeds,
+	}
+	if *files != "" {
+		for _, index := range strings.Split(*files, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(index))
+			if err != nil || n < 0 || n >= len(torrentFile.FileList()) {
+				log.Fatalf("Invalid file index: %s", index)
+			}
+			opts.SelectFiles = append(opts.SelectFiles, n)
+		}
+	}
+	fmt.Println(torrentFile.Magnet(opts))
+}
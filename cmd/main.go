@@ -1,30 +1,138 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/metrics"
 	"github.com/vaguilera/MiniTorrent/torrentfile"
 	"github.com/vaguilera/MiniTorrent/torrentp2p"
+	"github.com/vaguilera/MiniTorrent/utp"
 )
 
 func printHelp() {
-	fmt.Printf("MiniTorrent client V1.0\nUsage:\n\tminitorrent -W=<NumOfWorkers> <torrentfile>\n")
+	fmt.Printf("MiniTorrent client V1.0\nUsage:\n\tminitorrent [-w=<NumOfWorkers>] [-v=<level>] [-metrics=<address>] [-down-limit=<KiB/s>] [-up-limit=<KiB/s>] [-transport=<policy>] <torrentfile>\n")
+	fmt.Printf("\tminitorrent session [-port=<port>] [-metrics=<address>] [-max-active=<n>] [-max-seeds=<n>] [-max-conns=<n>] [-max-conns-per-torrent=<n>] [-max-half-open=<n>] [-down-limit=<KiB/s>] [-up-limit=<KiB/s>] [-alt-schedule=<schedule>] <torrentfile>...\n")
+	fmt.Printf("\tminitorrent daemon [-addr=<address> | -socket=<path>] [-token=<token>] [-state=<directory>] [-dir=<directory>]\n")
+	fmt.Printf("\tminitorrent serve [-addr=<address>] [-metrics=<address>] [-w=<NumOfWorkers>] <torrentfile>\n")
+	fmt.Printf("\tminitorrent create [-o=<output>] [-a=<tracker,...>] [-piece-length=<bytes>] <file or directory>\n")
+	fmt.Printf("\tminitorrent verify [-dir=<directory>] [-md5] <torrentfile>\n")
+	fmt.Printf("\tminitorrent info [-json] <torrentfile>\n")
+	fmt.Printf("\tminitorrent magnet [-so=<index,...>] <torrentfile>\n")
 	flag.PrintDefaults()
 }
 
-type fichero struct {
-	name string
-	size uint32
+// newLogger returns the logger for a -v level: 0 only logs the errors, 1
+// the progress and the warnings too, 2 everything
+func newLogger(w io.Writer, verbose int, json bool) logging.Logger {
+	level := logging.LevelError
+	switch {
+	case verbose >= 2:
+		level = logging.LevelDebug
+	case verbose == 1:
+		level = logging.LevelInfo
+	}
+	return logging.New(w, level, json)
+}
+
+// serveMetrics exposes the Prometheus metrics on http://addr/metrics, unless
+// addr is empty
+func serveMetrics(addr string) {
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Default)
+	go func() {
+		log.Printf("Error serving metrics: %s", http.ListenAndServe(addr, mux))
+	}()
+}
+
+// rateFlags are the bandwidth limits of the session and daemon commands, in
+// KiB/s
+type rateFlags struct {
+	down, up         *int
+	peerDown, peerUp *int
+	altDown, altUp   *int
+	altSchedule      *string
+}
+
+func addRateFlags(flags *flag.FlagSet) *rateFlags {
+	return &rateFlags{
+		down:        flags.Int("down-limit", 0, "Download limit in KiB/s (0 for no limit)"),
+		up:          flags.Int("up-limit", 0, "Upload limit in KiB/s (0 for no limit)"),
+		peerDown:    flags.Int("peer-down-limit", 0, "Download limit of each peer in KiB/s (0 for no limit)"),
+		peerUp:      flags.Int("peer-up-limit", 0, "Upload limit of each peer in KiB/s (0 for no limit)"),
+		altDown:     flags.Int("alt-down-limit", 0, "Download limit in KiB/s during -alt-schedule"),
+		altUp:       flags.Int("alt-up-limit", 0, "Upload limit in KiB/s during -alt-schedule"),
+		altSchedule: flags.String("alt-schedule", "", "When the alternative limits apply, like 09:00-17:30 or 22:00-06:00/sat,sun"),
+	}
+}
+
+// encryptionMode returns the ENCRYPTION_* mode of the -encryption flag
+func encryptionMode(name string) int {
+	mode, err := torrentp2p.ParseEncryption(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return mode
+}
+
+// transportPolicy returns the TRANSPORT_* policy of the -transport flag
+func transportPolicy(name string) int {
+	policy, err := torrentp2p.ParseTransport(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return policy
+}
+
+// apply sets the limits of the session config
+func (r *rateFlags) apply(config *torrentp2p.SessionConfig) {
+	config.RateLimits = torrentp2p.Limits{Download: *r.down * 1024, Upload: *r.up * 1024}
+	config.PeerRateLimits = torrentp2p.Limits{Download: *r.peerDown * 1024, Upload: *r.peerUp * 1024}
+	config.AltSpeed.Limits = torrentp2p.Limits{Download: *r.altDown * 1024, Upload: *r.altUp * 1024}
+	if err := config.AltSpeed.ParseSchedule(*r.altSchedule); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var commands = map[string]func(args []string){
+	"daemon":  daemonCommand,
+	"serve":   serveCommand,
+	"session": sessionCommand,
+	"create":  createCommand,
+	"verify":  verifyCommand,
+	"info":    infoCommand,
+	"magnet":  magnetCommand,
 }
 
 func main() {
 
 	log.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	workers := flag.Int("w", 4, "Number of workers")
+	verbose := flag.Int("v", 0, "Log level: 0 errors, 1 progress, 2 every peer message")
+	jsonLogs := flag.Bool("log-json", false, "Write the logs as JSON")
+	metricsAddr := flag.String("metrics", "", "Serve Prometheus metrics on http://<address>/metrics")
+	downLimit := flag.Int("down-limit", 0, "Download limit in KiB/s (0 for no limit)")
+	upLimit := flag.Int("up-limit", 0, "Upload limit in KiB/s (0 for no limit)")
+	encryption := flag.String("encryption", "prefer", "Peer connection encryption: prefer, require or disable")
+	transport := flag.String("transport", "utp-first", "Peer connections: utp-first, tcp-first, tcp or utp")
 	flag.Parse()
 	args := flag.Args()
 
@@ -39,7 +147,65 @@ func main() {
 		log.Fatalf("Error while opening file: %s", err)
 	}
 
-	downloader := new(torrentp2p.Downloader)
-	downloader.Run(torrentFile, *workers)
+	tui := isTerminal(os.Stdout)
+	logs := &logBuffer{}
+	var logger logging.Logger
+	if tui {
+		log.SetOutput(logs)
+		logger = newLogger(logs, *verbose, *jsonLogs)
+	} else {
+		logger = newLogger(os.Stderr, *verbose, *jsonLogs)
+	}
+
+	downloader, err := torrentp2p.NewDownloader(torrentFile)
+	if err != nil {
+		log.Fatalf("Error creating files: %s", err)
+	}
+	defer downloader.Close()
+	downloader.SetLogger(logger)
+	downloader.SetRateLimits(torrentp2p.Limits{Download: *downLimit * 1024, Upload: *upLimit * 1024})
+	downloader.SetEncryption(encryptionMode(*encryption))
+	if policy := transportPolicy(*transport); policy != torrentp2p.TRANSPORT_TCP {
+		socket, err := utp.Listen("udp", ":0")
+		if err != nil {
+			log.Fatalf("Error opening uTP socket: %s", err)
+		}
+		defer socket.Close()
+		downloader.SetTransport(policy, socket)
+	}
+	serveMetrics(*metricsAddr)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	uiCtx, stopUI := context.WithCancel(context.Background())
+	uiDone := make(chan struct{})
+	ui := newProgressUI(torrentFile, downloader, logs)
+	if tui {
+		go func() {
+			ui.runTUI(uiCtx, cancel)
+			close(uiDone)
+		}()
+	} else {
+		log.Printf("Downloading %s (%d bytes) - InfoHash: %x\n", torrentFile.Name, torrentFile.Length, torrentFile.InfoHash)
+		go func() {
+			ui.runStatus(uiCtx)
+			close(uiDone)
+		}()
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Println("Stopping...")
+		cancel()
+	}()
+
+	err = downloader.Run(ctx, *workers)
+	stopUI()
+	<-uiDone
+	log.SetOutput(os.Stderr)
+	if err != nil {
+		log.Printf("Download not completed: %s", err)
+	}
 
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/vaguilera/MiniTorrent/server"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+func serveCommand(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "HTTP listen address")
+	workers := flags.Int("w", 4, "Number of workers")
+	verbose := flags.Int("v", 1, "Log level: 0 errors, 1 progress, 2 every peer message")
+	jsonLogs := flags.Bool("log-json", false, "Write the logs as JSON")
+	metricsAddr := flags.String("metrics", "", "Serve Prometheus metrics on http://<address>/metrics")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	torrentFile, err := torrentfile.TorrentFromFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error while opening file: %s", err)
+	}
+
+	downloader, err := torrentp2p.NewDownloader(torrentFile)
+	if err != nil {
+		log.Fatalf("Error creating files: %s", err)
+	}
+	defer downloader.Close()
+	downloader.SetLogger(newLogger(os.Stderr, *verbose, *jsonLogs))
+	serveMetrics(*metricsAddr)
+
+	go downloader.Run(context.Background(), *workers)
+
+	log.Printf("Serving files on http://%s/\n", *addr)
+	log.Fatal(http.ListenAndServe(*addr, server.New(torrentFile, downloader)))
+}
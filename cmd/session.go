@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+func sessionCommand(args []string) {
+	flags := flag.NewFlagSet("session", flag.ExitOnError)
+	port := flags.Int("port", 25771, "Listen port shared by all the torrents")
+	dir := flags.String("dir", "download", "Download directory")
+	maxActive := flags.Int("max-active", 3, "Max active downloads (0 for no limit)")
+	maxSeeds := flags.Int("max-seeds", 3, "Max active seeds (0 for no limit)")
+	maxConns := flags.Int("max-conns", 200, "Max peer connections (0 for no limit)")
+	maxTorrentConns := flags.Int("max-conns-per-torrent", 50, "Max peer connections of each torrent")
+	maxHalfOpen := flags.Int("max-half-open", 8, "Max peer connections being set up at once")
+	workers := flags.Int("w", 4, "Number of workers per torrent")
+	verbose := flags.Int("v", 1, "Log level: 0 errors, 1 progress, 2 every peer message")
+	jsonLogs := flags.Bool("log-json", false, "Write the logs as JSON")
+	metricsAddr := flags.String("metrics", "", "Serve Prometheus metrics on http://<address>/metrics")
+	rates := addRateFlags(flags)
+	encryption := flags.String("encryption", "prefer", "Peer connection encryption: prefer, require or disable")
+	transport := flags.String("transport", "utp-first", "Peer connections: utp-first, tcp-first, tcp or utp")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	config := torrentp2p.SessionConfig{
+		ListenAddr:         ":" + strconv.Itoa(*port),
+		DownloadDir:        *dir,
+		MaxConnections:     *maxConns,
+		MaxActiveDownloads: *maxActive,
+		MaxActiveSeeds:     *maxSeeds,
+		WorkersPerTorrent:  *workers,
+		MaxConnsPerTorrent: *maxTorrentConns,
+		MaxHalfOpen:        *maxHalfOpen,
+		Encryption:         encryptionMode(*encryption),
+		Transport:          transportPolicy(*transport),
+		Logger:             newLogger(os.Stderr, *verbose, *jsonLogs),
+	}
+	rates.apply(&config)
+	session, err := torrentp2p.NewSession(config)
+	if err != nil {
+		log.Fatalf("Error starting session: %s", err)
+	}
+	serveMetrics(*metricsAddr)
+
+	for _, file := range flags.Args() {
+		torrent, err := torrentfile.TorrentFromFile(file)
+		if err != nil {
+			log.Printf("Error while opening %s: %s", file, err)
+			continue
+		}
+		if _, err := session.Add(torrent); err != nil {
+			log.Printf("Error adding %s: %s", file, err)
+		}
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	<-interrupt
+	log.Println("Stopping...")
+	session.Close()
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+const (
+	statusInterval = 5 * time.Second // of the plain status lines
+	mapWidth       = 64              // cells per row of the piece map
+	mapRows        = 2
+	maxPeerRows    = 10
+	maxFileRows    = 8
+	maxLogLines    = 5
+)
+
+// isTerminal reports whether f is a terminal and not a file or a pipe
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// logBuffer keeps the last log lines to show them in the TUI
+type logBuffer struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		b.lines = append(b.lines, line)
+	}
+	if len(b.lines) > maxLogLines {
+		b.lines = b.lines[len(b.lines)-maxLogLines:]
+	}
+	return len(p), nil
+}
+
+func (b *logBuffer) last() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.lines...)
+}
+
+// progressUI shows the progress of a download, either as a full screen TUI
+// or as plain status lines
+type progressUI struct {
+	torrent *torrentfile.Torrent
+	down    *torrentp2p.Downloader
+	logs    *logBuffer
+	mu      sync.Mutex
+	sortBy  byte // d: download rate, u: upload rate, i: address, p: pieces
+}
+
+func newProgressUI(torrent *torrentfile.Torrent, down *torrentp2p.Downloader, logs *logBuffer) *progressUI {
+	return &progressUI{torrent: torrent, down: down, logs: logs, sortBy: 'd'}
+}
+
+// stty runs stty on the terminal of stdin
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// rawTerminal makes key presses available without enter and returns the
+// function that restores the terminal
+func rawTerminal() func() {
+	state, err := stty("-g")
+	if err != nil {
+		return func() {}
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return func() {}
+	}
+	return func() { stty(state) }
+}
+
+// readKeys changes the order of the peers, and stops the download with q
+func (ui *progressUI) readKeys(quit func()) {
+	key := make([]byte, 1)
+	for {
+		if _, err := os.Stdin.Read(key); err != nil {
+			return
+		}
+		switch key[0] {
+		case 'd', 'u', 'i', 'p':
+			ui.mu.Lock()
+			ui.sortBy = key[0]
+			ui.mu.Unlock()
+		case 'q':
+			quit()
+		}
+	}
+}
+
+// runTUI redraws the screen every second until ctx is done
+func (ui *progressUI) runTUI(ctx context.Context, quit func()) {
+	restore := rawTerminal()
+	defer restore()
+	go ui.readKeys(quit)
+
+	fmt.Print("\x1b[?25l") // hide the cursor
+	defer fmt.Print("\x1b[?25h")
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		fmt.Print("\x1b[H\x1b[2J" + ui.render())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			fmt.Print("\x1b[H\x1b[2J" + ui.render())
+			return
+		}
+	}
+}
+
+// runStatus prints a status line every statusInterval until ctx is done
+func (ui *progressUI) runStatus(ctx context.Context) {
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Println(ui.statusLine(ui.down.Stats()))
+		case <-ctx.Done():
+			fmt.Println(ui.statusLine(ui.down.Stats()))
+			return
+		}
+	}
+}
+
+func formatRate(rate float64) string {
+	return formatSize(uint64(rate)) + "/s"
+}
+
+func formatETA(eta time.Duration) string {
+	if eta < 0 {
+		return "-"
+	}
+	return eta.Round(time.Second).String()
+}
+
+func progressBar(done, total uint64, width int) string {
+	filled := width
+	if total > 0 {
+		filled = int(done * uint64(width) / total)
+	}
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
+
+func percent(done, total uint64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
+
+func (ui *progressUI) statusLine(stats torrentp2p.Stats) string {
+	return fmt.Sprintf("%5.1f%% %d/%d pieces  down %s  up %s  peers %d  ETA %s",
+		percent(stats.Length-stats.Left, stats.Length), stats.OwnedPieces, stats.NumPieces,
+		formatRate(stats.DownloadRate), formatRate(stats.UploadRate), stats.ConnectedPeers, formatETA(stats.ETA))
+}
+
+// pieceMap draws a cell for every group of pieces: # if all of them are
+// downloaded, + if some are and . if none
+func (ui *progressUI) pieceMap(numPieces int) []string {
+	cells := mapWidth * mapRows
+	if numPieces < cells {
+		cells = numPieces
+	}
+	var row strings.Builder
+	var rows []string
+	for c := 0; c < cells; c++ {
+		first := c * numPieces / cells
+		last := (c+1)*numPieces/cells - 1
+		have := 0
+		for i := first; i <= last; i++ {
+			if ui.down.HasPiece(i) {
+				have++
+			}
+		}
+		switch {
+		case have == last-first+1:
+			row.WriteByte('#')
+		case have > 0:
+			row.WriteByte('+')
+		default:
+			row.WriteByte('.')
+		}
+		if row.Len() == mapWidth {
+			rows = append(rows, row.String())
+			row.Reset()
+		}
+	}
+	if row.Len() > 0 {
+		rows = append(rows, row.String())
+	}
+	return rows
+}
+
+// peerFlags are D/d when we download or want to but are choked, U/u when we
+// upload or the peer wants to but is choked, and I for incoming connections
+func peerFlags(p torrentp2p.PeerStats) string {
+	flags := ""
+	if p.Interesting {
+		if p.Choked {
+			flags += "d"
+		} else {
+			flags += "D"
+		}
+	}
+	if p.Interested {
+		if p.Choking {
+			flags += "u"
+		} else {
+			flags += "U"
+		}
+	}
+	if p.Incoming {
+		flags += "I"
+	}
+	return flags
+}
+
+func (ui *progressUI) sortPeers(peers []torrentp2p.PeerStats) {
+	ui.mu.Lock()
+	sortBy := ui.sortBy
+	ui.mu.Unlock()
+
+	sort.SliceStable(peers, func(i, j int) bool {
+		switch sortBy {
+		case 'u':
+			return peers[i].UploadRate > peers[j].UploadRate
+		case 'i':
+			return peers[i].Address < peers[j].Address
+		case 'p':
+			return peers[i].Pieces > peers[j].Pieces
+		}
+		return peers[i].DownloadRate > peers[j].DownloadRate
+	})
+}
+
+// render draws the whole screen
+func (ui *progressUI) render() string {
+	stats := ui.down.Stats()
+	var b strings.Builder
+
+	done := stats.Length - stats.Left
+	fmt.Fprintf(&b, "%s\n%s %5.1f%%  %s of %s\n", stats.Name, progressBar(done, stats.Length, 50),
+		percent(done, stats.Length), formatSize(done), formatSize(stats.Length))
+	fmt.Fprintf(&b, "down %s  up %s  ETA %s  wasted %s\n", formatRate(stats.DownloadRate),
+		formatRate(stats.UploadRate), formatETA(stats.ETA), formatSize(stats.Wasted))
+	fmt.Fprintf(&b, "pieces %d/%d  peers %d (%d choking us, %d interested)\n\n", stats.OwnedPieces,
+		stats.NumPieces, stats.ConnectedPeers, stats.ChokedPeers, stats.InterestedPeers)
+
+	for _, row := range ui.pieceMap(stats.NumPieces) {
+		b.WriteString(row + "\n")
+	}
+
+	fmt.Fprintf(&b, "\n%-22s %-20s %11s %11s %6s %s\n", "PEER", "CLIENT", "DOWN", "UP", "HAS", "FLAGS")
+	ui.sortPeers(stats.Peers)
+	for i, p := range stats.Peers {
+		if i == maxPeerRows {
+			fmt.Fprintf(&b, "... and %d more\n", len(stats.Peers)-maxPeerRows)
+			break
+		}
+		fmt.Fprintf(&b, "%-22s %-20s %11s %11s %5.1f%% %s\n", p.Address, p.Client, formatRate(p.DownloadRate),
+			formatRate(p.UploadRate), percent(uint64(p.Pieces), uint64(stats.NumPieces)), peerFlags(p))
+	}
+
+	if len(stats.Trackers) > 0 {
+		b.WriteString("\nTRACKERS\n")
+	}
+	for _, t := range stats.Trackers {
+		status := fmt.Sprintf("%d peers", t.Peers)
+		if t.Err != "" {
+			status = "error: " + t.Err
+		}
+		fmt.Fprintf(&b, "%s  %s  %s ago\n", t.URL, status, time.Since(t.LastAnnounce).Round(time.Second))
+	}
+
+	b.WriteString("\nFILES\n")
+	var offset uint64
+	rows := 0
+	files := ui.torrent.FileList()
+	for i, f := range files {
+		start := offset
+		offset += f.Length
+		if f.IsPadding() {
+			continue
+		}
+		if rows == maxFileRows {
+			fmt.Fprintf(&b, "... and %d more\n", len(files)-i)
+			break
+		}
+		rows++
+		fmt.Fprintf(&b, "%5.1f%% %10s  %s\n", percent(ui.down.Completed(start, f.Length), f.Length),
+			formatSize(f.Length), strings.Join(f.Path, "/"))
+	}
+
+	if lines := ui.logs.last(); len(lines) > 0 {
+		b.WriteString("\nLOG\n")
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+	}
+	b.WriteString("\nsort peers: [d]own [u]p [i]p [p]ieces   [q]uit\n")
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := flags.String("dir", "download", "Directory with the downloaded data")
+	checkMD5 := flags.Bool("md5", false, "Also check the md5sum of the files")
+	workers := flags.Int("w", 0, "Number of hashing workers (default one per CPU)")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		printHelp()
+		os.Exit(2)
+	}
+
+	torrentFile, err := torrentfile.TorrentFromFile(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("Error while opening file: %s", err)
+	}
+
+	result, err := torrentp2p.Verify(torrentFile, *dir, torrentp2p.VerifyOptions{
+		Workers:  *workers,
+		CheckMD5: *checkMD5,
+	})
+	if err != nil {
+		log.Fatalf("Error verifying data: %s", err)
+	}
+
+	fmt.Printf("Pieces: %d good, %d bad, %d missing\n", len(result.Good), len(result.Bad), len(result.Missing))
+	for _, f := range result.Files {
+		switch {
+		case f.BadPieces > 0 || f.MissingPieces > 0:
+			fmt.Printf("  %s: %d bad, %d missing pieces\n", f.Path, f.BadPieces, f.MissingPieces)
+		case f.MD5Mismatch:
+			fmt.Printf("  %s: md5sum mismatch\n", f.Path)
+		}
+	}
+
+	if !result.Complete() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,746 @@
+// Package daemon implements the HTTP JSON API of the daemon mode, that adds,
+// lists and controls the torrents of a session.
+//
+//	GET    /api/torrents                 list the torrents with their stats
+//	POST   /api/torrents                 add a .torrent file, upload or URL
+//	GET    /api/torrents/<id>            stats of a torrent
+//	DELETE /api/torrents/<id>            remove it, ?delete_data=true deletes the files
+//	POST   /api/torrents/<id>/pause
+//	POST   /api/torrents/<id>/resume
+//	GET    /api/torrents/<id>/files      files with their progress and priority
+//	PUT    /api/torrents/<id>/files      change the priorities of some files
+//	GET    /api/torrents/<id>/peers
+//	GET    /api/torrents/<id>/trackers
+//	GET    /api/torrents/<id>/limits     bandwidth limits of a torrent
+//	PUT    /api/torrents/<id>/limits
+//	GET    /api/limits                   limits of active torrents and bandwidth
+//	PUT    /api/limits
+//
+// Every request needs an "Authorization: Bearer <token>" header.
+//
+// The handler returned by RPC implements a subset of the Transmission RPC,
+// so that Transmission clients can drive the daemon.
+package daemon
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+// maxTorrentSize is the largest .torrent file accepted
+const maxTorrentSize = 10 << 20
+
+// Config of the API of a daemon
+type Config struct {
+	Token    string         // required in the Authorization header
+	StateDir string         // where the torrents are saved, nothing is saved if empty
+	Logger   logging.Logger // discards the messages if nil
+}
+
+// Daemon serves the API of a session. The torrents added through it are
+// kept in its state directory and added again when the daemon starts.
+type Daemon struct {
+	session  *torrentp2p.Session
+	token    string
+	stateDir string
+	log      logging.Logger
+	client   *http.Client // fetches the torrents added by URL
+	mux      *http.ServeMux
+
+	mu         sync.Mutex
+	torrents   map[string]*entry
+	order      []string         // ids in the order they were added
+	priorities map[string][]int // file priorities set through the API
+	rates      map[string]rates // bandwidth limits of the torrents that have them
+	limits     *limits          // nil until they are changed through the API
+	numbers    int              // last number given to a torrent
+	started    time.Time
+	sessionID  string // of the Transmission RPC
+}
+
+// entry is a torrent added through the daemon
+type entry struct {
+	torrent *torrentfile.Torrent
+	number  int // id of the torrent in the Transmission RPC
+	added   time.Time
+}
+
+// New creates the API of session. The torrents saved in the state directory
+// are added to the session.
+func New(session *torrentp2p.Session, config Config) (*Daemon, error) {
+	if config.Token == "" {
+		return nil, errors.New("Empty API token")
+	}
+	if config.Logger == nil {
+		config.Logger = logging.Discard
+	}
+	d := &Daemon{
+		session:    session,
+		token:      config.Token,
+		stateDir:   config.StateDir,
+		log:        config.Logger,
+		client:     &http.Client{Timeout: 30 * time.Second},
+		mux:        http.NewServeMux(),
+		torrents:   make(map[string]*entry),
+		priorities: make(map[string][]int),
+		rates:      make(map[string]rates),
+		started:    time.Now(),
+		sessionID:  newSessionID(),
+	}
+	d.mux.HandleFunc("/api/torrents", d.serveTorrents)
+	d.mux.HandleFunc("/api/torrents/", d.serveTorrent)
+	d.mux.HandleFunc("/api/limits", d.serveLimits)
+
+	if d.stateDir != "" {
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(d.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="minitorrent"`)
+		writeError(w, http.StatusUnauthorized, errors.New("Invalid or missing token"))
+		return
+	}
+	d.mux.ServeHTTP(w, r)
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, apiError{err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
+
+type torrentInfo struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	State        string  `json:"state"`
+	Error        string  `json:"error,omitempty"`
+	Length       uint64  `json:"length"`
+	Progress     float64 `json:"progress"` // verified pieces, from 0 to 1
+	Pieces       int     `json:"pieces"`
+	NumPieces    int     `json:"num_pieces"`
+	Downloaded   uint64  `json:"downloaded"`
+	Uploaded     uint64  `json:"uploaded"`
+	Wasted       uint64  `json:"wasted"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	ETA          int64   `json:"eta"` // seconds, -1 if unknown
+	Peers        int     `json:"peers"`
+}
+
+func (d *Daemon) torrentInfo(status torrentp2p.TorrentStatus) torrentInfo {
+	info := torrentInfo{
+		ID:        status.ID,
+		Name:      status.Name,
+		State:     torrentp2p.StateName(status.State),
+		Pieces:    status.OwnedPieces,
+		NumPieces: status.NumPieces,
+		ETA:       -1,
+	}
+	if status.Err != nil {
+		info.Error = status.Err.Error()
+	}
+	if status.NumPieces > 0 {
+		info.Progress = float64(status.OwnedPieces) / float64(status.NumPieces)
+	}
+	stats, err := d.session.Stats(status.ID)
+	if err != nil {
+		return info
+	}
+	info.Length = stats.Length
+	info.Downloaded = stats.Downloaded
+	info.Uploaded = stats.Uploaded
+	info.Wasted = stats.Wasted
+	info.DownloadRate = stats.DownloadRate
+	info.UploadRate = stats.UploadRate
+	info.Peers = stats.ConnectedPeers
+	if stats.ETA >= 0 {
+		info.ETA = int64(stats.ETA / time.Second)
+	}
+	return info
+}
+
+// find returns the status of a torrent of the session
+func (d *Daemon) find(id string) (torrentp2p.TorrentStatus, bool) {
+	for _, status := range d.session.Torrents() {
+		if status.ID == id {
+			return status, true
+		}
+	}
+	return torrentp2p.TorrentStatus{}, false
+}
+
+func (d *Daemon) serveTorrents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := []torrentInfo{}
+		for _, status := range d.session.Torrents() {
+			list = append(list, d.torrentInfo(status))
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		d.addTorrent(w, r)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+type addRequest struct {
+	URL    string `json:"url"`    // http(s) URL of a .torrent file, or a magnet link
+	Magnet string `json:"magnet"` // magnet link
+	Paused bool   `json:"paused"`
+}
+
+var errMagnet = errors.New("Magnet links are not supported: fetching the metadata from the peers is not implemented")
+
+// addTorrent adds a .torrent file sent as the body, as the "torrent" field
+// of a form or by URL in a JSON request
+func (d *Daemon) addTorrent(w http.ResponseWriter, r *http.Request) {
+	req := addRequest{Paused: r.URL.Query().Get("paused") == "true"}
+	var data []byte
+	var err error
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/json":
+		err = json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if req.Magnet != "" || strings.HasPrefix(req.URL, "magnet:") {
+			writeError(w, http.StatusNotImplemented, errMagnet)
+			return
+		}
+		data, err = d.fetch(req.URL)
+	case "multipart/form-data":
+		r.Body = http.MaxBytesReader(w, r.Body, maxTorrentSize)
+		file, _, formErr := r.FormFile("torrent")
+		if formErr != nil {
+			writeError(w, http.StatusBadRequest, formErr)
+			return
+		}
+		defer file.Close()
+		data, err = ioutil.ReadAll(file)
+		if r.FormValue("paused") == "true" {
+			req.Paused = true
+		}
+	default:
+		data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxTorrentSize))
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	torrent, err := torrentfile.TorrentFromBytes(data)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id, err := d.add(torrent, data, req.Paused)
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	status, _ := d.find(id)
+	writeJSON(w, http.StatusCreated, d.torrentInfo(status))
+}
+
+// fetch downloads a .torrent file
+func (d *Daemon) fetch(url string) ([]byte, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, errors.New("Unsupported URL: " + url)
+	}
+	resp, err := d.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Fetching " + url + ": " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxTorrentSize+1))
+	if err == nil && len(data) > maxTorrentSize {
+		err = errors.New("Torrent file too large")
+	}
+	return data, err
+}
+
+// add adds a torrent to the session and saves it in the state directory
+func (d *Daemon) add(torrent *torrentfile.Torrent, data []byte, paused bool) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, err := d.session.Add(torrent)
+	if err != nil {
+		return "", err
+	}
+	if paused {
+		d.session.Pause(id)
+	}
+	d.addEntry(id, torrent)
+	if err := d.saveTorrent(id, data); err != nil {
+		return id, err
+	}
+	return id, d.save()
+}
+
+// addEntry registers a torrent added to the session. It must be called with
+// the lock held.
+func (d *Daemon) addEntry(id string, torrent *torrentfile.Torrent) {
+	d.numbers++
+	d.torrents[id] = &entry{torrent: torrent, number: d.numbers, added: time.Now()}
+	d.order = append(d.order, id)
+}
+
+// remove removes a torrent from the session and the state directory
+func (d *Daemon) remove(id string, deleteData bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	err := d.session.Remove(id, deleteData)
+	delete(d.torrents, id)
+	delete(d.priorities, id)
+	delete(d.rates, id)
+	for i, other := range d.order {
+		if other == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+	d.removeTorrentFile(id)
+	if saveErr := d.save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// pause pauses or resumes a torrent
+func (d *Daemon) pause(id string, paused bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var err error
+	if paused {
+		err = d.session.Pause(id)
+	} else {
+		err = d.session.Resume(id)
+	}
+	if err != nil {
+		return err
+	}
+	return d.save()
+}
+
+// changePriorities calls change with the current file priorities of a
+// torrent and applies the ones it leaves
+func (d *Daemon) changePriorities(id string, change func(priorities []int) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	e := d.torrents[id]
+	if e == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	files, err := d.session.Files(id)
+	if err != nil {
+		return err
+	}
+	priorities := make([]int, len(e.torrent.FileList()))
+	for _, f := range files {
+		priorities[f.Index] = f.Priority
+	}
+	if err := change(priorities); err != nil {
+		return err
+	}
+	if err := d.session.SetFilePriorities(id, priorities); err != nil {
+		return err
+	}
+	d.priorities[id] = priorities
+	return d.save()
+}
+
+// setLimits changes the limits of the session
+func (d *Daemon) setLimits(l limits) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.applyLimits(l); err != nil {
+		return err
+	}
+	d.limits = &l
+	return d.save()
+}
+
+// applyLimits sets the limits of the session. It must be called with the
+// lock held.
+func (d *Daemon) applyLimits(l limits) error {
+	if l.MaxActiveDownloads < 0 || l.MaxActiveSeeds < 0 || l.Rates.negative() || l.PeerRates.negative() || l.AltSpeed.Rates.negative() {
+		return errors.New("Negative limit")
+	}
+	alt, _ := d.session.AltSpeed()
+	if err := alt.ParseSchedule(l.AltSpeed.Schedule); err != nil {
+		return err
+	}
+	alt.Limits = l.AltSpeed.Rates.limits()
+	alt.Enabled = l.AltSpeed.Enabled
+	d.session.SetMaxActive(l.MaxActiveDownloads, l.MaxActiveSeeds)
+	d.session.SetRateLimits(l.Rates.limits())
+	d.session.SetPeerRateLimits(l.PeerRates.limits())
+	d.session.SetAltSpeed(alt)
+	return nil
+}
+
+// changeRates sets the bandwidth limits of a torrent
+func (d *Daemon) changeRates(id string, r rates) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.torrents[id] == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	if r.negative() {
+		return errors.New("Negative limit")
+	}
+	if err := d.session.SetTorrentRateLimits(id, r.limits()); err != nil {
+		return err
+	}
+	if r == (rates{}) {
+		delete(d.rates, id)
+	} else {
+		d.rates[id] = r
+	}
+	return d.save()
+}
+
+// serveTorrent serves /api/torrents/<id> and its subresources
+func (d *Daemon) serveTorrent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/torrents/"), "/", 2)
+	id := strings.ToLower(parts[0])
+	status, ok := d.find(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("Unknown torrent: "+id))
+		return
+	}
+	resource := ""
+	if len(parts) == 2 {
+		resource = parts[1]
+	}
+
+	switch resource {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, d.torrentInfo(status))
+		case http.MethodDelete:
+			d.removeTorrent(w, id, r.URL.Query().Get("delete_data") == "true")
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case "pause", "resume":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		d.setPaused(w, id, resource == "pause")
+	case "files":
+		switch r.Method {
+		case http.MethodGet:
+			d.serveFiles(w, id)
+		case http.MethodPut:
+			d.setPriorities(w, r, id)
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	case "limits":
+		switch r.Method {
+		case http.MethodGet:
+			d.serveRates(w, id)
+		case http.MethodPut:
+			d.setRates(w, r, id)
+		default:
+			methodNotAllowed(w, "GET, PUT")
+		}
+	case "peers", "trackers":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		stats, err := d.session.Stats(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		if resource == "peers" {
+			writeJSON(w, http.StatusOK, peerList(stats.Peers))
+		} else {
+			writeJSON(w, http.StatusOK, trackerList(stats.Trackers))
+		}
+	default:
+		writeError(w, http.StatusNotFound, errors.New("Unknown resource: "+resource))
+	}
+}
+
+func (d *Daemon) removeTorrent(w http.ResponseWriter, id string, deleteData bool) {
+	if err := d.remove(id, deleteData); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (d *Daemon) setPaused(w http.ResponseWriter, id string, paused bool) {
+	if err := d.pause(id, paused); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, _ := d.find(id)
+	writeJSON(w, http.StatusOK, d.torrentInfo(status))
+}
+
+type fileInfo struct {
+	Index     int     `json:"index"`
+	Path      string  `json:"path"`
+	Length    uint64  `json:"length"`
+	Completed uint64  `json:"completed"`
+	Progress  float64 `json:"progress"`
+	Priority  string  `json:"priority"` // normal, high or skip
+}
+
+func (d *Daemon) serveFiles(w http.ResponseWriter, id string) {
+	files, err := d.session.Files(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	list := []fileInfo{}
+	for _, f := range files {
+		info := fileInfo{
+			Index:     f.Index,
+			Path:      f.Path,
+			Length:    f.Length,
+			Completed: f.Completed,
+			Progress:  1,
+			Priority:  torrentp2p.PriorityName(f.Priority),
+		}
+		if f.Length > 0 {
+			info.Progress = float64(f.Completed) / float64(f.Length)
+		}
+		list = append(list, info)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type priorityChange struct {
+	Index    int    `json:"index"`
+	Priority string `json:"priority"`
+}
+
+// setPriorities changes the priorities of the files in the body, a list of
+// index and priority pairs. The other files keep theirs.
+func (d *Daemon) setPriorities(w http.ResponseWriter, r *http.Request, id string) {
+	var changes []priorityChange
+	err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&changes)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	err = d.changePriorities(id, func(priorities []int) error {
+		for _, change := range changes {
+			if change.Index < 0 || change.Index >= len(priorities) {
+				return errors.New("Invalid file index")
+			}
+			var err error
+			priorities[change.Index], err = torrentp2p.ParsePriority(change.Priority)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	d.serveFiles(w, id)
+}
+
+type peerInfo struct {
+	Address      string  `json:"address"`
+	Client       string  `json:"client,omitempty"`
+	Incoming     bool    `json:"incoming"`
+	Encrypted    bool    `json:"encrypted"`
+	UTP          bool    `json:"utp"`
+	Downloaded   uint64  `json:"downloaded"`
+	Uploaded     uint64  `json:"uploaded"`
+	DownloadRate float64 `json:"download_rate"`
+	UploadRate   float64 `json:"upload_rate"`
+	Choked       bool    `json:"choked"`
+	Choking      bool    `json:"choking"`
+	Interested   bool    `json:"interested"`
+	Interesting  bool    `json:"interesting"`
+	Pieces       int     `json:"pieces"`
+}
+
+func peerList(peers []torrentp2p.PeerStats) []peerInfo {
+	list := []peerInfo{}
+	for _, p := range peers {
+		list = append(list, peerInfo(p))
+	}
+	return list
+}
+
+type trackerInfo struct {
+	URL          string     `json:"url"`
+	LastAnnounce *time.Time `json:"last_announce,omitempty"`
+	Peers        int        `json:"peers"`
+	Error        string     `json:"error,omitempty"`
+}
+
+func trackerList(trackers []torrentp2p.TrackerStats) []trackerInfo {
+	list := []trackerInfo{}
+	for _, t := range trackers {
+		info := trackerInfo{URL: t.URL, Peers: t.Peers, Error: t.Err}
+		if !t.LastAnnounce.IsZero() {
+			last := t.LastAnnounce
+			info.LastAnnounce = &last
+		}
+		list = append(list, info)
+	}
+	return list
+}
+
+// rates are bandwidth limits in bytes per second, 0 for no limit
+type rates struct {
+	Download int `json:"download"`
+	Upload   int `json:"upload"`
+}
+
+func newRates(l torrentp2p.Limits) rates {
+	return rates{Download: l.Download, Upload: l.Upload}
+}
+
+func (r rates) limits() torrentp2p.Limits {
+	return torrentp2p.Limits{Download: r.Download, Upload: r.Upload}
+}
+
+func (r rates) negative() bool {
+	return r.Download < 0 || r.Upload < 0
+}
+
+// altSpeed are the alternative bandwidth limits
+type altSpeed struct {
+	Rates    rates  `json:"rates"`
+	Enabled  bool   `json:"enabled"`          // on regardless of the schedule
+	Schedule string `json:"schedule"`         // like "22:00-06:00/sat,sun", empty for none
+	Active   bool   `json:"active,omitempty"` // read only
+}
+
+type limits struct {
+	MaxActiveDownloads int      `json:"max_active_downloads"` // 0 for no limit
+	MaxActiveSeeds     int      `json:"max_active_seeds"`
+	Rates              rates    `json:"rates"`      // of all the torrents together
+	PeerRates          rates    `json:"peer_rates"` // of each peer
+	AltSpeed           altSpeed `json:"alt_speed"`
+}
+
+// currentLimits returns the limits of the session
+func (d *Daemon) currentLimits() limits {
+	current := limits{}
+	current.MaxActiveDownloads, current.MaxActiveSeeds = d.session.MaxActive()
+	current.Rates = newRates(d.session.RateLimits())
+	current.PeerRates = newRates(d.session.PeerRateLimits())
+	alt, active := d.session.AltSpeed()
+	current.AltSpeed = altSpeed{
+		Rates:    newRates(alt.Limits),
+		Enabled:  alt.Enabled,
+		Schedule: alt.Schedule(),
+		Active:   active,
+	}
+	return current
+}
+
+func (d *Daemon) serveLimits(w http.ResponseWriter, r *http.Request) {
+	current := d.currentLimits()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		// fields missing from the body keep their value
+		err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&current)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		current.AltSpeed.Active = false
+		if err := d.setLimits(current); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		current = d.currentLimits()
+	default:
+		methodNotAllowed(w, "GET, PUT")
+		return
+	}
+	writeJSON(w, http.StatusOK, current)
+}
+
+func (d *Daemon) serveRates(w http.ResponseWriter, id string) {
+	l, err := d.session.TorrentRateLimits(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRates(l))
+}
+
+func (d *Daemon) setRates(w http.ResponseWriter, r *http.Request, id string) {
+	l, err := d.session.TorrentRateLimits(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	// fields missing from the body keep their value
+	current := newRates(l)
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxTorrentSize)).Decode(&current); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := d.changeRates(id, current); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, current)
+}
@@ -0,0 +1,175 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+const testToken = "secret"
+
+func testTorrent(t *testing.T, dir string) []byte {
+	src := filepath.Join(dir, "src")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, "a.bin"), make([]byte, 40000), 0644)
+	ioutil.WriteFile(filepath.Join(src, "b.bin"), make([]byte, 40000), 0644)
+	data, err := torrentfile.Create(torrentfile.CreateOptions{Path: src, PieceLength: 16384})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testDaemon(t *testing.T, dir string) (*Daemon, *torrentp2p.Session) {
+	session, err := torrentp2p.NewSession(torrentp2p.SessionConfig{
+		ListenAddr:  "127.0.0.1:0",
+		DownloadDir: filepath.Join(dir, "download"),
+		Logger:      logging.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(session, Config{Token: testToken, StateDir: filepath.Join(dir, "state"), Logger: logging.Discard})
+	if err != nil {
+		session.Close()
+		t.Fatal(err)
+	}
+	return d, session
+}
+
+// call sends a request to the API and decodes the answer into v
+func call(t *testing.T, h http.Handler, method, path, contentType string, body []byte, v interface{}) int {
+	r := httptest.NewRequest(method, path, bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+testToken)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Errorf("%s %s: %s in %q", method, path, err, w.Body.String())
+		}
+	}
+	return w.Code
+}
+
+func Test_Auth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, session := testDaemon(t, dir)
+	defer session.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", testToken} {
+		r := httptest.NewRequest("GET", "/api/torrents", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		d.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q answered %d", auth, w.Code)
+		}
+	}
+}
+
+func Test_API(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := testTorrent(t, dir)
+	d, session := testDaemon(t, dir)
+
+	var added torrentInfo
+	if code := call(t, d, "POST", "/api/torrents?paused=true", "application/x-bittorrent", data, &added); code != http.StatusCreated {
+		t.Fatalf("Add answered %d", code)
+	}
+	if added.Name != "src" || added.State != "paused" || added.NumPieces != 5 {
+		t.Errorf("Unexpected torrent %+v", added)
+	}
+	if code := call(t, d, "POST", "/api/torrents", "application/x-bittorrent", data, nil); code != http.StatusConflict {
+		t.Errorf("Adding twice answered %d", code)
+	}
+	if code := call(t, d, "POST", "/api/torrents", "application/json", []byte(`{"url":"magnet:?xt=urn:btih:00"}`), nil); code != http.StatusNotImplemented {
+		t.Errorf("Magnet answered %d", code)
+	}
+
+	var files []fileInfo
+	call(t, d, "PUT", "/api/torrents/"+added.ID+"/files", "application/json", []byte(`[{"index":1,"priority":"skip"}]`), &files)
+	if len(files) != 2 || files[0].Priority != "normal" || files[1].Priority != "skip" || files[1].Path != "b.bin" {
+		t.Errorf("Unexpected files %+v", files)
+	}
+	if code := call(t, d, "PUT", "/api/torrents/"+added.ID+"/files", "application/json", []byte(`[{"index":5,"priority":"skip"}]`), nil); code != http.StatusBadRequest {
+		t.Errorf("Invalid index answered %d", code)
+	}
+
+	var lim limits
+	call(t, d, "PUT", "/api/limits", "application/json", []byte(`{"max_active_seeds":1,"rates":{"download":100000},"alt_speed":{"enabled":true,"rates":{"upload":2000},"schedule":"22:00-06:00/sat"}}`), &lim)
+	if lim.MaxActiveDownloads != 0 || lim.MaxActiveSeeds != 1 || lim.Rates.Download != 100000 || !lim.AltSpeed.Active || lim.AltSpeed.Schedule != "22:00-06:00/sat" {
+		t.Errorf("Unexpected limits %+v", lim)
+	}
+	if code := call(t, d, "PUT", "/api/limits", "application/json", []byte(`{"alt_speed":{"schedule":"9-5"}}`), nil); code != http.StatusBadRequest {
+		t.Errorf("Invalid schedule answered %d", code)
+	}
+	var r rates
+	call(t, d, "PUT", "/api/torrents/"+added.ID+"/limits", "application/json", []byte(`{"upload":5000}`), &r)
+	if r.Download != 0 || r.Upload != 5000 {
+		t.Errorf("Unexpected torrent limits %+v", r)
+	}
+	var peers []peerInfo
+	if code := call(t, d, "GET", "/api/torrents/"+added.ID+"/peers", "", nil, &peers); code != http.StatusOK || len(peers) != 0 {
+		t.Errorf("Peers answered %d %v", code, peers)
+	}
+	if code := call(t, d, "GET", "/api/torrents/0000/peers", "", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Unknown torrent answered %d", code)
+	}
+	session.Close()
+
+	// the torrent, its state and the limits are restored from the state directory
+	d, session = testDaemon(t, dir)
+	defer session.Close()
+	var list []torrentInfo
+	call(t, d, "GET", "/api/torrents", "", nil, &list)
+	if len(list) != 1 || list[0].ID != added.ID || list[0].State != "paused" {
+		t.Errorf("Unexpected torrents after restart %+v", list)
+	}
+	call(t, d, "GET", "/api/torrents/"+added.ID+"/files", "", nil, &files)
+	if len(files) != 2 || files[1].Priority != "skip" {
+		t.Errorf("Unexpected files after restart %+v", files)
+	}
+	call(t, d, "GET", "/api/limits", "", nil, &lim)
+	if lim.MaxActiveSeeds != 1 || lim.Rates.Download != 100000 || lim.AltSpeed.Rates.Upload != 2000 {
+		t.Errorf("Unexpected limits after restart %+v", lim)
+	}
+	call(t, d, "GET", "/api/torrents/"+added.ID+"/limits", "", nil, &r)
+	if r.Upload != 5000 {
+		t.Errorf("Unexpected torrent limits after restart %+v", r)
+	}
+
+	var resumed torrentInfo
+	call(t, d, "POST", "/api/torrents/"+added.ID+"/resume", "", nil, &resumed)
+	if resumed.State != "downloading" {
+		t.Errorf("Unexpected state after resume %s", resumed.State)
+	}
+	if code := call(t, d, "DELETE", "/api/torrents/"+added.ID+"?delete_data=true", "", nil, nil); code != http.StatusNoContent {
+		t.Errorf("Remove answered %d", code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "download", "a.bin")); !os.IsNotExist(err) {
+		t.Errorf("Files not deleted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state", added.ID+".torrent")); !os.IsNotExist(err) {
+		t.Errorf("Saved torrent not deleted: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+// stateFile lists the torrents of the state directory, that are saved next
+// to it as <id>.torrent
+const stateFile = "state.json"
+
+type savedTorrent struct {
+	ID         string `json:"id"`
+	Paused     bool   `json:"paused,omitempty"`
+	Priorities []int  `json:"priorities,omitempty"`
+	Rates      *rates `json:"rates,omitempty"`
+}
+
+type savedState struct {
+	Torrents []savedTorrent `json:"torrents"`
+	Limits   *limits        `json:"limits,omitempty"`
+}
+
+func (d *Daemon) torrentPath(id string) string {
+	return filepath.Join(d.stateDir, id+".torrent")
+}
+
+// writeFile replaces a file of the state directory without leaving it half
+// written
+func (d *Daemon) writeFile(name string, data []byte) error {
+	if d.stateDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(d.stateDir, 0700); err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.stateDir, name+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.stateDir, name))
+}
+
+func (d *Daemon) saveTorrent(id string, data []byte) error {
+	return d.writeFile(id+".torrent", data)
+}
+
+func (d *Daemon) removeTorrentFile(id string) {
+	if d.stateDir != "" {
+		os.Remove(d.torrentPath(id))
+	}
+}
+
+// save writes the state file. It must be called with the lock held.
+func (d *Daemon) save() error {
+	if d.stateDir == "" {
+		return nil
+	}
+	paused := map[string]bool{}
+	for _, status := range d.session.Torrents() {
+		// torrents paused by an error are tried again
+		paused[status.ID] = status.State == torrentp2p.TORRENT_PAUSED && status.Err == nil
+	}
+	state := savedState{Torrents: []savedTorrent{}, Limits: d.limits}
+	for _, id := range d.order {
+		saved := savedTorrent{
+			ID:         id,
+			Paused:     paused[id],
+			Priorities: d.priorities[id],
+		}
+		if r, ok := d.rates[id]; ok {
+			saved.Rates = &r
+		}
+		state.Torrents = append(state.Torrents, saved)
+	}
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	return d.writeFile(stateFile, data)
+}
+
+// load adds the saved torrents to the session. Torrents that can't be added
+// are logged and dropped.
+func (d *Daemon) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(d.stateDir, stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if state.Limits != nil {
+		if err := d.applyLimits(*state.Limits); err != nil {
+			d.log.Error("Can't apply saved limits", "err", err)
+		} else {
+			d.limits = state.Limits
+		}
+	}
+	for _, saved := range state.Torrents {
+		torrent, err := torrentfile.TorrentFromFile(d.torrentPath(saved.ID))
+		if err == nil {
+			_, err = d.session.Add(torrent)
+		}
+		if err != nil {
+			d.log.Error("Can't add saved torrent", "infohash", saved.ID, "err", err)
+			continue
+		}
+		if saved.Priorities != nil {
+			if err := d.session.SetFilePriorities(saved.ID, saved.Priorities); err == nil {
+				d.priorities[saved.ID] = saved.Priorities
+			}
+		}
+		if saved.Rates != nil {
+			if err := d.session.SetTorrentRateLimits(saved.ID, saved.Rates.limits()); err == nil {
+				d.rates[saved.ID] = *saved.Rates
+			}
+		}
+		if saved.Paused {
+			d.session.Pause(saved.ID)
+		}
+		d.addEntry(saved.ID, torrent)
+	}
+	return nil
+}
+
+// LoadToken returns the API token saved in stateDir, creating a random one
+// the first time
+func LoadToken(stateDir string) (string, error) {
+	path := filepath.Join(stateDir, "token")
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return "", err
+	}
+	return token, ioutil.WriteFile(path, []byte(token+"\n"), 0600)
+}
@@ -0,0 +1,762 @@
+package daemon
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+// The Transmission RPC is served on /transmission/rpc with HTTP basic
+// authentication, where the password is the API token. It implements
+// torrent-add, torrent-get, torrent-start, torrent-start-now, torrent-stop,
+// torrent-remove, torrent-set, session-get and session-stats.
+
+const (
+	rpcVersion      = 15
+	sessionIDHeader = "X-Transmission-Session-Id"
+	speedBytes      = 1000 // speeds are in kB/s
+)
+
+// Transmission torrent status codes
+const (
+	TR_STATUS_STOPPED       = 0
+	TR_STATUS_DOWNLOAD_WAIT = 3
+	TR_STATUS_DOWNLOAD      = 4
+	TR_STATUS_SEED_WAIT     = 5
+	TR_STATUS_SEED          = 6
+)
+
+// Transmission file priorities. There are no low priority files, they are
+// downloaded as normal ones.
+const (
+	TR_PRI_LOW    = -1
+	TR_PRI_NORMAL = 0
+	TR_PRI_HIGH   = 1
+)
+
+var trStatus = map[int]int{
+	torrentp2p.TORRENT_QUEUED:      TR_STATUS_DOWNLOAD_WAIT,
+	torrentp2p.TORRENT_DOWNLOADING: TR_STATUS_DOWNLOAD,
+	torrentp2p.TORRENT_SEEDING:     TR_STATUS_SEED,
+	torrentp2p.TORRENT_FINISHED:    TR_STATUS_SEED_WAIT,
+	torrentp2p.TORRENT_PAUSED:      TR_STATUS_STOPPED,
+}
+
+func newSessionID() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+type rpcRequest struct {
+	Method    string          `json:"method"`
+	Arguments json.RawMessage `json:"arguments"`
+	Tag       *int            `json:"tag,omitempty"`
+}
+
+type rpcResponse struct {
+	Result    string      `json:"result"`
+	Arguments interface{} `json:"arguments"`
+	Tag       *int        `json:"tag,omitempty"`
+}
+
+// RPC returns the handler of the Transmission RPC
+func (d *Daemon) RPC() http.Handler {
+	return http.HandlerFunc(d.serveRPC)
+}
+
+func (d *Daemon) serveRPC(w http.ResponseWriter, r *http.Request) {
+	_, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(password), []byte(d.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Transmission"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	// the session id protects against CSRF: clients retry with the id of
+	// the 409 answer
+	w.Header().Set(sessionIDHeader, d.sessionID)
+	if r.Header.Get(sessionIDHeader) != d.sessionID {
+		http.Error(w, "Invalid or missing "+sessionIDHeader, http.StatusConflict)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req rpcRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, 2*maxTorrentSize)).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := rpcResponse{Result: "success", Arguments: struct{}{}, Tag: req.Tag}
+	args, err := d.call(req.Method, req.Arguments)
+	if err != nil {
+		resp.Result = err.Error()
+	} else if args != nil {
+		resp.Arguments = args
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (d *Daemon) call(method string, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		raw = json.RawMessage("{}")
+	}
+	switch method {
+	case "session-get":
+		return d.sessionGet(raw)
+	case "session-stats":
+		return d.sessionStats(), nil
+	case "torrent-get":
+		return d.torrentGet(raw)
+	case "torrent-add":
+		return d.torrentAdd(raw)
+	case "torrent-start", "torrent-start-now", "torrent-stop":
+		return nil, d.eachTorrent(raw, func(id string) error {
+			return d.pause(id, method == "torrent-stop")
+		})
+	case "torrent-remove":
+		var args struct {
+			DeleteData bool `json:"delete-local-data"`
+		}
+		if err := json.Unmarshal(raw, &args); err != nil {
+			return nil, err
+		}
+		return nil, d.eachTorrent(raw, func(id string) error {
+			return d.remove(id, args.DeleteData)
+		})
+	case "torrent-set":
+		return nil, d.torrentSet(raw)
+	}
+	return nil, errors.New("method name not recognized")
+}
+
+// selectTorrents returns the torrents of the "ids" argument: a number, a
+// hash, a list of them, or all of them if it is missing or is
+// "recently-active"
+func (d *Daemon) selectTorrents(raw json.RawMessage) ([]string, error) {
+	var args struct {
+		IDs json.RawMessage `json:"ids"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var list []interface{}
+	if len(args.IDs) > 0 {
+		var v interface{}
+		if err := json.Unmarshal(args.IDs, &v); err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case []interface{}:
+			list = v
+		case string:
+			if v != "recently-active" {
+				list = []interface{}{v}
+			}
+		default:
+			list = []interface{}{v}
+		}
+	}
+	if list == nil {
+		return append([]string(nil), d.order...), nil
+	}
+
+	var ids []string
+	for _, item := range list {
+		switch item := item.(type) {
+		case float64:
+			for _, id := range d.order {
+				if float64(d.torrents[id].number) == item {
+					ids = append(ids, id)
+				}
+			}
+		case string:
+			id := strings.ToLower(item)
+			if d.torrents[id] != nil {
+				ids = append(ids, id)
+			}
+		default:
+			return nil, errors.New("invalid torrent id")
+		}
+	}
+	return ids, nil
+}
+
+func (d *Daemon) eachTorrent(raw json.RawMessage, fn func(id string) error) error {
+	ids, err := d.selectTorrents(raw)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := fn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// filterFields keeps the fields asked for in the "fields" argument
+func filterFields(raw json.RawMessage, all map[string]interface{}) (map[string]interface{}, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if args.Fields == nil {
+		return all, nil
+	}
+	fields := make(map[string]interface{})
+	for _, f := range args.Fields {
+		if v, ok := all[f]; ok {
+			fields[f] = v
+		}
+	}
+	return fields, nil
+}
+
+func (d *Daemon) sessionGet(raw json.RawMessage) (interface{}, error) {
+	downloads, seeds := d.session.MaxActive()
+	rates := d.session.RateLimits()
+	alt, _ := d.session.AltSpeed()
+	return filterFields(raw, map[string]interface{}{
+		"alt-speed-down":           alt.Download / speedBytes,
+		"alt-speed-enabled":        alt.Enabled,
+		"alt-speed-time-begin":     int(alt.Begin / time.Minute),
+		"alt-speed-time-enabled":   alt.Scheduled,
+		"alt-speed-time-end":       int(alt.End / time.Minute),
+		"alt-speed-up":             alt.Upload / speedBytes,
+		"speed-limit-down":         rates.Download / speedBytes,
+		"speed-limit-down-enabled": rates.Download > 0,
+		"speed-limit-up":           rates.Upload / speedBytes,
+		"speed-limit-up-enabled":   rates.Upload > 0,
+		"config-dir":               d.stateDir,
+		"download-dir":             d.session.DownloadDir(),
+		"download-queue-enabled":   downloads > 0,
+		"download-queue-size":      downloads,
+		"peer-port":                d.session.Port(),
+		"rpc-version":              rpcVersion,
+		"rpc-version-minimum":      1,
+		"seed-queue-enabled":       seeds > 0,
+		"seed-queue-size":          seeds,
+		"session-id":               d.sessionID,
+		"version":                  "3.00 (MiniTorrent)",
+	})
+}
+
+type trStats struct {
+	UploadedBytes   uint64 `json:"uploadedBytes"`
+	DownloadedBytes uint64 `json:"downloadedBytes"`
+	FilesAdded      int    `json:"filesAdded"`
+	SessionCount    int    `json:"sessionCount"`
+	SecondsActive   int64  `json:"secondsActive"`
+}
+
+type trSessionStats struct {
+	ActiveTorrentCount int     `json:"activeTorrentCount"`
+	PausedTorrentCount int     `json:"pausedTorrentCount"`
+	TorrentCount       int     `json:"torrentCount"`
+	DownloadSpeed      int64   `json:"downloadSpeed"`
+	UploadSpeed        int64   `json:"uploadSpeed"`
+	CumulativeStats    trStats `json:"cumulative-stats"`
+	CurrentStats       trStats `json:"current-stats"`
+}
+
+// sessionStats reports the totals of this run of the daemon, which are also
+// its cumulative stats
+func (d *Daemon) sessionStats() trSessionStats {
+	var stats trSessionStats
+	current := &stats.CurrentStats
+	for _, status := range d.session.Torrents() {
+		stats.TorrentCount++
+		switch status.State {
+		case torrentp2p.TORRENT_DOWNLOADING, torrentp2p.TORRENT_SEEDING:
+			stats.ActiveTorrentCount++
+		case torrentp2p.TORRENT_PAUSED:
+			stats.PausedTorrentCount++
+		}
+		s, err := d.session.Stats(status.ID)
+		if err != nil {
+			continue
+		}
+		stats.DownloadSpeed += int64(s.DownloadRate)
+		stats.UploadSpeed += int64(s.UploadRate)
+		current.DownloadedBytes += s.Downloaded
+		current.UploadedBytes += s.Uploaded
+	}
+	current.FilesAdded = stats.TorrentCount
+	current.SessionCount = 1
+	current.SecondsActive = int64(time.Since(d.started) / time.Second)
+	stats.CumulativeStats = *current
+	return stats
+}
+
+type trFile struct {
+	Name           string `json:"name"`
+	Length         uint64 `json:"length"`
+	BytesCompleted uint64 `json:"bytesCompleted"`
+}
+
+type trFileStats struct {
+	BytesCompleted uint64 `json:"bytesCompleted"`
+	Wanted         bool   `json:"wanted"`
+	Priority       int    `json:"priority"`
+}
+
+type trTracker struct {
+	Announce string `json:"announce"`
+	ID       int    `json:"id"`
+	Scrape   string `json:"scrape"`
+	Tier     int    `json:"tier"`
+}
+
+type trTrackerStats struct {
+	Announce              string `json:"announce"`
+	Host                  string `json:"host"`
+	ID                    int    `json:"id"`
+	Tier                  int    `json:"tier"`
+	HasAnnounced          bool   `json:"hasAnnounced"`
+	LastAnnounceTime      int64  `json:"lastAnnounceTime"`
+	LastAnnounceSucceeded bool   `json:"lastAnnounceSucceeded"`
+	LastAnnouncePeerCount int    `json:"lastAnnouncePeerCount"`
+	LastAnnounceResult    string `json:"lastAnnounceResult"`
+}
+
+type trPeer struct {
+	Address            string  `json:"address"`
+	Port               int     `json:"port"`
+	ClientName         string  `json:"clientName"`
+	ClientIsChoked     bool    `json:"clientIsChoked"`
+	ClientIsInterested bool    `json:"clientIsInterested"`
+	PeerIsChoked       bool    `json:"peerIsChoked"`
+	PeerIsInterested   bool    `json:"peerIsInterested"`
+	IsIncoming         bool    `json:"isIncoming"`
+	IsEncrypted        bool    `json:"isEncrypted"`
+	IsUTP              bool    `json:"isUTP"`
+	FlagStr            string  `json:"flagStr"`
+	Progress           float64 `json:"progress"`
+	RateToClient       int64   `json:"rateToClient"`
+	RateToPeer         int64   `json:"rateToPeer"`
+}
+
+// trPriority returns the Transmission priority and wanted flag of a
+// PRIORITY_*
+func trPriority(priority int) (int, bool) {
+	switch priority {
+	case torrentp2p.PRIORITY_HIGH:
+		return TR_PRI_HIGH, true
+	case torrentp2p.PRIORITY_SKIP:
+		return TR_PRI_NORMAL, false
+	}
+	return TR_PRI_NORMAL, true
+}
+
+func peerFlags(p torrentp2p.PeerStats) string {
+	flags := ""
+	if p.Interesting {
+		if p.Choked {
+			flags += "d"
+		} else {
+			flags += "D"
+		}
+	}
+	if p.Interested {
+		if p.Choking {
+			flags += "u"
+		} else {
+			flags += "U"
+		}
+	}
+	if p.Encrypted {
+		flags += "E"
+	}
+	if p.Incoming {
+		flags += "I"
+	}
+	if p.UTP {
+		flags += "T"
+	}
+	return flags
+}
+
+func trackerHost(announce string) string {
+	host := announce
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.IndexAny(host, "/?"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// torrentFields returns every field of a torrent supported by torrent-get
+func (d *Daemon) torrentFields(id string, e *entry, position int) map[string]interface{} {
+	status, _ := d.find(id)
+	stats, _ := d.session.Stats(id)
+	files, _ := d.session.Files(id)
+	rates, _ := d.session.TorrentRateLimits(id)
+	torrent := e.torrent
+
+	fields := map[string]interface{}{
+		"id":             e.number,
+		"hashString":     id,
+		"name":           torrent.Name,
+		"status":         trStatus[status.State],
+		"error":          0,
+		"errorString":    "",
+		"addedDate":      e.added.Unix(),
+		"downloadDir":    d.session.DownloadDir(),
+		"totalSize":      torrent.Length,
+		"pieceCount":     torrent.NumPieces(),
+		"pieceSize":      torrent.PieceLength,
+		"rateDownload":   int64(stats.DownloadRate),
+		"rateUpload":     int64(stats.UploadRate),
+		"downloadedEver": stats.Downloaded,
+		"uploadedEver":   stats.Uploaded,
+		"corruptEver":    stats.Wasted,
+		"peersConnected": stats.ConnectedPeers,
+		"queuePosition":  position,
+		"isPrivate":      torrent.Private,
+		"comment":        torrent.Comment,
+		"creator":        torrent.CreatedBy,
+		"eta":            -1,
+		"uploadRatio":    -1,
+
+		"downloadLimit":   rates.Download / speedBytes,
+		"downloadLimited": rates.Download > 0,
+		"uploadLimit":     rates.Upload / speedBytes,
+		"uploadLimited":   rates.Upload > 0,
+	}
+	if status.Err != nil {
+		fields["error"] = 3 // local error
+		fields["errorString"] = status.Err.Error()
+	}
+	if stats.ETA >= 0 {
+		fields["eta"] = int64(stats.ETA / time.Second)
+	}
+	if stats.Downloaded > 0 {
+		fields["uploadRatio"] = float64(stats.Uploaded) / float64(stats.Downloaded)
+	}
+
+	var sizeWhenDone, haveValid, left uint64
+	trFiles := []trFile{}
+	fileStats := []trFileStats{}
+	priorities := []int{}
+	wanted := []bool{}
+	for _, f := range files {
+		priority, want := trPriority(f.Priority)
+		trFiles = append(trFiles, trFile{Name: f.Path, Length: f.Length, BytesCompleted: f.Completed})
+		fileStats = append(fileStats, trFileStats{BytesCompleted: f.Completed, Wanted: want, Priority: priority})
+		priorities = append(priorities, priority)
+		wanted = append(wanted, want)
+		haveValid += f.Completed
+		if want {
+			sizeWhenDone += f.Length
+			left += f.Length - f.Completed
+		}
+	}
+	fields["files"] = trFiles
+	fields["fileStats"] = fileStats
+	fields["priorities"] = priorities
+	fields["wanted"] = wanted
+	fields["haveValid"] = haveValid
+	fields["sizeWhenDone"] = sizeWhenDone
+	fields["leftUntilDone"] = left
+	fields["percentDone"] = 1.0
+	if sizeWhenDone > 0 {
+		fields["percentDone"] = float64(sizeWhenDone-left) / float64(sizeWhenDone)
+	}
+	fields["isFinished"] = left == 0 && status.State != torrentp2p.TORRENT_DOWNLOADING
+
+	trackers := []trTracker{}
+	for tier, urls := range torrent.Tiers {
+		for _, url := range urls {
+			trackers = append(trackers, trTracker{Announce: url, ID: len(trackers), Tier: tier})
+		}
+	}
+	trackerStats := []trTrackerStats{}
+	for _, t := range trackers {
+		ts := trTrackerStats{Announce: t.Announce, Host: trackerHost(t.Announce), ID: t.ID, Tier: t.Tier}
+		for _, s := range stats.Trackers {
+			if s.URL != t.Announce {
+				continue
+			}
+			ts.HasAnnounced = true
+			ts.LastAnnounceTime = s.LastAnnounce.Unix()
+			ts.LastAnnounceSucceeded = s.Err == ""
+			ts.LastAnnouncePeerCount = s.Peers
+			ts.LastAnnounceResult = "Success"
+			if s.Err != "" {
+				ts.LastAnnounceResult = s.Err
+			}
+		}
+		trackerStats = append(trackerStats, ts)
+	}
+	fields["trackers"] = trackers
+	fields["trackerStats"] = trackerStats
+
+	peers := []trPeer{}
+	for _, p := range stats.Peers {
+		host, port, _ := net.SplitHostPort(p.Address)
+		portNumber, _ := strconv.Atoi(port)
+		peer := trPeer{
+			Address:            host,
+			Port:               portNumber,
+			ClientName:         p.Client,
+			ClientIsChoked:     p.Choked,
+			ClientIsInterested: p.Interesting,
+			PeerIsChoked:       p.Choking,
+			PeerIsInterested:   p.Interested,
+			IsIncoming:         p.Incoming,
+			IsEncrypted:        p.Encrypted,
+			IsUTP:              p.UTP,
+			FlagStr:            peerFlags(p),
+			RateToClient:       int64(p.DownloadRate),
+			RateToPeer:         int64(p.UploadRate),
+		}
+		if stats.NumPieces > 0 {
+			peer.Progress = float64(p.Pieces) / float64(stats.NumPieces)
+		}
+		peers = append(peers, peer)
+	}
+	fields["peers"] = peers
+	return fields
+}
+
+func (d *Daemon) torrentGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		Fields []string `json:"fields"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+	if len(args.Fields) == 0 {
+		return nil, errors.New("no fields specified")
+	}
+	ids, err := d.selectTorrents(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	torrents := []map[string]interface{}{}
+	for _, id := range ids {
+		d.mu.Lock()
+		e := d.torrents[id]
+		position := 0
+		for i, other := range d.order {
+			if other == id {
+				position = i
+			}
+		}
+		d.mu.Unlock()
+		if e == nil {
+			continue
+		}
+		fields, _ := filterFields(raw, d.torrentFields(id, e, position))
+		torrents = append(torrents, fields)
+	}
+	return map[string]interface{}{"torrents": torrents}, nil
+}
+
+// fileChanges are the arguments of torrent-add and torrent-set that change
+// the priorities of the files, by their index in the files list
+type fileChanges struct {
+	Wanted         []int `json:"files-wanted"`
+	Unwanted       []int `json:"files-unwanted"`
+	PriorityHigh   []int `json:"priority-high"`
+	PriorityLow    []int `json:"priority-low"`
+	PriorityNormal []int `json:"priority-normal"`
+}
+
+func (c *fileChanges) empty() bool {
+	return len(c.Wanted)+len(c.Unwanted)+len(c.PriorityHigh)+len(c.PriorityLow)+len(c.PriorityNormal) == 0
+}
+
+// apply changes the priorities of a torrent. The Transmission file indices
+// skip the padding files.
+func (d *Daemon) applyFileChanges(id string, c fileChanges) error {
+	if c.empty() {
+		return nil
+	}
+	files, err := d.session.Files(id)
+	if err != nil {
+		return err
+	}
+	return d.changePriorities(id, func(priorities []int) error {
+		set := func(indices []int, fn func(p int) int) error {
+			for _, i := range indices {
+				if i < 0 || i >= len(files) {
+					return errors.New("file index out of range")
+				}
+				index := files[i].Index
+				priorities[index] = fn(priorities[index])
+			}
+			return nil
+		}
+		normal := func(p int) int {
+			if p == torrentp2p.PRIORITY_SKIP {
+				return p
+			}
+			return torrentp2p.PRIORITY_NORMAL
+		}
+		changes := []struct {
+			indices []int
+			fn      func(p int) int
+		}{
+			{c.PriorityLow, normal},
+			{c.PriorityNormal, normal},
+			{c.PriorityHigh, func(p int) int {
+				if p == torrentp2p.PRIORITY_SKIP {
+					return p
+				}
+				return torrentp2p.PRIORITY_HIGH
+			}},
+			{c.Unwanted, func(p int) int { return torrentp2p.PRIORITY_SKIP }},
+			{c.Wanted, func(p int) int {
+				if p == torrentp2p.PRIORITY_SKIP {
+					return torrentp2p.PRIORITY_NORMAL
+				}
+				return p
+			}},
+		}
+		for _, change := range changes {
+			if err := set(change.indices, change.fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (d *Daemon) torrentSet(raw json.RawMessage) error {
+	var args struct {
+		fileChanges
+		DownloadLimit   *int  `json:"downloadLimit"`
+		DownloadLimited *bool `json:"downloadLimited"`
+		UploadLimit     *int  `json:"uploadLimit"`
+		UploadLimited   *bool `json:"uploadLimited"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return err
+	}
+	return d.eachTorrent(raw, func(id string) error {
+		if err := d.applyFileChanges(id, args.fileChanges); err != nil {
+			return err
+		}
+		if args.DownloadLimit == nil && args.DownloadLimited == nil && args.UploadLimit == nil && args.UploadLimited == nil {
+			return nil
+		}
+		l, err := d.session.TorrentRateLimits(id)
+		if err != nil {
+			return err
+		}
+		r := newRates(l)
+		r.Download = trRate(r.Download, args.DownloadLimit, args.DownloadLimited)
+		r.Upload = trRate(r.Upload, args.UploadLimit, args.UploadLimited)
+		return d.changeRates(id, r)
+	})
+}
+
+// trRate returns the bytes per second of a torrent-set limit in kB/s, and
+// whether it is enabled. The limit is dropped when it is disabled.
+func trRate(current int, limit *int, limited *bool) int {
+	if limit != nil {
+		current = *limit * speedBytes
+	}
+	if limited != nil && !*limited {
+		current = 0
+	}
+	return current
+}
+
+type trAdded struct {
+	ID         int    `json:"id"`
+	Name       string `json:"name"`
+	HashString string `json:"hashString"`
+}
+
+// torrentAdd adds a torrent from its base64 metainfo or the URL in filename.
+// The download-dir argument is ignored, all the torrents are stored in the
+// download directory of the session.
+func (d *Daemon) torrentAdd(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		fileChanges
+		Filename string `json:"filename"`
+		Metainfo string `json:"metainfo"`
+		Paused   bool   `json:"paused"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case args.Metainfo != "":
+		data, err = base64.StdEncoding.DecodeString(args.Metainfo)
+	case strings.HasPrefix(args.Filename, "magnet:"):
+		err = errMagnet
+	case args.Filename != "":
+		data, err = d.fetch(args.Filename)
+	default:
+		err = errors.New("no filename or metainfo specified")
+	}
+	if err != nil {
+		return nil, err
+	}
+	torrent, err := torrentfile.TorrentFromBytes(data)
+	if err != nil {
+		return nil, err
+	}
+
+	id := hex.EncodeToString(torrent.InfoHash[:])
+	if _, ok := d.find(id); ok {
+		return map[string]interface{}{"torrent-duplicate": d.added(id)}, nil
+	}
+	// files are skipped before the torrent starts
+	id, err = d.add(torrent, data, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.applyFileChanges(id, args.fileChanges); err != nil {
+		return nil, err
+	}
+	if !args.Paused {
+		if err := d.pause(id, false); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"torrent-added": d.added(id)}, nil
+}
+
+func (d *Daemon) added(id string) trAdded {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	e := d.torrents[id]
+	if e == nil {
+		return trAdded{HashString: id}
+	}
+	return trAdded{ID: e.number, Name: e.torrent.Name, HashString: id}
+}
@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// rpcCall sends a Transmission RPC request with the given credentials and
+// session id
+func rpcCall(h http.Handler, password, sessionID string, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/transmission/rpc", bytes.NewReader(body))
+	r.SetBasicAuth("user", password)
+	if sessionID != "" {
+		r.Header.Set(sessionIDHeader, sessionID)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func Test_RPCHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, session := testDaemon(t, dir)
+	defer session.Close()
+	rpc := d.RPC()
+	body := []byte(`{"method":"session-get"}`)
+
+	w := rpcCall(rpc, "wrong", "", body)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("Wrong password answered %d", w.Code)
+	}
+	w = rpcCall(rpc, testToken, "", body)
+	sessionID := w.Header().Get(sessionIDHeader)
+	if w.Code != http.StatusConflict || sessionID == "" {
+		t.Fatalf("Missing session id answered %d %q", w.Code, sessionID)
+	}
+	if w = rpcCall(rpc, testToken, "stale", body); w.Code != http.StatusConflict {
+		t.Errorf("Wrong session id answered %d", w.Code)
+	}
+	w = rpcCall(rpc, testToken, sessionID, body)
+	var resp struct {
+		Result    string                 `json:"result"`
+		Arguments map[string]interface{} `json:"arguments"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || resp.Result != "success" || resp.Arguments["session-id"] != sessionID {
+		t.Errorf("session-get answered %d %s", w.Code, w.Body.String())
+	}
+}
+
+// Test_RPCFixtures replays the requests of testdata/transmission in order
+// and compares the answers with the recorded responses
+func Test_RPCFixtures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, session := testDaemon(t, dir)
+	defer session.Close()
+
+	names, err := filepath.Glob(filepath.Join("testdata", "transmission", "*.json"))
+	if err != nil || len(names) == 0 {
+		t.Fatalf("No fixtures: %v", err)
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixture struct {
+			Request  json.RawMessage `json:"request"`
+			Response interface{}     `json:"response"`
+		}
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		w := rpcCall(d.RPC(), testToken, d.sessionID, fixture.Request)
+		var got interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %s in %q", name, err, w.Body.String())
+		}
+		if !reflect.DeepEqual(got, fixture.Response) {
+			t.Errorf("%s: got %s", name, w.Body.String())
+		}
+	}
+}
@@ -1,5 +1,3 @@
 module github.com/vaguilera/MiniTorrent
 
-go 1.14
-
-require github.com/jackpal/bencode-go v0.0.0-20180813173944-227668e840fa
+go 1.18
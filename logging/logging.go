@@ -0,0 +1,175 @@
+// Package logging is a small leveled logger with key value fields. Its Logger
+// interface is a subset of the methods of *slog.Logger, so a slog logger can
+// be used wherever a Logger is expected.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a message. The values are the ones of slog.
+type Level int
+
+const (
+	LevelDebug Level = -4
+	LevelInfo  Level = 0
+	LevelWarn  Level = 4
+	LevelError Level = 8
+)
+
+func (l Level) String() string {
+	switch {
+	case l < LevelInfo:
+		return "DEBUG"
+	case l < LevelWarn:
+		return "INFO"
+	case l < LevelError:
+		return "WARN"
+	}
+	return "ERROR"
+}
+
+// Logger logs a message with alternating keys and values, like
+// log.Info("Piece verified", "piece", 3)
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type withLogger struct {
+	parent Logger
+	args   []interface{}
+}
+
+// With returns a logger that adds the key value pairs of args to every
+// message logged to l. A nil l discards the messages.
+func With(l Logger, args ...interface{}) Logger {
+	if l == nil {
+		l = Discard
+	}
+	if w, ok := l.(*withLogger); ok {
+		return &withLogger{parent: w.parent, args: append(append([]interface{}{}, w.args...), args...)}
+	}
+	return &withLogger{parent: l, args: args}
+}
+
+func (w *withLogger) fields(args []interface{}) []interface{} {
+	return append(append([]interface{}{}, w.args...), args...)
+}
+
+func (w *withLogger) Debug(msg string, args ...interface{}) { w.parent.Debug(msg, w.fields(args)...) }
+func (w *withLogger) Info(msg string, args ...interface{})  { w.parent.Info(msg, w.fields(args)...) }
+func (w *withLogger) Warn(msg string, args ...interface{})  { w.parent.Warn(msg, w.fields(args)...) }
+func (w *withLogger) Error(msg string, args ...interface{}) { w.parent.Error(msg, w.fields(args)...) }
+
+type discard struct{}
+
+func (discard) Debug(msg string, args ...interface{}) {}
+func (discard) Info(msg string, args ...interface{})  {}
+func (discard) Warn(msg string, args ...interface{})  {}
+func (discard) Error(msg string, args ...interface{}) {}
+
+// Discard is a logger that drops every message
+var Discard Logger = discard{}
+
+// writerLogger writes the messages of level or above to w, one per line
+type writerLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	now   func() time.Time
+}
+
+// New returns a logger writing the messages of level or above to w, as
+// key=value text or as JSON objects
+func New(w io.Writer, level Level, json bool) Logger {
+	return &writerLogger{w: w, level: level, json: json, now: time.Now}
+}
+
+func (l *writerLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *writerLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *writerLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *writerLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+// pairs splits args in keys and values. A value without key gets the key
+// !BADKEY, like slog does.
+func pairs(args []interface{}) ([]string, []interface{}) {
+	var keys []string
+	var values []interface{}
+	for i := 0; i < len(args); i++ {
+		key, ok := args[i].(string)
+		if !ok || i == len(args)-1 {
+			keys = append(keys, "!BADKEY")
+			values = append(values, args[i])
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, args[i+1])
+		i++
+	}
+	return keys, values
+}
+
+func (l *writerLogger) log(level Level, msg string, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	keys, values := pairs(args)
+	keys = append([]string{"time", "level", "msg"}, keys...)
+	values = append([]interface{}{l.now().Format(time.RFC3339Nano), level.String(), msg}, values...)
+
+	var b strings.Builder
+	if l.json {
+		b.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Quote(key) + ":" + jsonValue(values[i]))
+		}
+		b.WriteString("}\n")
+	} else {
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(key + "=" + textValue(values[i]))
+		}
+		b.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+func jsonValue(v interface{}) string {
+	switch value := v.(type) {
+	case error:
+		v = value.Error()
+	case fmt.Stringer:
+		v = value.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return string(data)
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
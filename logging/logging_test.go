@@ -0,0 +1,39 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testLogger(buf *bytes.Buffer, level Level, json bool) Logger {
+	l := New(buf, level, json).(*writerLogger)
+	l.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return l
+}
+
+func Test_Text(t *testing.T) {
+	var buf bytes.Buffer
+	l := With(testLogger(&buf, LevelInfo, false), "infohash", "abcd")
+	l = With(l, "peer", "10.0.0.1:6881")
+	l.Debug("dropped")
+	l.Info("Piece verified", "piece", 3, "err", errors.New("bad hash"), "odd")
+
+	want := `time=2020-01-02T03:04:05Z level=INFO msg="Piece verified" infohash=abcd peer=10.0.0.1:6881 piece=3 err="bad hash" !BADKEY=odd` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %s\nwant %s", buf.String(), want)
+	}
+}
+
+func Test_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := With(testLogger(&buf, LevelWarn, true), "tracker", "udp://tracker:80")
+	l.Info("dropped")
+	l.Error("Announce failed", "peers", 0, "err", errors.New("timeout"))
+
+	want := `{"time":"2020-01-02T03:04:05Z","level":"ERROR","msg":"Announce failed","tracker":"udp://tracker:80","peers":0,"err":"timeout"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("got  %s\nwant %s", buf.String(), want)
+	}
+}
@@ -0,0 +1,391 @@
+// Package metrics implements counters, gauges and histograms that are
+// exported in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the latency histograms
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Registry holds a set of metrics and writes them in the text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Default is the registry of the metrics of the torrent client
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, old := range r.metrics {
+		if old.name() == m.name() {
+			panic("metrics: duplicate metric " + m.name())
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// WriteTo writes every metric of the registry, sorted by name
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].name() < metrics[j].name() })
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the metrics, so the registry can be mounted on /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if req.Method == http.MethodHead {
+		return
+	}
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is the name, help and label names shared by the series of a metric
+type desc struct {
+	metricName string
+	help       string
+	typ        string
+	labels     []string
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.metricName, help, d.metricName, d.typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelPairs formats the labels of a series, with extra appended at the end
+func labelPairs(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// value is a float that can be added to concurrently
+type value struct {
+	mu sync.Mutex
+	v  float64
+}
+
+func (v *value) add(n float64) {
+	v.mu.Lock()
+	v.v += n
+	v.mu.Unlock()
+}
+
+func (v *value) set(n float64) {
+	v.mu.Lock()
+	v.v = n
+	v.mu.Unlock()
+}
+
+func (v *value) get() float64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.v
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	value
+}
+
+// Add increases the counter. Negative values are ignored.
+func (c *Counter) Add(n float64) {
+	if n > 0 {
+		c.add(n)
+	}
+}
+
+func (c *Counter) Inc() {
+	c.add(1)
+}
+
+func (c *Counter) Value() float64 {
+	return c.get()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	value
+}
+
+func (g *Gauge) Set(n float64) {
+	g.set(n)
+}
+
+func (g *Gauge) Add(n float64) {
+	g.add(n)
+}
+
+func (g *Gauge) Inc() {
+	g.add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.add(-1)
+}
+
+func (g *Gauge) Value() float64 {
+	return g.get()
+}
+
+// Histogram counts observations in buckets of increasing upper bounds
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // observations of each bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// ObserveSince observes the seconds elapsed since start
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels, values []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, values, "le", formatValue(le)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labelPairs(labels, values, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labelPairs(labels, values), formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labelPairs(labels, values), h.count)
+}
+
+type counterMetric struct {
+	desc
+	c *Counter
+}
+
+func (m *counterMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", m.metricName, formatValue(m.c.Value()))
+}
+
+type gaugeMetric struct {
+	desc
+	g *Gauge
+}
+
+func (m *gaugeMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", m.metricName, formatValue(m.g.Value()))
+}
+
+type histogramMetric struct {
+	desc
+	h *Histogram
+}
+
+func (m *histogramMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	m.h.write(w, m.metricName, nil, nil)
+}
+
+// NewCounter creates and registers a counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	m := &counterMetric{desc{name, help, "counter", nil}, &Counter{}}
+	r.register(m)
+	return m.c
+}
+
+// NewGauge creates and registers a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	m := &gaugeMetric{desc{name, help, "gauge", nil}, &Gauge{}}
+	r.register(m)
+	return m.g
+}
+
+// NewHistogram creates and registers a histogram. The buckets must be sorted.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	m := &histogramMetric{desc{name, help, "histogram", nil}, newHistogram(buckets)}
+	r.register(m)
+	return m.h
+}
+
+// series are the values of a metric with labels, by their label values
+type series struct {
+	desc
+	mu     sync.Mutex
+	values map[string][]string
+	series map[string]interface{}
+}
+
+func (s *series) with(create func() interface{}, values []string) interface{} {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", s.metricName, len(s.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.series[key]; ok {
+		return m
+	}
+	if s.series == nil {
+		s.values = make(map[string][]string)
+		s.series = make(map[string]interface{})
+	}
+	m := create()
+	s.values[key] = append([]string(nil), values...)
+	s.series[key] = m
+	return m
+}
+
+// each calls fn with every series sorted by their label values
+func (s *series) each(fn func(values []string, m interface{})) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.series))
+	for k := range s.series {
+		keys = append(keys, k)
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		s.mu.Lock()
+		values, m := s.values[k], s.series[k]
+		s.mu.Unlock()
+		fn(values, m)
+	}
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	series
+}
+
+// With returns the counter of the label values, in the order of the labels
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.with(func() interface{} { return &Counter{} }, values).(*Counter)
+}
+
+func (v *CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, m interface{}) {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, labelPairs(v.labels, values), formatValue(m.(*Counter).Value()))
+	})
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	series
+	buckets []float64
+}
+
+// With returns the histogram of the label values, in the order of the labels
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.with(func() interface{} { return newHistogram(v.buckets) }, values).(*Histogram)
+}
+
+func (v *HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	v.each(func(values []string, m interface{}) {
+		m.(*Histogram).write(w, v.metricName, v.labels, values)
+	})
+}
+
+// NewCounterVec creates and registers a counter with labels
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{series{desc: desc{name, help, "counter", labels}}}
+	r.register(v)
+	return v
+}
+
+// NewHistogramVec creates and registers a histogram with labels
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{series{desc: desc{name, help, "histogram", labels}}, buckets}
+	r.register(v)
+	return v
+}
@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_bytes_total", "Bytes received")
+	g := r.NewGauge("test_peers", "Connected peers")
+	h := r.NewHistogram("test_latency_seconds", "Write latency", []float64{0.1, 1})
+	v := r.NewCounterVec("test_connections_total", "Connections by outcome", "outcome")
+
+	c.Add(1024)
+	c.Add(-1)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(3)
+	v.With("down").Inc()
+	v.With("connected").Add(2)
+	v.With(`a"b`).Inc()
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	want := `# HELP test_bytes_total Bytes received
+# TYPE test_bytes_total counter
+test_bytes_total 1024
+# HELP test_connections_total Connections by outcome
+# TYPE test_connections_total counter
+test_connections_total{outcome="a\"b"} 1
+test_connections_total{outcome="connected"} 2
+test_connections_total{outcome="down"} 1
+# HELP test_latency_seconds Write latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.15
+test_latency_seconds_count 3
+# HELP test_peers Connected peers
+# TYPE test_peers gauge
+test_peers 1
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func Test_HistogramVec(t *testing.T) {
+	r := NewRegistry()
+	v := r.NewHistogramVec("test_announce_seconds", "Announce latency", []float64{1}, "tracker")
+	v.With("udp://tracker:80").Observe(0.5)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `test_announce_seconds_bucket{tracker="udp://tracker:80",le="1"} 1`) {
+		t.Errorf("missing bucket in\n%s", rec.Body.String())
+	}
+}
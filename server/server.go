@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+type fileEntry struct {
+	Index     int     `json:"index"`
+	Path      string  `json:"path"`
+	Length    uint64  `json:"length"`
+	Completed uint64  `json:"completed"`
+	Progress  float64 `json:"progress"`
+	URL       string  `json:"url"`
+}
+
+// Server exposes the files of a torrent over HTTP while it is downloading.
+// GET / returns a JSON index of the files and GET /files/<index>/<name>
+// streams the file, with support for Range requests.
+type Server struct {
+	torrent *torrentfile.Torrent
+	down    *torrentp2p.Downloader
+	mux     *http.ServeMux
+}
+
+// New creates a server for the torrent being downloaded by down.
+func New(torrent *torrentfile.Torrent, down *torrentp2p.Downloader) *Server {
+	s := &Server{
+		torrent: torrent,
+		down:    down,
+		mux:     http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/", s.serveIndex)
+	s.mux.HandleFunc("/files/", s.serveFile)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var entries []fileEntry
+	var offset uint64
+	for i, f := range s.torrent.FileList() {
+		if f.IsPadding() {
+			offset += f.Length
+			continue
+		}
+		name := path.Join(f.Path...)
+		completed := s.down.Completed(offset, f.Length)
+		entry := fileEntry{
+			Index:     i,
+			Path:      name,
+			Length:    f.Length,
+			Completed: completed,
+			Progress:  1,
+			URL:       fmt.Sprintf("/files/%d/%s", i, name),
+		}
+		if f.Length > 0 {
+			entry.Progress = float64(completed) / float64(f.Length)
+		}
+		entries = append(entries, entry)
+		offset += f.Length
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/files/"), "/", 2)
+	index, err := strconv.Atoi(parts[0])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	files := s.torrent.FileList()
+	if index < 0 || index >= len(files) || files[index].IsPadding() {
+		http.NotFound(w, r)
+		return
+	}
+	reader, err := s.down.NewFileReader(r.Context(), index)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	file := files[index]
+	name := file.Path[len(file.Path)-1]
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", fmt.Sprintf("\"%x-%d\"", s.torrent.InfoHash, index))
+	http.ServeContent(w, r, name, time.Time{}, reader)
+}
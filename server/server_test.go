@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/torrentp2p"
+)
+
+// testServer downloads a torrent of two files separated by a padding file
+// from an HTTP seed and serves it. It returns the data of the torrent.
+func testServer(t *testing.T) (*httptest.Server, *torrentfile.Torrent, []byte) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	})
+
+	data := make([]byte, 36384)
+	for i := range data[:10000] {
+		data[i] = byte(i * 7)
+	}
+	for i := range data[16384:] {
+		data[16384+i] = byte(i * 3)
+	}
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		piece, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		end := (piece + 1) * 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[piece*16384 : end])
+	}))
+	defer seed.Close()
+
+	torrent := &torrentfile.Torrent{
+		Name:        "site",
+		PieceLength: 16384,
+		Length:      uint64(len(data)),
+		Files: []torrentfile.TorrentMultiFileInfo{
+			{Length: 10000, Path: []string{"index.html"}},
+			{Length: 6384, Path: []string{".pad", "6384"}, Attr: "p"},
+			{Length: 20000, Path: []string{"dir", "data.zzz"}},
+		},
+		HTTPSeeds: []string{seed.URL},
+	}
+	torrent.InfoHash[0] = 0xab
+	for i := 0; i < len(data); i += torrent.PieceLength {
+		end := i + torrent.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[i:end]))
+	}
+
+	down, err := torrentp2p.NewDownloader(torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(down.Close)
+	if err := down.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(New(torrent, down))
+	t.Cleanup(server.Close)
+	return server, torrent, data
+}
+
+func get(t *testing.T, url string, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func Test_serveIndex(t *testing.T) {
+	server, _, _ := testServer(t)
+	resp, body := get(t, server.URL+"/", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var entries []fileEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		t.Fatal(err)
+	}
+	expected := []fileEntry{
+		{Index: 0, Path: "index.html", Length: 10000, Completed: 10000, Progress: 1, URL: "/files/0/index.html"},
+		{Index: 2, Path: "dir/data.zzz", Length: 20000, Completed: 20000, Progress: 1, URL: "/files/2/dir/data.zzz"},
+	}
+	if fmt.Sprint(entries) != fmt.Sprint(expected) {
+		t.Errorf("Unexpected index %+v", entries)
+	}
+	if resp, _ := get(t, server.URL+"/other", nil); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func Test_serveFile(t *testing.T) {
+	server, torrent, data := testServer(t)
+
+	resp, body := get(t, server.URL+"/files/0/index.html", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != string(data[:10000]) {
+		t.Errorf("Unexpected response %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	etag := fmt.Sprintf("\"%x-0\"", torrent.InfoHash)
+	if resp.Header.Get("ETag") != etag {
+		t.Errorf("Unexpected ETag %q", resp.Header.Get("ETag"))
+	}
+	if resp, _ := get(t, server.URL+"/files/0/index.html", http.Header{"If-None-Match": {etag}}); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected 304, got %d", resp.StatusCode)
+	}
+
+	// the range crosses a piece boundary
+	resp, body = get(t, server.URL+"/files/2/data.zzz", http.Header{"Range": {"bytes=10-19999"}})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != string(data[16394:]) {
+		t.Errorf("Unexpected range response %d with %d bytes", resp.StatusCode, len(body))
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != "bytes 10-19999/20000" {
+		t.Errorf("Unexpected Content-Range %q", cr)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/octet-stream" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+
+	for _, path := range []string{"/files/1/.pad/6384", "/files/3/x", "/files/-1/x", "/files/abc"} {
+		if resp, _ := get(t, server.URL+path, nil); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500
+)
+
+// CreateOptions describes a torrent to be created from a file or directory
+type CreateOptions struct {
+	Path         string
+	PieceLength  int // 0 picks a piece length from the total size
+	AnnounceList [][]string
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time
+	Private      bool
+	WebSeeds     []string
+	Source       string
+	Workers      int // 0 uses one worker per CPU
+}
+
+type createdInfo struct {
+	Files       []TorrentMultiFileInfo `bencode:"files,omitempty"`
+	Length      uint64                 `bencode:"length,omitempty"`
+	Name        string                 `bencode:"name"`
+	PieceLength int                    `bencode:"piece length"`
+	Pieces      string                 `bencode:"pieces"`
+	Private     int                    `bencode:"private,omitempty"`
+	Source      string                 `bencode:"source,omitempty"`
+}
+
+type createdFile struct {
+	Announce     string      `bencode:"announce,omitempty"`
+	AnnounceList [][]string  `bencode:"announce-list,omitempty"`
+	Comment      string      `bencode:"comment,omitempty"`
+	CreatedBy    string      `bencode:"created by,omitempty"`
+	CreationDate int64       `bencode:"creation date,omitempty"`
+	Info         createdInfo `bencode:"info"`
+	URLList      []string    `bencode:"url-list,omitempty"`
+}
+
+type sourceFile struct {
+	path   string
+	length uint64
+}
+
+// PieceLengthFor returns a power of two piece length that splits totalLength
+// in about 1500 pieces, between 16KiB and 16MiB.
+func PieceLengthFor(totalLength uint64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && totalLength/uint64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+func collectFiles(root string) ([]sourceFile, bool, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, false, err
+	}
+	if !stat.IsDir() {
+		return []sourceFile{{path: root, length: uint64(stat.Size())}}, false, nil
+	}
+
+	var files []sourceFile
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, sourceFile{path: p, length: uint64(info.Size())})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, true, err
+	}
+	if len(files) == 0 {
+		return nil, true, errors.New("No files found in " + root)
+	}
+	return files, true, nil
+}
+
+// readPiece reads the piece starting at offset from the concatenation of files
+func readPiece(files []sourceFile, offset uint64, data []byte) error {
+	var start uint64
+	read := 0
+	for _, f := range files {
+		end := start + f.length
+		if end > offset && read < len(data) {
+			file, err := os.Open(f.path)
+			if err != nil {
+				return err
+			}
+			n, err := file.ReadAt(data[read:], int64(offset-start))
+			file.Close()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			read += n
+			offset += uint64(n)
+		}
+		start = end
+	}
+	if read != len(data) {
+		return errors.New("Files changed while hashing")
+	}
+	return nil
+}
+
+func hashPieces(files []sourceFile, totalLength uint64, pieceLength int, workers int) ([]byte, error) {
+	numPieces := int((totalLength + uint64(pieceLength) - 1) / uint64(pieceLength))
+	hashes := make([]byte, numPieces*20)
+
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, pieceLength)
+			for piece := range jobs {
+				offset := uint64(piece) * uint64(pieceLength)
+				size := uint64(pieceLength)
+				if offset+size > totalLength {
+					size = totalLength - offset
+				}
+				if err := readPiece(files, offset, data[:size]); err != nil {
+					errs <- err
+					return
+				}
+				hash := sha1.Sum(data[:size])
+				copy(hashes[piece*20:], hash[:])
+			}
+		}()
+	}
+
+	var err error
+feed:
+	for piece := 0; piece < numPieces; piece++ {
+		select {
+		case jobs <- piece:
+		case err = <-errs:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return hashes, err
+}
+
+// Create builds a bencoded .torrent from the file or directory in opts.Path.
+// Pieces are hashed in parallel.
+func Create(opts CreateOptions) ([]byte, error) {
+	root := filepath.Clean(opts.Path)
+	files, multifile, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+
+	info := createdInfo{
+		Name:        filepath.Base(root),
+		PieceLength: opts.PieceLength,
+		Source:      opts.Source,
+	}
+	var totalLength uint64
+	for _, f := range files {
+		totalLength += f.length
+		if multifile {
+			rel, err := filepath.Rel(root, f.path)
+			if err != nil {
+				return nil, err
+			}
+			info.Files = append(info.Files, TorrentMultiFileInfo{
+				Length: f.length,
+				Path:   strings.Split(filepath.ToSlash(rel), "/"),
+			})
+		}
+	}
+	if !multifile {
+		info.Length = totalLength
+	}
+	if totalLength == 0 {
+		return nil, errors.New("Can't create a torrent with no data")
+	}
+	if info.PieceLength == 0 {
+		info.PieceLength = PieceLengthFor(totalLength)
+	}
+	if info.PieceLength < minPieceLength || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, errors.New("Piece length must be a power of two of at least 16KiB")
+	}
+	if opts.Private {
+		info.Private = 1
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	pieces, err := hashPieces(files, totalLength, info.PieceLength, workers)
+	if err != nil {
+		return nil, err
+	}
+	info.Pieces = string(pieces)
+
+	tf := createdFile{
+		AnnounceList: opts.AnnounceList,
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		Info:         info,
+		URLList:      opts.WebSeeds,
+	}
+	if len(opts.AnnounceList) > 0 && len(opts.AnnounceList[0]) > 0 {
+		tf.Announce = opts.AnnounceList[0][0]
+	}
+	if !opts.CreationDate.IsZero() {
+		tf.CreationDate = opts.CreationDate.Unix()
+	}
+
+	return bencode.Marshal(tf)
+}
@@ -0,0 +1,66 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_PieceLengthFor(t *testing.T) {
+	if l := PieceLengthFor(1000); l != minPieceLength {
+		t.Errorf("Expected %d, got %d", minPieceLength, l)
+	}
+	if l := PieceLengthFor(1 << 40); l != maxPieceLength {
+		t.Errorf("Expected %d, got %d", maxPieceLength, l)
+	}
+	if l := PieceLengthFor(1500 * 1024 * 1024); l != 1024*1024 {
+		t.Errorf("Expected %d, got %d", 1024*1024, l)
+	}
+}
+
+func Test_Create(t *testing.T) {
+	dir, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := make([]byte, 40000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	os.MkdirAll(filepath.Join(dir, "data", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "data", "a.bin"), content[:30000], 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data", "sub", "b.bin"), content[30000:], 0644)
+
+	data, err := Create(CreateOptions{
+		Path:         filepath.Join(dir, "data"),
+		AnnounceList: [][]string{{"udp://tracker.example:80"}},
+		Private:      true,
+		Workers:      3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentPath := filepath.Join(dir, "data.torrent")
+	ioutil.WriteFile(torrentPath, data, 0644)
+
+	torrent, err := TorrentFromFile(torrentPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Name != "data" || torrent.Length != 40000 || len(torrent.Files) != 2 {
+		t.Errorf("Unexpected torrent %s with length %d and %d files", torrent.Name, torrent.Length, len(torrent.Files))
+	}
+	if !torrent.Private || len(torrent.Tiers) != 1 || len(torrent.Trackers) != 1 || torrent.Trackers[0].URL != "tracker.example:80" {
+		t.Errorf("Unexpected private flag %t or trackers %v", torrent.Private, torrent.Tiers)
+	}
+	if len(torrent.PieceHashes) != 3 {
+		t.Fatalf("Expected 3 pieces, got %d", len(torrent.PieceHashes))
+	}
+	if torrent.PieceHashes[1] != sha1.Sum(content[16384:32768]) {
+		t.Errorf("Wrong hash for piece spanning both files")
+	}
+}
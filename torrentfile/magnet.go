@@ -0,0 +1,79 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MagnetOptions selects the optional parts of a magnet link
+type MagnetOptions struct {
+	SelectFiles []int // BEP 53 indices of the files to download, all if empty
+	NoTrackers  bool
+	NoWebSeeds  bool
+}
+
+// selectOnly formats file indices as BEP 53 ranges, like "0,2,4-6"
+func selectOnly(files []int) string {
+	sorted := append([]int(nil), files...)
+	sort.Ints(sorted)
+
+	var ranges []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[i] == sorted[j] {
+			ranges = append(ranges, strconv.Itoa(sorted[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(sorted[i])+"-"+strconv.Itoa(sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ",")
+}
+
+// Magnet returns the magnet link of the torrent, with the v1 and v2 info
+// hashes, name, length, trackers and web seeds
+func (t *Torrent) Magnet(opts MagnetOptions) string {
+	var params []string
+	add := func(key, value string) {
+		params = append(params, key+"="+url.QueryEscape(value))
+	}
+
+	if !t.IsV2() || t.IsHybrid() {
+		params = append(params, "xt=urn:btih:"+hex.EncodeToString(t.InfoHash[:]))
+	}
+	if t.IsV2() {
+		// multihash of a sha2-256 digest
+		params = append(params, "xt=urn:btmh:1220"+hex.EncodeToString(t.InfoHashV2[:]))
+	}
+	if t.Name != "" {
+		add("dn", t.Name)
+	}
+	add("xl", strconv.FormatUint(t.Length, 10))
+
+	if !opts.NoTrackers {
+		seen := map[string]bool{}
+		for _, tier := range t.Tiers {
+			for _, tracker := range tier {
+				if !seen[tracker] {
+					seen[tracker] = true
+					add("tr", tracker)
+				}
+			}
+		}
+	}
+	if !opts.NoWebSeeds {
+		for _, seed := range t.WebSeeds {
+			add("ws", seed)
+		}
+	}
+	if len(opts.SelectFiles) > 0 {
+		params = append(params, "so="+selectOnly(opts.SelectFiles))
+	}
+	return "magnet:?" + strings.Join(params, "&")
+}
@@ -0,0 +1,32 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func Test_selectOnly(t *testing.T) {
+	if s := selectOnly([]int{6, 0, 2, 4, 5}); s != "0,2,4-6" {
+		t.Errorf("Expected 0,2,4-6, got %s", s)
+	}
+}
+
+func Test_Magnet(t *testing.T) {
+	info := "d4:name5:a b.c12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa1:zi1e6:lengthi3ee"
+	torrent, err := parseTorrent([]byte("d13:announce-listll3:urlel4:url2ee4:info" + info + "8:url-list6:http:/e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	magnet := torrent.Magnet(MagnetOptions{SelectFiles: []int{0}})
+	if !strings.HasPrefix(magnet, "magnet:?xt=urn:btih:"+hex.EncodeToString(torrent.InfoHash[:])) {
+		t.Fatalf("Unexpected magnet %s", magnet)
+	}
+	for _, part := range []string{"&dn=a+b.c", "&xl=3", "&tr=url&tr=url2", "&ws=http%3A%2F", "&so=0"} {
+		if !strings.Contains(magnet, part) {
+			t.Errorf("Missing %s in %s", part, magnet)
+		}
+	}
+
+}
@@ -0,0 +1,106 @@
+package torrentfile
+
+import (
+	"crypto/sha256"
+	"errors"
+)
+
+// BlockSize is the size of the leaves of the v2 merkle trees
+const BlockSize = 16384
+
+func hashPair(left, right [32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+func nextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+func log2(n int) int {
+	l := 0
+	for n > 1 {
+		n /= 2
+		l++
+	}
+	return l
+}
+
+// padHash returns the root of a subtree of width zero leaves
+func padHash(width int) [32]byte {
+	var pad [32]byte
+	for ; width > 1; width /= 2 {
+		pad = hashPair(pad, pad)
+	}
+	return pad
+}
+
+// merkleLevels builds the tree above hashes, padding them with pad up to width
+// entries. levels[0] are the padded hashes and the last level is the root.
+func merkleLevels(hashes [][32]byte, width int, pad [32]byte) [][][32]byte {
+	level := make([][32]byte, width)
+	copy(level, hashes)
+	for i := len(hashes); i < width; i++ {
+		level[i] = pad
+	}
+
+	levels := [][][32]byte{level}
+	for len(level) > 1 {
+		next := make([][32]byte, len(level)/2)
+		for i := range next {
+			next[i] = hashPair(level[2*i], level[2*i+1])
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+// merkleRoot returns the root of the tree whose leaves are hashes padded with
+// pad up to width entries
+func merkleRoot(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	levels := merkleLevels(hashes, width, pad)
+	return levels[len(levels)-1][0]
+}
+
+// blockHashes returns the SHA-256 of every 16KiB block of data
+func blockHashes(data []byte) [][32]byte {
+	var hashes [][32]byte
+	for i := 0; i < len(data); i += BlockSize {
+		end := i + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha256.Sum256(data[i:end]))
+	}
+	return hashes
+}
+
+// verifyProof checks that hashes, placed at index in their layer and
+// completed with the uncle hashes in proof, lead to root
+func verifyProof(root [32]byte, index int, hashes [][32]byte, proof [][32]byte) error {
+	if len(hashes) == 0 || len(hashes) != nextPow2(len(hashes)) || index%len(hashes) != 0 {
+		return errors.New("Invalid number of hashes")
+	}
+
+	node := merkleRoot(hashes, len(hashes), [32]byte{})
+	pos := index / len(hashes)
+	for _, uncle := range proof {
+		if pos%2 == 0 {
+			node = hashPair(node, uncle)
+		} else {
+			node = hashPair(uncle, node)
+		}
+		pos /= 2
+	}
+	if pos != 0 || node != root {
+		return errors.New("Hashes don't match the pieces root")
+	}
+	return nil
+}
@@ -1,9 +1,40 @@
 package torrentfile
 
+import (
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+)
+
 type TorrentMultiFileInfo struct {
-	Length uint64   `bencode:"length"`
-	Path   []string `bencode:"path"`
-	MD5sum string   `bencode:"md5sum"`
+	Length      uint64   `bencode:"length"`
+	Path        []string `bencode:"path"`
+	MD5sum      string   `bencode:"md5sum,omitempty"`
+	Attr        string   `bencode:"attr,omitempty"` // BEP 47 attributes
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+	PiecesRoot  [32]byte `bencode:"-"` // v2 merkle root of the file
+}
+
+// IsPadding reports whether the file is a padding file, only used to align
+// the next file to a piece boundary
+func (f TorrentMultiFileInfo) IsPadding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// IsExecutable reports whether the file has the executable attribute
+func (f TorrentMultiFileInfo) IsExecutable() bool {
+	return strings.Contains(f.Attr, "x")
+}
+
+// IsHidden reports whether the file has the hidden attribute
+func (f TorrentMultiFileInfo) IsHidden() bool {
+	return strings.Contains(f.Attr, "h")
+}
+
+// IsSymlink reports whether the file is a symlink to SymlinkPath
+func (f TorrentMultiFileInfo) IsSymlink() bool {
+	return strings.Contains(f.Attr, "l")
 }
 
 type torrentFileInfo struct {
@@ -12,30 +43,58 @@ type torrentFileInfo struct {
 	Length      uint64                 `bencode:"length"`
 	Name        string                 `bencode:"name"`
 	Files       []TorrentMultiFileInfo `bencode:"files"`
+	MetaVersion int                    `bencode:"meta version"`
+	FileTree    bencode.RawMessage     `bencode:"file tree"`
+	Private     int                    `bencode:"private"`
 }
 
 type torrentFile struct {
-	Announce     string     `bencode:"announce"`
-	AnnounceList [][]string `bencode:"announce-list"`
-	CreationDate int        `bencode:"creation date"`
-	Info         torrentFileInfo
-	Comment      string `bencode:"comment"`
-	CreatedBy    string `bencode:"created by"`
-	RawInfo      string
+	Announce     string             `bencode:"announce"`
+	AnnounceList [][]string         `bencode:"announce-list"`
+	CreationDate int64              `bencode:"creation date"`
+	RawInfo      bencode.RawMessage `bencode:"info"`
+	Info         torrentFileInfo    `bencode:"-"`
+	Comment      string             `bencode:"comment"`
+	CreatedBy    string             `bencode:"created by"`
+	PieceLayers  map[string]string  `bencode:"piece layers"`
+	URLList      bencode.RawMessage `bencode:"url-list"` // a string or a list of strings
+	HTTPSeeds    []string           `bencode:"httpseeds"`
 }
 
-type tracker struct {
+// Tracker is an announce URL of the torrent
+type Tracker struct {
 	URL      string
 	Protocol string
+	Announce string
 }
 
 // Torrent Represents a torrent entity
 type Torrent struct {
-	Trackers    []tracker
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      uint64
-	Name        string
-	Files       []TorrentMultiFileInfo
+	Trackers     []Tracker
+	InfoHash     [20]byte
+	PieceHashes  [][20]byte
+	PieceLength  int
+	Length       uint64
+	Name         string
+	Files        []TorrentMultiFileInfo
+	RawInfo      []byte // exact bencoded info dictionary, as found in the file
+	MetaVersion  int
+	InfoHashV2   [32]byte
+	PieceLayers  map[[32]byte][][32]byte // piece hashes of v2 files by pieces root
+	WebSeeds     []string                // BEP 19 url-list
+	HTTPSeeds    []string                // BEP 17 httpseeds
+	Tiers        [][]string              // tracker tiers, from announce-list or announce
+	Private      bool
+	Comment      string
+	CreatedBy    string
+	CreationDate time.Time // zero if not present
+}
+
+// FileList returns the files of the torrent. Single file torrents are
+// returned as a list with one entry named after the torrent.
+func (t *Torrent) FileList() []TorrentMultiFileInfo {
+	if len(t.Files) > 0 {
+		return t.Files
+	}
+	return []TorrentMultiFileInfo{{Length: t.Length, Path: []string{t.Name}}}
 }
@@ -1,16 +1,15 @@
 package torrentfile
 
 import (
-	"bytes"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
-	"log"
+	"io/ioutil"
 	"net/url"
-	"os"
 	"strings"
 	"time"
 
-	bencode "github.com/jackpal/bencode-go"
+	"github.com/vaguilera/MiniTorrent/bencode"
 )
 
 func (tf *torrentFile) pieceHashes() ([][20]byte, error) {
@@ -31,28 +30,17 @@ func (tf *torrentFile) pieceHashes() ([][20]byte, error) {
 
 }
 
-func generateInfoHash(info interface{}) ([20]byte, error) {
-	buf := bytes.Buffer{}
-	err := bencode.Marshal(&buf, info)
+// NewTracker parses the announce URL of a tracker. Invalid URLs give a
+// tracker with no protocol, which is never used.
+func NewTracker(announce string) Tracker {
+	u, err := url.Parse(strings.TrimSpace(announce))
 	if err != nil {
-		return [20]byte{}, err
+		return Tracker{Announce: announce}
 	}
-	hash := sha1.Sum(buf.Bytes())
-
-	return hash, err
-}
-
-func (tf *torrentFile) printInfo() {
-	log.Printf("Trackers: %v\n", tf.AnnounceList)
-	log.Printf("Creation Date: %s\n", time.Unix(int64(tf.CreationDate), 0))
-	log.Printf("Comment: %s\n", tf.Comment)
-	log.Printf("Created By: %s\n", tf.CreatedBy)
-	if tf.Info.Length > 0 {
-		log.Printf("File Size: %d\n", tf.Info.Length)
-	}
-	log.Printf("Filename: %s\n", tf.Info.Name)
-	if len(tf.Info.Files) > 0 {
-		log.Printf("Files: %v\n", tf.Info.Files)
+	return Tracker{
+		URL:      u.Host,
+		Protocol: u.Scheme,
+		Announce: u.String(),
 	}
 }
 
@@ -74,66 +62,108 @@ func newTorrent(tf *torrentFile) (*Torrent, error) {
 	t.PieceLength = tf.Info.PieceLength
 	t.PieceHashes, err = tf.pieceHashes()
 	if err != nil {
-		log.Fatal("Error processing torrent file:", err)
 		return nil, err
 	}
+	if t.PieceLength <= 0 {
+		return nil, errors.New("Invalid piece length")
+	}
+	t.MetaVersion = tf.Info.MetaVersion
+	if t.IsV2() {
+		err = t.parseV2(tf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if uint64(t.NumPieces()) != (t.Length+uint64(t.PieceLength)-1)/uint64(t.PieceLength) {
+		return nil, errors.New("Number of pieces doesn't match the torrent length")
+	}
 
-	var u *url.URL
-	var tr tracker
-
-	for i := 0; i < len(tf.AnnounceList); i++ {
-		for j := 0; j < len(tf.AnnounceList[i]); j++ {
-			u, err = url.Parse(strings.TrimSpace(tf.AnnounceList[i][j]))
-			if err != nil {
-				log.Fatal("Error processing torrent file:", err)
-				return nil, err
-			}
-			tr.Protocol = u.Scheme
-			tr.URL = u.Host
-
-			t.Trackers = append(t.Trackers, tr)
+	t.Tiers = tf.AnnounceList
+	if len(t.Tiers) == 0 && tf.Announce != "" {
+		t.Tiers = [][]string{{tf.Announce}}
+	}
+	for _, tier := range t.Tiers {
+		for _, announce := range tier {
+			t.Trackers = append(t.Trackers, NewTracker(announce))
 		}
 	}
-	tf.printInfo()
-	log.Printf("Files total length: %d\n\n", t.Length)
+
+	t.Private = tf.Info.Private == 1
+	t.Comment = tf.Comment
+	t.CreatedBy = tf.CreatedBy
+	if tf.CreationDate > 0 {
+		t.CreationDate = time.Unix(tf.CreationDate, 0)
+	}
+	t.WebSeeds, err = stringOrList(tf.URLList)
+	if err != nil {
+		return nil, errors.New("Invalid url-list: " + err.Error())
+	}
+	t.HTTPSeeds = tf.HTTPSeeds
+
 	return t, nil
 
 }
 
-// TorrentFromFile creates Torrent entity from .torrent file
-func TorrentFromFile(fileName string) (*Torrent, error) {
-
-	file, err := os.Open(fileName)
-	defer file.Close()
+// stringOrList decodes a value that can be a single string or a list of them
+func stringOrList(raw bencode.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var list []string
+	if raw[0] == 'l' {
+		err := bencode.Unmarshal(raw, &list)
+		return list, err
+	}
+	var single string
+	err := bencode.Unmarshal(raw, &single)
+	if err != nil || single == "" {
+		return nil, err
+	}
+	return []string{single}, nil
+}
 
+func parseTorrent(data []byte) (*Torrent, error) {
+	tfile := torrentFile{}
+	err := bencode.Unmarshal(data, &tfile)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("Couldn't parse torrent file: " + err.Error())
+	}
+	if len(tfile.RawInfo) == 0 || tfile.RawInfo[0] != 'd' {
+		return nil, errors.New("Couldn't parse torrent file: missing info dictionary")
+	}
+	err = bencode.Unmarshal(tfile.RawInfo, &tfile.Info)
+	if err != nil {
+		return nil, errors.New("Couldn't parse torrent file: " + err.Error())
 	}
 
-	fileDecoded, err := bencode.Decode(file)
+	torrent, err := newTorrent(&tfile)
 	if err != nil {
-		err = errors.New("Couldn't parse torrent file 1:" + err.Error())
 		return nil, err
 	}
-
-	mapper, ok := fileDecoded.(map[string]interface{})
-	if !ok {
-		return nil, errors.New("Couldn't parse torrent file 2")
+	torrent.InfoHash = sha1.Sum(tfile.RawInfo)
+	if torrent.IsV2() {
+		torrent.InfoHashV2 = sha256.Sum256(tfile.RawInfo)
+		if !torrent.IsHybrid() {
+			copy(torrent.InfoHash[:], torrent.InfoHashV2[:])
+		}
 	}
+	torrent.RawInfo = tfile.RawInfo
 
-	infoHash, _ := generateInfoHash(mapper["info"])
-	log.Printf("InfoHash: %x\n", infoHash)
+	return torrent, nil
+}
 
-	file.Seek(0, 0)
-	tfile := torrentFile{}
-	err = bencode.Unmarshal(file, &tfile)
+// TorrentFromFile creates Torrent entity from .torrent file
+func TorrentFromFile(fileName string) (*Torrent, error) {
+
+	data, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		err = errors.New("Couldn't parse torrent file 3:" + err.Error())
 		return nil, err
 	}
 
-	torrent, err := newTorrent(&tfile)
-	torrent.InfoHash = infoHash
+	return parseTorrent(data)
+}
 
-	return torrent, nil
+// TorrentFromBytes creates Torrent entity from the contents of a .torrent file
+func TorrentFromBytes(data []byte) (*Torrent, error) {
+	return parseTorrent(data)
 }
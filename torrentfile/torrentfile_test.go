@@ -0,0 +1,40 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"testing"
+)
+
+func Test_parseTorrent(t *testing.T) {
+	// keys out of order and an unknown key inside info: a re-encoding would
+	// sort them and give a different info hash
+	info := "d4:name1:a12:piece lengthi16384e6:pieces20:aaaaaaaaaaaaaaaaaaaa1:zi1e6:lengthi3ee"
+	data := []byte("d8:announce3:url4:info" + info + "7:comment1:xe")
+
+	torrent, err := parseTorrent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(torrent.RawInfo) != info {
+		t.Errorf("Unexpected info bytes %s", torrent.RawInfo)
+	}
+	if torrent.InfoHash != sha1.Sum([]byte(info)) {
+		t.Errorf("Info hash doesn't match the raw info bytes")
+	}
+	if len(torrent.Tiers) != 1 || torrent.Tiers[0][0] != "url" || torrent.Comment != "x" {
+		t.Errorf("Expected announce as the only tier and comment, got %v and %s", torrent.Tiers, torrent.Comment)
+	}
+
+	for _, bad := range []string{
+		"",
+		"li1ee",
+		"d4:infoi1ee",
+		"d3:foo3:bare",
+		"d4:infod4:name1:a12:piece lengthi0e6:pieces0:6:lengthi3eee",
+		"d4:infod4:name1:a12:piece lengthi1e6:pieces20:aaaaaaaaaaaaaaaaaaaa6:lengthi3eee",
+	} {
+		if _, err := parseTorrent([]byte(bad)); err == nil {
+			t.Errorf("Expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+)
+
+type fileTreeEntry struct {
+	Length      uint64   `bencode:"length"`
+	PiecesRoot  []byte   `bencode:"pieces root"`
+	Attr        string   `bencode:"attr"`
+	SymlinkPath []string `bencode:"symlink path"`
+}
+
+// parseFileTree flattens a BEP 52 file tree into a list of files, in the order
+// of their paths
+func parseFileTree(raw bencode.RawMessage, prefix []string, files *[]TorrentMultiFileInfo) error {
+	var node map[string]bencode.RawMessage
+	if err := bencode.Unmarshal(raw, &node); err != nil {
+		return err
+	}
+
+	if leaf, ok := node[""]; ok {
+		if len(prefix) == 0 {
+			return errors.New("File without name in file tree")
+		}
+		var entry fileTreeEntry
+		if err := bencode.Unmarshal(leaf, &entry); err != nil {
+			return err
+		}
+		file := TorrentMultiFileInfo{
+			Length:      entry.Length,
+			Path:        append([]string(nil), prefix...),
+			Attr:        entry.Attr,
+			SymlinkPath: entry.SymlinkPath,
+		}
+		if entry.Length > 0 && !file.IsSymlink() {
+			if len(entry.PiecesRoot) != 32 {
+				return errors.New("Invalid pieces root for " + strings.Join(prefix, "/"))
+			}
+			copy(file.PiecesRoot[:], entry.PiecesRoot)
+		}
+		*files = append(*files, file)
+		return nil
+	}
+
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+			return errors.New("Invalid file name in file tree: " + name)
+		}
+		if err := parseFileTree(node[name], append(prefix, name), files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alignFiles inserts padding files so every file starts at a piece boundary,
+// which is the layout of v2 torrents
+func alignFiles(files []TorrentMultiFileInfo, pieceLength uint64) ([]TorrentMultiFileInfo, uint64) {
+	var aligned []TorrentMultiFileInfo
+	var length uint64
+	for i, f := range files {
+		aligned = append(aligned, f)
+		length += f.Length
+		if rest := f.Length % pieceLength; rest != 0 && i < len(files)-1 {
+			pad := pieceLength - rest
+			aligned = append(aligned, TorrentMultiFileInfo{
+				Length: pad,
+				Path:   []string{".pad", strconv.FormatUint(pad, 10)},
+				Attr:   "p",
+			})
+			length += pad
+		}
+	}
+	return aligned, length
+}
+
+// parseV2 reads the file tree and piece layers of a v2 or hybrid torrent
+func (t *Torrent) parseV2(tf *torrentFile) error {
+	if t.PieceLength < BlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return errors.New("Invalid piece length for a v2 torrent")
+	}
+
+	var files []TorrentMultiFileInfo
+	if err := parseFileTree(tf.Info.FileTree, nil, &files); err != nil {
+		return errors.New("Invalid file tree: " + err.Error())
+	}
+	if len(files) == 0 {
+		return errors.New("Empty file tree")
+	}
+
+	if len(t.PieceHashes) == 0 {
+		t.Files, t.Length = alignFiles(files, uint64(t.PieceLength))
+	} else {
+		// hybrid torrent: keep the v1 layout and add the pieces roots to it
+		roots := map[string][32]byte{}
+		for _, f := range files {
+			roots[strings.Join(f.Path, "/")] = f.PiecesRoot
+		}
+		if len(t.Files) == 0 {
+			t.Files = files
+		}
+		for i := range t.Files {
+			if !t.Files[i].IsPadding() {
+				t.Files[i].PiecesRoot = roots[strings.Join(t.Files[i].Path, "/")]
+			}
+		}
+	}
+
+	t.PieceLayers = map[[32]byte][][32]byte{}
+	pieceWidth := t.PieceLength / BlockSize
+	for _, f := range files {
+		if f.Length <= uint64(t.PieceLength) {
+			continue
+		}
+		layer, ok := tf.PieceLayers[string(f.PiecesRoot[:])]
+		numPieces := int((f.Length + uint64(t.PieceLength) - 1) / uint64(t.PieceLength))
+		if !ok || len(layer) != numPieces*32 {
+			return errors.New("Missing or invalid piece layer for " + strings.Join(f.Path, "/"))
+		}
+		hashes := make([][32]byte, numPieces)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*32:])
+		}
+		if merkleRoot(hashes, nextPow2(numPieces), padHash(pieceWidth)) != f.PiecesRoot {
+			return errors.New("Piece layer doesn't match the pieces root of " + strings.Join(f.Path, "/"))
+		}
+		t.PieceLayers[f.PiecesRoot] = hashes
+	}
+	return nil
+}
+
+// IsV2 reports whether the torrent has v2 metadata
+func (t *Torrent) IsV2() bool {
+	return t.MetaVersion == 2
+}
+
+// IsHybrid reports whether the torrent has both v1 and v2 metadata
+func (t *Torrent) IsHybrid() bool {
+	return t.IsV2() && len(t.PieceHashes) > 0
+}
+
+// InfoHashes returns the info hashes of every swarm the torrent belongs to.
+// The v2 info hash is truncated to 20 bytes, as used in handshakes and by
+// trackers.
+func (t *Torrent) InfoHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	if t.IsHybrid() {
+		var v2 [20]byte
+		copy(v2[:], t.InfoHashV2[:])
+		hashes = append(hashes, v2)
+	}
+	return hashes
+}
+
+// NumPieces returns the number of pieces of the torrent
+func (t *Torrent) NumPieces() int {
+	if len(t.PieceHashes) > 0 || t.PieceLength <= 0 {
+		return len(t.PieceHashes)
+	}
+	return int((t.Length + uint64(t.PieceLength) - 1) / uint64(t.PieceLength))
+}
+
+// VerifyPiece checks the data of a piece against its SHA-1 hash and, for v2
+// torrents, against the merkle tree of its file
+func (t *Torrent) VerifyPiece(index int, data []byte) bool {
+	if index < 0 || index >= t.NumPieces() {
+		return false
+	}
+	if len(t.PieceHashes) > 0 && sha1.Sum(data) != t.PieceHashes[index] {
+		return false
+	}
+	if t.IsV2() {
+		return t.verifyPieceV2(index, data) == nil
+	}
+	return true
+}
+
+func (t *Torrent) verifyPieceV2(index int, data []byte) error {
+	pieceLength := uint64(t.PieceLength)
+	offset := uint64(index) * pieceLength
+
+	var start uint64
+	for _, f := range t.FileList() {
+		end := start + f.Length
+		if f.IsPadding() || f.Length == 0 || end <= offset {
+			start = end
+			continue
+		}
+		if start > offset || (offset-start)%pieceLength != 0 {
+			return errors.New("Piece not aligned to a file")
+		}
+		fileData := data
+		if uint64(len(fileData)) > end-offset {
+			fileData = fileData[:end-offset]
+		}
+
+		leaves := blockHashes(fileData)
+		if f.Length <= pieceLength {
+			if merkleRoot(leaves, nextPow2(len(leaves)), [32]byte{}) != f.PiecesRoot {
+				return errors.New("Merkle root mismatch")
+			}
+			return nil
+		}
+		layer := t.PieceLayers[f.PiecesRoot]
+		filePiece := int((offset - start) / pieceLength)
+		if filePiece >= len(layer) || merkleRoot(leaves, t.PieceLength/BlockSize, [32]byte{}) != layer[filePiece] {
+			return errors.New("Piece layer hash mismatch")
+		}
+		return nil
+	}
+	return errors.New("Piece outside of the torrent")
+}
+
+// pieceLayerIndex returns the layer of the piece hashes, counting from the
+// 16KiB blocks
+func (t *Torrent) pieceLayerIndex() int {
+	return log2(t.PieceLength / BlockSize)
+}
+
+// Hashes returns the piece layer hashes of a file between index and
+// index+length, followed by up to proofLayers uncle hashes needed to verify
+// them against the pieces root. Only the piece layer can be served.
+func (t *Torrent) Hashes(root [32]byte, baseLayer, index, length, proofLayers int) ([][32]byte, [][32]byte, error) {
+	layer, ok := t.PieceLayers[root]
+	if !ok || baseLayer != t.pieceLayerIndex() {
+		return nil, nil, errors.New("Hashes not available")
+	}
+	levels := merkleLevels(layer, nextPow2(len(layer)), padHash(t.PieceLength/BlockSize))
+	if length <= 0 || length != nextPow2(length) || index < 0 || index%length != 0 || index+length > len(levels[0]) {
+		return nil, nil, errors.New("Invalid hash request")
+	}
+
+	hashes := levels[0][index : index+length]
+	var proof [][32]byte
+	pos := index / length
+	for level := log2(length); level < len(levels)-1 && len(proof) < proofLayers; level++ {
+		proof = append(proof, levels[level][pos^1])
+		pos /= 2
+	}
+	return hashes, proof, nil
+}
+
+// CheckHashes verifies hashes received from a peer against the pieces root
+func (t *Torrent) CheckHashes(root [32]byte, baseLayer, index int, hashes, proof [][32]byte) error {
+	if baseLayer != t.pieceLayerIndex() {
+		return errors.New("Unsupported base layer")
+	}
+	return verifyProof(root, index, hashes, proof)
+}
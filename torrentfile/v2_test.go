@@ -0,0 +1,127 @@
+package torrentfile
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+)
+
+type testFileTreeLeaf struct {
+	Length     uint64 `bencode:"length"`
+	PiecesRoot []byte `bencode:"pieces root"`
+}
+
+func buildV2Torrent(t *testing.T, pieceLength int, a, b []byte) []byte {
+	pieceWidth := pieceLength / BlockSize
+
+	var layer [][32]byte
+	for i := 0; i < len(a); i += pieceLength {
+		end := i + pieceLength
+		if end > len(a) {
+			end = len(a)
+		}
+		layer = append(layer, merkleRoot(blockHashes(a[i:end]), pieceWidth, [32]byte{}))
+	}
+	rootA := merkleRoot(layer, nextPow2(len(layer)), padHash(pieceWidth))
+	leavesB := blockHashes(b)
+	rootB := merkleRoot(leavesB, nextPow2(len(leavesB)), [32]byte{})
+
+	var layerBytes []byte
+	for _, h := range layer {
+		layerBytes = append(layerBytes, h[:]...)
+	}
+
+	info := map[string]interface{}{
+		"meta version": 2,
+		"name":         "v2",
+		"piece length": pieceLength,
+		"file tree": map[string]interface{}{
+			"a.bin": map[string]interface{}{"": testFileTreeLeaf{uint64(len(a)), rootA[:]}},
+			"dir": map[string]interface{}{
+				"b.bin": map[string]interface{}{"": testFileTreeLeaf{uint64(len(b)), rootB[:]}},
+			},
+		},
+	}
+	data, err := bencode.Marshal(map[string]interface{}{
+		"info":         info,
+		"piece layers": map[string][]byte{string(rootA[:]): layerBytes},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func Test_parseV2(t *testing.T) {
+	a := make([]byte, 40000)
+	b := make([]byte, 1000)
+	for i := range a {
+		a[i] = byte(i * 7)
+	}
+	for i := range b {
+		b[i] = byte(i * 3)
+	}
+
+	torrent, err := parseTorrent(buildV2Torrent(t, 32768, a, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !torrent.IsV2() || torrent.IsHybrid() {
+		t.Errorf("Expected a v2 only torrent")
+	}
+	if len(torrent.Files) != 3 || !torrent.Files[1].IsPadding() || torrent.Files[1].Length != 65536-40000 {
+		t.Fatalf("Unexpected file layout %v", torrent.Files)
+	}
+	if torrent.Length != 65536+1000 || torrent.NumPieces() != 3 {
+		t.Errorf("Unexpected length %d and %d pieces", torrent.Length, torrent.NumPieces())
+	}
+	if string(torrent.InfoHash[:]) != string(torrent.InfoHashV2[:20]) {
+		t.Errorf("Expected the truncated v2 info hash")
+	}
+	if magnet := torrent.Magnet(MagnetOptions{}); !strings.HasPrefix(magnet, "magnet:?xt=urn:btmh:1220") || strings.Contains(magnet, "btih") {
+		t.Errorf("Unexpected magnet for v2 torrent %s", magnet)
+	}
+
+	pieces := [][]byte{a[:32768], append(append([]byte{}, a[32768:]...), make([]byte, 65536-40000)...), b}
+	for i, piece := range pieces {
+		if !torrent.VerifyPiece(i, piece) {
+			t.Errorf("Piece %d not verified", i)
+		}
+	}
+	pieces[0][5]++
+	if torrent.VerifyPiece(0, pieces[0]) {
+		t.Errorf("Corrupted piece verified")
+	}
+
+	root := torrent.Files[0].PiecesRoot
+	hashes, proof, err := torrent.Hashes(root, 1, 0, 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := torrent.CheckHashes(root, 1, 0, hashes, proof); err != nil {
+		t.Errorf("Hashes not verified: %s", err)
+	}
+	if _, _, err := torrent.Hashes(root, 0, 0, 2, 0); err == nil {
+		t.Errorf("Expected error for unavailable layer")
+	}
+}
+
+func Test_merkleRoot(t *testing.T) {
+	block := make([]byte, BlockSize)
+	block[0] = 1
+	if merkleRoot(blockHashes(block), 1, [32]byte{}) != sha256.Sum256(block) {
+		t.Errorf("Single block root must be the block hash")
+	}
+
+	leaves := blockHashes(append(block, 2))
+	expected := hashPair(leaves[0], leaves[1])
+	if merkleRoot(leaves, 2, [32]byte{}) != expected {
+		t.Errorf("Unexpected root for two blocks")
+	}
+	if merkleRoot(leaves[:1], 2, [32]byte{}) != hashPair(leaves[0], [32]byte{}) {
+		t.Errorf("Missing leaves must be zero hashes")
+	}
+}
@@ -5,6 +5,8 @@ const (
 	PEER_DOWN
 	PEER_NOINFOHASH
 	PEER_NOPIECES
+	PEER_NOENCRYPTION // refused the encrypted handshake we require
+	PEER_VIOLATION    // broke the peer wire protocol
 )
 
 type StPiece struct {
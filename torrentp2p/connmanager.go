@@ -0,0 +1,418 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/tracker"
+)
+
+// States of the peers in the peer database
+const (
+	peerIdle      = iota // waiting to be dialed
+	peerDialing          // being dialed
+	peerConnected        // connected, by us or by the peer
+	peerBanned           // failed too often or broke the protocol, not tried again
+)
+
+// Sources of the peers, besides the names of the PeerSources
+const (
+	sourceTracker  = "tracker"
+	sourceLocal    = "local"
+	sourceIncoming = "incoming" // connected to us, maybe from a port we can't dial
+)
+
+// defaultMaxHalfOpen is the number of connections being set up at once by a
+// downloader outside of a session
+const defaultMaxHalfOpen = 8
+
+// maxFailures is the number of failed connections in a row after which a
+// peer is given up
+const maxFailures = 8
+
+// Retry delays of the peers, variables for the tests
+var (
+	// retryBackoff is the wait after the first failed connection, doubled on
+	// every failure, and after a connection closes
+	retryBackoff = 30 * time.Second
+	// maxRetryBackoff bounds the wait between connection attempts
+	maxRetryBackoff = 30 * time.Minute
+)
+
+// knownPeer is an entry of the peer database
+type knownPeer struct {
+	host        tracker.Peer // address, swarm and outcome of the last connection
+	source      string       // who told us about the peer
+	state       int          // peer* state
+	lastAttempt time.Time
+	failures    int       // failed connections in a row
+	retryAt     time.Time // when an idle peer may be dialed again
+}
+
+// peerDB is the peer database of a torrent: every peer found, where it came
+// from and how the connections to it went
+type peerDB struct {
+	mu    sync.Mutex
+	peers map[string]*knownPeer // by address
+}
+
+// peerAddr returns the address of a peer, the key of the peer database
+func peerAddr(ip net.IP, port uint16) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// add adds the peers not known yet and returns how many
+func (db *peerDB) add(peers []tracker.Peer, source string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.peers == nil {
+		db.peers = make(map[string]*knownPeer)
+	}
+	added := 0
+	for _, p := range peers {
+		addr := peerAddr(p.IP, p.Port)
+		if k := db.peers[addr]; k != nil {
+			if k.source == sourceIncoming {
+				// the peer listens on the port it connected from
+				k.source = source
+				added++
+			}
+			continue
+		}
+		p.Status = PEER_NEW
+		db.peers[addr] = &knownPeer{host: p, source: source}
+		added++
+	}
+	return added
+}
+
+// next picks the idle peer to dial now with the highest BEP 40 priority
+// towards our address, and marks it as dialing. It returns nil if there is
+// none. The peers only known by their incoming connections aren't dialed.
+func (db *peerDB) next(now time.Time, ourIP net.IP, ourPort uint16) *knownPeer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var best *knownPeer
+	var bestPriority uint32
+	for _, k := range db.peers {
+		if k.state != peerIdle || k.retryAt.After(now) || k.source == sourceIncoming {
+			continue
+		}
+		priority := canonicalPriority(ourIP, ourPort, k.host.IP, k.host.Port)
+		if best == nil || priority > bestPriority {
+			best, bestPriority = k, priority
+		}
+	}
+	if best != nil {
+		best.state = peerDialing
+		best.lastAttempt = now
+	}
+	return best
+}
+
+// nextRetry returns when the next idle peer may be dialed, the zero time if
+// there is none
+func (db *peerDB) nextRetry() time.Time {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var next time.Time
+	for _, k := range db.peers {
+		if k.state == peerIdle && k.source != sourceIncoming && (next.IsZero() || k.retryAt.Before(next)) {
+			next = k.retryAt
+		}
+	}
+	return next
+}
+
+// accepted records the incoming connection of a peer as connected. It
+// returns nil if the peer is banned or we are already connected to it.
+func (db *peerDB) accepted(host tracker.Peer, now time.Time) *knownPeer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.peers == nil {
+		db.peers = make(map[string]*knownPeer)
+	}
+	addr := peerAddr(host.IP, host.Port)
+	k := db.peers[addr]
+	if k == nil {
+		host.Status = PEER_NEW
+		k = &knownPeer{host: host, source: sourceIncoming}
+		db.peers[addr] = k
+	}
+	if k.state == peerBanned || k.state == peerConnected {
+		return nil
+	}
+	k.state = peerConnected
+	k.lastAttempt = now
+	return k
+}
+
+// connected records a peer that completed the handshake. It returns false
+// if the peer connected to us meanwhile.
+func (db *peerDB) connected(k *knownPeer) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if k.state == peerConnected {
+		return false
+	}
+	k.state = peerConnected
+	k.failures = 0
+	return true
+}
+
+// closed records the end of a connection with the PEER_* status it left. The
+// peers that failed wait longer and longer, the ones that broke the protocol
+// or belong to another swarm are banned.
+func (db *peerDB) closed(k *knownPeer, status byte, now time.Time) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k.host.Status = status
+	wasConnected := k.state == peerConnected
+	switch {
+	case status == PEER_VIOLATION || status == PEER_NOINFOHASH:
+		k.state = peerBanned
+		return
+	case status == PEER_NEW && wasConnected:
+		// a connection that went well, the peer may be useful again later
+		k.failures = 0
+	default:
+		k.failures++
+	}
+	if k.failures >= maxFailures {
+		k.state = peerBanned
+		return
+	}
+	k.state = peerIdle
+	k.retryAt = now.Add(backoff(k.failures))
+}
+
+// release puts back a peer that wasn't dialed after all
+func (db *peerDB) release(k *knownPeer) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	k.state = peerIdle
+}
+
+// get returns a copy of the entry of a peer
+func (db *peerDB) get(addr string) (knownPeer, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if k := db.peers[addr]; k != nil {
+		return *k, true
+	}
+	return knownPeer{}, false
+}
+
+// backoff returns the wait before dialing a peer again after failures
+// connections failed in a row
+func backoff(failures int) time.Duration {
+	wait := retryBackoff
+	for i := 1; i < failures && wait < maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryBackoff {
+		wait = maxRetryBackoff
+	}
+	return wait
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// canonicalPriority returns the BEP 40 priority of the connection between our
+// address and the one of a peer. Both ends compute the same one, so the
+// swarm connects the same pairs of peers whoever dials. An unknown ourIP
+// counts as the unspecified address.
+func canonicalPriority(ourIP net.IP, ourPort uint16, ip net.IP, port uint16) uint32 {
+	a, b := ourIP.To4(), ip.To4()
+	if b == nil {
+		a, b = ourIP.To16(), ip.To16()
+	}
+	if b == nil {
+		return 0
+	}
+	if a == nil {
+		a = make(net.IP, len(b))
+	}
+	if a.Equal(b) {
+		ports := []uint16{ourPort, port}
+		if ports[0] > ports[1] {
+			ports[0], ports[1] = ports[1], ports[0]
+		}
+		var buf [4]byte
+		binary.BigEndian.PutUint16(buf[0:], ports[0])
+		binary.BigEndian.PutUint16(buf[2:], ports[1])
+		return crc32.Checksum(buf[:], castagnoli)
+	}
+
+	// the first 2 bytes of IPv4 and 6 of IPv6 count, and one more byte for
+	// each byte in common beyond them, up to 4 and 8
+	full, widest := 2, 4
+	if len(a) == net.IPv6len {
+		full, widest = 6, 8
+	}
+	common := 0
+	for common < len(a) && a[common] == b[common] {
+		common++
+	}
+	if common >= full {
+		full = common + 1
+	}
+	if full > widest {
+		full = widest
+	}
+	masked := [][]byte{make([]byte, len(a)), make([]byte, len(b))}
+	for i := range a {
+		mask := byte(0x55)
+		if i < full {
+			mask = 0xff
+		}
+		masked[0][i] = a[i] & mask
+		masked[1][i] = b[i] & mask
+	}
+	sort.Slice(masked, func(i, j int) bool { return bytes.Compare(masked[i], masked[j]) < 0 })
+	return crc32.Checksum(append(masked[0], masked[1]...), castagnoli)
+}
+
+// reserveConnection takes one of the connections of the torrent. It returns
+// false if they are all taken.
+func (down *Downloader) reserveConnection() bool {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	if down.maxConns > 0 && down.conns >= down.maxConns {
+		return false
+	}
+	down.conns++
+	return true
+}
+
+func (down *Downloader) releaseConnection() {
+	down.statsMu.Lock()
+	down.conns--
+	down.statsMu.Unlock()
+	down.wakeDialer()
+}
+
+// wakeDialer tells connectPeers that there may be new peers to dial
+func (down *Downloader) wakeDialer() {
+	select {
+	case down.dialWake <- struct{}{}:
+	default:
+	}
+}
+
+// acquireDial waits for a free half-open slot, shared by the torrents of a
+// session. It returns false if the download is done meanwhile.
+func (down *Downloader) acquireDial() bool {
+	select {
+	case down.dials <- struct{}{}:
+		return true
+	case <-down.done:
+		return false
+	}
+}
+
+func (down *Downloader) releaseDial() {
+	<-down.dials
+}
+
+// connectPeers keeps up to numWorkers outgoing connections, dialing the best
+// peers of the database as the connections close and the failed peers are
+// due for a retry. It returns once the downloader is finished and its
+// connections are closed.
+func (down *Downloader) connectPeers(numWorkers int) {
+	var connections sync.WaitGroup
+	defer connections.Wait()
+	ended := make(chan struct{}, numWorkers)
+	outgoing := 0
+	for {
+		now := time.Now()
+		full := false // releaseConnection wakes us up then
+		for outgoing < numWorkers {
+			if !down.reserveConnection() {
+				full = true
+				break
+			}
+			k := down.peerDB.next(now, down.externalIP, down.port)
+			if k == nil {
+				down.statsMu.Lock()
+				down.conns--
+				down.statsMu.Unlock()
+				break
+			}
+			outgoing++
+			connections.Add(1)
+			go func() {
+				defer connections.Done()
+				down.connectKnownPeer(k)
+				down.releaseConnection()
+				ended <- struct{}{}
+			}()
+		}
+
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if at := down.peerDB.nextRetry(); !at.IsZero() && outgoing < numWorkers && !full {
+			timer = time.NewTimer(time.Until(at))
+			retry = timer.C
+		}
+		select {
+		case <-ended:
+			outgoing--
+		case <-retry:
+		case <-down.dialWake:
+		case <-down.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// connectKnownPeer dials a peer of the database and exchanges messages with
+// it until the connection is closed
+func (down *Downloader) connectKnownPeer(k *knownPeer) {
+	p := down.newPeer()
+	p.host = k.host
+	p.host.Status = PEER_NEW
+	p.log = p.peerLogger()
+	infoHash := p.host.InfoHash
+	if infoHash == [20]byte{} {
+		infoHash = p.torrent.InfoHash
+	}
+	if !p.acquireSlot() {
+		down.peerDB.release(k)
+		return
+	}
+	defer p.releaseSlot()
+	if !down.acquireDial() {
+		down.peerDB.release(k)
+		return
+	}
+	err := p.connectPeer(infoHash)
+	down.releaseDial()
+	if err != nil {
+		down.peerDB.closed(k, p.host.Status, time.Now())
+		return
+	}
+	if !down.peerDB.connected(k) {
+		p.log.Debug("Already connected to the peer")
+		p.conn.Close()
+		return
+	}
+
+	p.emit(Event{Type: EVENT_PEER_CONNECTED, Peer: p.host})
+	p.sendBitfield()
+	err = p.run(&down.piecesList)
+	p.emit(Event{Type: EVENT_PEER_DISCONNECTED, Peer: p.host, Err: err})
+	down.peerDB.closed(k, p.host.Status, time.Now())
+}
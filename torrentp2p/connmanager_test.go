@@ -0,0 +1,297 @@
+package torrentp2p
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/tracker"
+)
+
+func Test_canonicalPriority(t *testing.T) {
+	// the examples of BEP 40
+	ip := net.ParseIP("123.213.32.10")
+	if p := canonicalPriority(ip, 6881, net.ParseIP("98.76.54.32"), 6881); p != 0xec2d7224 {
+		t.Errorf("Unexpected priority %x", p)
+	}
+	if p := canonicalPriority(ip, 6881, net.ParseIP("123.213.32.234"), 6881); p != 0x99568189 {
+		t.Errorf("Unexpected priority %x", p)
+	}
+	// both ends get the same one
+	if canonicalPriority(net.ParseIP("98.76.54.32"), 1, ip, 2) != canonicalPriority(ip, 2, net.ParseIP("98.76.54.32"), 1) {
+		t.Error("Priority depends on the side")
+	}
+	if canonicalPriority(ip, 6881, ip, 6882) != canonicalPriority(ip, 6882, ip, 6881) {
+		t.Error("Priority of the same address depends on the side")
+	}
+	if canonicalPriority(ip, 6881, ip, 6882) == canonicalPriority(ip, 6881, ip, 6883) {
+		t.Error("Ports of the same address ignored")
+	}
+	// IPv6 masked with FFFF:FFFF:FFFF:5555:..., FF55 in the same /48 and
+	// FFFF in the same /56
+	ipv6 := []struct {
+		a, b     string
+		priority uint32
+	}{
+		{"2001:db8::1", "2001:db8:1::2", 0x2de59f19},
+		{"2001:db8:1::1", "2001:db8:1:ff00::2", 0x9a58bb4d},
+		{"2001:db8:1:ff00::1", "2001:db8:1:ff80::2", 0x3d468428},
+	}
+	for _, tt := range ipv6 {
+		a, b := net.ParseIP(tt.a), net.ParseIP(tt.b)
+		if p := canonicalPriority(a, 1, b, 2); p != tt.priority || canonicalPriority(b, 2, a, 1) != p {
+			t.Errorf("Unexpected priority %x for %s and %s", p, tt.a, tt.b)
+		}
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		wait     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{20, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if wait := backoff(tt.failures); wait != tt.wait {
+			t.Errorf("backoff(%d) = %s, expected %s", tt.failures, wait, tt.wait)
+		}
+	}
+}
+
+func Test_peerDB(t *testing.T) {
+	var db peerDB
+	peers := []tracker.Peer{
+		{IP: net.ParseIP("10.0.0.1"), Port: 6881},
+		{IP: net.ParseIP("10.0.0.2"), Port: 6881},
+	}
+	if added := db.add(peers, sourceTracker); added != 2 {
+		t.Errorf("Expected 2 peers added, got %d", added)
+	}
+	if added := db.add(peers[:1], "DHT"); added != 0 {
+		t.Errorf("Known peer added again")
+	}
+
+	now := time.Now()
+	first, second := db.next(now, nil, 0), db.next(now, nil, 0)
+	if first == nil || second == nil || first == second || db.next(now, nil, 0) != nil {
+		t.Fatal("Expected both peers dialed once")
+	}
+	if first.state != peerDialing || first.source != sourceTracker || !first.lastAttempt.Equal(now) {
+		t.Errorf("Unexpected entry %+v", first)
+	}
+
+	// failed dials wait longer and longer
+	db.closed(first, PEER_DOWN, now)
+	if first.state != peerIdle || first.failures != 1 || !first.retryAt.Equal(now.Add(retryBackoff)) {
+		t.Errorf("Unexpected entry after a failure %+v", first)
+	}
+	if db.next(now, nil, 0) != nil {
+		t.Error("Peer dialed before its retry")
+	}
+	if at := db.nextRetry(); !at.Equal(first.retryAt) {
+		t.Errorf("Unexpected next retry %s", at)
+	}
+	later := now.Add(retryBackoff)
+	if db.next(later, nil, 0) != first {
+		t.Fatal("Peer not dialed again")
+	}
+	db.closed(first, PEER_DOWN, later)
+	if first.failures != 2 || !first.retryAt.Equal(later.Add(2*retryBackoff)) {
+		t.Errorf("Unexpected entry after two failures %+v", first)
+	}
+
+	// a connection that went well resets them
+	first.state = peerDialing
+	db.connected(first)
+	db.closed(first, PEER_NEW, later)
+	if first.state != peerIdle || first.failures != 0 {
+		t.Errorf("Unexpected entry after a connection %+v", first)
+	}
+
+	db.closed(second, PEER_VIOLATION, now)
+	if second.state != peerBanned {
+		t.Errorf("Peer breaking the protocol not banned %+v", second)
+	}
+	for i := 0; i < maxFailures; i++ {
+		first.state = peerDialing
+		db.closed(first, PEER_DOWN, now)
+	}
+	if k, _ := db.get(peerAddr(first.host.IP, first.host.Port)); k.state != peerBanned {
+		t.Errorf("Peer failing too often not banned %+v", k)
+	}
+	if !db.nextRetry().IsZero() || db.next(now.Add(time.Hour), nil, 0) != nil {
+		t.Error("Banned peers dialed again")
+	}
+
+	// the peers that connect to us are dialed once a source tells their port
+	incoming := tracker.Peer{IP: net.ParseIP("10.0.0.3"), Port: 6881}
+	k := db.accepted(incoming, now)
+	if k == nil || k.state != peerConnected || k.source != sourceIncoming || db.accepted(incoming, now) != nil {
+		t.Fatalf("Unexpected incoming entry %+v", k)
+	}
+	db.closed(k, PEER_NEW, now)
+	if db.next(now.Add(time.Hour), nil, 0) != nil {
+		t.Error("Incoming peer dialed")
+	}
+	if added := db.add([]tracker.Peer{incoming}, sourceTracker); added != 1 || db.next(now.Add(time.Hour), nil, 0) != k {
+		t.Error("Incoming peer not dialed once found by a tracker")
+	}
+	db.connected(k)
+	if db.connected(k) {
+		t.Error("Peer connected twice")
+	}
+}
+
+func Test_reserveConnection(t *testing.T) {
+	down := &Downloader{maxConns: 2, dialWake: make(chan struct{}, 1)}
+	if !down.reserveConnection() || !down.reserveConnection() || down.reserveConnection() {
+		t.Fatal("Expected 2 connections")
+	}
+	down.releaseConnection()
+	if len(down.dialWake) != 1 {
+		t.Error("Dialer not woken up")
+	}
+	if !down.reserveConnection() {
+		t.Error("Released connection not reserved")
+	}
+}
+
+// Test_connectPeersRetry dials a peer that closes every connection, that is
+// dialed again after the backoff
+func Test_connectPeersRetry(t *testing.T) {
+	defer func(wait time.Duration) { retryBackoff = wait }(retryBackoff)
+	retryBackoff = 10 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			conn.Close()
+		}
+	}()
+
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	addr := listener.Addr().(*net.TCPAddr)
+	down.addPeers([]tracker.Peer{{IP: addr.IP, Port: uint16(addr.Port)}}, down.torrent.InfoHash, sourceLocal)
+	ended := make(chan struct{})
+	go func() {
+		down.connectPeers(2)
+		close(ended)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&accepted) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	down.finish()
+	<-ended
+	if n := atomic.LoadInt32(&accepted); n < 3 {
+		t.Fatalf("Expected the peer dialed again, got %d connections", n)
+	}
+	k, _ := down.peerDB.get(peerAddr(addr.IP, uint16(addr.Port)))
+	if k.failures == 0 || k.host.Status != PEER_DOWN || k.source != sourceLocal {
+		t.Errorf("Unexpected entry %+v", k)
+	}
+	if down.conns != 0 {
+		t.Errorf("Connections not released: %d", down.conns)
+	}
+}
+
+// addrConn is a pipe connected from addr
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// Test_AcceptPeerDB records the incoming connections in the peer database,
+// refusing the banned peers and the ones already connected
+func Test_AcceptPeerDB(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	from := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 51413}
+	addr := peerAddr(from.IP, uint16(from.Port))
+	// accept connects a pipe from the address and returns the remote end,
+	// closed if the connection was refused
+	accept := func() (net.Conn, chan struct{}) {
+		local, remote := net.Pipe()
+		remote.SetDeadline(time.Now().Add(10 * time.Second))
+		accepted := make(chan struct{})
+		go func() {
+			down.AcceptPeer(addrConn{local, from}, down.torrent.InfoHash, [20]byte{}, [8]byte{})
+			close(accepted)
+		}()
+		return remote, accepted
+	}
+
+	remote, accepted := accept()
+	if _, err := remote.Read(make([]byte, 68)); err != nil {
+		t.Fatal(err)
+	}
+	if k, _ := down.peerDB.get(addr); k.state != peerConnected || k.source != sourceIncoming {
+		t.Errorf("Incoming peer not recorded as connected %+v", k)
+	}
+	if down.peerDB.next(time.Now(), nil, 0) != nil {
+		t.Error("Incoming peer dialed")
+	}
+	second, refused := accept()
+	<-refused
+	if _, err := second.Read(make([]byte, 68)); err == nil {
+		t.Error("Second connection of the peer accepted")
+	}
+
+	// a BITFIELD of the wrong length
+	msg := []byte{0, 0, 0, 3, BITFIELD, 0, 0}
+	remote.Write(msg)
+	<-accepted
+	if k, _ := down.peerDB.get(addr); k.state != peerBanned || k.host.Status != PEER_VIOLATION {
+		t.Errorf("Peer breaking the protocol not banned %+v", k)
+	}
+	third, refused := accept()
+	<-refused
+	if _, err := third.Read(make([]byte, 68)); err == nil {
+		t.Error("Banned peer accepted")
+	}
+	if down.conns != 0 {
+		t.Errorf("Connections not released: %d", down.conns)
+	}
+}
@@ -0,0 +1,52 @@
+package torrentp2p
+
+import "errors"
+
+var errDiskPoolClosed = errors.New("Disk pool closed")
+
+// diskPool runs the disk reads and writes of several torrents on a fixed
+// number of goroutines
+type diskPool struct {
+	jobs chan func()
+	quit chan struct{}
+}
+
+func newDiskPool(workers int) *diskPool {
+	d := &diskPool{
+		jobs: make(chan func()),
+		quit: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go d.worker()
+	}
+	return d
+}
+
+func (d *diskPool) worker() {
+	for {
+		select {
+		case job := <-d.jobs:
+			job()
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// do runs fn on the pool and waits for it. A nil pool runs fn directly.
+func (d *diskPool) do(fn func() error) error {
+	if d == nil {
+		return fn()
+	}
+	errc := make(chan error, 1)
+	select {
+	case d.jobs <- func() { errc <- fn() }:
+	case <-d.quit:
+		return errDiskPoolClosed
+	}
+	return <-errc
+}
+
+func (d *diskPool) close() {
+	close(d.quit)
+}
@@ -1,24 +1,75 @@
 package torrentp2p
 
 import (
-	"log"
+	"context"
+	"errors"
 	"net"
 	"os"
 	"sync"
+	"time"
 
+	"github.com/vaguilera/MiniTorrent/logging"
 	"github.com/vaguilera/MiniTorrent/torrentfile"
 	"github.com/vaguilera/MiniTorrent/tracker"
+	"github.com/vaguilera/MiniTorrent/utp"
 )
 
+// resumeInterval is the number of pieces downloaded between saves of the fast
+// resume file
+const resumeInterval = 32
+
 type atomicPieces struct {
-	mu     sync.Mutex
-	pieces []StPiece
+	mu       sync.Mutex
+	pieces   []StPiece
+	skipped  []StPiece // pending pieces that only belong to skipped files
+	priority []int     // PRIORITY_* of every piece, nil if all are normal
 }
 
+// Downloader downloads the pieces of a torrent from its peers and keeps track
+// of which ones are already verified and written to disk.
 type Downloader struct {
-	peers       []tracker.Peer
-	peersQueue  chan tracker.Peer
-	ownedPieces int
+	torrent       *torrentfile.Torrent
+	peerDB        peerDB
+	piecesList    atomicPieces
+	files         fileWriter
+	mu            sync.Mutex
+	pieceDone     *sync.Cond
+	completed     []bool
+	ownedPieces   int
+	priorities    []int         // PRIORITY_* of every file, nil if all are normal
+	wake          chan struct{} // wakes up Run when the priorities change
+	done          chan struct{} // closed when the download is complete or stopped
+	stop          chan struct{} // closed by Stop
+	doneOnce      sync.Once
+	stopOnce      sync.Once
+	results       chan StPieceResult
+	sources       []PeerSource
+	log           logging.Logger
+	extraTrackers []string
+	announced     []announced
+	handler       func(Event)
+	filePieces    []filePieces
+	statsMu       sync.Mutex
+	connected     map[*Peer]struct{}
+	availability  []int // number of connected peers that have each piece
+	downloadRate  rateMeter
+	uploadRate    rateMeter
+	wasted        uint64
+	trackers      []TrackerStats
+	port          uint16        // announced listen port, tracker.DefaultPort if 0
+	slots         chan struct{} // shared connection slots, nil if unlimited
+	dials         chan struct{} // half-open slots, shared by a session
+	dialWake      chan struct{} // wakes up connectPeers
+	maxConns      int           // connections of the torrent, 0 for no limit
+	conns         int           // connections of the torrent, guarded by statsMu
+	externalIP    net.IP        // our address for the BEP 40 priorities, nil if unknown
+	disk          *diskPool     // shared disk I/O pool, nil to do I/O inline
+	limits        bandwidth     // of the torrent
+	global        *bandwidth    // of the session, nil if there is none
+	peerLimits    Limits        // of each peer, guarded by statsMu
+	encryption    int           // ENCRYPTION_* of the peer connections
+	transport     int           // TRANSPORT_* of the peer connections
+	utp           *utp.Socket   // nil if there is no uTP
 }
 
 func (p *atomicPieces) findPiece(peerPieces []byte) *StPiece {
@@ -26,140 +77,724 @@ func (p *atomicPieces) findPiece(peerPieces []byte) *StPiece {
 	defer p.mu.Unlock() // Release the lock.
 	for i := range p.pieces {
 		if peerPieces[p.pieces[i].Order] == 1 {
-			cPiece := p.pieces[i]
-			if len(p.pieces) > 1 { // we left always 1 piece into the queue to prevent 1 peer blocks the download
-				p.pieces[i] = p.pieces[len(p.pieces)-1]
-				p.pieces = p.pieces[:len(p.pieces)-1]
-			}
-			return &cPiece
+			return p.take(i)
+		}
+	}
+	return nil
+}
+
+// hasPiece tells if a piece of peerPieces is waiting in the queue
+func (p *atomicPieces) hasPiece(peerPieces []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.pieces {
+		if peerPieces[p.pieces[i].Order] == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// claimPiece hands out a piece of peerPieces and removes it from the queue,
+// even the last one, for the sources that don't share pieces in the endgame
+func (p *atomicPieces) claimPiece(peerPieces []byte) *StPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.pieces {
+		if peerPieces[p.pieces[i].Order] == 1 {
+			piece := p.pieces[i]
+			p.pieces = append(p.pieces[:i], p.pieces[i+1:]...)
+			return &piece
+		}
+	}
+	return nil
+}
+
+// takePiece hands out a given piece if it is still pending, like the ones a
+// peer suggests
+func (p *atomicPieces) takePiece(order int) *StPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.pieces {
+		if p.pieces[i].Order == order {
+			return p.take(i)
 		}
 	}
 	return nil
 }
 
+func (p *atomicPieces) take(i int) *StPiece {
+	cPiece := p.pieces[i]
+	if len(p.pieces) > 1 { // we left always 1 piece into the queue to prevent 1 peer blocks the download
+		p.pieces[i] = p.pieces[len(p.pieces)-1]
+		p.pieces = p.pieces[:len(p.pieces)-1]
+	}
+	return &cPiece
+}
+
+// removePiece drops a piece that is already downloaded from the queue
+func (p *atomicPieces) removePiece(order int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.pieces {
+		if p.pieces[i].Order == order {
+			p.pieces = append(p.pieces[:i], p.pieces[i+1:]...)
+			return
+		}
+	}
+	for i := range p.skipped {
+		if p.skipped[i].Order == order {
+			p.skipped = append(p.skipped[:i], p.skipped[i+1:]...)
+			return
+		}
+	}
+}
+
+// addPiece puts back a piece that wasn't downloaded. A piece still in the
+// queue, like the last one handed out, isn't added twice.
 func (p *atomicPieces) addPiece(piece StPiece) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
+	for _, queued := range p.pieces {
+		if queued.Order == piece.Order {
+			return
+		}
+	}
+	for _, skipped := range p.skipped {
+		if skipped.Order == piece.Order {
+			return
+		}
+	}
 
+	if p.priority != nil && p.priority[piece.Order] == PRIORITY_SKIP {
+		p.skipped = append(p.skipped, piece)
+		return
+	}
 	p.pieces = append(p.pieces, piece)
 }
 
-func (down *Downloader) peerExists(peer tracker.Peer) bool {
-	for _, exPeers := range down.peers {
-		if (peer.IP.String() == exPeers.IP.String()) && (peer.Port == exPeers.Port) {
-			return true
+// prioritize moves the pending pieces between first and last (both included)
+// to the front of the queue, so they are the next ones handed to the peers.
+func (p *atomicPieces) prioritize(first, last int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// pieces read from a skipped file are downloaded anyway
+	var skipped []StPiece
+	for _, piece := range p.skipped {
+		if piece.Order >= first && piece.Order <= last {
+			p.priority[piece.Order] = PRIORITY_NORMAL
+			p.pieces = append(p.pieces, piece)
+		} else {
+			skipped = append(skipped, piece)
+		}
+	}
+	p.skipped = skipped
+
+	front := 0
+	for i := range p.pieces {
+		if p.pieces[i].Order >= first && p.pieces[i].Order <= last {
+			p.pieces[front], p.pieces[i] = p.pieces[i], p.pieces[front]
+			front++
 		}
 	}
-	return false
 }
 
-func (down *Downloader) getPeers(host string, infoHash [20]byte, torrentLength uint64) error {
+func (down *Downloader) getPeers(host string, infoHash [20]byte, left uint64, event int, log logging.Logger) ([]tracker.Peer, error) {
 	tracker := &tracker.UDPTracker{
 		Host:     host,
 		InfoHash: infoHash,
-		Length:   torrentLength,
+		Length:   left,
+		Port:     down.port,
+		Event:    event,
+		Log:      log,
 	}
+	defer tracker.Close()
 
 	err := tracker.Connect()
 	if err != nil {
-		log.Printf("%s ...KO\n", host)
-		return err
+		return nil, err
+	}
+	return tracker.Announce()
+}
+
+func (down *Downloader) getPeersHTTP(announce string, infoHash [20]byte, left uint64, event int, log logging.Logger) ([]tracker.Peer, error) {
+	tracker := &tracker.HTTPTracker{
+		URL:      announce,
+		InfoHash: infoHash,
+		Length:   left,
+		Port:     down.port,
+		Event:    event,
+		Log:      log,
 	}
+	return tracker.Announce()
+}
 
-	peers, err := tracker.Announce()
+// announce sends an event to a tracker. Trackers with unsupported protocols
+// return errUnsupportedTracker.
+func (down *Downloader) announce(t torrentfile.Tracker, infoHash [20]byte, event int) ([]tracker.Peer, error) {
+	var peers []tracker.Peer
+	var err error
+	log := logging.With(down.log, "tracker", t.Announce)
+	start := time.Now()
+	switch t.Protocol {
+	case "udp":
+		log.Info("Retrieving peers")
+		peers, err = down.getPeers(t.URL, infoHash, down.left(), event, log)
+	case "http", "https":
+		log.Info("Retrieving peers")
+		peers, err = down.getPeersHTTP(t.Announce, infoHash, down.left(), event, log)
+	default:
+		return nil, errUnsupportedTracker
+	}
+	announceLatency.With(t.Announce).ObserveSince(start)
+	down.trackerAnnounced(t.Announce, len(peers), err)
 	if err != nil {
-		log.Printf("%s ...KO (Error announcing)\n", host)
-		return err
+		announceErrors.With(t.Announce).Inc()
+		log.Warn("Announce failed", "err", err)
+		down.emit(Event{Type: EVENT_TRACKER_ERROR, Tracker: t.Announce, Err: err})
+	} else {
+		log.Info("Tracker answered", "peers", len(peers))
+	}
+	return peers, err
+}
+
+var errUnsupportedTracker = errors.New("Unsupported tracker protocol")
+
+// announced is a tracker that answered our started announce
+type announced struct {
+	tracker  torrentfile.Tracker
+	infoHash [20]byte
+}
+
+// announceAll sends an event to the trackers that answered the started
+// announce
+func (down *Downloader) announceAll(event int) {
+	for _, a := range down.announced {
+		down.announce(a.tracker, a.infoHash, event)
 	}
+}
 
-	for _, p := range peers {
-		if !down.peerExists(p) {
-			down.peers = append(down.peers, p)
+// left returns the number of bytes we still have to download
+func (down *Downloader) left() uint64 {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+
+	var left uint64
+	for i, done := range down.completed {
+		if !done {
+			_, size := down.pieceBounds(i)
+			left += size
 		}
 	}
+	return left
+}
 
-	return nil
+// addPeers adds the peers found by source in the swarm of infoHash to the
+// peer database
+func (down *Downloader) addPeers(peers []tracker.Peer, infoHash [20]byte, source string) {
+	found := make([]tracker.Peer, len(peers))
+	for i, p := range peers {
+		p.InfoHash = infoHash
+		found[i] = p
+	}
+	if down.peerDB.add(found, source) > 0 {
+		down.wakeDialer()
+	}
 }
 
+// scrapTrackers announces to the trackers of the torrent. Hybrid torrents are
+// announced with both their v1 and v2 info hashes to join both swarms.
 func (down *Downloader) scrapTrackers(torrent *torrentfile.Torrent) {
-	for _, t := range torrent.Trackers {
-		if t.Protocol == "udp" {
-			log.Printf("Retrieving peers from %s\n", t.URL)
-			err := down.getPeers(t.URL, torrent.InfoHash, torrent.Length)
-			if err == nil {
-				break
-			}
+	for _, infoHash := range torrent.InfoHashes() {
+		down.scrapSwarm(torrent, infoHash)
+	}
+}
+
+func (down *Downloader) scrapSwarm(torrent *torrentfile.Torrent, infoHash [20]byte) {
+	trackers := torrent.Trackers
+	if !torrent.Private {
+		for _, announce := range down.extraTrackers {
+			trackers = append(trackers, torrentfile.NewTracker(announce))
+		}
+	}
+	for _, t := range trackers {
+		peers, err := down.announce(t, infoHash, tracker.EVENT_STARTED)
+		if err == nil {
+			down.addPeers(peers, infoHash, sourceTracker)
+			down.announced = append(down.announced, announced{t, infoHash})
+			break
 		}
+	}
+}
 
+func pieceInfo(torrent *torrentfile.Torrent, order int) StPiece {
+	piece := StPiece{Order: order}
+	if len(torrent.PieceHashes) > 0 {
+		piece.Hash = torrent.PieceHashes[order]
 	}
+	return piece
 }
 
 func (down *Downloader) initPiecesList(numPieces int, torrent *torrentfile.Torrent, APieces *atomicPieces) {
 	var pieces []StPiece
 
 	for i := 0; i < numPieces; i++ {
-		pieces = append(pieces, StPiece{
-			Hash:  torrent.PieceHashes[i],
-			Order: i,
-		})
+		pieces = append(pieces, pieceInfo(torrent, i))
 	}
 
 	APieces.pieces = pieces
 }
 
-func (down *Downloader) initPeersQueue() {
-	down.peersQueue = make(chan tracker.Peer, len(down.peers))
+// NewDownloader creates the files of the torrent on disk and prepares the
+// list of pieces to download.
+func NewDownloader(torrent *torrentfile.Torrent) (*Downloader, error) {
+	return newDownloader(torrent, "")
+}
+
+// newDownloader creates a downloader that stores the files in root, or in
+// the default download directory if root is empty
+func newDownloader(torrent *torrentfile.Torrent, root string) (*Downloader, error) {
+	down := &Downloader{
+		torrent:      torrent,
+		completed:    make([]bool, torrent.NumPieces()),
+		availability: make([]int, torrent.NumPieces()),
+		done:         make(chan struct{}),
+		stop:         make(chan struct{}),
+		results:      make(chan StPieceResult, 1),
+		wake:         make(chan struct{}, 1),
+		dials:        make(chan struct{}, defaultMaxHalfOpen),
+		dialWake:     make(chan struct{}, 1),
+	}
+	down.pieceDone = sync.NewCond(&down.mu)
+	down.files.root = root
+	down.SetLogger(logging.Discard)
+
+	err := down.files.CreateFiles(torrent.FileList())
+	if err != nil {
+		return nil, err
+	}
+	down.initFilePieces()
+	down.initPiecesList(torrent.NumPieces(), torrent, &down.piecesList)
+
+	completed, err := readResume(down.files.root, torrent)
+	if err == nil {
+		down.resume(completed)
+	}
+	return down, nil
+}
+
+// resume marks the pieces verified in a previous session as completed
+func (down *Downloader) resume(completed []bool) {
+	var pending []StPiece
+	for _, piece := range down.piecesList.pieces {
+		if !completed[piece.Order] {
+			pending = append(pending, piece)
+		}
+	}
+	down.piecesList.pieces = pending
+	copy(down.completed, completed)
+	for _, done := range completed {
+		if done {
+			down.ownedPieces++
+		}
+	}
+	down.log.Info("Resuming", "pieces", down.ownedPieces, "total", len(completed))
+}
+
+// Close closes the files of the torrent.
+func (down *Downloader) Close() {
+	down.files.closeFiles()
+}
+
+// Stop stops the peers and web seeds of the torrent and makes Run return.
+// Incoming connections accepted with AcceptPeer are closed too.
+func (down *Downloader) Stop() {
+	down.stopOnce.Do(func() { close(down.stop) })
+	down.finish()
+}
+
+func (down *Downloader) finish() {
+	down.doneOnce.Do(func() {
+		close(down.done)
+		// wakes up the readers waiting for pieces
+		down.mu.Lock()
+		down.pieceDone.Broadcast()
+		down.mu.Unlock()
+	})
+}
+
+// IsComplete reports whether every piece of the torrent is on disk.
+func (down *Downloader) IsComplete() bool {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	return down.ownedPieces == len(down.completed)
+}
+
+// bitfield returns the pieces we have as a BITFIELD payload, or nil if we
+// don't have any yet
+func (down *Downloader) bitfield() []byte {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	if down.ownedPieces == 0 {
+		return nil
+	}
+	bitfield := make([]byte, (len(down.completed)+7)/8)
+	for i, done := range down.completed {
+		if done {
+			bitfield[i/8] |= 128 >> uint(i%8)
+		}
+	}
+	return bitfield
+}
+
+// readBlock reads length bytes at begin of a verified piece
+func (down *Downloader) readBlock(piece int, begin, length uint32) ([]byte, error) {
+	if piece < 0 || piece >= len(down.completed) || !down.HasPiece(piece) {
+		return nil, errors.New("Piece not available")
+	}
+	offset, size := down.pieceBounds(piece)
+	if uint64(begin)+uint64(length) > size {
+		return nil, errors.New("Block out of the piece")
+	}
+	data := make([]byte, length)
+	err := down.disk.do(func() error {
+		return down.files.readData(data, offset+uint64(begin))
+	})
+	return data, err
+}
+
+// AcceptPeer handles an incoming connection of a peer that already sent its
+// handshake for infoHash with peerID and reserved bits. It answers the
+// handshake, uploads the pieces we have and downloads the ones we miss. It
+// returns when the connection is closed.
+func (down *Downloader) AcceptPeer(conn net.Conn, infoHash, peerID [20]byte, reserved [8]byte) {
+	p := down.newPeer()
+	p.slots = nil // the slot is taken by whoever accepted the connection
+	p.done = down.stop
+	p.conn = conn
+	p.incoming = true
+	p.peerID = peerID
+	p.fast = reserved[7]&fastBit != 0
+	p.host.InfoHash = infoHash
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		p.host.IP = addr.IP
+		p.host.Port = uint16(addr.Port)
+	case *net.UDPAddr:
+		p.host.IP = addr.IP
+		p.host.Port = uint16(addr.Port)
+	}
+
+	k := down.peerDB.accepted(p.host, time.Now())
+	if k == nil {
+		down.log.Debug("Peer banned or already connected, refusing it", "peer", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	if !down.reserveConnection() {
+		down.log.Debug("Too many connections, refusing peer", "peer", conn.RemoteAddr().String())
+		down.peerDB.release(k)
+		conn.Close()
+		return
+	}
+	defer down.releaseConnection()
 
-	for _, cPeer := range down.peers {
-		cPeer.Status = PEER_NEW
-		down.peersQueue <- cPeer
+	_, err := conn.Write(p.handshake(infoHash))
+	if err != nil {
+		conn.Close()
+		down.peerDB.closed(k, PEER_DOWN, time.Now())
+		return
 	}
+	p.log = p.peerLogger()
+	p.log.Debug("Accepted peer")
+	peerConnections.With(outcomeIncoming).Inc()
+	down.emit(Event{Type: EVENT_PEER_CONNECTED, Peer: p.host})
+	p.sendBitfield()
+	err = p.run(&down.piecesList)
+	down.emit(Event{Type: EVENT_PEER_DISCONNECTED, Peer: p.host, Err: err})
+	down.peerDB.closed(k, p.host.Status, time.Now())
+}
 
+// newPeer creates a peer connection that shares the limits of the downloader
+func (down *Downloader) newPeer() *Peer {
+	p := NewPeer(down.torrent, down.results)
+	p.down = down
+	p.done = down.done
+	p.complete = down.done
+	p.slots = down.slots
+	return p
 }
 
-func (down *Downloader) Run(torrent *torrentfile.Torrent, numWorkers int) {
+// HasPiece reports whether the piece is already verified and written to disk.
+func (down *Downloader) HasPiece(piece int) bool {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	return down.completed[piece]
+}
+
+// pieceBounds returns the offset and size of a piece in the torrent.
+func (down *Downloader) pieceBounds(piece int) (uint64, uint64) {
+	offset := uint64(piece) * uint64(down.torrent.PieceLength)
+	size := uint64(down.torrent.PieceLength)
+	if offset+size > down.torrent.Length {
+		size = down.torrent.Length - offset
+	}
+	return offset, size
+}
+
+// Completed returns the number of verified bytes in the range
+// [offset, offset+length) of the torrent.
+func (down *Downloader) Completed(offset, length uint64) uint64 {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	return completedBytes(down.torrent, down.completed, offset, length)
+}
 
-	log.Printf("Number of workers: %d\n", numWorkers)
-	piecesList := atomicPieces{}
-	numPieces := len(torrent.PieceHashes)
-	filewriter := fileWriter{}
+// completedBytes returns the bytes of the completed pieces in the range
+// [offset, offset+length) of the torrent
+func completedBytes(torrent *torrentfile.Torrent, completed []bool, offset, length uint64) uint64 {
+	var total uint64
+	end := offset + length
+	for i, done := range completed {
+		if !done {
+			continue
+		}
+		pStart := uint64(i) * uint64(torrent.PieceLength)
+		pEnd := pStart + uint64(torrent.PieceLength)
+		if pEnd > torrent.Length {
+			pEnd = torrent.Length
+		}
+		if pEnd <= offset || pStart >= end {
+			continue
+		}
+		if pStart < offset {
+			pStart = offset
+		}
+		if pEnd > end {
+			pEnd = end
+		}
+		total += pEnd - pStart
+	}
+	return total
+}
 
-	filewriter.CreateFiles(torrent.Files)
-	defer filewriter.closeFiles()
+// waitPiece blocks until the piece is downloaded, raising the priority of the
+// pieces between piece and last so they are requested first. It returns an
+// error if ctx is cancelled or the download ends without the piece.
+func (down *Downloader) waitPiece(ctx context.Context, piece, last int) error {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	if down.completed[piece] {
+		return nil
+	}
+	down.piecesList.prioritize(piece, last)
+
+	waiting := make(chan struct{})
+	defer close(waiting)
+	go func() {
+		select {
+		case <-ctx.Done():
+			down.mu.Lock()
+			down.pieceDone.Broadcast()
+			down.mu.Unlock()
+		case <-waiting:
+		}
+	}()
+	for !down.completed[piece] {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		select {
+		case <-down.done:
+			return ErrStopped
+		default:
+		}
+		down.pieceDone.Wait()
+	}
+	return nil
+}
+
+func (down *Downloader) pieceCompleted(res StPieceResult) error {
+	events, err := down.storePiece(res)
+	for _, e := range events {
+		down.emit(e)
+	}
+	return err
+}
+
+// storePiece writes a verified piece to disk and returns the events it
+// causes
+func (down *Downloader) storePiece(res StPieceResult) ([]Event, error) {
+	// only Run stores pieces, the lock isn't held during the write so the
+	// readers and the stats don't wait for the disk
+	down.mu.Lock()
+	completed := down.completed[res.Order]
+	down.mu.Unlock()
+	if completed {
+		return nil, nil
+	}
+	err := down.disk.do(func() error {
+		defer diskWriteLatency.ObserveSince(time.Now())
+		return down.files.writeData(res.Data, uint64(res.Order*down.torrent.PieceLength))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	down.mu.Lock()
+	piecesVerified.Inc()
+	down.piecesList.removePiece(res.Order)
+	down.completed[res.Order] = true
+	down.ownedPieces++
+	down.pieceDone.Broadcast()
+
+	var completedPieces []bool
+	if down.ownedPieces%resumeInterval == 0 || down.ownedPieces == len(down.completed) {
+		completedPieces = append([]bool(nil), down.completed...)
+	}
+	events := []Event{{Type: EVENT_PIECE_VERIFIED, Piece: res.Order}}
+	events = append(events, down.completedFiles(res.Order)...)
+	if down.ownedPieces == len(down.completed) {
+		events = append(events, Event{Type: EVENT_TORRENT_COMPLETED})
+	}
+	down.mu.Unlock()
+
+	if completedPieces != nil {
+		if err := down.saveResume(completedPieces); err != nil {
+			down.log.Error("Error writing resume file", "err", err)
+		}
+	}
+	return events, nil
+}
+
+// saveResume syncs the files and writes the resume file with the completed
+// pieces. The resume file only lists pieces that are on disk, they aren't
+// checked again when resuming.
+func (down *Downloader) saveResume(completed []bool) error {
+	if err := down.disk.do(down.files.sync); err != nil {
+		return err
+	}
+	return writeResume(down.files.root, down.torrent, completed)
+}
+
+// flush syncs the files to disk and saves the resume file
+func (down *Downloader) flush() error {
+	down.mu.Lock()
+	completed := append([]bool(nil), down.completed...)
+	down.mu.Unlock()
+	return down.saveResume(completed)
+}
+
+// ErrStopped is returned by Run when the download is stopped with Stop
+var ErrStopped = errors.New("Download stopped")
+
+// Run gets the peers from the trackers and downloads the torrent keeping up
+// to numWorkers outgoing peer connections. It returns nil once every piece
+// of the files that aren't skipped is on disk, or an error if it was
+// stopped, ctx was cancelled or the files couldn't be flushed. The pieces
+// that can't be written are downloaded again. Before returning it closes the
+// peer connections, flushes the files and sends the stopped or completed
+// event to the trackers.
+func (down *Downloader) Run(ctx context.Context, numWorkers int) error {
+	defer down.finish()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			down.Stop()
+		case <-down.done:
+		}
+	}()
+
+	select {
+	case <-down.stop:
+		return down.stopError(ctx)
+	default:
+	}
+
+	down.log.Info("Starting download", "workers", numWorkers)
+	torrent := down.torrent
+	wasComplete := down.IsComplete()
 
 	if os.Getenv("TEST_LOCAL_CLIENT") == "true" {
-		log.Printf("- DEBUG: Using local connection. Not scrapping peers.")
-		down.peers = append(down.peers, tracker.Peer{
-			IP:     net.ParseIP("127.0.0.1"),
-			Port:   25771,
-			Status: PEER_NEW,
-		})
+		down.log.Debug("Using local connection. Not scrapping peers.")
+		down.addPeers([]tracker.Peer{{
+			IP:   net.ParseIP("127.0.0.1"),
+			Port: 25771,
+		}}, torrent.InfoHash, sourceLocal)
 	} else {
-		down.scrapTrackers(torrent)
+		down.discoverPeers()
 	}
 
-	down.initPiecesList(numPieces, torrent, &piecesList)
-	down.initPeersQueue()
+	resultsChan := down.results
+	var workers sync.WaitGroup
+	start := func(fn func()) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			fn()
+		}()
+	}
 
-	resultsChan := make(chan StPieceResult, 1)
+	if numWorkers > 0 {
+		start(func() { down.connectPeers(numWorkers) })
+	}
 
-	for i := 0; i < numWorkers; i++ {
-		worker := NewPeer(
-			torrent,
-			down.peersQueue,
-			resultsChan,
-		)
-		go worker.Start(&piecesList)
+	for _, url := range torrent.WebSeeds {
+		seed := NewWebSeed(url, false, torrent, resultsChan)
+		seed.down = down
+		seed.log = logging.With(down.log, "webseed", url)
+		start(func() { seed.Start(&down.piecesList, down.done) })
+	}
+	for _, url := range torrent.HTTPSeeds {
+		seed := NewWebSeed(url, true, torrent, resultsChan)
+		seed.down = down
+		seed.log = logging.With(down.log, "webseed", url)
+		start(func() { seed.Start(&down.piecesList, down.done) })
 	}
 
-	for {
-		res := <-resultsChan
-		filewriter.writeData(res.Data, uint64(res.Order*torrent.PieceLength))
-		down.ownedPieces++
-		if down.ownedPieces == numPieces {
-			break
+	var err error
+	for err == nil && !down.isDone() {
+		select {
+		case <-down.wake:
+		case res := <-resultsChan:
+			if writeErr := down.pieceCompleted(res); writeErr != nil {
+				// downloaded again, the disk may have room by then
+				down.log.Error("Error writing piece", "piece", res.Order, "err", writeErr)
+				down.piecesList.addPiece(pieceInfo(torrent, res.Order))
+			}
+		case <-down.stop:
+			err = down.stopError(ctx)
 		}
 	}
+	if err != nil && err != ErrStopped && err != ctx.Err() {
+		down.Stop()
+	}
+	down.finish()
+	workers.Wait()
+
+	if flushErr := down.flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		down.log.Info("Download stopped", "err", err)
+		down.announceAll(tracker.EVENT_STOPPED)
+		return err
+	}
 
-	log.Println("File(s) downloaded")
+	down.log.Info("File(s) downloaded")
+	if !wasComplete && down.IsComplete() {
+		down.announceAll(tracker.EVENT_COMPLETED)
+	}
+	return nil
+}
+
+// stopError is the error returned by Run when the download is stopped
+func (down *Downloader) stopError(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return ErrStopped
 }
@@ -1,7 +1,15 @@
 package torrentp2p
 
 import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test_findPiece(t *testing.T) {
@@ -33,3 +41,203 @@ func Test_findPiece(t *testing.T) {
 		t.Errorf("Unexpected piece order in remaining list: %v", APieces.pieces)
 	}
 }
+
+func Test_claimPiece(t *testing.T) {
+	pieces := atomicPieces{pieces: []StPiece{{Order: 0}, {Order: 1}}}
+	if piece := pieces.claimPiece([]byte{0, 1}); piece == nil || piece.Order != 1 {
+		t.Errorf("Unexpected piece %v", piece)
+	}
+	// the last piece leaves the queue too
+	if piece := pieces.claimPiece([]byte{1, 1}); piece == nil || piece.Order != 0 || len(pieces.pieces) != 0 {
+		t.Errorf("Unexpected piece %v, %v left", piece, pieces.pieces)
+	}
+	if piece := pieces.claimPiece([]byte{1, 1}); piece != nil {
+		t.Errorf("Piece handed out twice")
+	}
+
+	pieces.addPiece(StPiece{Order: 1})
+	pieces.addPiece(StPiece{Order: 1})
+	if len(pieces.pieces) != 1 {
+		t.Errorf("Piece queued twice: %v", pieces.pieces)
+	}
+}
+
+func Test_prioritize(t *testing.T) {
+
+	var pieces []StPiece
+	for i := 0; i < 6; i++ {
+		pieces = append(pieces, StPiece{Order: i})
+	}
+
+	APieces := atomicPieces{
+		pieces: pieces,
+	}
+	APieces.prioritize(3, 4)
+
+	if APieces.pieces[0].Order != 3 || APieces.pieces[1].Order != 4 {
+		t.Errorf("Expected pieces 3 and 4 first, got %v", APieces.pieces)
+	}
+	if len(APieces.pieces) != 6 {
+		t.Errorf("Expected 6 pieces in list, got %d", len(APieces.pieces))
+	}
+}
+
+func Test_storePieceWriteError(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	down.files.closeFiles()
+	if err := down.pieceCompleted(StPieceResult{Data: make([]byte, 16384), Order: 1}); err == nil {
+		t.Fatal("Expected write error")
+	}
+	if down.HasPiece(1) || down.ownedPieces != 0 {
+		t.Error("Piece not written marked as completed")
+	}
+}
+
+func Test_FileReaderStops(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	read := func(ctx context.Context) chan error {
+		result := make(chan error, 1)
+		reader, err := down.NewFileReader(ctx, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, err := reader.Read(make([]byte, 10))
+			result <- err
+		}()
+		return result
+	}
+	wait := func(result chan error, expected error) {
+		select {
+		case err := <-result:
+			if err != expected {
+				t.Errorf("Expected %v, got %v", expected, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Read still waiting for the piece")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := read(ctx)
+	cancel()
+	wait(result, context.Canceled)
+
+	result = read(context.Background())
+	down.Stop()
+	wait(result, ErrStopped)
+}
+
+func Test_RunEvents(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	var requestsMu sync.Mutex
+	requests := map[int]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		piece, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		requestsMu.Lock()
+		requests[piece]++
+		requestsMu.Unlock()
+		end := (piece + 1) * 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[piece*16384 : end])
+	}))
+	defer server.Close()
+
+	torrent := testWebSeedTorrent(data)
+	torrent.HTTPSeeds = []string{server.URL}
+	down, err := newDownloader(torrent, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	verified, downloaded := piecesVerified.Value(), bytesDownloaded.Value()
+	var mu sync.Mutex
+	counts := map[int]int{}
+	down.OnEvent(func(e Event) {
+		mu.Lock()
+		counts[e.Type]++
+		mu.Unlock()
+	})
+	err = down.Run(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requestsMu.Lock()
+	if len(requests) != 4 || requests[0] != 1 || requests[1] != 1 || requests[2] != 1 || requests[3] != 1 {
+		t.Errorf("Pieces not requested once each: %v", requests)
+	}
+	requestsMu.Unlock()
+	if counts[EVENT_PIECE_VERIFIED] != 4 || counts[EVENT_FILE_COMPLETED] != 2 || counts[EVENT_TORRENT_COMPLETED] != 1 {
+		t.Errorf("Unexpected events %v", counts)
+	}
+	stats := down.Stats()
+	if stats.Downloaded != 50000 || stats.Left != 0 || stats.ETA != 0 || stats.OwnedPieces != 4 || stats.Availability[0] != 4 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+	if piecesVerified.Value()-verified != 4 || bytesDownloaded.Value()-downloaded != 50000 {
+		t.Errorf("Unexpected metrics: %v pieces, %v bytes", piecesVerified.Value()-verified, bytesDownloaded.Value()-downloaded)
+	}
+}
+
+func Test_RunCancel(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() { result <- down.Run(ctx, 2) }()
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after cancelling the context")
+	}
+	if _, err := readResume(root, down.torrent); err != nil {
+		t.Errorf("Resume file not written: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package torrentp2p
+
+import "github.com/vaguilera/MiniTorrent/tracker"
+
+// Types of the events of a download
+const (
+	EVENT_PIECE_VERIFIED = iota
+	EVENT_FILE_COMPLETED
+	EVENT_PEER_CONNECTED
+	EVENT_PEER_DISCONNECTED
+	EVENT_TRACKER_ERROR
+	EVENT_TORRENT_COMPLETED
+)
+
+// Event is something that happened in a download. Only the fields that make
+// sense for its type are set.
+type Event struct {
+	Type    int
+	Piece   int          // EVENT_PIECE_VERIFIED
+	File    int          // EVENT_FILE_COMPLETED, index in the FileList of the torrent
+	Peer    tracker.Peer // EVENT_PEER_CONNECTED and EVENT_PEER_DISCONNECTED
+	Tracker string       // EVENT_TRACKER_ERROR
+	Err     error        // EVENT_TRACKER_ERROR, and why the peer disconnected if it failed
+}
+
+// OnEvent sets the function called with the events of the download. It is
+// called from several goroutines and must not block. Set it before Run.
+func (down *Downloader) OnEvent(handler func(Event)) {
+	down.handler = handler
+}
+
+func (down *Downloader) emit(e Event) {
+	if down.handler != nil {
+		down.handler(e)
+	}
+}
+
+// filePieces is the range of pieces of a file of the torrent
+type filePieces struct {
+	first, last int
+}
+
+// initFilePieces finds the pieces of every file with data
+func (down *Downloader) initFilePieces() {
+	var offset uint64
+	pieceLength := uint64(down.torrent.PieceLength)
+	for _, file := range down.torrent.FileList() {
+		pieces := filePieces{first: -1, last: -1}
+		if file.Length > 0 && !file.IsPadding() && !file.IsSymlink() {
+			pieces.first = int(offset / pieceLength)
+			pieces.last = int((offset + file.Length - 1) / pieceLength)
+		}
+		down.filePieces = append(down.filePieces, pieces)
+		offset += file.Length
+	}
+}
+
+// completedFiles returns the events of the files completed by piece. It must
+// be called with the lock held.
+func (down *Downloader) completedFiles(piece int) []Event {
+	var events []Event
+	for i, pieces := range down.filePieces {
+		if piece < pieces.first || piece > pieces.last {
+			continue
+		}
+		complete := true
+		for j := pieces.first; j <= pieces.last; j++ {
+			if !down.completed[j] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			events = append(events, Event{Type: EVENT_FILE_COMPLETED, File: i})
+		}
+	}
+	return events
+}
@@ -0,0 +1,198 @@
+package torrentp2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// fastBit is the reserved bit of the handshake that advertises the Fast
+// Extension (BEP 6), in the last reserved byte
+const fastBit = 0x04
+
+// allowedFastCount is the number of pieces a choked peer may download from us
+const allowedFastCount = 10
+
+// maxSuggestedPieces bounds the suggestions of a peer waiting to be picked
+const maxSuggestedPieces = 32
+
+// allowedFastSet returns the k pieces a peer with ip may request while
+// choked, as described by BEP 6. Peers behind the same /24 share the set.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces, k int) []int {
+	ip = ip.To4()
+	if ip == nil || numPieces == 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+	x := make([]byte, 0, 24)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+	var set []int
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 20 && len(set) < k; i += 4 {
+			piece := int(binary.BigEndian.Uint32(x[i:i+4]) % uint32(numPieces))
+			if indexOfInt(set, piece) < 0 {
+				set = append(set, piece)
+			}
+		}
+	}
+	return set
+}
+
+func indexOfInt(list []int, n int) int {
+	for i := range list {
+		if list[i] == n {
+			return i
+		}
+	}
+	return -1
+}
+
+// processFastMessage handles the messages of the Fast Extension, first
+// tells whether it is the first message of the peer
+func (p *Peer) processFastMessage(msg Message, first bool) error {
+	if !p.fast {
+		return protocolError("Fast Extension message without negotiating it")
+	}
+	var piece int
+	switch msg.ID {
+	case HAVE_ALL, HAVE_NONE:
+		if len(msg.Payload) != 0 {
+			return protocolError("Invalid HAVE_ALL or HAVE_NONE message")
+		}
+	case REJECT_REQUEST:
+		if len(msg.Payload) != 12 {
+			return protocolError("Invalid REJECT_REQUEST message")
+		}
+		piece = int(binary.BigEndian.Uint32(msg.Payload))
+	default:
+		if len(msg.Payload) != 4 {
+			return protocolError("Invalid SUGGEST_PIECE or ALLOWED_FAST message")
+		}
+		piece = int(binary.BigEndian.Uint32(msg.Payload))
+	}
+	if piece < 0 || piece >= len(p.bitfield) {
+		return protocolError("Piece out of range in Fast Extension message")
+	}
+
+	switch msg.ID {
+	case HAVE_ALL:
+		p.log.Debug("HAVE ALL")
+		if !first {
+			return protocolError("HAVE_ALL received but not as first message")
+		}
+		for i := range p.bitfield {
+			p.havePiece(i)
+		}
+		p.bitFieldRecv = true
+		p.gotBitfield()
+	case HAVE_NONE:
+		p.log.Debug("HAVE NONE")
+		if !first {
+			return protocolError("HAVE_NONE received but not as first message")
+		}
+		// nothing to download until the peer announces a piece
+		p.bitFieldRecv = true
+		p.gotBitfield()
+	case SUGGEST_PIECE:
+		p.log.Debug("SUGGEST PIECE", "piece", piece)
+		if len(p.suggested) < maxSuggestedPieces && indexOfInt(p.suggested, piece) < 0 {
+			p.suggested = append(p.suggested, piece)
+		}
+	case REJECT_REQUEST:
+		p.log.Debug("REJECT REQUEST", "piece", piece)
+		request := blockRequest{}
+		copy(request[:], msg.Payload)
+		switch {
+		case p.outstanding[request]:
+			delete(p.outstanding, request)
+		case p.abandoned[request]:
+			delete(p.abandoned, request)
+		default:
+			return protocolError("REJECT_REQUEST of a block not requested")
+		}
+		// the peer won't send it, other peers may. Not asked again until
+		// the next unchoke.
+		p.rejected[piece] = true
+		if p.state == stateDownloading && uint32(piece) == p.currentPieceNum {
+			p.dropPiece = true
+		}
+	case ALLOWED_FAST:
+		p.log.Debug("ALLOWED FAST", "piece", piece)
+		p.allowedFast[piece] = true
+		if p.state == stateChoked && p.chocked {
+			p.state = statePick
+		}
+	}
+	return nil
+}
+
+// gotBitfield answers the first message of the peer with the pieces it has,
+// the BITFIELD or its HAVE_ALL and HAVE_NONE shortcuts
+func (p *Peer) gotBitfield() {
+	p.state = stateChoked
+	if p.chocked {
+		p.log.Debug("Sending UNCHOKE")
+		p.sendMessage(UNCHOKE, nil)
+		p.amChoking = false
+		p.sendMessage(INTERESTED, nil)
+		p.amInterested = true
+	}
+	if p.chocked && len(p.allowedFast) > 0 {
+		// start with the pieces we may download while choked
+		p.state = statePick
+	}
+}
+
+// pickable returns the pieces of the peer we can ask for now: not the ones
+// it rejected, and only the allowed fast ones while it chokes us
+func (p *Peer) pickable() []byte {
+	if !p.chocked && len(p.rejected) == 0 {
+		return p.bitfield
+	}
+	mask := make([]byte, len(p.bitfield))
+	for i, has := range p.bitfield {
+		if has == 1 && !p.rejected[i] && (!p.chocked || p.allowedFast[i]) {
+			mask[i] = 1
+		}
+	}
+	return mask
+}
+
+// sendAllowedFast tells the peer which of our pieces it may download while we
+// choke it
+func (p *Peer) sendAllowedFast() error {
+	p.ourAllowedFast = make(map[int]bool)
+	if !p.fast || p.down == nil {
+		return nil
+	}
+	infoHash := p.host.InfoHash
+	if infoHash == [20]byte{} {
+		infoHash = p.torrent.InfoHash
+	}
+	for _, piece := range allowedFastSet(p.host.IP, infoHash, len(p.bitfield), allowedFastCount) {
+		if !p.down.HasPiece(piece) {
+			continue
+		}
+		p.ourAllowedFast[piece] = true
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], uint32(piece))
+		if err := p.sendMessage(ALLOWED_FAST, payload[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejectRequest tells a peer with the Fast Extension that we won't upload a
+// block it requested. The others just don't get it.
+func (p *Peer) rejectRequest(request []byte) error {
+	if !p.fast {
+		return nil
+	}
+	return p.sendMessage(REJECT_REQUEST, request)
+}
@@ -0,0 +1,205 @@
+package torrentp2p
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+// recordConn keeps the messages written to it
+type recordConn struct {
+	net.Conn
+	written []byte
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.written = append(c.written, b...)
+	return len(b), nil
+}
+
+func testFastPeer(numPieces int) (*Peer, *recordConn) {
+	torrent := &torrentfile.Torrent{PieceLength: 16384, Length: uint64(numPieces) * 16384, PieceHashes: make([][20]byte, numPieces)}
+	p := NewPeer(torrent, nil)
+	conn := &recordConn{}
+	p.conn = conn
+	p.fast = true
+	p.allowedFast = make(map[int]bool)
+	p.rejected = make(map[int]bool)
+	p.outstanding = make(map[blockRequest]bool)
+	p.abandoned = make(map[blockRequest]bool)
+	return p, conn
+}
+
+func fastMessage(id byte, values ...uint32) Message {
+	payload := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(payload[4*i:], v)
+	}
+	return Message{ID: id, Payload: payload}
+}
+
+func Test_allowedFastSet(t *testing.T) {
+	var infoHash [20]byte
+	for i := range infoHash {
+		infoHash[i] = 0xaa
+	}
+	// the examples of BEP 6
+	ip := net.ParseIP("80.4.4.200")
+	if set := allowedFastSet(ip, infoHash, 1313, 7); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188}) {
+		t.Errorf("Unexpected set %v", set)
+	}
+	if set := allowedFastSet(ip, infoHash, 1313, 9); !reflect.DeepEqual(set, []int{1059, 431, 808, 1217, 287, 376, 1188, 353, 508}) {
+		t.Errorf("Unexpected set %v", set)
+	}
+	if set := allowedFastSet(net.ParseIP("80.4.4.1"), infoHash, 1313, 7); set[0] != 1059 {
+		t.Errorf("Same /24 got another set %v", set)
+	}
+	if set := allowedFastSet(ip, infoHash, 3, 10); len(set) != 3 {
+		t.Errorf("Expected every piece, got %v", set)
+	}
+	if set := allowedFastSet(net.ParseIP("::1"), infoHash, 1313, 7); set != nil {
+		t.Errorf("Expected no set for IPv6, got %v", set)
+	}
+}
+
+func Test_processFastMessage(t *testing.T) {
+	p, conn := testFastPeer(4)
+	if err := p.processMessage(Message{ID: HAVE_ALL}); err != nil {
+		t.Fatal(err)
+	}
+	if p.numPieces != 4 || p.state != stateChoked || p.amChoking || !p.amInterested {
+		t.Errorf("Unexpected state after HAVE_ALL: %d pieces, state %d", p.numPieces, p.state)
+	}
+	if string(conn.written) != "\x00\x00\x00\x01\x01\x00\x00\x00\x01\x02" {
+		t.Errorf("Expected UNCHOKE and INTERESTED, got %v", conn.written)
+	}
+	if err := p.processMessage(Message{ID: HAVE_NONE}); err == nil {
+		t.Error("Expected error for HAVE_NONE after HAVE_ALL")
+	}
+
+	// choked, only the allowed fast pieces are picked
+	p.processMessage(fastMessage(ALLOWED_FAST, 2))
+	if p.state != statePick {
+		t.Errorf("Expected to pick after ALLOWED_FAST, got state %d", p.state)
+	}
+	if pickable := p.pickable(); !reflect.DeepEqual(pickable, []byte{0, 0, 1, 0}) {
+		t.Errorf("Unexpected pickable pieces %v", pickable)
+	}
+
+	p.state = stateDownloading
+	p.currentPieceNum = 2
+	p.outstanding[newBlockRequest(2, 0, 16384)] = true
+	p.processMessage(fastMessage(REJECT_REQUEST, 2, 0, 16384))
+	if !p.dropPiece {
+		t.Error("Rejected piece not given up")
+	}
+	if pickable := p.pickable(); !reflect.DeepEqual(pickable, []byte{0, 0, 0, 0}) {
+		t.Errorf("Rejected piece still pickable %v", pickable)
+	}
+	p.processMessage(Message{ID: UNCHOKE})
+	if pickable := p.pickable(); !reflect.DeepEqual(pickable, []byte{1, 1, 1, 1}) {
+		t.Errorf("Unexpected pickable pieces after unchoke %v", pickable)
+	}
+
+	p.processMessage(fastMessage(SUGGEST_PIECE, 3))
+	p.processMessage(fastMessage(SUGGEST_PIECE, 3))
+	if !reflect.DeepEqual(p.suggested, []int{3}) {
+		t.Errorf("Unexpected suggestions %v", p.suggested)
+	}
+
+	for _, msg := range []Message{
+		fastMessage(ALLOWED_FAST, 4),
+		fastMessage(SUGGEST_PIECE, 1, 2),
+		fastMessage(REJECT_REQUEST, 1),
+		{ID: HAVE_ALL, Payload: []byte{1}},
+	} {
+		if err := p.processMessage(msg); err == nil {
+			t.Errorf("Expected error for %v", msg)
+		}
+	}
+	p.fast = false
+	if err := p.processMessage(fastMessage(SUGGEST_PIECE, 1)); err == nil {
+		t.Error("Expected error without the Fast Extension")
+	}
+}
+
+func Test_processRequestChoking(t *testing.T) {
+	p, conn := testFastPeer(4)
+	p.down = &Downloader{torrent: p.torrent}
+	p.uploads = make(chan [12]byte, 1)
+	p.ourAllowedFast = map[int]bool{1: true}
+	p.gotMessage = true // after the BITFIELD
+
+	request := fastMessage(REQUEST, 1, 0, 16384)
+	if err := p.processMessage(request); err != nil || len(p.uploads) != 1 {
+		t.Errorf("Allowed fast request not queued: %v", err)
+	}
+	if err := p.processMessage(fastMessage(REQUEST, 2, 0, 16384)); err != nil || len(conn.written) != 17 || conn.written[4] != REJECT_REQUEST {
+		t.Errorf("Expected REJECT_REQUEST, got %v %v", conn.written, err)
+	}
+	// the queue is full
+	conn.written = nil
+	p.processMessage(request)
+	if len(conn.written) != 17 || conn.written[4] != REJECT_REQUEST {
+		t.Errorf("Expected REJECT_REQUEST, got %v", conn.written)
+	}
+}
+
+func Test_takePiece(t *testing.T) {
+	pieces := atomicPieces{pieces: []StPiece{{Order: 0}, {Order: 1}, {Order: 2}}}
+	if piece := pieces.takePiece(1); piece == nil || piece.Order != 1 || len(pieces.pieces) != 2 {
+		t.Errorf("Unexpected piece %v", piece)
+	}
+	if piece := pieces.takePiece(1); piece != nil {
+		t.Errorf("Piece handed out twice")
+	}
+}
+
+// Test_FastBootstrap scripts a seeder that lets us download a piece while
+// choked, rejects it and unchokes us
+func Test_FastBootstrap(t *testing.T) {
+	var reserved [8]byte
+	reserved[7] = fastBit
+	r, down := acceptRemote(t, reserved)
+	if r.handshake[27]&fastBit == 0 {
+		t.Error("Fast Extension not advertised")
+	}
+
+	r.expect(HAVE_NONE)
+	r.send(Message{ID: HAVE_ALL})
+	r.send(fastMessage(ALLOWED_FAST, 1))
+	request := r.expect(REQUEST)
+	if piece := binary.BigEndian.Uint32(request.Payload); piece != 1 {
+		t.Errorf("Expected a request of the allowed fast piece, got %d", piece)
+	}
+	r.send(Message{ID: REJECT_REQUEST, Payload: request.Payload})
+	r.send(Message{ID: UNCHOKE})
+	r.expect(REQUEST)
+	r.conn.Close()
+	r.disconnected()
+
+	if len(down.piecesList.pieces) != 4 {
+		t.Errorf("Pieces not given back: %v", down.piecesList.pieces)
+	}
+}
+
+// Test_FastHaveNone downloads from a peer that starts with no pieces
+func Test_FastHaveNone(t *testing.T) {
+	var reserved [8]byte
+	reserved[7] = fastBit
+	r, _ := acceptRemote(t, reserved)
+	r.expect(HAVE_NONE)
+	r.send(Message{ID: HAVE_NONE})
+	r.expect(UNCHOKE)
+	r.expect(INTERESTED)
+	r.send(fastMessage(HAVE, 2))
+	r.send(Message{ID: UNCHOKE})
+	if request := r.expect(REQUEST); binary.BigEndian.Uint32(request.Payload) != 2 {
+		t.Errorf("Expected a request of the announced piece, got %v", request.Payload)
+	}
+	r.conn.Close()
+	r.disconnected()
+}
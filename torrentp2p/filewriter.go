@@ -1,56 +1,70 @@
 package torrentp2p
 
 import (
-	"log"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/vaguilera/MiniTorrent/torrentfile"
 )
 
 func create(p string) (*os.File, error) {
-	if err := os.MkdirAll(filepath.Dir(p), 0600); err != nil {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
 		return nil, err
 	}
-	return os.OpenFile(p, os.O_WRONLY|os.O_CREATE, 0600)
+	return os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0644)
 }
 
 type fileData struct {
-	file   *os.File
-	length uint64
+	file    *os.File
+	length  uint64
+	padding bool // padding files are never written to disk and read as zeros
 }
 
 type fileWriter struct {
+	root      string
 	files     []fileData
 	multifile bool
 }
 
 func (fw *fileWriter) closeFiles() {
 	for _, file := range fw.files {
-		file.file.Close()
+		if file.file != nil {
+			file.file.Close()
+		}
 	}
 }
 
-func (fw *fileWriter) writeData(data []byte, offset uint64) error {
-	if !fw.multifile {
-		_, err := fw.files[0].file.WriteAt(data, int64(offset))
-		return err
+// sync commits the written data of the files to disk
+func (fw *fileWriter) sync() error {
+	for _, file := range fw.files {
+		if file.file != nil {
+			if err := file.file.Sync(); err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
+
+// span calls fn for every file chunk covered by [offset, offset+length) in the
+// torrent address space. dataOff is the position of the chunk inside the data.
+func (fw *fileWriter) span(offset, length uint64, fn func(f fileData, relative, dataOff, n uint64) error) error {
 	cOffset := uint64(0)
 	dataOff := uint64(0)
 	i := 0
-	dataLength := uint64(len(data))
-	for dataOff < dataLength {
+	for dataOff < length && i < len(fw.files) {
 		cOffset += fw.files[i].length
 		if cOffset > offset {
 			relative := offset - (cOffset - fw.files[i].length)
 			relData := fw.files[i].length - relative
-			if relData > dataLength-dataOff {
-				relData = dataLength - dataOff
+			if relData > length-dataOff {
+				relData = length - dataOff
 			}
-			_, err := fw.files[i].file.WriteAt(data[dataOff:dataOff+relData], int64(relative))
-			if err != nil {
+			if err := fn(fw.files[i], relative, dataOff, relData); err != nil {
 				return err
 			}
 			dataOff += relData
@@ -58,32 +72,145 @@ func (fw *fileWriter) writeData(data []byte, offset uint64) error {
 		}
 		i++
 	}
+	return nil
+}
 
+func (fw *fileWriter) writeData(data []byte, offset uint64) error {
+	if !fw.multifile {
+		_, err := fw.files[0].file.WriteAt(data, int64(offset))
+		return err
+	}
+	return fw.span(offset, uint64(len(data)), func(f fileData, relative, dataOff, n uint64) error {
+		if f.padding {
+			return nil
+		}
+		_, err := f.file.WriteAt(data[dataOff:dataOff+n], int64(relative))
+		return err
+	})
+}
+
+var errMissingData = errors.New("Missing data on disk")
+
+func (fw *fileWriter) readData(data []byte, offset uint64) error {
+	return fw.span(offset, uint64(len(data)), func(f fileData, relative, dataOff, n uint64) error {
+		if f.padding {
+			for i := dataOff; i < dataOff+n; i++ {
+				data[i] = 0
+			}
+			return nil
+		}
+		if f.file == nil {
+			return errMissingData
+		}
+		_, err := f.file.ReadAt(data[dataOff:dataOff+n], int64(relative))
+		if err == io.EOF {
+			return errMissingData
+		}
+		return err
+	})
+}
+
+// safePath joins the path of a torrent file to root, making sure it can't
+// point outside of it
+func safePath(root string, parts []string) (string, error) {
+	if len(parts) == 0 {
+		return "", errors.New("Empty file path")
+	}
+	for _, part := range parts {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+			return "", errors.New("Invalid file path: " + strings.Join(parts, "/"))
+		}
+	}
+	return filepath.Join(root, filepath.Join(parts...)), nil
+}
+
+// createSymlink creates a symlink to a file of the torrent. Targets outside
+// the download root are refused.
+func (fw *fileWriter) createSymlink(link string, file torrentfile.TorrentMultiFileInfo) error {
+	target, err := safePath(fw.root, file.SymlinkPath)
+	if err != nil {
+		return err
+	}
+	relative, err := filepath.Rel(filepath.Dir(link), target)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+		return err
+	}
+	if stat, err := os.Lstat(link); err == nil {
+		if stat.Mode()&os.ModeSymlink == 0 {
+			return errors.New("File exists and is not a symlink: " + link)
+		}
+		os.Remove(link)
+	}
+	return os.Symlink(relative, link)
+}
+
+// openFiles opens the existing files of the torrent for reading. Missing
+// files are kept in the list without a file so reads from them fail.
+func (fw *fileWriter) openFiles(files []torrentfile.TorrentMultiFileInfo) error {
+	for _, file := range files {
+		if file.IsPadding() || file.IsSymlink() {
+			fw.files = append(fw.files, fileData{length: file.Length, padding: true})
+			continue
+		}
+		filePath, err := safePath(fw.root, file.Path)
+		if err != nil {
+			return err
+		}
+		cfile, err := os.Open(filePath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fw.files = append(fw.files, fileData{file: cfile, length: file.Length})
+	}
+
+	if len(fw.files) > 1 {
+		fw.multifile = true
+	}
 	return nil
 }
 
+// CreateFiles creates the files of the torrent inside the download root.
+// Padding files are not created, executable files get their permissions set
+// and symlinks are created pointing to their target.
 func (fw *fileWriter) CreateFiles(files []torrentfile.TorrentMultiFileInfo) error {
-	if _, err := os.Stat("download"); os.IsNotExist(err) {
-		err = os.Mkdir("download", 0600)
+	if fw.root == "" {
+		fw.root = "download"
+	}
+	if _, err := os.Stat(fw.root); os.IsNotExist(err) {
+		err = os.Mkdir(fw.root, 0755)
 		if err != nil {
 			return err
 		}
 	}
 
-	var filePath string
 	for _, file := range files {
-		if len(file.Path) > 1 {
-			lastItem := len(file.Path) - 1
-			pathString := strings.Join(file.Path[:lastItem], "/")
-			filePath = pathString + "/" + file.Path[lastItem]
-		} else {
-			filePath = file.Path[0]
-		}
-		cfile, err := create("download/" + filePath)
+		if file.IsPadding() {
+			fw.files = append(fw.files, fileData{length: file.Length, padding: true})
+			continue
+		}
+		filePath, err := safePath(fw.root, file.Path)
+		if err != nil {
+			return err
+		}
+		if file.IsSymlink() {
+			err = fw.createSymlink(filePath, file)
+			if err != nil {
+				return errors.New("Can't create symlink " + filePath + ": " + err.Error())
+			}
+			// symlinks have no data, handle them like padding
+			fw.files = append(fw.files, fileData{length: file.Length, padding: true})
+			continue
+		}
+		cfile, err := create(filePath)
 		if err != nil {
-			log.Printf("error creating : %s", filePath)
 			return err
 		}
+		if file.IsExecutable() {
+			cfile.Chmod(0755)
+		}
 		fw.files = append(fw.files, fileData{file: cfile, length: file.Length})
 	}
 
@@ -92,3 +219,38 @@ func (fw *fileWriter) CreateFiles(files []torrentfile.TorrentMultiFileInfo) erro
 	}
 	return nil
 }
+
+// removeFiles deletes the files of the torrent and its resume file from
+// root, and the directories they leave empty
+func removeFiles(root string, torrent *torrentfile.Torrent) error {
+	var firstErr error
+	remove := func(p string) {
+		err := os.Remove(p)
+		if err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var dirs []string
+	for _, file := range torrent.FileList() {
+		if file.IsPadding() {
+			continue
+		}
+		p, err := safePath(root, file.Path)
+		if err != nil {
+			continue
+		}
+		remove(p)
+		for dir := filepath.Dir(p); dir != filepath.Clean(root); dir = filepath.Dir(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	remove(resumePath(root, torrent))
+
+	// deepest first, the ones that are not empty are kept
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+	return firstErr
+}
@@ -0,0 +1,92 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+func Test_writeReadData(t *testing.T) {
+
+	fw := fileWriter{multifile: true}
+	for _, length := range []uint64{3, 5, 4} {
+		f, err := ioutil.TempFile("", "minitorrent")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		fw.files = append(fw.files, fileData{file: f, length: length})
+	}
+	defer fw.closeFiles()
+
+	data := []byte("abcdefghijkl")
+	if err := fw.writeData(data[2:9], 2); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]byte, 7)
+	if err := fw.readData(got, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[2:9]) {
+		t.Errorf("Expected %s, got %s", data[2:9], got)
+	}
+
+	second, _ := ioutil.ReadFile(fw.files[1].file.Name())
+	if string(second) != "defgh" {
+		t.Errorf("Expected 'defgh' in second file, got %s", second)
+	}
+}
+
+func Test_CreateFilesAttributes(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	fw := fileWriter{root: root}
+	err = fw.CreateFiles([]torrentfile.TorrentMultiFileInfo{
+		{Length: 3, Path: []string{"bin", "run"}, Attr: "x"},
+		{Length: 13, Path: []string{".pad", "13"}, Attr: "p"},
+		{Length: 0, Path: []string{"link"}, Attr: "l", SymlinkPath: []string{"bin", "run"}},
+		{Length: 4, Path: []string{"data"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fw.closeFiles()
+
+	if _, err := os.Stat(filepath.Join(root, ".pad")); !os.IsNotExist(err) {
+		t.Errorf("Padding file created on disk")
+	}
+	if stat, err := os.Stat(filepath.Join(root, "bin", "run")); err != nil || stat.Mode()&0111 == 0 {
+		t.Errorf("Expected executable file, got %v (%v)", stat, err)
+	}
+	if target, err := os.Readlink(filepath.Join(root, "link")); err != nil || target != filepath.Join("bin", "run") {
+		t.Errorf("Unexpected symlink target %s (%v)", target, err)
+	}
+
+	if err := fw.writeData([]byte("abcPPPPPPPPPPPPPdata"), 0); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 20)
+	fw.readData(got, 0)
+	if string(got[:3]) != "abc" || !bytes.Equal(got[3:16], make([]byte, 13)) || string(got[16:]) != "data" {
+		t.Errorf("Unexpected data %q", got)
+	}
+
+	for _, bad := range [][]torrentfile.TorrentMultiFileInfo{
+		{{Length: 1, Path: []string{"..", "escape"}}},
+		{{Path: []string{"link2"}, Attr: "l", SymlinkPath: []string{"..", "..", "etc", "passwd"}}},
+	} {
+		fw := fileWriter{root: root}
+		if err := fw.CreateFiles(bad); err == nil {
+			t.Errorf("Expected error for %v", bad)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzParseMessage checks that no stream of bytes makes the message parser
+// panic or accept a message of the wrong length
+func FuzzParseMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 5, HAVE, 0, 0, 0, 3})
+	f.Add([]byte{0, 0, 0, 2, BITFIELD, 0xf0})
+	f.Add([]byte{0, 0, 0, 13, REQUEST, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0})
+	f.Add([]byte{0, 0, 0, 10, PIECE, 0, 0, 0, 1, 0, 0, 0, 0, 7})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		for {
+			buf, err := readFrame(r, maxMessageLength)
+			if err != nil {
+				return
+			}
+			if buf == nil {
+				continue
+			}
+			msg, err := parseMessage(buf, 4)
+			if err != nil {
+				continue
+			}
+			if length, ok := payloadLengths[msg.ID]; ok && len(msg.Payload) != length {
+				t.Fatalf("Accepted message %d with %d bytes", msg.ID, len(msg.Payload))
+			}
+		}
+	})
+}
+
+// FuzzPeerMessages feeds the parsed messages to a peer downloading a piece,
+// that must report bad ones as errors rather than panic
+func FuzzPeerMessages(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 1, HAVE_ALL, 0, 0, 0, 5, ALLOWED_FAST, 0, 0, 0, 1})
+	f.Add([]byte{0, 0, 0, 13, REJECT_REQUEST, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0})
+	f.Add([]byte{0, 0, 0, 13, PIECE, 0, 0, 0, 1, 0, 0, 0, 0, 1, 2, 3, 4})
+	f.Add([]byte{0, 0, 0, 1, CHOKE, 0, 0, 0, 5, SUGGEST_PIECE, 0, 0, 0, 2})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		p, _ := testFastPeer(4)
+		p.state = stateDownloading
+		p.currentPieceNum = 1
+		p.currentPieceSize = 16384
+		p.outstanding[newBlockRequest(1, 0, 16384)] = true
+		r := bytes.NewReader(data)
+		for {
+			buf, err := readFrame(r, maxMessageLength)
+			if err != nil {
+				return
+			}
+			if buf == nil {
+				continue
+			}
+			msg, err := parseMessage(buf, len(p.bitfield))
+			if err != nil {
+				continue
+			}
+			if p.processMessage(msg) != nil {
+				return
+			}
+		}
+	})
+}
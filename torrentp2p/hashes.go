@@ -0,0 +1,85 @@
+package torrentp2p
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// hashRequest is the header shared by the BEP 52 hash request, hashes and
+// hash reject messages
+type hashRequest struct {
+	piecesRoot  [32]byte
+	baseLayer   uint32
+	index       uint32
+	length      uint32
+	proofLayers uint32
+}
+
+const hashRequestSize = 48
+
+func unmarshallHashRequest(payload []byte) (*hashRequest, error) {
+	if len(payload) < hashRequestSize {
+		return nil, errors.New("Hash message too short")
+	}
+	req := &hashRequest{
+		baseLayer:   binary.BigEndian.Uint32(payload[32:36]),
+		index:       binary.BigEndian.Uint32(payload[36:40]),
+		length:      binary.BigEndian.Uint32(payload[40:44]),
+		proofLayers: binary.BigEndian.Uint32(payload[44:48]),
+	}
+	copy(req.piecesRoot[:], payload[0:32])
+	return req, nil
+}
+
+func (req *hashRequest) marshall(hashes [][32]byte) []byte {
+	buf := make([]byte, hashRequestSize, hashRequestSize+32*len(hashes))
+	copy(buf[0:32], req.piecesRoot[:])
+	binary.BigEndian.PutUint32(buf[32:36], req.baseLayer)
+	binary.BigEndian.PutUint32(buf[36:40], req.index)
+	binary.BigEndian.PutUint32(buf[40:44], req.length)
+	binary.BigEndian.PutUint32(buf[44:48], req.proofLayers)
+	for _, h := range hashes {
+		buf = append(buf, h[:]...)
+	}
+	return buf
+}
+
+// processHashRequest answers with the requested piece layer hashes, or with a
+// hash reject if they are not available
+func (p *Peer) processHashRequest(payload []byte) error {
+	req, err := unmarshallHashRequest(payload)
+	if err != nil {
+		return err
+	}
+	p.log.Debug("HASH REQUEST", "root", hex.EncodeToString(req.piecesRoot[:]), "layer", req.baseLayer, "index", req.index, "length", req.length)
+
+	hashes, proof, err := p.torrent.Hashes(req.piecesRoot, int(req.baseLayer), int(req.index), int(req.length), int(req.proofLayers))
+	if err != nil {
+		return p.sendMessage(HASH_REJECT, req.marshall(nil))
+	}
+	return p.sendMessage(HASHES, req.marshall(append(hashes, proof...)))
+}
+
+// processHashes checks the hashes sent by the peer against the pieces root
+func (p *Peer) processHashes(payload []byte) error {
+	req, err := unmarshallHashRequest(payload)
+	if err != nil {
+		return err
+	}
+	data := payload[hashRequestSize:]
+	if len(data)%32 != 0 || uint32(len(data)/32) < req.length {
+		return errors.New("Invalid hashes message")
+	}
+
+	hashes := make([][32]byte, len(data)/32)
+	for i := range hashes {
+		copy(hashes[i][:], data[i*32:])
+	}
+	err = p.torrent.CheckHashes(req.piecesRoot, int(req.baseLayer), int(req.index), hashes[:req.length], hashes[req.length:])
+	if err != nil {
+		return err
+	}
+	p.log.Debug("HASHES verified", "root", hex.EncodeToString(req.piecesRoot[:]), "layer", req.baseLayer, "index", req.index, "length", req.length)
+	return nil
+}
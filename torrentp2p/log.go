@@ -0,0 +1,24 @@
+package torrentp2p
+
+import (
+	"encoding/hex"
+	"strconv"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+)
+
+// SetLogger sets the logger of the download, that discards the messages
+// until then. Its messages get the info hash of the torrent, and the ones of
+// the peers their address.
+func (down *Downloader) SetLogger(l logging.Logger) {
+	down.log = logging.With(l, "infohash", hex.EncodeToString(down.torrent.InfoHash[:]))
+}
+
+// peerLogger returns the logger of a connection
+func (p *Peer) peerLogger() logging.Logger {
+	var l logging.Logger = logging.Discard
+	if p.down != nil {
+		l = p.down.log
+	}
+	return logging.With(l, "peer", p.host.IP.String()+":"+strconv.Itoa(int(p.host.Port)))
+}
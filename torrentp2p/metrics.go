@@ -0,0 +1,45 @@
+package torrentp2p
+
+import "github.com/vaguilera/MiniTorrent/metrics"
+
+// Metrics of every download of the process, exported by metrics.Default
+var (
+	bytesDownloaded = metrics.Default.NewCounter("minitorrent_downloaded_bytes_total",
+		"Bytes received from peers and web seeds.")
+	bytesUploaded = metrics.Default.NewCounter("minitorrent_uploaded_bytes_total",
+		"Bytes sent to peers.")
+	piecesVerified = metrics.Default.NewCounter("minitorrent_pieces_verified_total",
+		"Pieces that passed the hash check and were written to disk.")
+	piecesFailed = metrics.Default.NewCounter("minitorrent_pieces_failed_total",
+		"Pieces that failed the hash check.")
+	activePeers = metrics.Default.NewGauge("minitorrent_peers_active",
+		"Open peer connections.")
+	peerConnections = metrics.Default.NewCounterVec("minitorrent_peer_connections_total",
+		"Peer connection attempts by outcome.", "outcome")
+	announceLatency = metrics.Default.NewHistogramVec("minitorrent_tracker_announce_seconds",
+		"Latency of the tracker announces.", metrics.DefaultBuckets, "tracker")
+	announceErrors = metrics.Default.NewCounterVec("minitorrent_tracker_announce_errors_total",
+		"Tracker announces that failed.", "tracker")
+	diskWriteLatency = metrics.Default.NewHistogram("minitorrent_disk_write_seconds",
+		"Latency of the piece writes to disk.", metrics.DefaultBuckets)
+)
+
+// Outcomes of the connections to peers, besides the PEER_* failures
+const (
+	outcomeConnected = "connected"
+	outcomeIncoming  = "incoming"
+)
+
+// peerOutcomes are the labels of the failed peer statuses
+var peerOutcomes = map[int]string{
+	PEER_DOWN:         "down",
+	PEER_NOINFOHASH:   "noinfohash",
+	PEER_NOPIECES:     "nopieces",
+	PEER_NOENCRYPTION: "noencryption",
+	PEER_VIOLATION:    "violation",
+}
+
+// peerOutcome counts a connection that ended with status
+func peerOutcome(status int) {
+	peerConnections.With(peerOutcomes[status]).Inc()
+}
@@ -0,0 +1,386 @@
+package torrentp2p
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+// Encryption modes of the peer connections, that use Message Stream
+// Encryption (MSE) to get past the throttling of plaintext BitTorrent
+const (
+	ENCRYPTION_PREFER  = iota // encrypt if the peer supports it
+	ENCRYPTION_REQUIRE        // only RC4 encrypted connections
+	ENCRYPTION_DISABLE        // only plaintext connections
+)
+
+var encryptionNames = []string{"prefer", "require", "disable"}
+
+// EncryptionName returns the name of an encryption mode
+func EncryptionName(mode int) string {
+	if mode < 0 || mode >= len(encryptionNames) {
+		return "unknown"
+	}
+	return encryptionNames[mode]
+}
+
+// ParseEncryption returns the encryption mode of a name returned by
+// EncryptionName
+func ParseEncryption(name string) (int, error) {
+	for i, n := range encryptionNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, errors.New("Unknown encryption mode: " + name)
+}
+
+// crypto_provide and crypto_select bits
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// maxPad is the longest padding of the handshake
+const maxPad = 512
+
+// dhPrime is the 768 bit prime of the key exchange, whose generator is 2
+var dhPrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+var dhGenerator = big.NewInt(2)
+
+var errMSEHandshake = errors.New("MSE handshake failed")
+
+// mseRandom is the source of the keys and padding of the handshakes
+var mseRandom io.Reader = rand.Reader
+
+// SetEncryption sets the ENCRYPTION_* mode of the connections to peers. It
+// must be called before Run.
+func (down *Downloader) SetEncryption(mode int) {
+	down.encryption = mode
+}
+
+// mseConn is a peer connection after the MSE handshake. Its payload is RC4
+// encrypted, unless plaintext was selected.
+type mseConn struct {
+	net.Conn
+	r   io.Reader   // the rest of the handshake reader, decrypted
+	mu  sync.Mutex  // guards enc
+	enc *rc4.Cipher // nil if plaintext
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// isEncrypted reports whether a connection is RC4 encrypted
+func isEncrypted(conn net.Conn) bool {
+	c, ok := conn.(*mseConn)
+	return ok && c.enc != nil
+}
+
+// cipherReader decrypts what it reads
+type cipherReader struct {
+	r io.Reader
+	c *rc4.Cipher
+}
+
+func (cr cipherReader) Read(b []byte) (int, error) {
+	n, err := cr.r.Read(b)
+	cr.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func mseHash(parts ...[]byte) [20]byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	var sum [20]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// pad96 returns n as 96 big endian bytes
+func pad96(n *big.Int) []byte {
+	buf := make([]byte, 96)
+	b := n.Bytes()
+	copy(buf[96-len(b):], b)
+	return buf
+}
+
+// newDHKey returns a random 160 bit private key and its public key
+func newDHKey(random io.Reader) (*big.Int, []byte, error) {
+	x := make([]byte, 20)
+	if _, err := io.ReadFull(random, x); err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(x)
+	return private, pad96(new(big.Int).Exp(dhGenerator, private, dhPrime)), nil
+}
+
+// sharedSecret returns S from our private key and the public key of the peer
+func sharedSecret(private *big.Int, public []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(public)
+	max := new(big.Int).Sub(dhPrime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		return nil, errors.New("Invalid MSE public key")
+	}
+	return pad96(new(big.Int).Exp(y, private, dhPrime)), nil
+}
+
+// randomPad returns 0 to maxPad random bytes
+func randomPad(random io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(random, length[:]); err != nil {
+		return nil, err
+	}
+	pad := make([]byte, int(binary.BigEndian.Uint16(length[:]))%(maxPad+1))
+	_, err := io.ReadFull(random, pad)
+	return pad, err
+}
+
+// newRC4 returns the cipher of key ("keyA" or "keyB") with the first 1024
+// bytes of the stream discarded
+func newRC4(key string, secret []byte, skey [20]byte) *rc4.Cipher {
+	h := mseHash([]byte(key), secret, skey[:])
+	c, _ := rc4.NewCipher(h[:])
+	var discard [1024]byte
+	c.XORKeyStream(discard[:], discard[:])
+	return c
+}
+
+// synchronize reads until pattern, that can follow up to maxPad bytes of
+// padding
+func synchronize(r io.ByteReader, pattern []byte) error {
+	window := make([]byte, 0, maxPad+len(pattern))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errMSEHandshake
+}
+
+// readDecrypted reads n bytes of the handshake and decrypts them
+func readDecrypted(r io.Reader, dec *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	dec.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// mseProvide returns the crypto methods we offer in a mode
+func mseProvide(mode int) uint32 {
+	if mode == ENCRYPTION_REQUIRE {
+		return cryptoRC4
+	}
+	return cryptoRC4 | cryptoPlaintext
+}
+
+// mseSelect picks one of the crypto methods offered by a peer, RC4 if
+// possible
+func mseSelect(provide uint32, mode int) uint32 {
+	switch {
+	case provide&cryptoRC4 != 0:
+		return cryptoRC4
+	case provide&cryptoPlaintext != 0 && mode != ENCRYPTION_REQUIRE:
+		return cryptoPlaintext
+	}
+	return 0
+}
+
+// mseInitiate runs the handshake as the side that opened conn, for the
+// torrent of infoHash. It offers the methods of provide and sends ia as
+// initial payload.
+func mseInitiate(conn net.Conn, random io.Reader, infoHash [20]byte, provide uint32, ia []byte) (*mseConn, error) {
+	private, public, err := newDHKey(random)
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPad(random)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, padA...)); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	yb := make([]byte, 96)
+	if _, err := io.ReadFull(r, yb); err != nil {
+		return nil, err
+	}
+	secret, err := sharedSecret(private, yb)
+	if err != nil {
+		return nil, err
+	}
+	enc := newRC4("keyA", secret, infoHash)
+	dec := newRC4("keyB", secret, infoHash)
+
+	req1 := mseHash([]byte("req1"), secret)
+	req2 := mseHash([]byte("req2"), infoHash[:])
+	req3 := mseHash([]byte("req3"), secret)
+	msg := append([]byte{}, req1[:]...)
+	for i := range req2 {
+		msg = append(msg, req2[i]^req3[i])
+	}
+	// VC, crypto_provide, len(PadC) with no PadC, len(IA), IA
+	plain := make([]byte, 16+len(ia))
+	binary.BigEndian.PutUint32(plain[8:12], provide)
+	binary.BigEndian.PutUint16(plain[14:16], uint16(len(ia)))
+	copy(plain[16:], ia)
+	enc.XORKeyStream(plain, plain)
+	if _, err := conn.Write(append(msg, plain...)); err != nil {
+		return nil, err
+	}
+
+	// the encrypted VC of the peer comes after PadB
+	vc := make([]byte, 8)
+	dec.XORKeyStream(vc, vc)
+	if err := synchronize(r, vc); err != nil {
+		return nil, err
+	}
+	buf, err := readDecrypted(r, dec, 6)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(buf[0:4])
+	if selected != cryptoRC4 && selected != cryptoPlaintext || selected&provide == 0 {
+		return nil, errors.New("Invalid MSE crypto_select")
+	}
+	padD := int(binary.BigEndian.Uint16(buf[4:6]))
+	if padD > maxPad {
+		return nil, errMSEHandshake
+	}
+	if _, err := readDecrypted(r, dec, padD); err != nil {
+		return nil, err
+	}
+
+	c := &mseConn{Conn: conn, r: r}
+	if selected == cryptoRC4 {
+		c.r = cipherReader{r, dec}
+		c.enc = enc
+	}
+	return c, nil
+}
+
+// mseAccept runs the handshake as the side that accepted conn, whose first
+// bytes are buffered in r. skey returns the info hash whose
+// HASH('req2', info hash) is req2, if it is one of our torrents.
+func mseAccept(conn net.Conn, r *bufio.Reader, random io.Reader, skey func(req2 [20]byte) ([20]byte, bool), mode int) (*mseConn, [20]byte, error) {
+	var infoHash [20]byte
+	ya := make([]byte, 96)
+	if _, err := io.ReadFull(r, ya); err != nil {
+		return nil, infoHash, err
+	}
+	private, public, err := newDHKey(random)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	padB, err := randomPad(random)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	if _, err := conn.Write(append(public, padB...)); err != nil {
+		return nil, infoHash, err
+	}
+	secret, err := sharedSecret(private, ya)
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	// HASH('req1', S) comes after PadA
+	req1 := mseHash([]byte("req1"), secret)
+	if err := synchronize(r, req1[:]); err != nil {
+		return nil, infoHash, err
+	}
+	var req2 [20]byte
+	if _, err := io.ReadFull(r, req2[:]); err != nil {
+		return nil, infoHash, err
+	}
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	infoHash, ok := skey(req2)
+	if !ok {
+		return nil, infoHash, errors.New("MSE handshake for unknown torrent")
+	}
+	dec := newRC4("keyA", secret, infoHash)
+	enc := newRC4("keyB", secret, infoHash)
+
+	buf, err := readDecrypted(r, dec, 14)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	if !bytes.Equal(buf[0:8], make([]byte, 8)) {
+		return nil, infoHash, errMSEHandshake
+	}
+	provide := binary.BigEndian.Uint32(buf[8:12])
+	padC := int(binary.BigEndian.Uint16(buf[12:14]))
+	if padC > maxPad {
+		return nil, infoHash, errMSEHandshake
+	}
+	if _, err := readDecrypted(r, dec, padC); err != nil {
+		return nil, infoHash, err
+	}
+	buf, err = readDecrypted(r, dec, 2)
+	if err != nil {
+		return nil, infoHash, err
+	}
+	ia, err := readDecrypted(r, dec, int(binary.BigEndian.Uint16(buf)))
+	if err != nil {
+		return nil, infoHash, err
+	}
+
+	selected := mseSelect(provide, mode)
+	if selected == 0 {
+		return nil, infoHash, errors.New("No MSE crypto method in common")
+	}
+	// VC, crypto_select, len(PadD) with no PadD
+	plain := make([]byte, 14)
+	binary.BigEndian.PutUint32(plain[8:12], selected)
+	enc.XORKeyStream(plain, plain)
+	if _, err := conn.Write(plain); err != nil {
+		return nil, infoHash, err
+	}
+
+	c := &mseConn{Conn: conn}
+	var payload io.Reader = r
+	if selected == cryptoRC4 {
+		payload = cipherReader{r, dec}
+		c.enc = enc
+	}
+	c.r = io.MultiReader(bytes.NewReader(ia), payload)
+	return c, infoHash, nil
+}
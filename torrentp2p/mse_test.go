@@ -0,0 +1,224 @@
+package torrentp2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// mseVector is a handshake written by testdata/mse/gen, an implementation
+// of MSE that follows the specification and shares no code with this one.
+// The random streams hold the private key, the length of the padding and
+// the padding of each side, in the order they are read from mseRandom.
+type mseVector struct {
+	Name         string `json:"name"`
+	InfoHash     string `json:"info_hash"`
+	RandomA      string `json:"random_a"`
+	RandomB      string `json:"random_b"`
+	Provide      uint32 `json:"provide"`
+	Select       uint32 `json:"select"`
+	IA           string `json:"ia"`
+	PayloadA     string `json:"payload_a"`
+	PayloadB     string `json:"payload_b"`
+	InitiatorOut string `json:"initiator_out"`
+	ReceiverOut  string `json:"receiver_out"`
+}
+
+func loadMSEVectors(t *testing.T) []mseVector {
+	names, err := filepath.Glob(filepath.Join("testdata", "mse", "*.json"))
+	if err != nil || len(names) == 0 {
+		t.Fatalf("No vectors: %v", err)
+	}
+	var vectors []mseVector
+	for _, name := range names {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v mseVector
+		if err := json.Unmarshal(data, &v); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		vectors = append(vectors, v)
+	}
+	return vectors
+}
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// scriptedConn reads what the other side of a recorded handshake sent and
+// keeps what is written to it
+type scriptedConn struct {
+	net.Conn
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+func (c *scriptedConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+func Test_mseInitiateVectors(t *testing.T) {
+	for _, v := range loadMSEVectors(t) {
+		var infoHash [20]byte
+		copy(infoHash[:], unhex(t, v.InfoHash))
+		conn := &scriptedConn{in: bytes.NewReader(unhex(t, v.ReceiverOut))}
+		c, err := mseInitiate(conn, bytes.NewReader(unhex(t, v.RandomA)), infoHash, v.Provide, unhex(t, v.IA))
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+		if isEncrypted(c) != (v.Select == cryptoRC4) {
+			t.Errorf("%s: expected crypto_select %d", v.Name, v.Select)
+		}
+		c.Write(unhex(t, v.PayloadA))
+		if out := hex.EncodeToString(conn.out.Bytes()); out != v.InitiatorOut {
+			t.Errorf("%s: sent %s", v.Name, out)
+		}
+		payload, _ := ioutil.ReadAll(c)
+		if !bytes.Equal(payload, unhex(t, v.PayloadB)) {
+			t.Errorf("%s: received %x", v.Name, payload)
+		}
+	}
+}
+
+func Test_mseAcceptVectors(t *testing.T) {
+	for _, v := range loadMSEVectors(t) {
+		var want [20]byte
+		copy(want[:], unhex(t, v.InfoHash))
+		skey := func(req2 [20]byte) ([20]byte, bool) {
+			return want, mseHash([]byte("req2"), want[:]) == req2
+		}
+		conn := &scriptedConn{in: bytes.NewReader(unhex(t, v.InitiatorOut))}
+		c, infoHash, err := mseAccept(conn, bufio.NewReader(conn), bytes.NewReader(unhex(t, v.RandomB)), skey, ENCRYPTION_PREFER)
+		if err != nil {
+			t.Errorf("%s: %s", v.Name, err)
+			continue
+		}
+		if infoHash != want {
+			t.Errorf("%s: got info hash %x", v.Name, infoHash)
+		}
+		c.Write(unhex(t, v.PayloadB))
+		if out := hex.EncodeToString(conn.out.Bytes()); out != v.ReceiverOut {
+			t.Errorf("%s: sent %s", v.Name, out)
+		}
+		// IA comes first
+		payload, _ := ioutil.ReadAll(c)
+		if want := append(unhex(t, v.IA), unhex(t, v.PayloadA)...); !bytes.Equal(payload, want) {
+			t.Errorf("%s: received %x", v.Name, payload)
+		}
+	}
+}
+
+func Test_mseHandshake(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	skey := func(req2 [20]byte) ([20]byte, bool) {
+		return infoHash, mseHash([]byte("req2"), infoHash[:]) == req2
+	}
+	tests := []struct {
+		initiator, receiver int
+		encrypted           bool
+	}{
+		{ENCRYPTION_PREFER, ENCRYPTION_PREFER, true},
+		{ENCRYPTION_REQUIRE, ENCRYPTION_PREFER, true},
+		{ENCRYPTION_PREFER, ENCRYPTION_REQUIRE, true},
+	}
+	for _, test := range tests {
+		a, b := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			c, _, err := mseAccept(b, bufio.NewReader(b), mseRandom, skey, test.receiver)
+			if err == nil {
+				buf := make([]byte, 5)
+				if _, err = io.ReadFull(c, buf); err == nil {
+					_, err = c.Write(bytes.ToUpper(buf))
+				}
+			}
+			b.Close()
+			done <- err
+		}()
+		c, err := mseInitiate(a, mseRandom, infoHash, mseProvide(test.initiator), []byte("hel"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isEncrypted(c) != test.encrypted {
+			t.Errorf("%v: encrypted %v", test, isEncrypted(c))
+		}
+		c.Write([]byte("lo"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "HELLO" {
+			t.Errorf("%v: got %q %v", test, buf, err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("%v: %s", test, err)
+		}
+		a.Close()
+	}
+
+	// a receiver that requires encryption refuses plaintext
+	a, b := net.Pipe()
+	go mseInitiate(a, mseRandom, infoHash, cryptoPlaintext, nil)
+	if _, _, err := mseAccept(b, bufio.NewReader(b), mseRandom, skey, ENCRYPTION_REQUIRE); err == nil {
+		t.Error("Plaintext accepted in require mode")
+	}
+	a.Close()
+	b.Close()
+
+	// and the torrent must be one of ours
+	a, b = net.Pipe()
+	go mseInitiate(a, mseRandom, [20]byte{9}, cryptoRC4, nil)
+	if _, _, err := mseAccept(b, bufio.NewReader(b), mseRandom, skey, ENCRYPTION_PREFER); err == nil {
+		t.Error("Handshake for an unknown torrent accepted")
+	}
+	a.Close()
+	b.Close()
+}
+
+func Test_synchronize(t *testing.T) {
+	pattern := []byte("pattern")
+	pad := make([]byte, maxPad)
+	r := bufio.NewReader(bytes.NewReader(append(pad, pattern...)))
+	if err := synchronize(r, pattern); err != nil {
+		t.Error(err)
+	}
+	r = bufio.NewReader(bytes.NewReader(append(append(pad, 0), pattern...)))
+	if err := synchronize(r, pattern); err == nil {
+		t.Error("Expected error with a padding too long")
+	}
+}
+
+func Test_ParseEncryption(t *testing.T) {
+	for mode := ENCRYPTION_PREFER; mode <= ENCRYPTION_DISABLE; mode++ {
+		if got, err := ParseEncryption(EncryptionName(mode)); err != nil || got != mode {
+			t.Errorf("%s: got %d %v", EncryptionName(mode), got, err)
+		}
+	}
+	if _, err := ParseEncryption("always"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func Test_SessionEncryption(t *testing.T) {
+	// encrypted both ways
+	testUpload(t, SessionConfig{Encryption: ENCRYPTION_REQUIRE}, SessionConfig{Encryption: ENCRYPTION_REQUIRE})
+	// the seeder falls back to an incoming plaintext connection
+	testUpload(t, SessionConfig{}, SessionConfig{Encryption: ENCRYPTION_DISABLE})
+	// the leecher redials in plaintext
+	testUpload(t, SessionConfig{Encryption: ENCRYPTION_DISABLE}, SessionConfig{})
+}
@@ -1,17 +1,17 @@
 package torrentp2p
 
 import (
-	"bytes"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
 	"errors"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/vaguilera/MiniTorrent/logging"
 	"github.com/vaguilera/MiniTorrent/torrentfile"
 	"github.com/vaguilera/MiniTorrent/tracker"
 )
@@ -28,6 +28,27 @@ const (
 	CANCEL
 	PORT      // Not implemented. For DHT support.
 	EXTENSION = 20
+
+	// BEP 52 messages to exchange v2 merkle hashes
+	HASH_REQUEST = 21
+	HASHES       = 22
+	HASH_REJECT  = 23
+
+	// BEP 6 Fast Extension messages
+	SUGGEST_PIECE  = 13
+	HAVE_ALL       = 14
+	HAVE_NONE      = 15
+	REJECT_REQUEST = 16
+	ALLOWED_FAST   = 17
+)
+
+// states of the connection to a peer
+const (
+	stateBitfield    = iota // waiting for the pieces the peer has
+	stateChoked             // waiting for the peer to unchoke us or to have a piece
+	statePick               // picking the next piece
+	stateDownloading        // requesting the blocks of the current piece
+	stateSeeding            // nothing to download for now, uploading to the peer
 )
 
 type handshakeP struct {
@@ -49,21 +70,48 @@ type Peer struct {
 	bytesReq         uint32
 	currentPieceSize uint32
 	bitfield         []byte
-	peersQueue       chan tracker.Peer
 	resultsChan      chan StPieceResult
 	bitFieldRecv     bool
 	currentInfoPiece StPiece
 	pieceLength      uint32
-	status           byte
+	state            int             // state* of the connection
+	down             *Downloader     // source of the blocks we upload, nil if we don't seed
+	done             <-chan struct{} // closed to stop the peer
+	complete         <-chan struct{} // closed once the download is complete
+	slots            chan struct{}   // shared connection slots, nil if unlimited
+	amChoking        bool
+	peerInterested   bool
+	numPieces        int // pieces the peer has
+	amInterested     bool
+	incoming         bool
+	peerID           [20]byte
+	stats            *peerStats // stats of the current connection
+	log              logging.Logger
+	writeMu          sync.Mutex            // the uploads are sent from their own goroutine
+	limits           bandwidth             // of this peer alone
+	uploads          chan [12]byte         // requests waiting for upload bandwidth
+	fast             bool                  // both sides support the Fast Extension
+	allowedFast      map[int]bool          // pieces we may download while choked
+	suggested        []int                 // pieces the peer suggests, picked first
+	rejected         map[int]bool          // pieces the peer rejected since it unchoked us
+	dropPiece        bool                  // the current piece can't be downloaded from the peer anymore
+	ourAllowedFast   map[int]bool          // pieces the peer may download while we choke it
+	outstanding      map[blockRequest]bool // blocks of the current piece requested
+	abandoned        map[blockRequest]bool // blocks requested of pieces we gave up
+	gotMessage       bool                  // a message was received after the handshake
+	lastWrite        time.Time             // guarded by writeMu
+	lastBlock        time.Time             // when the current piece last progressed
 }
 
-func NewPeer(torrent *torrentfile.Torrent, peersQueue chan tracker.Peer, results chan StPieceResult) *Peer {
+func NewPeer(torrent *torrentfile.Torrent, results chan StPieceResult) *Peer {
 	p := &Peer{
 		chocked:     true,
+		amChoking:   true,
 		torrent:     torrent,
-		bitfield:    make([]byte, len(torrent.PieceHashes)),
-		peersQueue:  peersQueue,
+		bitfield:    make([]byte, torrent.NumPieces()),
 		resultsChan: results,
+		stats:       &peerStats{},
+		log:         logging.Discard,
 	}
 	p.currentPieceData = make([]byte, torrent.PieceLength)
 	return p
@@ -89,6 +137,9 @@ func (p *Peer) sendUint32(n uint32) (err error) {
 }
 
 func (p *Peer) sendMessage(messageID byte, payload []byte) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.lastWrite = time.Now()
 
 	var buf []byte
 
@@ -99,27 +150,49 @@ func (p *Peer) sendMessage(messageID byte, payload []byte) error {
 		buf = make([]byte, l)
 		buf[0] = messageID
 		copy(buf[1:], payload)
-		p.sendUint32(l)
+		if err := p.sendUint32(l); err != nil {
+			return err
+		}
 	}
 	_, err := p.conn.Write(buf)
 	return err
 }
 
-func (p *Peer) processBlock(payload []byte) {
-	//piece := binary.BigEndian.Uint32(payload[0:4])
+// processBlock stores a block of the current piece. Only the blocks we
+// requested are accepted, the late ones of a piece we gave up are dropped.
+func (p *Peer) processBlock(payload []byte) error {
+	piece := binary.BigEndian.Uint32(payload[0:4])
 	offset := binary.BigEndian.Uint32(payload[4:8])
 	data := payload[8:]
+	request := newBlockRequest(piece, offset, uint32(len(data)))
+	if p.abandoned[request] {
+		delete(p.abandoned, request)
+		if p.down != nil {
+			p.down.addWasted(len(data))
+		}
+		return nil
+	}
+	if !p.outstanding[request] {
+		return protocolError("Block not requested")
+	}
+	delete(p.outstanding, request)
 	copy(p.currentPieceData[offset:], data)
 	p.bytesRcvd += uint32(len(data))
-
+	p.lastBlock = time.Now()
+	p.stats.download.add(len(data))
+	bytesDownloaded.Add(float64(len(data)))
+	if p.down != nil {
+		p.down.downloadRate.add(len(data))
+	}
+	return nil
 }
 
 func (p *Peer) sendPieceRequest() error {
 	var payload [12]byte
 	var err error
 
-	blocksize := uint32(0x4000)
-	if (p.bytesReq + 0x4000) > p.currentPieceSize {
+	blocksize := uint32(blockSize)
+	if (p.bytesReq + blockSize) > p.currentPieceSize {
 		blocksize = p.currentPieceSize - p.bytesReq
 	}
 
@@ -130,6 +203,7 @@ func (p *Peer) sendPieceRequest() error {
 	if err != nil {
 		return err
 	}
+	p.outstanding[blockRequest(payload)] = true
 	p.bytesReq += blocksize
 	return nil
 }
@@ -144,7 +218,7 @@ out:
 		for bitmask >= 1 {
 			cbit := (cbyte & bitmask)
 			if cbit > 0 {
-				p.bitfield[pos] = 1
+				p.havePiece(pos)
 			}
 			pos++
 			if pos == len(p.bitfield) {
@@ -157,133 +231,293 @@ out:
 	p.bitFieldRecv = true
 }
 
+// havePiece records that the peer has a piece
+func (p *Peer) havePiece(piece int) {
+	if p.bitfield[piece] == 1 {
+		return
+	}
+	p.bitfield[piece] = 1
+	p.numPieces++
+	if p.down != nil {
+		p.down.peerHas(piece)
+	}
+}
+
+// processMessage handles a message parsed by parseMessage. It returns a
+// protocolError if the message isn't allowed in the state of the connection.
 func (p *Peer) processMessage(msg Message) error {
+	first := !p.gotMessage
+	p.gotMessage = true
+	if first && msg.ID != BITFIELD && msg.ID != HAVE_ALL && msg.ID != HAVE_NONE {
+		// peers without pieces may skip the BITFIELD
+		p.bitFieldRecv = true
+		p.gotBitfield()
+	}
 
-	strHost := p.host.IP.String()
 	switch msg.ID {
 
 	case CHOKE:
-		log.Printf("(%s) CHOKE\n", strHost)
+		p.log.Debug("CHOKE")
 		p.chocked = true
+		if p.state == stateDownloading && !p.fast {
+			// our requests are dropped, the peer rejects them otherwise
+			p.dropPiece = true
+		}
 	case UNCHOKE:
-		log.Printf("(%s) UNCHOKE\n", strHost)
+		p.log.Debug("UNCHOKE")
 		p.chocked = false
-		if p.status == 1 {
-			p.status = 2
+		p.rejected = make(map[int]bool)
+		if (p.state == stateChoked || p.state == stateSeeding) && p.numPieces > 0 {
+			p.state = statePick
 		}
 	case HAVE:
 		piece := binary.BigEndian.Uint32(msg.Payload)
-		log.Printf("(%s) HAVE %d\n", strHost, piece)
-		p.bitfield[piece] = 1
+		p.log.Debug("HAVE", "piece", piece)
+		if int(piece) >= len(p.bitfield) {
+			return protocolError("Piece out of range in message HAVE")
+		}
+		p.havePiece(int(piece))
+		if (p.state == stateChoked || p.state == stateSeeding) && !p.chocked {
+			p.state = statePick
+		}
 	case BITFIELD:
-		log.Printf("(%s) BITFIELD\n", strHost)
-		if p.status > 0 {
-			return errors.New("(%s) BITFIELD received but not as first message")
+		p.log.Debug("BITFIELD")
+		if !first {
+			return protocolError("BITFIELD received but not as first message")
 		}
 		p.setBitField(msg.Payload)
-		p.status = 1
-		if p.chocked {
-			log.Printf("(%s) Sending UNCHOKE\n", strHost)
-			p.sendMessage(UNCHOKE, nil)
-			p.sendMessage(INTERESTED, nil)
-		}
+		p.gotBitfield()
 
 	case INTERESTED:
-		log.Printf("(%s) INTERESTED\n", strHost)
+		p.log.Debug("INTERESTED")
+		p.peerInterested = true
+		if p.amChoking && p.down != nil {
+			p.amChoking = false
+			return p.sendMessage(UNCHOKE, nil)
+		}
 	case NOT_INTERESTED:
-		log.Printf("(%s) NOT INTERESTED\n", strHost)
+		p.log.Debug("NOT INTERESTED")
+		p.peerInterested = false
+	case REQUEST:
+		return p.processRequest(msg.Payload)
+	case HASH_REQUEST:
+		return p.processHashRequest(msg.Payload)
+	case HASHES:
+		return p.processHashes(msg.Payload)
+	case HASH_REJECT:
+		p.log.Debug("HASH REJECT")
+	case SUGGEST_PIECE, HAVE_ALL, HAVE_NONE, REJECT_REQUEST, ALLOWED_FAST:
+		return p.processFastMessage(msg, first)
 	case PIECE:
-		p.processBlock(msg.Payload)
-		if (p.bytesReq < p.currentPieceSize) && (p.chocked == false) {
-			return p.sendPieceRequest()
+		if err := p.processBlock(msg.Payload); err != nil {
+			return err
+		}
+		if p.state == stateDownloading && (!p.chocked || p.allowedFast[int(p.currentPieceNum)]) {
+			return p.requestBlocks()
 		}
 	default:
-		log.Printf("Undefined or unexpected message %d - %v\n", msg.ID, msg.Payload)
+		p.log.Debug("Undefined or unexpected message", "id", msg.ID, "length", len(msg.Payload))
 	}
 	return nil
 }
 
-func (p *Peer) readMessage(msgQueue chan<- Message, out chan<- struct{}) {
-
+// readMessage reads the messages of the peer and passes them to msgQueue
+// until quit is closed. It sends the error that ends the connection to out:
+// a read failure, a timeout or a protocolError.
+func (p *Peer) readMessage(conn net.Conn, log logging.Logger, msgQueue chan<- Message, out chan<- error, quit <-chan struct{}) {
+	limit := p.downloadLimiters()
+	maxLength := p.maxMessageLength()
 	for {
-		lengthBuf := make([]byte, 4)
-		_, err := io.ReadFull(p.conn, lengthBuf)
+		conn.SetReadDeadline(time.Now().Add(peerTimeout))
+		buf, err := readFrame(conn, maxLength)
 		if err != nil {
-			log.Printf("Error reading from peer: %s\n", err)
-			close(out)
+			log.Debug("Error reading from peer", "err", err)
+			out <- err
 			return
 		}
+		if buf == nil {
+			log.Debug("Keep alive message")
+			continue
+		}
 
-		lengthM := binary.BigEndian.Uint32(lengthBuf)
-		if lengthM == 0 {
-			log.Printf("(%s) Keep alive message\n", p.host.IP.String())
-			return
+		// only blocks wait for bandwidth, control messages are just counted.
+		// Not reading the socket meanwhile slows down the peer.
+		if buf[0] == PIECE {
+			if !limit.wait(4+len(buf), quit) {
+				return
+			}
+		} else {
+			limit.charge(4 + len(buf))
 		}
-		messageBuf := make([]byte, lengthM)
 
-		_, err = io.ReadFull(p.conn, messageBuf)
+		msg, err := parseMessage(buf, len(p.bitfield))
 		if err != nil {
-			log.Printf("Error reading from peer: %s\n", err)
-			close(out)
+			out <- err
 			return
 		}
-
-		msgQueue <- Message{
-			ID:      messageBuf[0],
-			Payload: messageBuf[1:],
+		select {
+		case msgQueue <- msg:
+		case <-quit:
+			return
 		}
 	}
-
 }
 
-func (p *Peer) connectPeer(infoHash [20]byte) error {
+// handshake returns our handshake message for the swarm of infoHash
+func (p *Peer) handshake(infoHash [20]byte) []byte {
 	handshake := handshakeP{
 		ptrLength: byte(19),
 		infoHash:  infoHash,
 	}
 
-	strHost := p.host.IP.String()
 	copy(handshake.protocol[:], "BitTorrent protocol")
+	if p.torrent.IsV2() {
+		handshake.reserved[7] |= 0x10
+	}
+	handshake.reserved[7] |= fastBit
 	copy(handshake.peerID[:], "-SHOToTorrent-0.1---")
 
 	token := make([]byte, 3)
 	rand.Read(token)
 	copy(handshake.peerID[17:], token)
 
-	buf := tracker.StructToBuffer(handshake)
+	return tracker.StructToBuffer(handshake)
+}
+
+// handshakeTimeout bounds the handshakes of the peer connections
+const handshakeTimeout = 20 * time.Second
+
+func (p *Peer) connectPeer(infoHash [20]byte) error {
+	buf := p.handshake(infoHash)
 	host := p.host.IP.String() + ":" + strconv.Itoa(int(p.host.Port))
-	log.Printf("Trying to connect %s...\n", strHost)
-	c, err := net.DialTimeout("tcp", host, 20*time.Second)
+	p.log.Debug("Trying to connect")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer p.onDone(cancel)()
+	c, err := p.dial(ctx, host)
 	if err != nil {
-		log.Printf("Cant connect peer (%s)\n", strHost)
-		p.host.Status = PEER_DOWN
 		return err
 	}
 
-	p.conn = c
-	log.Printf("connected To Peer (%s)\n", strHost)
-	c.Write(buf)
+	mode := p.encryption()
+	if mode != ENCRYPTION_DISABLE {
+		encrypted, err := p.encrypt(c, infoHash, mode)
+		if err == nil {
+			c = encrypted
+		} else {
+			c.Close()
+			if mode == ENCRYPTION_REQUIRE {
+				p.log.Debug("MSE handshake failed", "err", err)
+				p.host.Status = PEER_NOENCRYPTION
+				peerOutcome(PEER_NOENCRYPTION)
+				return err
+			}
+			// the peer may only speak plaintext
+			p.log.Debug("MSE handshake failed, retrying in plaintext", "err", err)
+			if c, err = p.dialTransport(ctx, transportOf(c), host); err != nil {
+				p.log.Debug("Can't connect peer", "err", err)
+				p.host.Status = PEER_DOWN
+				peerOutcome(PEER_DOWN)
+				return err
+			}
+		}
+	}
 
+	p.conn = c
+	p.log.Debug("Connected to peer", "transport", transportOf(c), "encrypted", isEncrypted(c))
+	defer p.onDone(func() { c.Close() })()
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
 	buffer := make([]byte, 68)
-	c.Read(buffer)
+	if _, err = c.Write(buf); err == nil {
+		_, err = io.ReadFull(c, buffer)
+	}
+	if err != nil {
+		p.log.Debug("Handshake failed", "err", err)
+		p.host.Status = PEER_DOWN
+		peerOutcome(PEER_DOWN)
+		c.Close()
+		return err
+	}
 
 	answer := p.unMarshallHandShake(buffer)
+	if answer.ptrLength != 19 || string(answer.protocol[:]) != "BitTorrent protocol" {
+		err = protocolError("Invalid protocol in handshake")
+		p.reportViolation(err)
+		c.Close()
+		return err
+	}
 	if infoHash != answer.infoHash {
-		log.Printf("Invalid Infohash with peer (%s)\n", strHost)
+		p.log.Debug("Invalid infohash in handshake")
 		p.host.Status = PEER_NOINFOHASH
+		peerOutcome(PEER_NOINFOHASH)
 		c.Close()
 		return errors.New("Invalid infoHash in handshake with peer")
 	}
 
-	log.Printf("HandShake received from Peer: %s - %s\n", strHost, answer.peerID)
+	p.peerID = answer.peerID
+	p.fast = answer.reserved[7]&fastBit != 0
+	peerConnections.With(outcomeConnected).Inc()
+	p.log.Debug("Handshake received", "peerid", string(answer.peerID[:]))
 	return nil
 }
 
+// dial connects to the peer over the transports of the policy in order
+func (p *Peer) dial(ctx context.Context, host string) (net.Conn, error) {
+	var err error
+	for _, transport := range p.transports() {
+		var c net.Conn
+		if c, err = p.dialTransport(ctx, transport, host); err == nil {
+			return c, nil
+		}
+		p.log.Debug("Can't connect peer", "transport", transport, "err", err)
+	}
+	p.host.Status = PEER_DOWN
+	peerOutcome(PEER_DOWN)
+	return nil, err
+}
+
+// encrypt runs the MSE handshake on a new connection
+func (p *Peer) encrypt(c net.Conn, infoHash [20]byte, mode int) (net.Conn, error) {
+	defer p.onDone(func() { c.Close() })()
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+	encrypted, err := mseInitiate(c, mseRandom, infoHash, mseProvide(mode), nil)
+	if err != nil {
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// encryption returns the ENCRYPTION_* mode of the connections
+func (p *Peer) encryption() int {
+	if p.down == nil {
+		return ENCRYPTION_PREFER
+	}
+	return p.down.encryption
+}
+
 func (p *Peer) newPiece(piecesList *atomicPieces) *StPiece {
-	piece := piecesList.findPiece(p.bitfield)
+	pickable := p.pickable()
+	var piece *StPiece
+	for piece == nil && len(p.suggested) > 0 {
+		order := p.suggested[0]
+		p.suggested = p.suggested[1:]
+		if pickable[order] == 1 {
+			piece = piecesList.takePiece(order)
+		}
+	}
 	if piece == nil {
-		log.Printf("This peer doesnt have any useful piece")
+		piece = piecesList.findPiece(pickable)
+	}
+	if piece == nil {
+		if p.chocked {
+			// the peer may have more to offer once it unchokes us
+			p.log.Debug("No piece we can download while choked")
+			return nil
+		}
+		p.log.Debug("This peer doesn't have any useful piece")
 		p.host.Status = PEER_NOPIECES
+		peerOutcome(PEER_NOPIECES)
 		return nil
 	}
 
@@ -294,96 +528,366 @@ func (p *Peer) newPiece(piecesList *atomicPieces) *StPiece {
 	p.bytesRcvd = 0
 	p.bytesReq = 0
 	p.currentPieceNum = uint32(piece.Order)
-	log.Printf("(%s) current PIECE %d - size: %d\n", p.host.IP.String(), piece.Order, p.currentPieceSize)
-	for i := 0; i < 5; i++ {
-		p.sendPieceRequest()
-	}
-
-	p.status = 3
+	p.lastBlock = time.Now()
+	p.state = stateDownloading
+	p.log.Debug("Requesting piece", "piece", piece.Order, "size", p.currentPieceSize)
+	p.requestBlocks()
 	return piece
 }
 
-func (p *Peer) checkIntegrity(hash [20]byte) error {
-	h := sha1.New()
-	h.Write(p.currentPieceData[:p.currentPieceSize])
-	sha1Piece := h.Sum(nil)
-	if !bytes.Equal(sha1Piece, hash[:]) {
-		return errors.New("SHA1 Error check")
+var errBadPiece = errors.New("Hash Error check")
+
+func (p *Peer) checkIntegrity() error {
+	if !p.torrent.VerifyPiece(int(p.currentPieceNum), p.currentPieceData[:p.currentPieceSize]) {
+		return errBadPiece
 	}
 	return nil
 }
 
-func (p *Peer) Start(piecesList *atomicPieces) {
+// onDone calls fn if the peer is stopped before the returned function is
+// called
+func (p *Peer) onDone(fn func()) func() {
+	release := make(chan struct{})
+	go func() {
+		select {
+		case <-p.done:
+			fn()
+		case <-release:
+		}
+	}()
+	return func() { close(release) }
+}
+
+func (p *Peer) emit(e Event) {
+	if p.down != nil {
+		p.down.emit(e)
+	}
+}
 
-	var msg Message
+// sendBitfield sends the pieces we have right after the handshake, and the
+// ones the peer may download while we choke it. Without the Fast Extension
+// nothing is sent if we have no pieces.
+func (p *Peer) sendBitfield() error {
+	if p.down == nil {
+		return nil
+	}
+	bitfield := p.down.bitfield()
+	var err error
+	switch {
+	case p.fast && bitfield == nil:
+		err = p.sendMessage(HAVE_NONE, nil)
+	case p.fast && p.down.IsComplete():
+		err = p.sendMessage(HAVE_ALL, nil)
+	case bitfield != nil:
+		err = p.sendMessage(BITFIELD, bitfield)
+	}
+	if err != nil {
+		return err
+	}
+	return p.sendAllowedFast()
+}
 
-	for p.host = range p.peersQueue {
-		if p.host.Status != PEER_NEW {
-			continue
+// processRequest queues the upload of a block of a piece we have to an
+// unchoked peer, or of an allowed fast piece to a choked one
+func (p *Peer) processRequest(payload []byte) error {
+	if len(payload) != 12 {
+		return protocolError("Invalid REQUEST message")
+	}
+	if p.down == nil {
+		return nil
+	}
+	piece := int(binary.BigEndian.Uint32(payload[0:4]))
+	begin := uint64(binary.BigEndian.Uint32(payload[4:8]))
+	length := uint64(binary.BigEndian.Uint32(payload[8:12]))
+	if length > maxRequestLength {
+		return protocolError("Requested block too big")
+	}
+	if _, size := p.down.pieceBounds(piece); length == 0 || begin+length > size {
+		return protocolError("Requested block out of the piece")
+	}
+	if p.amChoking && !p.ourAllowedFast[piece] {
+		return p.rejectRequest(payload)
+	}
+	var request [12]byte
+	copy(request[:], payload)
+	select {
+	case p.uploads <- request:
+	default:
+		// the peer asks again for the blocks it doesn't get
+		p.log.Debug("Too many queued requests, dropping one")
+		return p.rejectRequest(payload)
+	}
+	return nil
+}
+
+// upload sends the requested blocks as the upload limits allow, apart from
+// the message loop so that control messages are not held up. It stops when
+// quit is closed or the connection fails.
+func (p *Peer) upload(uploads <-chan [12]byte, quit <-chan struct{}) {
+	limit := p.uploadLimiters()
+	for {
+		var request [12]byte
+		select {
+		case request = <-uploads:
+		case <-quit:
+			return
 		}
-		err := p.connectPeer(p.torrent.InfoHash)
+		piece := binary.BigEndian.Uint32(request[0:4])
+		begin := binary.BigEndian.Uint32(request[4:8])
+		length := binary.BigEndian.Uint32(request[8:12])
+
+		data, err := p.down.readBlock(int(piece), begin, length)
 		if err != nil {
-			p.peersQueue <- p.host
+			p.log.Debug("Can't upload piece", "piece", piece, "err", err)
+			if p.rejectRequest(request[:]) != nil {
+				return
+			}
 			continue
 		}
+		if !limit.wait(13+len(data), quit) {
+			return
+		}
+		block := make([]byte, 8+len(data))
+		copy(block, request[0:8])
+		copy(block[8:], data)
+		if err := p.sendMessage(PIECE, block); err != nil {
+			return
+		}
+		p.stats.upload.add(len(data))
+		p.down.uploadRate.add(len(data))
+		bytesUploaded.Add(float64(len(data)))
+	}
+}
 
-		p.status = 0 // waiting for bitfield
-		p.bitFieldRecv = false
-		errorChan := make(chan struct{})
-		msgQueue := make(chan Message, 10)
-		var currentPiece *StPiece
-		go p.readMessage(msgQueue, errorChan)
-
-		readError := false
-		for readError == false {
-			select {
-			case msg = <-msgQueue:
-				err := p.processMessage(msg)
-				if err != nil {
-					log.Printf("Error processing message: %s\n", err)
-					readError = true
+// maxRequestLength is the biggest block we upload in a single PIECE message
+const maxRequestLength = 0x20000
+
+// blockSize is the size of the blocks we request
+const blockSize = 0x4000
+
+// maxRequests is the number of blocks requested at once when there are no
+// download limits
+const maxRequests = 5
+
+// maxQueuedUploads is the number of requests of a peer waiting to be
+// uploaded, the ones beyond are dropped
+const maxQueuedUploads = 64
+
+// requestBlocks requests the next blocks of the current piece, keeping as
+// many in flight as the download limits allow
+func (p *Peer) requestBlocks() error {
+	pipeline := maxRequests
+	if rate := p.downloadLimiters().rate(); rate > 0 {
+		// about a second of transfer
+		pipeline = rate / blockSize
+		if pipeline < 1 {
+			pipeline = 1
+		} else if pipeline > maxRequests {
+			pipeline = maxRequests
+		}
+	}
+	for p.bytesReq < p.currentPieceSize && p.bytesReq-p.bytesRcvd < uint32(pipeline*blockSize) {
+		if err := p.sendPieceRequest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloadLimiters returns the limiters of the blocks we receive: the ones of
+// the peer, its torrent and the session
+func (p *Peer) downloadLimiters() limiters {
+	return append(limiters{&p.limits.download}, p.down.downloadLimiters()...)
+}
+
+// uploadLimiters returns the limiters of the blocks we send
+func (p *Peer) uploadLimiters() limiters {
+	return append(limiters{&p.limits.upload}, p.down.uploadLimiters()...)
+}
+
+// acquireSlot waits for a free connection slot. It returns false if the peer
+// was stopped while waiting.
+func (p *Peer) acquireSlot() bool {
+	if p.slots == nil {
+		return true
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return true
+	case <-p.done:
+		return false
+	}
+}
+
+func (p *Peer) releaseSlot() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
+
+// run exchanges messages with the connected peer until the connection is
+// closed, there is nothing left to do with it or the peer is stopped. It
+// returns the error that closed the connection, if any.
+func (p *Peer) run(piecesList *atomicPieces) (err error) {
+	defer p.conn.Close()
+	defer func() { p.reportViolation(err) }()
+
+	p.state = stateBitfield
+	p.bitFieldRecv = false
+	p.chocked = true
+	p.amChoking = true
+	p.peerInterested = false
+	p.amInterested = false
+	for i := range p.bitfield {
+		p.bitfield[i] = 0
+	}
+	p.numPieces = 0
+	p.allowedFast = make(map[int]bool)
+	p.suggested = nil
+	p.rejected = make(map[int]bool)
+	p.dropPiece = false
+	p.outstanding = make(map[blockRequest]bool)
+	p.abandoned = make(map[blockRequest]bool)
+	p.gotMessage = false
+	p.lastWrite = time.Now()
+	p.stats = newPeerStats(p)
+	if p.down != nil {
+		p.down.addPeer(p)
+		defer p.down.removePeer(p)
+	}
+	errorChan := make(chan error, 1)
+	msgQueue := make(chan Message, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	var currentPiece *StPiece
+	defer func() {
+		if currentPiece != nil {
+			piecesList.addPiece(*currentPiece)
+		}
+	}()
+	// giveUp hands the current piece back to the other peers
+	giveUp := func() {
+		p.abandonPiece()
+		piecesList.addPiece(*currentPiece)
+		currentPiece = nil
+	}
+	ticker := time.NewTicker(peerTickInterval)
+	defer ticker.Stop()
+	go p.readMessage(p.conn, p.log, msgQueue, errorChan, quit)
+	if p.down != nil {
+		uploads := make(chan [12]byte, maxQueuedUploads)
+		p.uploads = uploads
+		stopUploads := make(chan struct{})
+		var uploading sync.WaitGroup
+		uploading.Add(1)
+		go func() {
+			defer uploading.Done()
+			p.upload(uploads, stopUploads)
+		}()
+		defer func() {
+			close(stopUploads)
+			p.conn.Close() // unblocks a pending write
+			uploading.Wait()
+		}()
+	}
+
+	for {
+		select {
+		case msg := <-msgQueue:
+			err := p.processMessage(msg)
+			p.stats.update(p)
+			if err != nil {
+				p.log.Debug("Error processing message", "err", err)
+				return err
+			}
+			if p.state == stateSeeding && !p.peerInterested {
+				return nil
+			}
+			if p.dropPiece {
+				p.dropPiece = false
+				giveUp()
+				p.state = statePick
+			}
+			if p.state == statePick {
+				currentPiece = p.newPiece(piecesList)
+				if currentPiece == nil && !p.idle() {
+					return nil
 				}
-				if p.status == 2 {
-					currentPiece = p.newPiece(piecesList)
-					if currentPiece == nil {
-						readError = true
-						break
+			}
+			if p.state == stateDownloading && p.bytesRcvd == p.currentPieceSize {
+				err := p.checkIntegrity()
+				if err != nil {
+					p.log.Warn("Piece failed the hash check", "piece", currentPiece.Order)
+					if p.down != nil {
+						p.down.addWasted(int(p.currentPieceSize))
 					}
-				}
-				if p.status == 3 {
-					if p.bytesRcvd == p.currentPieceSize {
-						log.Printf("Piece %d completed - ", currentPiece.Order)
-						err := p.checkIntegrity(currentPiece.Hash)
-						if err != nil {
-							log.Println(err)
-							piecesList.addPiece(*currentPiece)
-							break
-						}
-						log.Printf("Piece %d - valid SHA1\n", currentPiece.Order)
-
-						dataPiece := make([]byte, p.currentPieceSize)
-						copy(dataPiece, p.currentPieceData[:p.currentPieceSize])
-						p.resultsChan <- StPieceResult{
-							Data:  dataPiece,
-							Order: currentPiece.Order,
-						}
-
-						currentPiece = p.newPiece(piecesList)
-						if currentPiece == nil {
-							readError = true
-							break
-						}
+					piecesList.addPiece(*currentPiece)
+				} else {
+					p.log.Debug("Piece verified", "piece", currentPiece.Order)
+
+					dataPiece := make([]byte, p.currentPieceSize)
+					copy(dataPiece, p.currentPieceData[:p.currentPieceSize])
+					select {
+					case p.resultsChan <- StPieceResult{Data: dataPiece, Order: currentPiece.Order}:
+					case <-p.complete:
+					case <-p.done:
+						currentPiece = nil
+						return nil
 					}
 				}
-			case <-errorChan:
-				log.Printf("Error reading from peer...\n")
-				if currentPiece != nil {
-					piecesList.addPiece(*currentPiece)
+
+				currentPiece = p.newPiece(piecesList)
+				if currentPiece == nil && !p.idle() {
+					return nil
+				}
+			}
+		case now := <-ticker.C:
+			if now.Sub(p.idleSince()) >= keepAliveInterval {
+				if err := p.sendKeepAlive(); err != nil {
+					return err
 				}
-				readError = true
 			}
+			if p.state == stateDownloading && now.Sub(p.lastBlock) >= requestTimeout {
+				p.log.Debug("Peer stopped sending blocks", "piece", currentPiece.Order)
+				giveUp()
+				if !p.idle() {
+					return errRequestTimeout
+				}
+			}
+			if p.state == stateSeeding && !p.chocked && piecesList.hasPiece(p.pickable()) {
+				// a piece given back by another peer
+				currentPiece = p.newPiece(piecesList)
+				if currentPiece == nil && !p.idle() {
+					return nil
+				}
+			}
+		case err := <-errorChan:
+			return err
+		case <-p.done:
+			return nil
 		}
+	}
+}
+
+var errRequestTimeout = errors.New("Peer stopped sending the requested blocks")
 
+// idle keeps the connection open when there is no piece to download
+// from the peer now. A choked peer waits for the unchoke, others keep
+// seeding.
+func (p *Peer) idle() bool {
+	if p.chocked {
+		p.state = stateChoked
+		return true
 	}
+	return p.seeding()
+}
 
+// seeding keeps the connection open to upload to an interested peer once
+// there is nothing left to download from it
+func (p *Peer) seeding() bool {
+	if p.down == nil || !p.peerInterested {
+		return false
+	}
+	p.state = stateSeeding
+	return true
 }
@@ -24,7 +24,7 @@ func Test_setBitField(t *testing.T) {
 		PieceHashes: make([][20]byte, 10),
 	}
 	data := []byte{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xA0}
-	peer := NewPeer(&torrent, nil, nil)
+	peer := NewPeer(&torrent, nil)
 
 	peer.setBitField(data)
 
@@ -42,7 +42,7 @@ func Test_setBitField(t *testing.T) {
 }
 
 func Test_sendUint32(t *testing.T) {
-	peer := NewPeer(&torrent.Torrent{}, nil, nil)
+	peer := NewPeer(&torrent.Torrent{}, nil)
 	Cs := &connStub{}
 	peer.conn = Cs
 	peer.sendUint32(444)
@@ -66,7 +66,7 @@ func Test_unMarshallHandShake(t *testing.T) {
 	data = append(data, infoHash[:]...)
 	data = append(data, "PeerIDPeerIDPeerIDPe"...)
 
-	peer := NewPeer(&torrent, nil, nil)
+	peer := NewPeer(&torrent, nil)
 	hands := peer.unMarshallHandShake(data)
 
 	if hands.ptrLength != 10 {
@@ -88,3 +88,23 @@ func Test_unMarshallHandShake(t *testing.T) {
 	}
 
 }
+
+func Test_hashRequest(t *testing.T) {
+	req := hashRequest{baseLayer: 1, index: 4, length: 2, proofLayers: 3}
+	req.piecesRoot[0] = 9
+
+	data := req.marshall([][32]byte{{1}, {2}})
+	if len(data) != hashRequestSize+64 {
+		t.Fatalf("Expected %d bytes, got %d", hashRequestSize+64, len(data))
+	}
+	got, err := unmarshallHashRequest(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != req {
+		t.Errorf("Expected %v, got %v", req, *got)
+	}
+	if _, err := unmarshallHashRequest(data[:10]); err == nil {
+		t.Errorf("Expected error for short message")
+	}
+}
@@ -0,0 +1,50 @@
+package torrentp2p
+
+import "github.com/vaguilera/MiniTorrent/tracker"
+
+// PeerSource finds peers outside of the trackers of the torrent, like the DHT,
+// peer exchange or local service discovery
+type PeerSource interface {
+	Name() string
+	Peers(infoHash [20]byte) ([]tracker.Peer, error)
+}
+
+// AddPeerSource registers a source of peers. Sources are never used for
+// private torrents, which must only get peers from their own trackers.
+func (down *Downloader) AddPeerSource(source PeerSource) {
+	if down.torrent.Private {
+		down.log.Info("Private torrent, not using peer source", "source", source.Name())
+		return
+	}
+	down.sources = append(down.sources, source)
+}
+
+// AddTrackers adds trackers that are not in the torrent. They are ignored for
+// private torrents.
+func (down *Downloader) AddTrackers(announces []string) {
+	if down.torrent.Private {
+		down.log.Info("Private torrent, ignoring extra trackers", "trackers", len(announces))
+		return
+	}
+	down.extraTrackers = append(down.extraTrackers, announces...)
+}
+
+// discoverPeers gets peers from the trackers and, for public torrents, from
+// the other peer sources
+func (down *Downloader) discoverPeers() {
+	down.scrapTrackers(down.torrent)
+	if down.torrent.Private {
+		return
+	}
+
+	for _, source := range down.sources {
+		for _, infoHash := range down.torrent.InfoHashes() {
+			peers, err := source.Peers(infoHash)
+			if err != nil {
+				down.log.Warn("Peer source failed", "source", source.Name(), "err", err)
+				continue
+			}
+			down.addPeers(peers, infoHash, source.Name())
+		}
+	}
+}
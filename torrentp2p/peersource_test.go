@@ -0,0 +1,43 @@
+package torrentp2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/tracker"
+)
+
+type fakeSource struct {
+	calls int
+}
+
+func (s *fakeSource) Name() string {
+	return "fake DHT"
+}
+
+func (s *fakeSource) Peers(infoHash [20]byte) ([]tracker.Peer, error) {
+	s.calls++
+	return []tracker.Peer{{IP: net.ParseIP("10.0.0.1"), Port: 6881}}, nil
+}
+
+func Test_PrivateTorrentPeerSources(t *testing.T) {
+	for _, private := range []bool{true, false} {
+		source := &fakeSource{}
+		down := &Downloader{torrent: &torrentfile.Torrent{Private: private}, log: logging.Discard}
+		down.AddPeerSource(source)
+		down.AddTrackers([]string{"wss://tracker.example/announce"})
+		down.discoverPeers()
+
+		if private && (source.calls != 0 || len(down.peerDB.peers) != 0 || len(down.extraTrackers) != 0) {
+			t.Errorf("Private torrent used other peer sources: %d calls, %d peers, %v trackers", source.calls, len(down.peerDB.peers), down.extraTrackers)
+		}
+		if !private && (source.calls != 1 || len(down.peerDB.peers) != 1) {
+			t.Errorf("Public torrent didn't use the peer source: %d calls, %d peers", source.calls, len(down.peerDB.peers))
+		}
+		if k, ok := down.peerDB.get("10.0.0.1:6881"); !private && (!ok || k.source != "fake DHT") {
+			t.Errorf("Peer not recorded with its source: %v", k)
+		}
+	}
+}
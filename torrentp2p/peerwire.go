@@ -0,0 +1,193 @@
+package torrentp2p
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// maxMessageLength bounds the messages of the peers, well above our 16 KiB
+// blocks and the hash and extension messages. Only the bitfields of huge
+// torrents are bigger.
+const maxMessageLength = 1 << 17
+
+// Timeouts of the peer connections. They are variables for the tests.
+var (
+	// peerTimeout closes connections that don't send anything, not even
+	// a keep-alive
+	peerTimeout = 2 * time.Minute
+	// keepAliveInterval is how long the connection stays quiet before we
+	// send a keep-alive
+	keepAliveInterval = time.Minute
+	// requestTimeout gives up a piece when the peer doesn't send any of its
+	// blocks for this long
+	requestTimeout = time.Minute
+	// peerTickInterval is how often the timeouts are checked
+	peerTickInterval = 5 * time.Second
+)
+
+// protocolError is a message that breaks the peer wire protocol. The peer is
+// disconnected and not tried again.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// payloadLengths are the fixed payload lengths of the messages. The other
+// messages are checked by their handlers.
+var payloadLengths = map[byte]int{
+	CHOKE:          0,
+	UNCHOKE:        0,
+	INTERESTED:     0,
+	NOT_INTERESTED: 0,
+	HAVE:           4,
+	REQUEST:        12,
+	CANCEL:         12,
+	PORT:           2,
+	SUGGEST_PIECE:  4,
+	HAVE_ALL:       0,
+	HAVE_NONE:      0,
+	REJECT_REQUEST: 12,
+	ALLOWED_FAST:   4,
+}
+
+// readFrame reads a length-prefixed message of up to maxLength bytes. It
+// returns nil for a keep-alive.
+func readFrame(r io.Reader, maxLength int) ([]byte, error) {
+	var lengthBuf [4]byte
+	if _, err := io.ReadFull(r, lengthBuf[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(lengthBuf[:])
+	if length == 0 {
+		return nil, nil
+	}
+	if length > uint32(maxLength) {
+		return nil, protocolError("Message too long")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// parseMessage checks the framing of a message of a torrent with numPieces
+// pieces: the payload length and the piece index it refers to
+func parseMessage(buf []byte, numPieces int) (Message, error) {
+	msg := Message{ID: buf[0], Payload: buf[1:]}
+	if length, ok := payloadLengths[msg.ID]; ok && len(msg.Payload) != length {
+		return msg, protocolError("Invalid length of message " + messageName(msg.ID))
+	}
+	switch msg.ID {
+	case HAVE, REQUEST, CANCEL, PIECE, SUGGEST_PIECE, REJECT_REQUEST, ALLOWED_FAST:
+		if len(msg.Payload) < 8 && msg.ID == PIECE {
+			return msg, protocolError("Invalid length of message PIECE")
+		}
+		if binary.BigEndian.Uint32(msg.Payload) >= uint32(numPieces) {
+			return msg, protocolError("Piece out of range in message " + messageName(msg.ID))
+		}
+	case BITFIELD:
+		if len(msg.Payload) != (numPieces+7)/8 {
+			return msg, protocolError("Invalid length of message BITFIELD")
+		}
+		// the spare bits of the last byte are cleared
+		if numPieces%8 != 0 && msg.Payload[len(msg.Payload)-1]&(0xff>>uint(numPieces%8)) != 0 {
+			return msg, protocolError("Spare bits set in BITFIELD")
+		}
+	}
+	return msg, nil
+}
+
+var messageNames = map[byte]string{
+	CHOKE:          "CHOKE",
+	UNCHOKE:        "UNCHOKE",
+	INTERESTED:     "INTERESTED",
+	NOT_INTERESTED: "NOT_INTERESTED",
+	HAVE:           "HAVE",
+	BITFIELD:       "BITFIELD",
+	REQUEST:        "REQUEST",
+	PIECE:          "PIECE",
+	CANCEL:         "CANCEL",
+	PORT:           "PORT",
+	SUGGEST_PIECE:  "SUGGEST_PIECE",
+	HAVE_ALL:       "HAVE_ALL",
+	HAVE_NONE:      "HAVE_NONE",
+	REJECT_REQUEST: "REJECT_REQUEST",
+	ALLOWED_FAST:   "ALLOWED_FAST",
+	EXTENSION:      "EXTENSION",
+	HASH_REQUEST:   "HASH_REQUEST",
+	HASHES:         "HASHES",
+	HASH_REJECT:    "HASH_REJECT",
+}
+
+// messageName returns the name of a message for errors and logs
+func messageName(id byte) string {
+	if name, ok := messageNames[id]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// maxMessageLength returns the longest message the peer may send: the fixed
+// bound or the bitfield of the torrent
+func (p *Peer) maxMessageLength() int {
+	if length := 1 + (len(p.bitfield)+7)/8; length > maxMessageLength {
+		return length
+	}
+	return maxMessageLength
+}
+
+// blockRequest identifies a block by the payload of its REQUEST: piece, begin
+// and length
+type blockRequest [12]byte
+
+func newBlockRequest(piece, begin, length uint32) blockRequest {
+	var r blockRequest
+	binary.BigEndian.PutUint32(r[0:], piece)
+	binary.BigEndian.PutUint32(r[4:], begin)
+	binary.BigEndian.PutUint32(r[8:], length)
+	return r
+}
+
+// abandonPiece gives up the blocks of the current piece still in flight. They
+// are cancelled, unless the choke of a peer without the Fast Extension did,
+// and dropped if they arrive.
+func (p *Peer) abandonPiece() {
+	cancel := p.fast || !p.chocked
+	for r := range p.outstanding {
+		if cancel {
+			p.sendMessage(CANCEL, r[:])
+		}
+		p.abandoned[r] = true
+	}
+	p.outstanding = make(map[blockRequest]bool)
+}
+
+// sendKeepAlive keeps the connection open when we have nothing to send
+func (p *Peer) sendKeepAlive() error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.lastWrite = time.Now()
+	_, err := p.conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// idleSince returns when we last sent something to the peer
+func (p *Peer) idleSince() time.Time {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	return p.lastWrite
+}
+
+// reportViolation marks a peer that broke the protocol so it isn't tried
+// again
+func (p *Peer) reportViolation(err error) {
+	if _, ok := err.(protocolError); !ok {
+		return
+	}
+	p.log.Warn("Protocol violation, disconnecting peer", "err", err)
+	p.host.Status = PEER_VIOLATION
+	peerOutcome(PEER_VIOLATION)
+}
@@ -0,0 +1,350 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// keepAliveMessage stands for a keep-alive among the messages of a
+// remotePeer
+const keepAliveMessage = 0xff
+
+// remotePeer scripts the other end of a connection accepted by a Downloader
+type remotePeer struct {
+	t         *testing.T
+	conn      net.Conn
+	handshake []byte
+	messages  chan Message
+	accepted  chan struct{} // closed when AcceptPeer returns
+	mu        sync.Mutex
+	events    []Event
+}
+
+// acceptRemote connects a remotePeer to a downloader of 50000 bytes in 4
+// pieces. The handshake of the remote peer has the reserved bits.
+func acceptRemote(t *testing.T, reserved [8]byte) (*remotePeer, *Downloader) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down, err := newDownloader(testWebSeedTorrent(make([]byte, 50000)), root)
+	if err != nil {
+		os.RemoveAll(root)
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	r := &remotePeer{t: t, conn: remote, messages: make(chan Message, 16), accepted: make(chan struct{})}
+	t.Cleanup(func() {
+		remote.Close()
+		<-r.accepted
+		down.Close()
+		os.RemoveAll(root)
+	})
+	remote.SetDeadline(time.Now().Add(10 * time.Second))
+	down.OnEvent(func(e Event) {
+		r.mu.Lock()
+		r.events = append(r.events, e)
+		r.mu.Unlock()
+	})
+	go func() {
+		down.AcceptPeer(local, down.torrent.InfoHash, [20]byte{}, reserved)
+		close(r.accepted)
+	}()
+
+	r.handshake = make([]byte, 68)
+	if _, err := io.ReadFull(remote, r.handshake); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer close(r.messages)
+		for {
+			buf, err := readFrame(remote, 1<<20)
+			if err != nil {
+				return
+			}
+			if buf == nil {
+				buf = []byte{keepAliveMessage}
+			}
+			r.messages <- Message{ID: buf[0], Payload: buf[1:]}
+		}
+	}()
+	return r, down
+}
+
+func (r *remotePeer) send(msg Message) {
+	buf := make([]byte, 5+len(msg.Payload))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(msg.Payload)))
+	buf[4] = msg.ID
+	copy(buf[5:], msg.Payload)
+	if _, err := r.conn.Write(buf); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// expect skips the messages until one with id
+func (r *remotePeer) expect(id byte) Message {
+	for msg := range r.messages {
+		if msg.ID == id {
+			return msg
+		}
+	}
+	r.t.Fatalf("Expected message %d", id)
+	return Message{}
+}
+
+// disconnected waits for AcceptPeer to return and returns the error of the
+// connection
+func (r *remotePeer) disconnected() error {
+	select {
+	case <-r.accepted:
+	case <-time.After(10 * time.Second):
+		r.t.Fatal("Peer not disconnected")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.events {
+		if e.Type == EVENT_PEER_DISCONNECTED {
+			return e.Err
+		}
+	}
+	return nil
+}
+
+func Test_readFrame(t *testing.T) {
+	r := bytes.NewReader([]byte{0, 0, 0, 0, 0, 0, 0, 2, 7, 8, 0, 0, 0, 9, 1})
+	if buf, err := readFrame(r, 8); buf != nil || err != nil {
+		t.Errorf("Expected keep-alive, got %v %v", buf, err)
+	}
+	if buf, err := readFrame(r, 8); !bytes.Equal(buf, []byte{7, 8}) || err != nil {
+		t.Errorf("Unexpected frame %v %v", buf, err)
+	}
+	if _, err := readFrame(r, 8); err != protocolError("Message too long") {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+	if _, err := readFrame(bytes.NewReader([]byte{0, 0, 0, 3, 1}), 8); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected unexpected EOF, got %v", err)
+	}
+}
+
+func Test_parseMessage(t *testing.T) {
+	valid := [][]byte{
+		{CHOKE},
+		{HAVE, 0, 0, 0, 9},
+		{BITFIELD, 0xff, 0xc0},
+		{REQUEST, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0},
+		{PIECE, 0, 0, 0, 1, 0, 0, 0, 0},
+		{PORT, 0x1a, 0xe1},
+		{EXTENSION, 0, 'd', 'e'},
+		{99, 1, 2, 3},
+	}
+	for _, buf := range valid {
+		if msg, err := parseMessage(buf, 10); err != nil || msg.ID != buf[0] || !bytes.Equal(msg.Payload, buf[1:]) {
+			t.Errorf("Unexpected result for %v: %v %v", buf, msg, err)
+		}
+	}
+	invalid := [][]byte{
+		{CHOKE, 0},
+		{HAVE, 0, 0, 0},
+		{HAVE, 0, 0, 0, 10},
+		{BITFIELD, 0xff},
+		{BITFIELD, 0xff, 0xe0}, // spare bit
+		{REQUEST, 0, 0, 0, 1},
+		{PIECE, 0, 0, 0, 1, 0, 0, 0},
+		{PIECE, 0, 0, 0, 10, 0, 0, 0, 0},
+		{ALLOWED_FAST, 0, 0, 1, 0},
+		{HAVE_ALL, 0},
+	}
+	for _, buf := range invalid {
+		if _, err := parseMessage(buf, 10); err == nil {
+			t.Errorf("Expected error for %v", buf)
+		} else if _, ok := err.(protocolError); !ok {
+			t.Errorf("Expected protocol error for %v, got %v", buf, err)
+		}
+	}
+}
+
+func Test_processBlock(t *testing.T) {
+	p, _ := testFastPeer(4)
+	p.state = stateDownloading
+	p.currentPieceNum = 1
+	p.currentPieceSize = 16384
+	p.outstanding[newBlockRequest(1, 0, 8192)] = true
+	p.abandoned[newBlockRequest(0, 0, 8192)] = true
+
+	block := func(piece, begin uint32, data []byte) []byte {
+		return append(fastMessage(PIECE, piece, begin).Payload, data...)
+	}
+	data := bytes.Repeat([]byte{7}, 8192)
+	if err := p.processBlock(block(1, 0, data)); err != nil || p.bytesRcvd != 8192 || p.currentPieceData[8191] != 7 {
+		t.Errorf("Block not stored: %v", err)
+	}
+	if err := p.processBlock(block(1, 0, data)); err == nil {
+		t.Error("Expected error for a block received twice")
+	}
+	if err := p.processBlock(block(0, 0, data)); err != nil || p.bytesRcvd != 8192 {
+		t.Errorf("Abandoned block not dropped: %v", err)
+	}
+	if err := p.processBlock(block(1, 8192, data[:100])); err == nil {
+		t.Error("Expected error for a block not requested")
+	}
+	if err := p.processBlock(block(1, 16000, data)); err == nil {
+		t.Error("Expected error for a block out of the piece")
+	}
+}
+
+func Test_readMessage(t *testing.T) {
+	p, _ := testFastPeer(4)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	messages := make(chan Message, 1)
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	defer func(timeout time.Duration) { peerTimeout = timeout }(peerTimeout)
+	peerTimeout = 200 * time.Millisecond
+	go p.readMessage(local, p.log, messages, errs, quit)
+
+	// keep-alives don't stop the reader
+	remote.Write([]byte{0, 0, 0, 0, 0, 0, 0, 1, UNCHOKE})
+	select {
+	case msg := <-messages:
+		if msg.ID != UNCHOKE {
+			t.Errorf("Unexpected message %v", msg)
+		}
+	case err := <-errs:
+		t.Fatal(err)
+	}
+	// nor silence shorter than the timeout
+	time.Sleep(100 * time.Millisecond)
+	remote.Write([]byte{0, 0, 0, 0})
+	select {
+	case err := <-errs:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("Expected timeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Silent peer not timed out")
+	}
+}
+
+func Test_readMessageTooLong(t *testing.T) {
+	p, _ := testFastPeer(4)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	errs := make(chan error, 1)
+	quit := make(chan struct{})
+	defer close(quit)
+	go p.readMessage(local, p.log, make(chan Message), errs, quit)
+
+	// nothing is allocated for the 4 GiB message
+	remote.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if err := <-errs; err != protocolError("Message too long") {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+}
+
+func Test_PeerViolation(t *testing.T) {
+	r, _ := acceptRemote(t, [8]byte{})
+	r.send(Message{ID: BITFIELD, Payload: []byte{0xf0}})
+	r.send(Message{ID: UNCHOKE})
+	request := r.expect(REQUEST)
+	// a block of another piece
+	piece := binary.BigEndian.Uint32(request.Payload)
+	block := append(fastMessage(PIECE, (piece+1)%4, 0).Payload, make([]byte, 16384)...)
+	r.send(Message{ID: PIECE, Payload: block})
+	if err := r.disconnected(); err != protocolError("Block not requested") {
+		t.Errorf("Expected protocol violation, got %v", err)
+	}
+}
+
+func Test_PeerTimeouts(t *testing.T) {
+	defer func(keepAlive, request, tick time.Duration) {
+		keepAliveInterval, requestTimeout, peerTickInterval = keepAlive, request, tick
+	}(keepAliveInterval, requestTimeout, peerTickInterval)
+	keepAliveInterval = 50 * time.Millisecond
+	requestTimeout = 300 * time.Millisecond
+	peerTickInterval = 10 * time.Millisecond
+
+	r, down := acceptRemote(t, [8]byte{})
+	r.expect(keepAliveMessage)
+	r.send(Message{ID: BITFIELD, Payload: []byte{0xf0}})
+	r.send(Message{ID: UNCHOKE})
+	request := r.expect(REQUEST)
+	// the unanswered requests are cancelled
+	if cancel := r.expect(CANCEL); !bytes.Equal(cancel.Payload, request.Payload) {
+		t.Errorf("Expected CANCEL of %v, got %v", request.Payload, cancel.Payload)
+	}
+	if err := r.disconnected(); err != errRequestTimeout {
+		t.Errorf("Expected request timeout, got %v", err)
+	}
+	if len(down.piecesList.pieces) != 4 {
+		t.Errorf("Piece not given back: %v", down.piecesList.pieces)
+	}
+}
+
+// Test_PeerSeedingPicks picks again while seeding to an interested peer,
+// once it has a new piece or a piece is given back
+func Test_PeerSeedingPicks(t *testing.T) {
+	defer func(request, tick time.Duration) {
+		requestTimeout, peerTickInterval = request, tick
+	}(requestTimeout, peerTickInterval)
+	requestTimeout = 300 * time.Millisecond
+	peerTickInterval = 10 * time.Millisecond
+
+	r, down := acceptRemote(t, [8]byte{})
+	down.piecesList.removePiece(0)
+	r.send(Message{ID: BITFIELD, Payload: []byte{0x80}})
+	r.send(Message{ID: INTERESTED})
+	r.send(Message{ID: UNCHOKE})
+	r.send(fastMessage(HAVE, 3))
+	if request := r.expect(REQUEST); binary.BigEndian.Uint32(request.Payload) != 3 {
+		t.Errorf("Expected a request of the announced piece, got %v", request.Payload)
+	}
+	// the unanswered piece is given back and asked again
+	r.expect(CANCEL)
+	if request := r.expect(REQUEST); binary.BigEndian.Uint32(request.Payload) != 3 {
+		t.Errorf("Expected the piece requested again, got %v", request.Payload)
+	}
+	r.conn.Close()
+	r.disconnected()
+}
+
+// Test_PeerWithoutBitfield downloads from a peer that skips the BITFIELD
+// and announces its pieces later
+func Test_PeerWithoutBitfield(t *testing.T) {
+	r, _ := acceptRemote(t, [8]byte{})
+	r.send(Message{ID: UNCHOKE})
+	r.expect(INTERESTED)
+	r.send(fastMessage(HAVE, 3))
+	if request := r.expect(REQUEST); binary.BigEndian.Uint32(request.Payload) != 3 {
+		t.Errorf("Expected a request of the announced piece, got %v", request.Payload)
+	}
+	r.conn.Close()
+	r.disconnected()
+}
+
+func Test_PeerChokeDropsPiece(t *testing.T) {
+	r, down := acceptRemote(t, [8]byte{})
+	r.send(Message{ID: BITFIELD, Payload: []byte{0xf0}})
+	r.send(Message{ID: UNCHOKE})
+	first := r.expect(REQUEST)
+	// without the Fast Extension the choke drops our requests, so they are
+	// asked again after the unchoke
+	r.send(Message{ID: CHOKE})
+	r.send(Message{ID: UNCHOKE})
+	if request := r.expect(REQUEST); binary.BigEndian.Uint32(request.Payload[4:]) != 0 {
+		t.Errorf("Expected the piece requested from the start, got %v after %v", request.Payload, first.Payload)
+	}
+	r.conn.Close()
+	r.disconnected()
+	if len(down.piecesList.pieces) != 4 {
+		t.Errorf("Pieces not given back: %v", down.piecesList.pieces)
+	}
+}
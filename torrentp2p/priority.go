@@ -0,0 +1,142 @@
+package torrentp2p
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Download priorities of the files of a torrent
+const (
+	PRIORITY_NORMAL = iota
+	PRIORITY_HIGH   // downloaded before the normal files
+	PRIORITY_SKIP   // not downloaded, unless it shares pieces with other files
+)
+
+var priorityNames = []string{"normal", "high", "skip"}
+
+// PriorityName returns the name of a file priority
+func PriorityName(priority int) string {
+	if priority < 0 || priority >= len(priorityNames) {
+		return "unknown"
+	}
+	return priorityNames[priority]
+}
+
+// ParsePriority returns the priority of a name returned by PriorityName
+func ParsePriority(name string) (int, error) {
+	for i, n := range priorityNames {
+		if n == name {
+			return i, nil
+		}
+	}
+	return 0, errors.New("Unknown priority: " + name)
+}
+
+// rank orders the priorities from skip to high
+func rank(priority int) int {
+	switch priority {
+	case PRIORITY_SKIP:
+		return 0
+	case PRIORITY_HIGH:
+		return 2
+	}
+	return 1
+}
+
+// setPriorities sets the priority of every piece. Skipped pieces are moved
+// out of the queue and high priority ones to its front.
+func (p *atomicPieces) setPriorities(priority []int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pending := append(p.pieces, p.skipped...)
+	p.pieces, p.skipped = nil, nil
+	var normal []StPiece
+	for _, piece := range pending {
+		switch priority[piece.Order] {
+		case PRIORITY_HIGH:
+			p.pieces = append(p.pieces, piece)
+		case PRIORITY_SKIP:
+			p.skipped = append(p.skipped, piece)
+		default:
+			normal = append(normal, piece)
+		}
+	}
+	p.pieces = append(p.pieces, normal...)
+	p.priority = priority
+}
+
+func (p *atomicPieces) isSkipped(piece int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.priority != nil && p.priority[piece] == PRIORITY_SKIP
+}
+
+// checkPriorities validates the priorities of the numFiles files of a
+// torrent
+func checkPriorities(priorities []int, numFiles int) error {
+	if len(priorities) != numFiles {
+		return errors.New("Expected " + strconv.Itoa(numFiles) + " file priorities")
+	}
+	for _, priority := range priorities {
+		if priority < PRIORITY_NORMAL || priority > PRIORITY_SKIP {
+			return errors.New("Invalid priority " + strconv.Itoa(priority))
+		}
+	}
+	return nil
+}
+
+// SetFilePriorities sets the PRIORITY_* of every file of the torrent, in the
+// order of its file list. A piece shared by several files gets the highest
+// priority of them.
+func (down *Downloader) SetFilePriorities(priorities []int) error {
+	err := checkPriorities(priorities, len(down.filePieces))
+	if err != nil {
+		return err
+	}
+	pieces := make([]int, down.torrent.NumPieces())
+	for i := range pieces {
+		pieces[i] = PRIORITY_SKIP
+	}
+	for i, file := range down.filePieces {
+		for j := file.first; j >= 0 && j <= file.last; j++ {
+			if rank(priorities[i]) > rank(pieces[j]) {
+				pieces[j] = priorities[i]
+			}
+		}
+	}
+
+	down.mu.Lock()
+	down.priorities = append([]int(nil), priorities...)
+	down.piecesList.setPriorities(pieces)
+	down.mu.Unlock()
+
+	// Run may be done with the pieces that are left
+	select {
+	case down.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// FilePriorities returns the priority of every file of the torrent
+func (down *Downloader) FilePriorities() []int {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	if down.priorities == nil {
+		return make([]int, len(down.filePieces))
+	}
+	return append([]int(nil), down.priorities...)
+}
+
+// isDone reports whether every piece that isn't skipped is on disk
+func (down *Downloader) isDone() bool {
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	for i, done := range down.completed {
+		if !done && !down.piecesList.isSkipped(i) {
+			return false
+		}
+	}
+	return true
+}
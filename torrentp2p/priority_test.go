@@ -0,0 +1,92 @@
+package torrentp2p
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func pieceOrders(pieces []StPiece) []int {
+	var orders []int
+	for _, p := range pieces {
+		orders = append(orders, p.Order)
+	}
+	return orders
+}
+
+func Test_setPriorities(t *testing.T) {
+	var pieces atomicPieces
+	for i := 0; i < 4; i++ {
+		pieces.pieces = append(pieces.pieces, StPiece{Order: i})
+	}
+
+	pieces.setPriorities([]int{PRIORITY_SKIP, PRIORITY_NORMAL, PRIORITY_HIGH, PRIORITY_NORMAL})
+	if orders := pieceOrders(pieces.pieces); len(orders) != 3 || orders[0] != 2 || orders[1] != 1 || orders[2] != 3 {
+		t.Errorf("Unexpected queue %v", orders)
+	}
+	if !pieces.isSkipped(0) || pieces.isSkipped(1) {
+		t.Errorf("Unexpected skipped pieces %v", pieceOrders(pieces.skipped))
+	}
+
+	// a piece of a skipped file handed back, not queued twice
+	pieces.removePiece(0)
+	pieces.addPiece(StPiece{Order: 0})
+	pieces.addPiece(StPiece{Order: 0})
+	if len(pieces.skipped) != 1 || len(pieces.pieces) != 3 {
+		t.Errorf("Skipped piece added to the queue")
+	}
+	pieces.prioritize(0, 0)
+	if pieces.pieces[0].Order != 0 || len(pieces.skipped) != 0 {
+		t.Errorf("Skipped piece not prioritized: %v", pieceOrders(pieces.pieces))
+	}
+}
+
+func Test_RunSkipFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		piece, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		end := (piece + 1) * 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[piece*16384 : end])
+	}))
+	defer server.Close()
+
+	torrent := testWebSeedTorrent(data)
+	torrent.HTTPSeeds = []string{server.URL}
+	down, err := newDownloader(torrent, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	// a.bin is in pieces 0 and 1, and piece 1 is shared with dir/b b.bin
+	if err := down.SetFilePriorities([]int{PRIORITY_SKIP}); err == nil {
+		t.Error("Expected error with the wrong number of priorities")
+	}
+	down.SetFilePriorities([]int{PRIORITY_SKIP, PRIORITY_NORMAL})
+	err = down.Run(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if down.HasPiece(0) || !down.HasPiece(1) || !down.HasPiece(2) || !down.HasPiece(3) {
+		t.Errorf("Unexpected pieces %v", down.completed)
+	}
+	if down.IsComplete() || !down.isDone() {
+		t.Error("Expected a done but not complete download")
+	}
+}
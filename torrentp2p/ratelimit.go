@@ -0,0 +1,349 @@
+package torrentp2p
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits are transfer rates in bytes per second. Zero means no limit.
+type Limits struct {
+	Download int
+	Upload   int
+}
+
+// maxWait bounds each sleep of a throttled transfer, so that a new rate
+// applies quickly
+const maxWait = 250 * time.Millisecond
+
+// rateLimiter is a token bucket that lets rate bytes per second through,
+// with bursts of up to a second. The zero value doesn't limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+func (l *rateLimiter) setRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+func (l *rateLimiter) getRate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+func (l *rateLimiter) refill(now time.Time) {
+	if l.rate > 0 && !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// takeAt takes n bytes if there are tokens left, going into debt if n is
+// bigger than them. Otherwise it returns how long to wait for tokens.
+func (l *rateLimiter) takeAt(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(now)
+	if l.rate <= 0 {
+		return 0
+	}
+	if l.tokens > 0 {
+		l.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / float64(l.rate) * float64(time.Second))
+}
+
+// charge takes n bytes even if that leaves the bucket in debt
+func (l *rateLimiter) charge(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.rate > 0 {
+		l.tokens -= float64(n)
+	}
+}
+
+// limiters are the peer, torrent and session limiters a transfer goes
+// through. Nil entries don't limit.
+type limiters []*rateLimiter
+
+// wait blocks until every limiter lets n bytes through. It returns false if
+// quit is closed first.
+func (ls limiters) wait(n int, quit <-chan struct{}) bool {
+	for _, l := range ls {
+		if l == nil {
+			continue
+		}
+		for {
+			delay := l.takeAt(n, time.Now())
+			if delay == 0 {
+				break
+			}
+			if delay > maxWait {
+				delay = maxWait
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-quit:
+				timer.Stop()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// charge counts n bytes that can't be delayed, like control messages
+func (ls limiters) charge(n int) {
+	for _, l := range ls {
+		if l != nil {
+			l.charge(n)
+		}
+	}
+}
+
+// rate returns the lowest limit, 0 if there is none
+func (ls limiters) rate() int {
+	min := 0
+	for _, l := range ls {
+		if l == nil {
+			continue
+		}
+		if rate := l.getRate(); rate > 0 && (min == 0 || rate < min) {
+			min = rate
+		}
+	}
+	return min
+}
+
+// bandwidth holds the download and upload limiters of a peer, a torrent or a
+// session
+type bandwidth struct {
+	download rateLimiter
+	upload   rateLimiter
+}
+
+func (b *bandwidth) set(l Limits) {
+	b.download.setRate(l.Download)
+	b.upload.setRate(l.Upload)
+}
+
+func (b *bandwidth) get() Limits {
+	return Limits{Download: b.download.getRate(), Upload: b.upload.getRate()}
+}
+
+// SetRateLimits changes the limits of the torrent
+func (down *Downloader) SetRateLimits(l Limits) {
+	down.limits.set(l)
+}
+
+// RateLimits returns the limits of the torrent
+func (down *Downloader) RateLimits() Limits {
+	return down.limits.get()
+}
+
+// SetPeerRateLimits changes the limits of each peer of the torrent, the
+// connected ones included
+func (down *Downloader) SetPeerRateLimits(l Limits) {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	down.peerLimits = l
+	for p := range down.connected {
+		p.limits.set(l)
+	}
+}
+
+// PeerRateLimits returns the limits of each peer of the torrent
+func (down *Downloader) PeerRateLimits() Limits {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	return down.peerLimits
+}
+
+// downloadLimiters returns the limiters of the torrent and the session, that
+// web seeds go through
+func (down *Downloader) downloadLimiters() limiters {
+	if down == nil {
+		return nil
+	}
+	limit := limiters{&down.limits.download}
+	if down.global != nil {
+		limit = append(limit, &down.global.download)
+	}
+	return limit
+}
+
+// uploadLimiters returns the upload limiters of the torrent and the session
+func (down *Downloader) uploadLimiters() limiters {
+	if down == nil {
+		return nil
+	}
+	limit := limiters{&down.limits.upload}
+	if down.global != nil {
+		limit = append(limit, &down.global.upload)
+	}
+	return limit
+}
+
+// limitedReader throttles reads of an HTTP body, like the ones of web seeds
+type limitedReader struct {
+	r     io.Reader
+	limit limiters
+	quit  <-chan struct{}
+}
+
+func (lr *limitedReader) Read(buf []byte) (int, error) {
+	if len(buf) > blockSize {
+		buf = buf[:blockSize]
+	}
+	n, err := lr.r.Read(buf)
+	if n > 0 && !lr.limit.wait(n, lr.quit) {
+		return n, ErrStopped
+	}
+	return n, err
+}
+
+// AltSpeed are alternative limits of a session, turned on by hand or during
+// a time of the day
+type AltSpeed struct {
+	Limits
+	Enabled   bool           // on regardless of the schedule
+	Scheduled bool           // on from Begin to End
+	Begin     time.Duration  // since midnight, local time
+	End       time.Duration  // before Begin if the schedule spans midnight
+	Days      []time.Weekday // days the schedule starts, every day if empty
+}
+
+// activeAt reports whether the alternative limits apply at t
+func (a AltSpeed) activeAt(t time.Time) bool {
+	if a.Enabled {
+		return true
+	}
+	if !a.Scheduled {
+		return false
+	}
+	year, month, day := t.Date()
+	since := t.Sub(time.Date(year, month, day, 0, 0, 0, 0, t.Location()))
+	weekday := t.Weekday()
+	if a.Begin <= a.End {
+		return since >= a.Begin && since < a.End && a.onDay(weekday)
+	}
+	if since >= a.Begin {
+		return a.onDay(weekday)
+	}
+	// the schedule started the day before
+	return since < a.End && a.onDay((weekday+6)%7)
+}
+
+func (a AltSpeed) onDay(day time.Weekday) bool {
+	if len(a.Days) == 0 {
+		return true
+	}
+	for _, d := range a.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+var dayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseSchedule sets the schedule of the alternative limits from a time of
+// the day like "09:00-17:30", optionally followed by a slash and comma
+// separated days, like "22:00-06:00/fri,sat". An empty string removes it.
+func (a *AltSpeed) ParseSchedule(schedule string) error {
+	if schedule == "" {
+		a.Scheduled = false
+		a.Begin, a.End, a.Days = 0, 0, nil
+		return nil
+	}
+	hours := schedule
+	var days []time.Weekday
+	if i := strings.IndexByte(schedule, '/'); i >= 0 {
+		hours = schedule[:i]
+		for _, name := range strings.Split(schedule[i+1:], ",") {
+			day := indexOf(dayNames, strings.ToLower(strings.TrimSpace(name)))
+			if day < 0 {
+				return errors.New("Invalid day in schedule: " + name)
+			}
+			days = append(days, time.Weekday(day))
+		}
+	}
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return errors.New("Invalid schedule: " + schedule)
+	}
+	begin, err := parseTimeOfDay(parts[0])
+	if err != nil {
+		return err
+	}
+	end, err := parseTimeOfDay(parts[1])
+	if err != nil {
+		return err
+	}
+	a.Scheduled = true
+	a.Begin, a.End, a.Days = begin, end, days
+	return nil
+}
+
+// Schedule returns the schedule in the format of ParseSchedule, empty if
+// there is none
+func (a AltSpeed) Schedule() string {
+	if !a.Scheduled {
+		return ""
+	}
+	schedule := formatTimeOfDay(a.Begin) + "-" + formatTimeOfDay(a.End)
+	for i, day := range a.Days {
+		if i == 0 {
+			schedule += "/"
+		} else {
+			schedule += ","
+		}
+		schedule += dayNames[day]
+	}
+	return schedule
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var hour, min int
+	_, err := fmt.Sscanf(strings.TrimSpace(s), "%d:%d", &hour, &min)
+	if err != nil || hour < 0 || hour > 23 || min < 0 || min > 59 {
+		return 0, errors.New("Invalid time of the day: " + s)
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute, nil
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
+
+func indexOf(list []string, s string) int {
+	for i, item := range list {
+		if item == s {
+			return i
+		}
+	}
+	return -1
+}
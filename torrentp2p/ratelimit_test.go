@@ -0,0 +1,173 @@
+package torrentp2p
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	var l rateLimiter
+	now := time.Unix(1000, 0)
+	if delay := l.takeAt(1<<20, now); delay != 0 {
+		t.Errorf("Unlimited limiter waits %s", delay)
+	}
+
+	l.setRate(1000)
+	l.last = now
+	if delay := l.takeAt(500, now); delay == 0 {
+		t.Errorf("Empty bucket didn't wait")
+	}
+	// a second fills the bucket, a bigger block leaves it in debt
+	if delay := l.takeAt(3000, now.Add(time.Second)); delay != 0 {
+		t.Errorf("Full bucket waits %s", delay)
+	}
+	delay := l.takeAt(100, now.Add(time.Second))
+	if delay < 2*time.Second || delay > 3*time.Second {
+		t.Errorf("Expected to wait for the 2000 bytes of debt, got %s", delay)
+	}
+	if delay := l.takeAt(100, now.Add(3*time.Second+10*time.Millisecond)); delay != 0 {
+		t.Errorf("Bucket still empty after paying the debt, waits %s", delay)
+	}
+
+	// bursts are limited to a second
+	if l.takeAt(1000, now.Add(time.Hour)); l.tokens != 0 {
+		t.Errorf("Expected an empty bucket after a second of burst, got %f", l.tokens)
+	}
+}
+
+func Test_limitersRate(t *testing.T) {
+	var peer, torrent, session rateLimiter
+	ls := limiters{&peer, &torrent, nil, &session}
+	if rate := ls.rate(); rate != 0 {
+		t.Errorf("Expected no limit, got %d", rate)
+	}
+	torrent.setRate(5000)
+	session.setRate(3000)
+	if rate := ls.rate(); rate != 3000 {
+		t.Errorf("Expected the lowest limit, got %d", rate)
+	}
+
+	quit := make(chan struct{})
+	close(quit)
+	ls.charge(10000)
+	if ls.wait(1, quit) {
+		t.Errorf("Wait in debt didn't stop on quit")
+	}
+}
+
+func Test_RunRateLimit(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 50000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		piece, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+		end := (piece + 1) * 16384
+		if end > len(data) {
+			end = len(data)
+		}
+		w.Write(data[piece*16384 : end])
+	}))
+	defer server.Close()
+
+	torrent := testWebSeedTorrent(data)
+	torrent.HTTPSeeds = []string{server.URL}
+	down, err := newDownloader(torrent, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer down.Close()
+
+	// the torrent limit is lower than the one of the session
+	down.global = &bandwidth{}
+	down.global.set(Limits{Download: 1 << 20})
+	down.SetRateLimits(Limits{Download: 25000})
+	start := time.Now()
+	if err := down.Run(context.Background(), 0); err != nil {
+		t.Fatal(err)
+	}
+	// the last block goes into debt instead of waiting
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("50000 bytes at 25000 B/s took %s", elapsed)
+	}
+}
+
+func Test_AltSpeedSchedule(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		// 2021-03-01 was a Monday
+		return time.Date(2021, 3, day, hour, min, 0, 0, time.Local)
+	}
+	day := AltSpeed{Scheduled: true, Begin: 9 * time.Hour, End: 17*time.Hour + 30*time.Minute,
+		Days: []time.Weekday{time.Monday, time.Tuesday}}
+	night := AltSpeed{Scheduled: true, Begin: 22 * time.Hour, End: 6 * time.Hour,
+		Days: []time.Weekday{time.Friday}}
+
+	tests := []struct {
+		alt  AltSpeed
+		t    time.Time
+		want bool
+	}{
+		{day, at(1, 8, 59), false},
+		{day, at(1, 9, 0), true},
+		{day, at(2, 17, 29), true},
+		{day, at(2, 17, 30), false},
+		{day, at(3, 12, 0), false}, // Wednesday
+		{night, at(5, 23, 0), true},
+		{night, at(6, 5, 59), true}, // Saturday morning, started on Friday
+		{night, at(6, 23, 0), false},
+		{night, at(5, 5, 0), false}, // Friday morning, started on Thursday
+		{AltSpeed{}, at(1, 12, 0), false},
+		{AltSpeed{Enabled: true}, at(1, 12, 0), true},
+	}
+	for _, test := range tests {
+		if got := test.alt.activeAt(test.t); got != test.want {
+			t.Errorf("%v at %s: got %v", test.alt, test.t.Format("Mon 15:04"), got)
+		}
+	}
+}
+
+func Test_ParseSchedule(t *testing.T) {
+	var alt AltSpeed
+	if err := alt.ParseSchedule("22:00-6:30/fri,Sat"); err != nil {
+		t.Fatal(err)
+	}
+	if !alt.Scheduled || alt.Begin != 22*time.Hour || alt.End != 6*time.Hour+30*time.Minute || len(alt.Days) != 2 || alt.Days[1] != time.Saturday {
+		t.Errorf("Unexpected schedule %+v", alt)
+	}
+	if s := alt.Schedule(); s != "22:00-06:30/fri,sat" {
+		t.Errorf("Unexpected schedule %q", s)
+	}
+	for _, invalid := range []string{"22:00", "25:00-06:00", "22:00-06:00/xyz", "a-b"} {
+		if err := alt.ParseSchedule(invalid); err == nil {
+			t.Errorf("Expected error parsing %q", invalid)
+		}
+	}
+	if alt.ParseSchedule(""); alt.Scheduled || alt.Schedule() != "" {
+		t.Errorf("Schedule not removed: %+v", alt)
+	}
+}
+
+func Test_SessionAltSpeed(t *testing.T) {
+	s := testSession(t, SessionConfig{RateLimits: Limits{Download: 5000}})
+	defer s.Close()
+	if l := s.global.get(); l.Download != 5000 {
+		t.Errorf("Unexpected session limits %+v", l)
+	}
+	s.SetAltSpeed(AltSpeed{Limits: Limits{Upload: 1000}, Enabled: true})
+	if _, active := s.AltSpeed(); !active || s.global.get() != (Limits{Upload: 1000}) {
+		t.Errorf("Alternative limits not applied: %+v", s.global.get())
+	}
+	s.SetAltSpeed(AltSpeed{})
+	if s.global.get() != (Limits{Download: 5000}) {
+		t.Errorf("Normal limits not restored: %+v", s.global.get())
+	}
+}
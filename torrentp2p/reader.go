@@ -0,0 +1,86 @@
+package torrentp2p
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// readAhead is the number of pieces prioritized after the one being read.
+const readAhead = 4
+
+// FileReader reads one file of the torrent while it is being downloaded.
+// Reads block until the pieces they cover are verified, and raise the
+// priority of those pieces.
+type FileReader struct {
+	ctx    context.Context
+	down   *Downloader
+	start  uint64
+	length uint64
+	pos    int64
+}
+
+// NewFileReader returns a reader for the file at index in the torrent file
+// list. Its reads stop waiting for pieces once ctx is cancelled.
+func (down *Downloader) NewFileReader(ctx context.Context, index int) (*FileReader, error) {
+	files := down.torrent.FileList()
+	if index < 0 || index >= len(files) {
+		return nil, errors.New("File index out of range")
+	}
+
+	r := &FileReader{ctx: ctx, down: down, length: files[index].Length}
+	for _, f := range files[:index] {
+		r.start += f.Length
+	}
+	return r, nil
+}
+
+// Read implements io.Reader. It returns at most the data up to the end of the
+// piece containing the current position.
+func (r *FileReader) Read(b []byte) (int, error) {
+	if r.pos >= int64(r.length) {
+		return 0, io.EOF
+	}
+	if remaining := int64(r.length) - r.pos; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+
+	offset := r.start + uint64(r.pos)
+	pieceLength := uint64(r.down.torrent.PieceLength)
+	piece := int(offset / pieceLength)
+	last := piece + readAhead
+	if last >= r.down.torrent.NumPieces() {
+		last = r.down.torrent.NumPieces() - 1
+	}
+	if err := r.down.waitPiece(r.ctx, piece, last); err != nil {
+		return 0, err
+	}
+
+	if inPiece := pieceLength - offset%pieceLength; uint64(len(b)) > inPiece {
+		b = b[:inPiece]
+	}
+	err := r.down.files.readData(b, offset)
+	if err != nil {
+		return 0, err
+	}
+	r.pos += int64(len(b))
+	return len(b), nil
+}
+
+// Seek implements io.Seeker.
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.length)
+	default:
+		return 0, errors.New("Invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
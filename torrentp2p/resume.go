@@ -0,0 +1,71 @@
+package torrentp2p
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+// resumeState is the fast resume file, which records the verified pieces so a
+// download can continue without hashing the data again
+type resumeState struct {
+	InfoHash []byte `bencode:"info hash"`
+	Pieces   []byte `bencode:"pieces"` // bitfield of the verified pieces
+}
+
+func resumePath(root string, torrent *torrentfile.Torrent) string {
+	return filepath.Join(root, ".minitorrent-"+hex.EncodeToString(torrent.InfoHash[:])+".resume")
+}
+
+// writeResume saves the list of verified pieces of the torrent
+func writeResume(root string, torrent *torrentfile.Torrent, completed []bool) error {
+	state := resumeState{
+		InfoHash: torrent.InfoHash[:],
+		Pieces:   make([]byte, (len(completed)+7)/8),
+	}
+	for i, done := range completed {
+		if done {
+			state.Pieces[i/8] |= 128 >> uint(i%8)
+		}
+	}
+	data, err := bencode.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	path := resumePath(root, torrent)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readResume loads the list of verified pieces saved for the torrent
+func readResume(root string, torrent *torrentfile.Torrent) ([]bool, error) {
+	data, err := ioutil.ReadFile(resumePath(root, torrent))
+	if err != nil {
+		return nil, err
+	}
+
+	var state resumeState
+	err = bencode.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	numPieces := torrent.NumPieces()
+	if string(state.InfoHash) != string(torrent.InfoHash[:]) || len(state.Pieces) != (numPieces+7)/8 {
+		return nil, errors.New("Resume file doesn't match the torrent")
+	}
+
+	completed := make([]bool, numPieces)
+	for i := range completed {
+		completed[i] = state.Pieces[i/8]&(128>>uint(i%8)) != 0
+	}
+	return completed, nil
+}
@@ -0,0 +1,895 @@
+package torrentp2p
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+	"github.com/vaguilera/MiniTorrent/tracker"
+	"github.com/vaguilera/MiniTorrent/utp"
+)
+
+// States of a torrent in a session
+const (
+	TORRENT_QUEUED      = iota // waiting for a download slot
+	TORRENT_DOWNLOADING        // downloading pieces
+	TORRENT_SEEDING            // complete and uploading to other peers
+	TORRENT_FINISHED           // complete, waiting for a seed slot
+	TORRENT_PAUSED             // stopped by the user
+)
+
+var stateNames = []string{"queued", "downloading", "seeding", "finished", "paused"}
+
+// StateName returns the name of a torrent state
+func StateName(state int) string {
+	if state < 0 || state >= len(stateNames) {
+		return "unknown"
+	}
+	return stateNames[state]
+}
+
+// SessionConfig holds the limits shared by all the torrents of a session.
+// Zero limits mean no limit.
+type SessionConfig struct {
+	ListenAddr         string // address of the shared listener, ":25771" by default
+	DownloadDir        string // where the files are stored, "download" by default
+	MaxConnections     int    // peer connections of all the torrents
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	DiskWorkers        int            // goroutines doing disk I/O, 4 by default
+	WorkersPerTorrent  int            // outgoing peer connections per torrent, 4 by default
+	MaxConnsPerTorrent int            // incoming and outgoing connections of each torrent, 50 by default
+	MaxHalfOpen        int            // connections being set up at once, 8 by default
+	ExternalIP         net.IP         // our public address, for the order peers are dialed in
+	RateLimits         Limits         // of all the torrents together
+	PeerRateLimits     Limits         // of each peer
+	AltSpeed           AltSpeed       // replaces RateLimits while it is active
+	Encryption         int            // ENCRYPTION_* of the peer connections
+	Transport          int            // TRANSPORT_* of the peer connections
+	Logger             logging.Logger // discards the messages if nil
+}
+
+// TorrentStatus is a snapshot of a torrent of the session
+type TorrentStatus struct {
+	ID          string // hex info hash
+	Name        string
+	State       int
+	Err         error // why the torrent couldn't be started, if it was paused by an error
+	OwnedPieces int
+	NumPieces   int
+}
+
+// FileStatus is the progress and priority of a file of a torrent
+type FileStatus struct {
+	Index     int    // in the file list of the torrent
+	Path      string // separated by /
+	Length    uint64
+	Completed uint64
+	Priority  int
+}
+
+type sessionTorrent struct {
+	id         string
+	torrent    *torrentfile.Torrent
+	state      int
+	err        error
+	down       *Downloader
+	finished   chan struct{} // closed when Run of down returns
+	closed     chan struct{} // closed when the files of down are closed
+	starting   bool          // its downloader is being created
+	owned      int           // pieces on disk when the downloader was stopped
+	priorities []int         // file priorities, nil if all are normal
+	limits     Limits
+}
+
+// Session runs many torrents at once. They share one listen port, the peer
+// sources, a disk I/O pool and the connection limit, and are started in the
+// order they were added as download and seed slots get free.
+type Session struct {
+	config   SessionConfig
+	listener net.Listener
+	utp      *utp.Socket // on the port of listener, nil with TRANSPORT_TCP
+	port     uint16
+	disk     *diskPool
+	slots    chan struct{}
+	dials    chan struct{} // half-open slots
+	sources  []PeerSource
+	mu       sync.Mutex
+	torrents []*sessionTorrent
+	closed   bool
+	opening  sync.WaitGroup // torrents whose downloader is being created
+	global   bandwidth      // RateLimits or the ones of AltSpeed
+	altSpeed bool           // whether AltSpeed is active
+	quit     chan struct{}  // closed by Close
+}
+
+// NewSession opens the shared listener and starts accepting peers
+func NewSession(config SessionConfig) (*Session, error) {
+	if config.ListenAddr == "" {
+		config.ListenAddr = ":" + strconv.Itoa(tracker.DefaultPort)
+	}
+	if config.DownloadDir == "" {
+		config.DownloadDir = "download"
+	}
+	if config.DiskWorkers <= 0 {
+		config.DiskWorkers = 4
+	}
+	if config.WorkersPerTorrent <= 0 {
+		config.WorkersPerTorrent = 4
+	}
+	if config.MaxConnsPerTorrent <= 0 {
+		config.MaxConnsPerTorrent = 50
+	}
+	if config.MaxHalfOpen <= 0 {
+		config.MaxHalfOpen = defaultMaxHalfOpen
+	}
+	if config.Logger == nil {
+		config.Logger = logging.Discard
+	}
+
+	listener, socket, err := listen(config.ListenAddr, config.Transport != TRANSPORT_TCP)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{
+		config:   config,
+		listener: listener,
+		utp:      socket,
+		port:     uint16(listener.Addr().(*net.TCPAddr).Port),
+		disk:     newDiskPool(config.DiskWorkers),
+		dials:    make(chan struct{}, config.MaxHalfOpen),
+		quit:     make(chan struct{}),
+	}
+	if config.MaxConnections > 0 {
+		s.slots = make(chan struct{}, config.MaxConnections)
+	}
+	s.applyRateLimits(time.Now())
+	config.Logger.Info("Listening for peers", "addr", listener.Addr().String(), "utp", socket != nil)
+	go s.acceptPeers(listener)
+	if socket != nil {
+		go s.acceptPeers(socket)
+	}
+	go s.scheduleAltSpeed()
+	return s, nil
+}
+
+// listen opens the TCP listener and, if withUTP, the uTP socket on the same
+// port. A random port is retried until both are free.
+func listen(addr string, withUTP bool) (net.Listener, *utp.Socket, error) {
+	for tries := 0; ; tries++ {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil || !withUTP {
+			return listener, nil, err
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		udpAddr := net.JoinHostPort(host, strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+		socket, err := utp.Listen("udp", udpAddr)
+		if err == nil {
+			return listener, socket, nil
+		}
+		listener.Close()
+		if port != "0" || tries == 10 {
+			return nil, nil, err
+		}
+	}
+}
+
+// Port returns the port of the shared listener
+func (s *Session) Port() uint16 {
+	return s.port
+}
+
+// DownloadDir returns the directory where the files are stored
+func (s *Session) DownloadDir() string {
+	return s.config.DownloadDir
+}
+
+// AddPeerSource registers a source of peers, like the DHT, for all the
+// public torrents started from now on
+func (s *Session) AddPeerSource(source PeerSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append(s.sources, source)
+}
+
+// Add queues a torrent and returns its id, the hex info hash
+func (s *Session) Add(torrent *torrentfile.Torrent) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return "", errors.New("Session closed")
+	}
+	id := hex.EncodeToString(torrent.InfoHash[:])
+	if s.find(id) != nil {
+		return "", errors.New("Torrent already added: " + id)
+	}
+	s.torrents = append(s.torrents, &sessionTorrent{
+		id:      id,
+		torrent: torrent,
+		state:   TORRENT_QUEUED,
+	})
+	s.schedule()
+	return id, nil
+}
+
+// Pause stops a torrent. Its progress is kept in the resume file.
+func (s *Session) Pause(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.find(id)
+	if t == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	s.stopTorrent(t)
+	t.state = TORRENT_PAUSED
+	s.schedule()
+	return nil
+}
+
+// Resume queues a paused torrent again
+func (s *Session) Resume(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.find(id)
+	if t == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	if t.state != TORRENT_PAUSED {
+		return nil
+	}
+	t.state = TORRENT_QUEUED
+	t.err = nil
+	s.schedule()
+	return nil
+}
+
+// Remove stops a torrent and removes it from the session. With deleteFiles
+// it waits for the files to be closed and deletes them, otherwise they are
+// left on disk.
+func (s *Session) Remove(id string, deleteFiles bool) error {
+	s.mu.Lock()
+	var removed *sessionTorrent
+	for i, t := range s.torrents {
+		if t.id == id {
+			s.stopTorrent(t)
+			s.torrents = append(s.torrents[:i], s.torrents[i+1:]...)
+			s.schedule()
+			removed = t
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if removed == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	if !deleteFiles {
+		return nil
+	}
+	if removed.closed != nil {
+		<-removed.closed
+	}
+	return removeFiles(s.config.DownloadDir, removed.torrent)
+}
+
+// SetFilePriorities sets the PRIORITY_* of every file of a torrent. Seeding
+// and finished torrents are queued again if they have files left to
+// download.
+func (s *Session) SetFilePriorities(id string, priorities []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.find(id)
+	if t == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	err := checkPriorities(priorities, len(t.torrent.FileList()))
+	if err != nil {
+		return err
+	}
+	t.priorities = append([]int(nil), priorities...)
+	if t.down != nil {
+		t.down.SetFilePriorities(priorities)
+		if t.state == TORRENT_SEEDING && !t.down.isDone() {
+			s.stopTorrent(t)
+			t.state = TORRENT_QUEUED
+		}
+	} else if t.state == TORRENT_FINISHED {
+		t.state = TORRENT_QUEUED
+	}
+	s.schedule()
+	return nil
+}
+
+// Files returns the progress and priority of the files of a torrent,
+// without the padding files
+func (s *Session) Files(id string) ([]FileStatus, error) {
+	s.mu.Lock()
+	t := s.find(id)
+	if t == nil {
+		s.mu.Unlock()
+		return nil, errors.New("Unknown torrent: " + id)
+	}
+	down := t.down
+	priorities := t.priorities
+	s.mu.Unlock()
+
+	var completed []bool
+	if down != nil {
+		down.mu.Lock()
+		completed = append([]bool(nil), down.completed...)
+		down.mu.Unlock()
+	} else {
+		completed, _ = readResume(s.config.DownloadDir, t.torrent)
+	}
+
+	var files []FileStatus
+	var offset uint64
+	for i, f := range t.torrent.FileList() {
+		start := offset
+		offset += f.Length
+		if f.IsPadding() {
+			continue
+		}
+		status := FileStatus{
+			Index:     i,
+			Path:      strings.Join(f.Path, "/"),
+			Length:    f.Length,
+			Completed: completedBytes(t.torrent, completed, start, f.Length),
+		}
+		if priorities != nil {
+			status.Priority = priorities[i]
+		}
+		files = append(files, status)
+	}
+	return files, nil
+}
+
+// MaxActive returns the limits of active downloads and seeds
+func (s *Session) MaxActive() (downloads, seeds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.MaxActiveDownloads, s.config.MaxActiveSeeds
+}
+
+// SetMaxActive changes the limits of active downloads and seeds. The last
+// added torrents over the new limits are queued again.
+func (s *Session) SetMaxActive(downloads, seeds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.config.MaxActiveDownloads = downloads
+	s.config.MaxActiveSeeds = seeds
+	for i := len(s.torrents) - 1; i >= 0; i-- {
+		t := s.torrents[i]
+		switch {
+		case t.state == TORRENT_DOWNLOADING && downloads > 0 && s.count(TORRENT_DOWNLOADING) > downloads:
+			s.stopTorrent(t)
+			t.state = TORRENT_QUEUED
+		case t.state == TORRENT_SEEDING && seeds > 0 && s.count(TORRENT_SEEDING) > seeds:
+			s.stopTorrent(t)
+			t.state = TORRENT_FINISHED
+		}
+	}
+	s.schedule()
+}
+
+// RateLimits returns the limits of all the torrents together, without the
+// alternative ones
+func (s *Session) RateLimits() Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.RateLimits
+}
+
+// SetRateLimits changes the limits of all the torrents together. They apply
+// while the alternative limits are not active.
+func (s *Session) SetRateLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.RateLimits = l
+	s.applyRateLimits(time.Now())
+}
+
+// PeerRateLimits returns the limits of each peer
+func (s *Session) PeerRateLimits() Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.PeerRateLimits
+}
+
+// SetPeerRateLimits changes the limits of each peer of every torrent
+func (s *Session) SetPeerRateLimits(l Limits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.PeerRateLimits = l
+	for _, t := range s.torrents {
+		if t.down != nil {
+			t.down.SetPeerRateLimits(l)
+		}
+	}
+}
+
+// TorrentRateLimits returns the limits of a torrent
+func (s *Session) TorrentRateLimits(id string) (Limits, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(id)
+	if t == nil {
+		return Limits{}, errors.New("Unknown torrent: " + id)
+	}
+	return t.limits, nil
+}
+
+// SetTorrentRateLimits changes the limits of a torrent, on top of the ones
+// of the session
+func (s *Session) SetTorrentRateLimits(id string, l Limits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.find(id)
+	if t == nil {
+		return errors.New("Unknown torrent: " + id)
+	}
+	t.limits = l
+	if t.down != nil {
+		t.down.SetRateLimits(l)
+	}
+	return nil
+}
+
+// AltSpeed returns the alternative limits and whether they are active
+func (s *Session) AltSpeed() (AltSpeed, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.config.AltSpeed, s.altSpeed
+}
+
+// SetAltSpeed changes the alternative limits and their schedule
+func (s *Session) SetAltSpeed(alt AltSpeed) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.AltSpeed = alt
+	s.applyRateLimits(time.Now())
+}
+
+// applyRateLimits sets the session limiters to the alternative limits if
+// they are active at now, or to the normal ones. It must be called with the
+// lock held.
+func (s *Session) applyRateLimits(now time.Time) {
+	active := s.config.AltSpeed.activeAt(now)
+	if active != s.altSpeed {
+		s.config.Logger.Info("Alternative speed limits", "active", active)
+	}
+	s.altSpeed = active
+	if active {
+		s.global.set(s.config.AltSpeed.Limits)
+	} else {
+		s.global.set(s.config.RateLimits)
+	}
+}
+
+// scheduleAltSpeed turns the alternative limits on and off following their
+// schedule until the session is closed
+func (s *Session) scheduleAltSpeed() {
+	ticker := time.NewTicker(altSpeedCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			s.applyRateLimits(now)
+			s.mu.Unlock()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// altSpeedCheck is how often the schedule of the alternative limits is
+// checked
+const altSpeedCheck = 30 * time.Second
+
+// Torrents returns the status of every torrent, in the order they were added
+func (s *Session) Torrents() []TorrentStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]TorrentStatus, 0, len(s.torrents))
+	for _, t := range s.torrents {
+		status := TorrentStatus{
+			ID:          t.id,
+			Name:        t.torrent.Name,
+			State:       t.state,
+			Err:         t.err,
+			OwnedPieces: t.owned,
+			NumPieces:   t.torrent.NumPieces(),
+		}
+		if t.down != nil {
+			t.down.mu.Lock()
+			status.OwnedPieces = t.down.ownedPieces
+			t.down.mu.Unlock()
+		}
+		list = append(list, status)
+	}
+	return list
+}
+
+// Stats returns the stats of a torrent. Torrents that are not running only
+// report their pieces.
+func (s *Session) Stats(id string) (Stats, error) {
+	s.mu.Lock()
+	t := s.find(id)
+	if t == nil {
+		s.mu.Unlock()
+		return Stats{}, errors.New("Unknown torrent: " + id)
+	}
+	down := t.down
+	stats := Stats{
+		Name:        t.torrent.Name,
+		Length:      t.torrent.Length,
+		OwnedPieces: t.owned,
+		NumPieces:   t.torrent.NumPieces(),
+		ETA:         -1,
+	}
+	s.mu.Unlock()
+
+	if down != nil {
+		return down.Stats(), nil
+	}
+	return stats, nil
+}
+
+// Close stops every torrent and the listener, and waits for the downloads to
+// stop
+func (s *Session) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		close(s.quit)
+	}
+	s.closed = true
+	s.listener.Close()
+	if s.utp != nil {
+		s.utp.Close()
+	}
+	var running []chan struct{}
+	for _, t := range s.torrents {
+		if t.down != nil {
+			running = append(running, t.finished)
+		}
+		s.stopTorrent(t)
+	}
+	s.mu.Unlock()
+
+	for _, finished := range running {
+		<-finished
+	}
+	s.opening.Wait()
+	s.disk.close()
+}
+
+func (s *Session) find(id string) *sessionTorrent {
+	for _, t := range s.torrents {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// count returns the number of torrents in a state
+func (s *Session) count(state int) int {
+	n := 0
+	for _, t := range s.torrents {
+		if t.state == state {
+			n++
+		}
+	}
+	return n
+}
+
+// countStarting returns the number of torrents being started from a state
+func (s *Session) countStarting(state int) int {
+	n := 0
+	for _, t := range s.torrents {
+		if t.starting && t.state == state {
+			n++
+		}
+	}
+	return n
+}
+
+// schedule starts the queued torrents while there are free download slots,
+// and the finished ones while there are free seed slots. It is called with
+// s.mu held, that startTorrent releases while the files are opened.
+func (s *Session) schedule() {
+	for !s.closed {
+		t := s.next()
+		if t == nil {
+			return
+		}
+		s.startTorrent(t)
+	}
+}
+
+// next returns the first torrent that can be started
+func (s *Session) next() *sessionTorrent {
+	for _, t := range s.torrents {
+		if !t.starting && s.canStart(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// canStart tells if there is a free slot for a torrent, counting the ones
+// of the torrents being started
+func (s *Session) canStart(t *sessionTorrent) bool {
+	switch t.state {
+	case TORRENT_QUEUED:
+		return s.config.MaxActiveDownloads == 0 ||
+			s.count(TORRENT_DOWNLOADING)+s.countStarting(TORRENT_QUEUED) < s.config.MaxActiveDownloads
+	case TORRENT_FINISHED:
+		return s.canSeed()
+	}
+	return false
+}
+
+func (s *Session) canSeed() bool {
+	return s.config.MaxActiveSeeds == 0 ||
+		s.count(TORRENT_SEEDING)+s.countStarting(TORRENT_FINISHED) < s.config.MaxActiveSeeds
+}
+
+// startTorrent creates the downloader of t and runs it. s.mu is released
+// while the downloader opens the files, so t is left as it is if it was
+// removed, changed state or lost its slot meanwhile.
+func (s *Session) startTorrent(t *sessionTorrent) {
+	from := t.state
+	t.starting = true
+	closed := make(chan struct{})
+	t.closed = closed
+	s.opening.Add(1)
+	defer s.opening.Done()
+	s.mu.Unlock()
+	down, err := newDownloader(t.torrent, s.config.DownloadDir)
+	s.mu.Lock()
+	t.starting = false
+
+	if err != nil {
+		close(closed)
+		s.config.Logger.Error("Can't start torrent", "infohash", t.id, "err", err)
+		if t.state == from {
+			t.state = TORRENT_PAUSED
+			t.err = err
+		}
+		return
+	}
+	if s.closed || s.find(t.id) != t || t.state != from || !s.canStart(t) {
+		down.Close()
+		close(closed)
+		return
+	}
+	t.owned = down.ownedPieces
+	if t.priorities != nil {
+		down.SetFilePriorities(t.priorities)
+	}
+	if down.isDone() {
+		if !s.canSeed() {
+			down.Close()
+			close(closed)
+			t.state = TORRENT_FINISHED
+			return
+		}
+		t.state = TORRENT_SEEDING
+	} else {
+		t.state = TORRENT_DOWNLOADING
+	}
+
+	down.SetLogger(s.config.Logger)
+	down.global = &s.global
+	down.SetRateLimits(t.limits)
+	down.SetPeerRateLimits(s.config.PeerRateLimits)
+	down.encryption = s.config.Encryption
+	down.SetTransport(s.config.Transport, s.utp)
+	down.port = s.port
+	down.slots = s.slots
+	down.dials = s.dials
+	down.maxConns = s.config.MaxConnsPerTorrent
+	down.externalIP = s.config.ExternalIP
+	down.disk = s.disk
+	for _, source := range s.sources {
+		down.AddPeerSource(source)
+	}
+	t.down = down
+	t.finished = make(chan struct{})
+
+	go func(finished chan struct{}) {
+		err := down.Run(context.Background(), s.config.WorkersPerTorrent)
+		close(finished)
+		if err != nil && err != ErrStopped {
+			s.failed(t, down, err)
+			return
+		}
+		s.downloadDone(t, down)
+	}(t.finished)
+}
+
+// failed pauses a torrent whose download stopped with an error
+func (s *Session) failed(t *sessionTorrent, down *Downloader, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.down != down {
+		return
+	}
+	s.stopTorrent(t)
+	t.state = TORRENT_PAUSED
+	t.err = err
+	s.schedule()
+}
+
+// downloadDone moves a torrent whose download completed to seeding, or to
+// finished if there are no free seed slots
+func (s *Session) downloadDone(t *sessionTorrent, down *Downloader) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.down != down || t.state != TORRENT_DOWNLOADING || !down.isDone() {
+		return
+	}
+	down.log.Info("Torrent completed", "name", t.torrent.Name)
+	if s.canSeed() {
+		t.state = TORRENT_SEEDING
+	} else {
+		s.stopTorrent(t)
+		t.state = TORRENT_FINISHED
+	}
+	s.schedule()
+}
+
+// stopTorrent stops the downloader of a torrent and closes its files once it
+// is done
+func (s *Session) stopTorrent(t *sessionTorrent) {
+	down := t.down
+	if down == nil {
+		return
+	}
+	t.down = nil
+	down.mu.Lock()
+	t.owned = down.ownedPieces
+	down.mu.Unlock()
+	down.Stop()
+	go func(finished, closed chan struct{}) {
+		<-finished
+		down.Close()
+		close(closed)
+	}(t.finished, t.closed)
+}
+
+// downloader returns the running downloader of the swarm of infoHash
+func (s *Session) downloader(infoHash [20]byte) *Downloader {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.torrents {
+		if t.down == nil {
+			continue
+		}
+		for _, hash := range t.torrent.InfoHashes() {
+			if hash == infoHash {
+				return t.down
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Session) acceptPeers(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handlePeer(conn)
+	}
+}
+
+// handlePeer reads the handshake of an incoming connection, encrypted or
+// not, and hands it to the torrent it asks for
+func (s *Session) handlePeer(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	r := bufio.NewReader(conn)
+	head, err := r.Peek(20)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	var peer net.Conn = &mseConn{Conn: conn, r: r}
+	var skey [20]byte
+	if head[0] == 19 && bytes.Equal(head[1:20], []byte("BitTorrent protocol")) {
+		if s.config.Encryption == ENCRYPTION_REQUIRE {
+			s.config.Logger.Debug("Refusing plaintext peer", "peer", conn.RemoteAddr().String())
+			conn.Close()
+			return
+		}
+	} else {
+		if s.config.Encryption == ENCRYPTION_DISABLE {
+			conn.Close()
+			return
+		}
+		peer, skey, err = mseAccept(conn, r, mseRandom, s.mseKey, s.config.Encryption)
+		if err != nil {
+			s.config.Logger.Debug("MSE handshake failed", "peer", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			return
+		}
+	}
+
+	buffer := make([]byte, 68)
+	_, err = io.ReadFull(peer, buffer)
+	if err != nil || buffer[0] != 19 || !bytes.Equal(buffer[1:20], []byte("BitTorrent protocol")) {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	var infoHash, peerID [20]byte
+	var reserved [8]byte
+	copy(reserved[:], buffer[20:28])
+	copy(infoHash[:], buffer[28:48])
+	copy(peerID[:], buffer[48:68])
+	if skey != ([20]byte{}) && skey != infoHash {
+		s.config.Logger.Debug("Handshake for another torrent than the MSE one", "peer", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+	down := s.downloader(infoHash)
+	if down == nil {
+		s.config.Logger.Debug("Peer asked for unknown torrent", "peer", conn.RemoteAddr().String(), "infohash", hex.EncodeToString(infoHash[:]))
+		conn.Close()
+		return
+	}
+
+	if s.slots != nil {
+		select {
+		case s.slots <- struct{}{}:
+			defer func() { <-s.slots }()
+		default:
+			s.config.Logger.Debug("Too many connections, refusing peer", "peer", conn.RemoteAddr().String())
+			conn.Close()
+			return
+		}
+	}
+	down.AcceptPeer(peer, infoHash, peerID, reserved)
+}
+
+// mseKey returns the info hash of the running torrent whose
+// HASH('req2', info hash) is req2
+func (s *Session) mseKey(req2 [20]byte) ([20]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.torrents {
+		if t.down == nil {
+			continue
+		}
+		for _, hash := range t.torrent.InfoHashes() {
+			if mseHash([]byte("req2"), hash[:]) == req2 {
+				return hash, true
+			}
+		}
+	}
+	return [20]byte{}, false
+}
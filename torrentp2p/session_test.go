@@ -0,0 +1,191 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/tracker"
+)
+
+type staticSource struct {
+	peers []tracker.Peer
+}
+
+func (s *staticSource) Name() string {
+	return "static"
+}
+
+func (s *staticSource) Peers(infoHash [20]byte) ([]tracker.Peer, error) {
+	return s.peers, nil
+}
+
+func testSession(t *testing.T, config SessionConfig) *Session {
+	config.ListenAddr = "127.0.0.1:0"
+	s, err := NewSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func sessionStates(s *Session) []int {
+	var states []int
+	for _, status := range s.Torrents() {
+		states = append(states, status.State)
+	}
+	return states
+}
+
+func Test_SessionQueue(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := testSession(t, SessionConfig{DownloadDir: root, MaxActiveDownloads: 1})
+	defer s.Close()
+
+	first := testWebSeedTorrent(make([]byte, 50000))
+	first.InfoHash[0] = 1
+	second := testWebSeedTorrent(make([]byte, 30000))
+	second.Name = "other"
+	second.Files[1].Path = []string{"other.bin"}
+	second.InfoHash[0] = 2
+
+	id1, err := s.Add(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := s.Add(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(first); err == nil {
+		t.Error("Expected error adding a torrent twice")
+	}
+	if states := sessionStates(s); states[0] != TORRENT_DOWNLOADING || states[1] != TORRENT_QUEUED {
+		t.Errorf("Unexpected states after add %v", states)
+	}
+
+	s.Pause(id1)
+	if states := sessionStates(s); states[0] != TORRENT_PAUSED || states[1] != TORRENT_DOWNLOADING {
+		t.Errorf("Unexpected states after pause %v", states)
+	}
+	s.Resume(id1)
+	if states := sessionStates(s); states[0] != TORRENT_QUEUED || states[1] != TORRENT_DOWNLOADING {
+		t.Errorf("Unexpected states after resume %v", states)
+	}
+	s.Remove(id2, false)
+	if states := sessionStates(s); len(states) != 1 || states[0] != TORRENT_DOWNLOADING {
+		t.Errorf("Unexpected states after remove %v", states)
+	}
+}
+
+func Test_SessionRemoveFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	s := testSession(t, SessionConfig{DownloadDir: root})
+	defer s.Close()
+
+	id, err := s.Add(testWebSeedTorrent(make([]byte, 50000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFilePriorities(id, []int{PRIORITY_HIGH, PRIORITY_SKIP}); err != nil {
+		t.Fatal(err)
+	}
+	files, err := s.Files(id)
+	if err != nil || len(files) != 2 || files[1].Path != "dir/b b.bin" || files[1].Priority != PRIORITY_SKIP {
+		t.Errorf("Unexpected files %+v %v", files, err)
+	}
+
+	s.SetMaxActive(0, 0)
+	if states := sessionStates(s); states[0] != TORRENT_DOWNLOADING {
+		t.Errorf("Unexpected states %v", states)
+	}
+	if err := s.Remove(id, true); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := ioutil.ReadDir(root)
+	if len(left) != 0 {
+		t.Errorf("%d files left in the download directory", len(left))
+	}
+}
+
+func Test_SessionUpload(t *testing.T) {
+	testUpload(t, SessionConfig{}, SessionConfig{})
+}
+
+// testUpload seeds a torrent with a session of seedConfig and downloads it
+// with one of leechConfig
+func testUpload(t *testing.T, seedConfig, leechConfig SessionConfig) {
+	seedRoot, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(seedRoot)
+	leechRoot, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(leechRoot)
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 11)
+	}
+	torrent := testWebSeedTorrent(data)
+	torrent.InfoHash[0] = 1
+	ioutil.WriteFile(filepath.Join(seedRoot, "a.bin"), data[:20000], 0644)
+	os.MkdirAll(filepath.Join(seedRoot, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(seedRoot, "dir", "b b.bin"), data[20000:], 0644)
+	if _, err := Verify(torrent, seedRoot, VerifyOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	seedConfig.DownloadDir = seedRoot
+	seeder := testSession(t, seedConfig)
+	defer seeder.Close()
+	if _, err := seeder.Add(torrent); err != nil {
+		t.Fatal(err)
+	}
+	if states := sessionStates(seeder); states[0] != TORRENT_SEEDING {
+		t.Fatalf("Expected seeding torrent, got %v", states)
+	}
+
+	leechConfig.DownloadDir = leechRoot
+	leechConfig.MaxConnections = 2
+	leecher := testSession(t, leechConfig)
+	defer leecher.Close()
+	leecher.AddPeerSource(&staticSource{
+		peers: []tracker.Peer{{IP: net.ParseIP("127.0.0.1"), Port: seeder.Port()}},
+	})
+	leechTorrent := *torrent
+	if _, err := leecher.Add(&leechTorrent); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for sessionStates(leecher)[0] != TORRENT_SEEDING {
+		if time.Now().After(deadline) {
+			t.Fatalf("Download not completed: %v", leecher.Torrents())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	a, _ := ioutil.ReadFile(filepath.Join(leechRoot, "a.bin"))
+	b, _ := ioutil.ReadFile(filepath.Join(leechRoot, "dir", "b b.bin"))
+	if got := append(a, b...); !bytes.Equal(got, data) {
+		t.Error("Downloaded data doesn't match")
+	}
+}
@@ -0,0 +1,328 @@
+package torrentp2p
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of seconds averaged by the transfer rates
+const rateWindow = 10
+
+// rateMeter counts the bytes transferred and their rate over the last
+// rateWindow seconds
+type rateMeter struct {
+	mu      sync.Mutex
+	total   uint64
+	buckets [rateWindow]uint64
+	last    int64 // second of the last bucket in use
+}
+
+func (m *rateMeter) add(n int) {
+	m.addAt(n, time.Now())
+}
+
+func (m *rateMeter) addAt(n int, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sec := now.Unix()
+	m.advance(sec)
+	m.buckets[sec%rateWindow] += uint64(n)
+	m.total += uint64(n)
+}
+
+// advance clears the buckets of the seconds elapsed since the last one used
+func (m *rateMeter) advance(sec int64) {
+	if sec <= m.last {
+		return
+	}
+	if sec-m.last >= rateWindow {
+		m.buckets = [rateWindow]uint64{}
+	} else {
+		for s := m.last + 1; s <= sec; s++ {
+			m.buckets[s%rateWindow] = 0
+		}
+	}
+	m.last = sec
+}
+
+// rate returns the bytes per second of the window and the total bytes
+func (m *rateMeter) rate() (float64, uint64) {
+	return m.rateAt(time.Now())
+}
+
+func (m *rateMeter) rateAt(now time.Time) (float64, uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.advance(now.Unix())
+	var sum uint64
+	for _, n := range m.buckets {
+		sum += n
+	}
+	return float64(sum) / rateWindow, m.total
+}
+
+// peerStats is the state of a connection shown in the stats. The peer updates
+// it from its goroutine while Stats reads it.
+type peerStats struct {
+	mu          sync.Mutex
+	address     string
+	client      string
+	incoming    bool
+	encrypted   bool
+	utp         bool
+	download    rateMeter
+	upload      rateMeter
+	choked      bool
+	choking     bool
+	interested  bool
+	interesting bool
+	pieces      int
+}
+
+// PeerStats are the stats of a connected peer
+type PeerStats struct {
+	Address      string
+	Client       string // name and version from the peer id, if known
+	Incoming     bool   // the peer connected to us
+	Encrypted    bool   // the connection is RC4 encrypted
+	UTP          bool   // the connection is over uTP instead of TCP
+	Downloaded   uint64
+	Uploaded     uint64
+	DownloadRate float64 // bytes per second
+	UploadRate   float64
+	Choked       bool // the peer is choking us
+	Choking      bool // we are choking the peer
+	Interested   bool // the peer is interested in our pieces
+	Interesting  bool // we are interested in the pieces of the peer
+	Pieces       int  // pieces the peer has
+}
+
+// TrackerStats is the result of the last announce to a tracker
+type TrackerStats struct {
+	URL          string
+	LastAnnounce time.Time
+	Peers        int
+	Err          string // empty if the announce succeeded
+}
+
+// Stats is a snapshot of the progress of a download
+type Stats struct {
+	Name         string
+	Length       uint64
+	Left         uint64 // bytes not verified yet
+	OwnedPieces  int
+	NumPieces    int
+	Downloaded   uint64 // bytes received from peers and web seeds
+	Uploaded     uint64
+	Wasted       uint64 // bytes of pieces that failed the hash check
+	DownloadRate float64
+	UploadRate   float64
+	ETA          time.Duration // -1 if it can't be estimated
+
+	Peers           []PeerStats
+	ConnectedPeers  int
+	ChokedPeers     int // peers choking us
+	InterestedPeers int // peers interested in our pieces
+
+	// Availability[n] is the number of pieces that n connected peers have
+	Availability []int
+	Trackers     []TrackerStats
+}
+
+// addPeer registers a connected peer
+func (down *Downloader) addPeer(p *Peer) {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	if down.connected == nil {
+		down.connected = make(map[*Peer]struct{})
+	}
+	down.connected[p] = struct{}{}
+	p.limits.set(down.peerLimits)
+	activePeers.Inc()
+}
+
+// removePeer unregisters a peer once its connection is closed
+func (down *Downloader) removePeer(p *Peer) {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	delete(down.connected, p)
+	activePeers.Dec()
+	for i, has := range p.bitfield {
+		if has == 1 && i < len(down.availability) {
+			down.availability[i]--
+		}
+	}
+}
+
+// peerHas counts a piece announced by a connected peer
+func (down *Downloader) peerHas(piece int) {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	down.availability[piece]++
+}
+
+// addWasted counts the bytes of a piece that failed the hash check
+func (down *Downloader) addWasted(n int) {
+	piecesFailed.Inc()
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+	down.wasted += uint64(n)
+}
+
+// trackerAnnounced records the result of an announce
+func (down *Downloader) trackerAnnounced(url string, peers int, err error) {
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+
+	status := TrackerStats{URL: url, LastAnnounce: time.Now(), Peers: peers}
+	if err != nil {
+		status.Err = err.Error()
+	}
+	for i := range down.trackers {
+		if down.trackers[i].URL == url {
+			down.trackers[i] = status
+			return
+		}
+	}
+	down.trackers = append(down.trackers, status)
+}
+
+// Stats returns a snapshot of the progress of the download
+func (down *Downloader) Stats() Stats {
+	stats := Stats{
+		Name:      down.torrent.Name,
+		Length:    down.torrent.Length,
+		Left:      down.left(),
+		NumPieces: down.torrent.NumPieces(),
+		ETA:       -1,
+	}
+	down.mu.Lock()
+	stats.OwnedPieces = down.ownedPieces
+	down.mu.Unlock()
+
+	stats.DownloadRate, stats.Downloaded = down.downloadRate.rate()
+	stats.UploadRate, stats.Uploaded = down.uploadRate.rate()
+	if stats.Left == 0 {
+		stats.ETA = 0
+	} else if stats.DownloadRate > 0 {
+		stats.ETA = time.Duration(float64(stats.Left) / stats.DownloadRate * float64(time.Second))
+	}
+
+	down.statsMu.Lock()
+	defer down.statsMu.Unlock()
+
+	stats.Wasted = down.wasted
+	stats.Trackers = append([]TrackerStats(nil), down.trackers...)
+	for p := range down.connected {
+		ps := p.stats.snapshot()
+		stats.Peers = append(stats.Peers, ps)
+		if ps.Choked {
+			stats.ChokedPeers++
+		}
+		if ps.Interested {
+			stats.InterestedPeers++
+		}
+	}
+	stats.ConnectedPeers = len(stats.Peers)
+
+	stats.Availability = make([]int, stats.ConnectedPeers+1)
+	for i := 0; i < stats.NumPieces; i++ {
+		n := down.availability[i]
+		if n >= 0 && n < len(stats.Availability) {
+			stats.Availability[n]++
+		}
+	}
+	return stats
+}
+
+func newPeerStats(p *Peer) *peerStats {
+	return &peerStats{
+		address:   net.JoinHostPort(p.host.IP.String(), strconv.Itoa(int(p.host.Port))),
+		client:    clientName(p.peerID),
+		incoming:  p.incoming,
+		encrypted: isEncrypted(p.conn),
+		utp:       transportOf(p.conn) == "utp",
+		choked:    true,
+		choking:   true,
+	}
+}
+
+// clients are the names of the common Azureus style client ids
+var clients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libtorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+}
+
+// clientName returns the client of an Azureus style peer id, like
+// -TR2940- for Transmission 2.94
+func clientName(peerID [20]byte) string {
+	if peerID[0] != '-' || peerID[7] != '-' {
+		return ""
+	}
+	name, ok := clients[string(peerID[1:3])]
+	if !ok {
+		name = string(peerID[1:3])
+	}
+	version := make([]byte, 0, 7)
+	for _, c := range peerID[3:7] {
+		if c < '0' || c > '9' {
+			break
+		}
+		if len(version) > 0 {
+			version = append(version, '.')
+		}
+		version = append(version, c)
+	}
+	if len(version) == 0 {
+		return name
+	}
+	return name + " " + string(version)
+}
+
+// update copies the state of the connection
+func (s *peerStats) update(p *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.choked = p.chocked
+	s.choking = p.amChoking
+	s.interested = p.peerInterested
+	s.interesting = p.amInterested
+	s.pieces = p.numPieces
+}
+
+func (s *peerStats) snapshot() PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ps := PeerStats{
+		Address:     s.address,
+		Client:      s.client,
+		Incoming:    s.incoming,
+		Encrypted:   s.encrypted,
+		UTP:         s.utp,
+		Choked:      s.choked,
+		Choking:     s.choking,
+		Interested:  s.interested,
+		Interesting: s.interesting,
+		Pieces:      s.pieces,
+	}
+	ps.DownloadRate, ps.Downloaded = s.download.rate()
+	ps.UploadRate, ps.Uploaded = s.upload.rate()
+	return ps
+}
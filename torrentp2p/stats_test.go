@@ -0,0 +1,44 @@
+package torrentp2p
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_rateMeter(t *testing.T) {
+	var m rateMeter
+	now := time.Unix(1000, 0)
+	for i := 0; i < rateWindow; i++ {
+		m.addAt(1000, now.Add(time.Duration(i)*time.Second))
+	}
+	rate, total := m.rateAt(now.Add((rateWindow - 1) * time.Second))
+	if rate != 1000 || total != rateWindow*1000 {
+		t.Errorf("Expected 1000 B/s, got %f (total %d)", rate, total)
+	}
+
+	rate, _ = m.rateAt(now.Add((rateWindow + 4) * time.Second))
+	if rate != 500 {
+		t.Errorf("Expected 500 B/s after 5 idle seconds, got %f", rate)
+	}
+	rate, total = m.rateAt(now.Add(time.Hour))
+	if rate != 0 || total != rateWindow*1000 {
+		t.Errorf("Expected no rate after an hour, got %f (total %d)", rate, total)
+	}
+}
+
+func Test_clientName(t *testing.T) {
+	tests := map[string]string{
+		"-TR2940-abcdefghijkl": "Transmission 2.9.4.0",
+		"-qB4250-abcdefghijkl": "qBittorrent 4.2.5.0",
+		"-XX1000-abcdefghijkl": "XX 1.0.0.0",
+		"-SHOToTorrent-0.1---": "",
+		"M7-4-3--abcdefghijkl": "",
+	}
+	for id, want := range tests {
+		var peerID [20]byte
+		copy(peerID[:], id)
+		if got := clientName(peerID); got != want {
+			t.Errorf("clientName(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
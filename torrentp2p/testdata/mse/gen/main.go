@@ -0,0 +1,214 @@
+// Command gen writes the handshakes of the MSE vectors. It follows the
+// Message Stream Encryption specification and doesn't share any code with
+// the package, so both can't be wrong the same way.
+//
+// Each vector names its inputs: the info hash, crypto_provide, IA and the
+// payloads. The random streams are kept if they are set and picked
+// otherwise, then crypto_select and what each side sends are written.
+//
+//	go run ./testdata/mse/gen [file.json ...]
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+)
+
+// vector has the fields of mseVector in mse_test.go
+type vector struct {
+	Name         string `json:"name"`
+	InfoHash     string `json:"info_hash"`
+	RandomA      string `json:"random_a"`
+	RandomB      string `json:"random_b"`
+	Provide      uint32 `json:"provide"`
+	Select       uint32 `json:"select"`
+	IA           string `json:"ia"`
+	PayloadA     string `json:"payload_a"`
+	PayloadB     string `json:"payload_b"`
+	InitiatorOut string `json:"initiator_out"`
+	ReceiverOut  string `json:"receiver_out"`
+}
+
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// P of the specification, the generator is 2
+var prime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+
+func main() {
+	files := os.Args[1:]
+	if len(files) == 0 {
+		var err error
+		files, err = filepath.Glob(filepath.Join("testdata", "mse", "*.json"))
+		if err != nil || len(files) == 0 {
+			log.Fatal("No vectors in testdata/mse")
+		}
+	}
+	for _, file := range files {
+		if err := generate(file); err != nil {
+			log.Fatalf("%s: %s", file, err)
+		}
+	}
+}
+
+func generate(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var v vector
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	if v.RandomA == "" {
+		v.RandomA = hex.EncodeToString(randomStream())
+	}
+	if v.RandomB == "" {
+		v.RandomB = hex.EncodeToString(randomStream())
+	}
+	if err := handshake(&v); err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, append(data, '\n'), 0644)
+}
+
+// randomStream returns a private key Xa or Xb, the length of the padding
+// as 2 big endian bytes and the padding
+func randomStream() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	padLen := binary.BigEndian.Uint16(n[:]) % 513
+	stream := make([]byte, 20+2+int(padLen))
+	rand.Read(stream)
+	binary.BigEndian.PutUint16(stream[20:22], padLen)
+	return stream
+}
+
+// side is the part of the handshake a random stream sets
+type side struct {
+	x   *big.Int
+	y   []byte
+	pad []byte
+}
+
+func newSide(stream []byte) (side, error) {
+	if len(stream) < 22 {
+		return side{}, fmt.Errorf("random stream of %d bytes", len(stream))
+	}
+	padLen := int(binary.BigEndian.Uint16(stream[20:22]))
+	if padLen > 512 || len(stream) != 22+padLen {
+		return side{}, fmt.Errorf("padding of %d bytes in a stream of %d", padLen, len(stream))
+	}
+	x := new(big.Int).SetBytes(stream[:20])
+	return side{x: x, y: bytes96(new(big.Int).Exp(big.NewInt(2), x, prime)), pad: stream[22:]}, nil
+}
+
+// bytes96 is the 768 bit big endian encoding of the keys and S
+func bytes96(n *big.Int) []byte {
+	b := make([]byte, 96)
+	return n.FillBytes(b)
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// cipher is RC4 keyed with HASH(name, S, SKEY), without the first 1024
+// bytes
+func cipher(name string, s, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	c.XORKeyStream(make([]byte, 1024), make([]byte, 1024))
+	return c
+}
+
+func encrypt(c *rc4.Cipher, b []byte) []byte {
+	out := make([]byte, len(b))
+	c.XORKeyStream(out, b)
+	return out
+}
+
+func handshake(v *vector) error {
+	var in [6][]byte
+	for i, s := range []string{v.InfoHash, v.RandomA, v.RandomB, v.IA, v.PayloadA, v.PayloadB} {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		in[i] = b
+	}
+	skey, randomA, randomB, ia, payloadA, payloadB := in[0], in[1], in[2], in[3], in[4], in[5]
+	a, err := newSide(randomA)
+	if err != nil {
+		return err
+	}
+	b, err := newSide(randomB)
+	if err != nil {
+		return err
+	}
+	s := bytes96(new(big.Int).Exp(new(big.Int).SetBytes(b.y), a.x, prime))
+	if s2 := bytes96(new(big.Int).Exp(new(big.Int).SetBytes(a.y), b.x, prime)); string(s) != string(s2) {
+		return fmt.Errorf("sides don't agree on S")
+	}
+
+	switch {
+	case v.Provide&cryptoRC4 != 0:
+		v.Select = cryptoRC4
+	case v.Provide&cryptoPlaintext != 0:
+		v.Select = cryptoPlaintext
+	default:
+		return fmt.Errorf("crypto_provide %d", v.Provide)
+	}
+	keyA, keyB := cipher("keyA", s, skey), cipher("keyB", s, skey)
+
+	// A->B: Ya, PadA, HASH('req1', S), HASH('req2', SKEY) xor
+	// HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC,
+	// len(IA)), ENCRYPT(IA), without PadC
+	out := append(append([]byte{}, a.y...), a.pad...)
+	out = append(out, hash([]byte("req1"), s)...)
+	req2, req3 := hash([]byte("req2"), skey), hash([]byte("req3"), s)
+	for i := range req2 {
+		out = append(out, req2[i]^req3[i])
+	}
+	header := make([]byte, 16)
+	binary.BigEndian.PutUint32(header[8:12], v.Provide)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(ia)))
+	out = append(out, encrypt(keyA, header)...)
+	out = append(out, encrypt(keyA, ia)...)
+
+	// B->A: Yb, PadB, ENCRYPT(VC, crypto_select, len(PadD), PadD), without
+	// PadD
+	back := append(append([]byte{}, b.y...), b.pad...)
+	header = make([]byte, 14)
+	binary.BigEndian.PutUint32(header[8:12], v.Select)
+	back = append(back, encrypt(keyB, header)...)
+
+	if v.Select == cryptoRC4 {
+		payloadA, payloadB = encrypt(keyA, payloadA), encrypt(keyB, payloadB)
+	}
+	v.InitiatorOut = hex.EncodeToString(append(out, payloadA...))
+	v.ReceiverOut = hex.EncodeToString(append(back, payloadB...))
+	return nil
+}
@@ -0,0 +1,96 @@
+package torrentp2p
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/utp"
+)
+
+// Transports of the outgoing peer connections. Incoming ones are accepted
+// over both while there is a uTP socket.
+const (
+	TRANSPORT_UTP_FIRST = iota // try uTP, then TCP
+	TRANSPORT_TCP_FIRST        // try TCP, then uTP
+	TRANSPORT_TCP              // only TCP, no uTP socket
+	TRANSPORT_UTP              // only uTP
+)
+
+var transportNames = []string{"utp-first", "tcp-first", "tcp", "utp"}
+
+// TransportName returns the name of a transport policy
+func TransportName(policy int) string {
+	if policy < 0 || policy >= len(transportNames) {
+		return "unknown"
+	}
+	return transportNames[policy]
+}
+
+// ParseTransport returns the transport policy of a name returned by
+// TransportName
+func ParseTransport(name string) (int, error) {
+	if i := indexOf(transportNames, name); i >= 0 {
+		return i, nil
+	}
+	return 0, errors.New("Unknown transport: " + name)
+}
+
+// Dial timeouts of the transports. The one of uTP is shorter, so that peers
+// without uTP are soon tried over TCP. They keep the half-open slots from
+// being held by unreachable peers.
+var (
+	tcpDialTimeout = 10 * time.Second
+	utpDialTimeout = 5 * time.Second
+)
+
+// SetTransport sets the transport policy of the connections to peers and
+// the socket of the uTP ones, that are skipped if it is nil. It must be
+// called before Run.
+func (down *Downloader) SetTransport(policy int, socket *utp.Socket) {
+	down.transport = policy
+	down.utp = socket
+}
+
+// transports returns the networks to dial in order, "utp" or "tcp"
+func (p *Peer) transports() []string {
+	if p.down == nil || p.down.utp == nil {
+		return []string{"tcp"}
+	}
+	switch p.down.transport {
+	case TRANSPORT_TCP_FIRST:
+		return []string{"tcp", "utp"}
+	case TRANSPORT_TCP:
+		return []string{"tcp"}
+	case TRANSPORT_UTP:
+		return []string{"utp"}
+	}
+	return []string{"utp", "tcp"}
+}
+
+// dialTransport connects to host over one transport
+func (p *Peer) dialTransport(ctx context.Context, transport, host string) (net.Conn, error) {
+	if transport == "tcp" {
+		dialer := net.Dialer{Timeout: tcpDialTimeout}
+		return dialer.DialContext(ctx, "tcp", host)
+	}
+	ctx, cancel := context.WithTimeout(ctx, utpDialTimeout)
+	defer cancel()
+	c, err := p.down.utp.DialContext(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// transportOf returns the transport of a connection, encrypted or not
+func transportOf(conn net.Conn) string {
+	if c, ok := conn.(*mseConn); ok {
+		conn = c.Conn
+	}
+	if _, ok := conn.(*utp.Conn); ok {
+		return "utp"
+	}
+	return "tcp"
+}
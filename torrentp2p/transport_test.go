@@ -0,0 +1,61 @@
+package torrentp2p
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/utp"
+)
+
+func Test_transports(t *testing.T) {
+	socket, err := utp.Listen("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+
+	tests := []struct {
+		policy int
+		socket *utp.Socket
+		want   []string
+	}{
+		{TRANSPORT_UTP_FIRST, socket, []string{"utp", "tcp"}},
+		{TRANSPORT_TCP_FIRST, socket, []string{"tcp", "utp"}},
+		{TRANSPORT_TCP, socket, []string{"tcp"}},
+		{TRANSPORT_UTP, socket, []string{"utp"}},
+		{TRANSPORT_UTP_FIRST, nil, []string{"tcp"}},
+	}
+	for _, test := range tests {
+		down := &Downloader{}
+		down.SetTransport(test.policy, test.socket)
+		p := &Peer{down: down}
+		if got := p.transports(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v", TransportName(test.policy), got)
+		}
+	}
+	if got := (&Peer{}).transports(); !reflect.DeepEqual(got, []string{"tcp"}) {
+		t.Errorf("Peer without downloader: got %v", got)
+	}
+}
+
+func Test_ParseTransport(t *testing.T) {
+	for policy := TRANSPORT_UTP_FIRST; policy <= TRANSPORT_UTP; policy++ {
+		if got, err := ParseTransport(TransportName(policy)); err != nil || got != policy {
+			t.Errorf("%s: got %d %v", TransportName(policy), got, err)
+		}
+	}
+	if _, err := ParseTransport("sctp"); err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func Test_SessionTransport(t *testing.T) {
+	// only uTP, encrypted and not
+	testUpload(t, SessionConfig{Transport: TRANSPORT_UTP}, SessionConfig{Transport: TRANSPORT_UTP})
+	testUpload(t, SessionConfig{Transport: TRANSPORT_UTP, Encryption: ENCRYPTION_DISABLE}, SessionConfig{Transport: TRANSPORT_UTP})
+	// a seeder without uTP is reached over TCP after the SYNs time out
+	defer func(timeout time.Duration) { utpDialTimeout = timeout }(utpDialTimeout)
+	utpDialTimeout = 500 * time.Millisecond
+	testUpload(t, SessionConfig{Transport: TRANSPORT_TCP}, SessionConfig{Transport: TRANSPORT_UTP_FIRST})
+}
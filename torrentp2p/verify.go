@@ -0,0 +1,165 @@
+package torrentp2p
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	Workers    int  // 0 uses one worker per CPU
+	CheckMD5   bool // also check the md5sum of complete files, when present
+	SkipResume bool // don't write the fast resume file
+}
+
+// FileVerifyResult is the state of one file of the torrent on disk
+type FileVerifyResult struct {
+	Path          string
+	Length        uint64
+	BadPieces     int
+	MissingPieces int
+	MD5Mismatch   bool
+}
+
+// VerifyResult lists the pieces of the torrent found on disk by Verify
+type VerifyResult struct {
+	Good    []int
+	Bad     []int
+	Missing []int
+	Files   []FileVerifyResult
+}
+
+// Complete reports whether every piece was found and is valid
+func (r *VerifyResult) Complete() bool {
+	return len(r.Bad) == 0 && len(r.Missing) == 0
+}
+
+// Verify checks the data of the torrent stored in root, hashing the pieces in
+// parallel. The verified pieces are saved to the fast resume file, so a
+// download in root continues from them.
+func Verify(torrent *torrentfile.Torrent, root string, opts VerifyOptions) (*VerifyResult, error) {
+	fw := fileWriter{root: root}
+	err := fw.openFiles(torrent.FileList())
+	defer fw.closeFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	numPieces := torrent.NumPieces()
+	state := make([]error, numPieces)
+	good := make([]bool, numPieces)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, torrent.PieceLength)
+			for piece := range jobs {
+				offset := uint64(piece) * uint64(torrent.PieceLength)
+				size := uint64(torrent.PieceLength)
+				if offset+size > torrent.Length {
+					size = torrent.Length - offset
+				}
+				err := fw.readData(data[:size], offset)
+				if err == nil && !torrent.VerifyPiece(piece, data[:size]) {
+					err = errBadPiece
+				}
+				state[piece] = err
+				good[piece] = err == nil
+			}
+		}()
+	}
+	for piece := 0; piece < numPieces; piece++ {
+		jobs <- piece
+	}
+	close(jobs)
+	wg.Wait()
+
+	result := &VerifyResult{}
+	for piece, err := range state {
+		switch err {
+		case nil:
+			result.Good = append(result.Good, piece)
+		case errMissingData:
+			result.Missing = append(result.Missing, piece)
+		case errBadPiece:
+			result.Bad = append(result.Bad, piece)
+		default:
+			return nil, err
+		}
+	}
+	result.Files = verifyFiles(torrent, root, state, opts.CheckMD5)
+
+	if !opts.SkipResume {
+		err = writeResume(root, torrent, good)
+		if err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// verifyFiles maps the bad and missing pieces to the files they overlap
+func verifyFiles(torrent *torrentfile.Torrent, root string, state []error, checkMD5 bool) []FileVerifyResult {
+	var files []FileVerifyResult
+	var start uint64
+	pieceLength := uint64(torrent.PieceLength)
+	for _, f := range torrent.FileList() {
+		end := start + f.Length
+		if f.IsPadding() || f.IsSymlink() {
+			start = end
+			continue
+		}
+
+		res := FileVerifyResult{Path: path.Join(f.Path...), Length: f.Length}
+		if f.Length > 0 {
+			for piece := int(start / pieceLength); piece <= int((end-1)/pieceLength); piece++ {
+				switch state[piece] {
+				case errBadPiece:
+					res.BadPieces++
+				case errMissingData:
+					res.MissingPieces++
+				}
+			}
+		}
+		if checkMD5 && f.MD5sum != "" && res.BadPieces == 0 && res.MissingPieces == 0 {
+			sum, err := fileMD5(root, f)
+			res.MD5Mismatch = err != nil || !strings.EqualFold(sum, f.MD5sum)
+		}
+		files = append(files, res)
+		start = end
+	}
+	return files
+}
+
+func fileMD5(root string, f torrentfile.TorrentMultiFileInfo) (string, error) {
+	filePath, err := safePath(root, f.Path)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, io.LimitReader(file, int64(f.Length))); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package torrentp2p
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Verify(t *testing.T) {
+	root, err := ioutil.TempDir("", "minitorrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	torrent := testWebSeedTorrent(data)
+	sum := md5.Sum(data[:20000])
+	torrent.Files[0].MD5sum = hex.EncodeToString(sum[:])
+
+	a := append([]byte{}, data[:20000]...)
+	a[100]++ // corrupts piece 0
+	ioutil.WriteFile(filepath.Join(root, "a.bin"), a, 0644)
+	os.MkdirAll(filepath.Join(root, "dir"), 0755)
+	// piece 3 is truncated
+	ioutil.WriteFile(filepath.Join(root, "dir", "b b.bin"), data[20000:49152], 0644)
+
+	result, err := Verify(torrent, root, VerifyOptions{Workers: 2, CheckMD5: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Good) != 2 || len(result.Bad) != 1 || result.Bad[0] != 0 || len(result.Missing) != 1 || result.Missing[0] != 3 {
+		t.Errorf("Unexpected result good %v bad %v missing %v", result.Good, result.Bad, result.Missing)
+	}
+	if result.Files[0].BadPieces != 1 || result.Files[1].MissingPieces != 1 || result.Files[1].BadPieces != 0 {
+		t.Errorf("Unexpected files result %v", result.Files)
+	}
+
+	completed, err := readResume(root, torrent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if completed[0] || !completed[1] || !completed[2] || completed[3] {
+		t.Errorf("Unexpected resume state %v", completed)
+	}
+
+	ioutil.WriteFile(filepath.Join(root, "a.bin"), data[:20000], 0644)
+	ioutil.WriteFile(filepath.Join(root, "dir", "b b.bin"), data[20000:], 0644)
+	result, err = Verify(torrent, root, VerifyOptions{CheckMD5: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Complete() || result.Files[0].MD5Mismatch {
+		t.Errorf("Expected complete data, got %v", result)
+	}
+}
@@ -0,0 +1,234 @@
+package torrentp2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/logging"
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+const (
+	webSeedMinBackoff = 5 * time.Second
+	webSeedMaxBackoff = 10 * time.Minute
+)
+
+// WebSeed downloads pieces from an HTTP mirror of the torrent, either a BEP 19
+// url-list entry or a BEP 17 httpseeds entry
+type WebSeed struct {
+	url         string
+	bep17       bool
+	torrent     *torrentfile.Torrent
+	client      *http.Client
+	bitfield    []byte
+	resultsChan chan StPieceResult
+	failures    int
+	retryAt     time.Time
+	ctx         context.Context // cancels the requests when the web seed is stopped
+	down        *Downloader     // collects the stats, may be nil
+	log         logging.Logger
+}
+
+// NewWebSeed creates a web seed worker for url. bep17 selects the httpseeds
+// protocol instead of plain byte ranges.
+func NewWebSeed(url string, bep17 bool, torrent *torrentfile.Torrent, results chan StPieceResult) *WebSeed {
+	w := &WebSeed{
+		url:         url,
+		bep17:       bep17,
+		torrent:     torrent,
+		client:      &http.Client{Timeout: 60 * time.Second},
+		bitfield:    make([]byte, torrent.NumPieces()),
+		resultsChan: results,
+		ctx:         context.Background(),
+		log:         logging.Discard,
+	}
+	// a mirror has every piece
+	for i := range w.bitfield {
+		w.bitfield[i] = 1
+	}
+	return w
+}
+
+// fileURL returns the BEP 19 URL of a file of the torrent
+func (w *WebSeed) fileURL(file torrentfile.TorrentMultiFileInfo) string {
+	if len(w.torrent.Files) == 0 {
+		if strings.HasSuffix(w.url, "/") {
+			return w.url + url.PathEscape(w.torrent.Name)
+		}
+		return w.url
+	}
+
+	base := w.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	parts := []string{url.PathEscape(w.torrent.Name)}
+	for _, p := range file.Path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return base + strings.Join(parts, "/")
+}
+
+func (w *WebSeed) get(address string, rangeStart, rangeEnd uint64, data []byte) error {
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(w.ctx)
+	if rangeEnd > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd-1))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range, skip to the start of it
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, int64(rangeStart)); err != nil {
+			return err
+		}
+	case http.StatusServiceUnavailable:
+		if seconds, err := strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After"))); err == nil {
+			w.retryAt = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		return errors.New("Web seed busy")
+	default:
+		return errors.New("Web seed answered " + resp.Status)
+	}
+	body := &limitedReader{r: resp.Body, limit: w.down.downloadLimiters(), quit: w.ctx.Done()}
+	n, err := io.ReadFull(body, data)
+	bytesDownloaded.Add(float64(n))
+	if w.down != nil {
+		w.down.downloadRate.add(n)
+	}
+	return err
+}
+
+// downloadPiece fetches a piece, splitting the request across the files it
+// spans, and checks its hash
+func (w *WebSeed) downloadPiece(piece int) ([]byte, error) {
+	pieceLength := uint64(w.torrent.PieceLength)
+	offset := uint64(piece) * pieceLength
+	size := pieceLength
+	if offset+size > w.torrent.Length {
+		size = w.torrent.Length - offset
+	}
+	data := make([]byte, size)
+
+	if w.bep17 {
+		query := url.Values{}
+		query.Set("info_hash", string(w.torrent.InfoHash[:]))
+		query.Set("piece", strconv.Itoa(piece))
+		sep := "?"
+		if strings.Contains(w.url, "?") {
+			sep = "&"
+		}
+		if err := w.get(w.url+sep+query.Encode(), 0, 0, data); err != nil {
+			return nil, err
+		}
+	} else {
+		var start uint64
+		for _, file := range w.torrent.FileList() {
+			end := start + file.Length
+			if end > offset && start < offset+size {
+				from, to := offset, offset+size
+				if from < start {
+					from = start
+				}
+				if to > end {
+					to = end
+				}
+				chunk := data[from-offset : to-offset]
+				if !file.IsPadding() && !file.IsSymlink() {
+					if err := w.get(w.fileURL(file), from-start, to-start, chunk); err != nil {
+						return nil, err
+					}
+				}
+			}
+			start = end
+		}
+	}
+
+	if !w.torrent.VerifyPiece(piece, data) {
+		if w.down != nil {
+			w.down.addWasted(len(data))
+		}
+		return nil, errBadPiece
+	}
+	return data, nil
+}
+
+// fail schedules the next attempt with an exponential backoff
+func (w *WebSeed) fail() {
+	w.failures++
+	backoff := webSeedMinBackoff << uint(w.failures-1)
+	if backoff > webSeedMaxBackoff || backoff <= 0 {
+		backoff = webSeedMaxBackoff
+	}
+	if retry := time.Now().Add(backoff); retry.After(w.retryAt) {
+		w.retryAt = retry
+	}
+}
+
+// Start downloads pieces from the mirror until the list of pieces is empty or
+// done is closed
+func (w *WebSeed) Start(piecesList *atomicPieces, done <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	w.ctx = ctx
+
+	for {
+		if wait := time.Until(w.retryAt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-done:
+				return
+			}
+		}
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		// the piece leaves the queue, or the seed would download the last
+		// one again while it is being stored
+		piece := piecesList.claimPiece(w.bitfield)
+		if piece == nil {
+			return
+		}
+		data, err := w.downloadPiece(piece.Order)
+		if err != nil {
+			w.log.Warn("Web seed error", "piece", piece.Order, "err", err)
+			piecesList.addPiece(*piece)
+			w.fail()
+			continue
+		}
+		w.failures = 0
+
+		select {
+		case w.resultsChan <- StPieceResult{Data: data, Order: piece.Order}:
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package torrentp2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/torrentfile"
+)
+
+func testWebSeedTorrent(data []byte) *torrentfile.Torrent {
+	torrent := &torrentfile.Torrent{
+		Name:        "mirror",
+		PieceLength: 16384,
+		Length:      uint64(len(data)),
+		Files: []torrentfile.TorrentMultiFileInfo{
+			{Length: 20000, Path: []string{"a.bin"}},
+			{Length: uint64(len(data)) - 20000, Path: []string{"dir", "b b.bin"}},
+		},
+	}
+	for i := 0; i < len(data); i += torrent.PieceLength {
+		end := i + torrent.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		torrent.PieceHashes = append(torrent.PieceHashes, sha1.Sum(data[i:end]))
+	}
+	return torrent
+}
+
+func Test_WebSeedDownloadPiece(t *testing.T) {
+	data := make([]byte, 50000)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	files := map[string][]byte{
+		"/mirror/a.bin":       data[:20000],
+		"/mirror/dir/b b.bin": data[20000:],
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/seed" {
+			piece, _ := strconv.Atoi(r.URL.Query().Get("piece"))
+			end := (piece + 1) * 16384
+			if end > len(data) {
+				end = len(data)
+			}
+			w.Write(data[piece*16384 : end])
+			return
+		}
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	torrent := testWebSeedTorrent(data)
+	for _, seed := range []*WebSeed{
+		NewWebSeed(server.URL, false, torrent, nil),
+		NewWebSeed(server.URL+"/seed", true, torrent, nil),
+	} {
+		for piece := 0; piece < torrent.NumPieces(); piece++ {
+			got, err := seed.downloadPiece(piece)
+			if err != nil {
+				t.Fatalf("Piece %d from %s: %s", piece, seed.url, err)
+			}
+			if !bytes.Equal(got, data[piece*16384:piece*16384+len(got)]) {
+				t.Errorf("Unexpected data for piece %d from %s", piece, seed.url)
+			}
+		}
+	}
+}
+
+func Test_WebSeedBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	torrent := testWebSeedTorrent(make([]byte, 50000))
+	seed := NewWebSeed(server.URL, false, torrent, nil)
+	if _, err := seed.downloadPiece(0); err == nil {
+		t.Fatal("Expected error from failing mirror")
+	}
+
+	seed.fail()
+	first := time.Until(seed.retryAt)
+	seed.fail()
+	second := time.Until(seed.retryAt)
+	if first < webSeedMinBackoff-time.Second || second < 2*webSeedMinBackoff-time.Second {
+		t.Errorf("Unexpected backoff %s then %s", first, second)
+	}
+	for i := 0; i < 20; i++ {
+		seed.fail()
+	}
+	if time.Until(seed.retryAt) > webSeedMaxBackoff {
+		t.Errorf("Backoff over the maximum")
+	}
+}
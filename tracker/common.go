@@ -3,13 +3,35 @@ package tracker
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"net"
 )
 
+// DefaultPort is the port announced to the trackers when none is set
+const DefaultPort = 25771
+
+// Announce events
+const (
+	EVENT_STARTED = iota
+	EVENT_COMPLETED
+	EVENT_STOPPED
+	EVENT_NONE // regular announce
+)
+
+var udpEvents = []uint32{2, 1, 3, 0}
+var httpEvents = []string{"started", "completed", "stopped", ""}
+
+var errUnknownEvent = errors.New("Unknown announce event")
+
+func validEvent(event int) bool {
+	return event >= 0 && event < len(httpEvents)
+}
+
 type Peer struct {
-	IP     net.IP
-	Port   uint16
-	Status byte
+	IP       net.IP
+	Port     uint16
+	Status   byte
+	InfoHash [20]byte // swarm where the peer was found
 }
 
 func StructToBuffer(st interface{}) []byte {
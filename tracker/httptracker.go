@@ -0,0 +1,146 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/vaguilera/MiniTorrent/bencode"
+	"github.com/vaguilera/MiniTorrent/logging"
+)
+
+// maxAnnounceResponse bounds the answers of the trackers, far above the
+// compact lists of peers they send
+const maxAnnounceResponse = 1 << 20
+
+type httpPeer struct {
+	IP   string `bencode:"ip"`
+	Port uint16 `bencode:"port"`
+}
+
+type httpAnnounceResponse struct {
+	FailureReason string             `bencode:"failure reason"`
+	Interval      int                `bencode:"interval"`
+	Peers         bencode.RawMessage `bencode:"peers"`
+}
+
+// HTTPTracker announces to an HTTP or HTTPS tracker
+type HTTPTracker struct {
+	URL      string
+	InfoHash [20]byte
+	Length   uint64
+	Port     uint16 // listen port, DefaultPort if 0
+	Event    int    // EVENT_STARTED by default
+	Log      logging.Logger
+}
+
+func (t *HTTPTracker) announceURL() (string, error) {
+	if !validEvent(t.Event) {
+		return "", errUnknownEvent
+	}
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return "", err
+	}
+
+	var peerID [20]byte
+	copy(peerID[:], "-SHOToTorrent-0.1---")
+
+	query := u.Query()
+	query.Set("info_hash", string(t.InfoHash[:]))
+	query.Set("peer_id", string(peerID[:]))
+	port := t.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	query.Set("port", strconv.Itoa(int(port)))
+	query.Set("uploaded", "0")
+	query.Set("downloaded", "0")
+	query.Set("left", strconv.FormatUint(t.Length, 10))
+	query.Set("compact", "1")
+	if event := httpEvents[t.Event]; event != "" {
+		query.Set("event", event)
+	}
+	query.Set("numwant", "200")
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func unmarshallPeers(raw bencode.RawMessage) ([]Peer, error) {
+	peers := []Peer{}
+
+	var compact []byte
+	if err := bencode.Unmarshal(raw, &compact); err == nil {
+		if len(compact)%6 != 0 {
+			return nil, errors.New("Invalid compact peers list")
+		}
+		for i := 0; i < len(compact); i += 6 {
+			peers = append(peers, Peer{
+				IP:   net.IP(compact[i : i+4]),
+				Port: binary.BigEndian.Uint16(compact[i+4 : i+6]),
+			})
+		}
+		return peers, nil
+	}
+
+	var list []httpPeer
+	if err := bencode.Unmarshal(raw, &list); err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			continue
+		}
+		peers = append(peers, Peer{IP: ip, Port: p.Port})
+	}
+	return peers, nil
+}
+
+// Announce sends the event to the tracker and returns the peers
+func (t *HTTPTracker) Announce() ([]Peer, error) {
+	announce, err := t.announceURL()
+	if err != nil {
+		return nil, err
+	}
+
+	client := http.Client{Timeout: 15 * time.Second}
+	if t.Log != nil {
+		t.Log.Debug("Announcing", "event", httpEvents[t.Event])
+	}
+	response, err := client.Get(announce)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("Tracker answered " + response.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxAnnounceResponse+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxAnnounceResponse {
+		return nil, errors.New("Tracker response too large")
+	}
+
+	var answer httpAnnounceResponse
+	err = bencode.Unmarshal(body, &answer)
+	if err != nil {
+		return nil, err
+	}
+	if answer.FailureReason != "" {
+		return nil, errors.New("Tracker failure: " + answer.FailureReason)
+	}
+	if len(answer.Peers) == 0 {
+		return []Peer{}, nil
+	}
+	return unmarshallPeers(answer.Peers)
+}
@@ -0,0 +1,80 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func Test_HTTPAnnounce(t *testing.T) {
+	var infoHash [20]byte
+	copy(infoHash[:], "01234567890123456789")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("info_hash") != string(infoHash[:]) {
+			w.Write([]byte("d14:failure reason7:unknowne"))
+			return
+		}
+		w.Write([]byte("d8:intervali900e5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x00\x50e"))
+	}))
+	defer server.Close()
+
+	tracker := &HTTPTracker{URL: server.URL + "/announce", InfoHash: infoHash}
+	peers, err := tracker.Announce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 || peers[0].IP.String() != "127.0.0.1" || peers[0].Port != 6881 || peers[1].Port != 80 {
+		t.Errorf("Unexpected peers %v", peers)
+	}
+
+	tracker.InfoHash = [20]byte{}
+	if _, err := tracker.Announce(); err == nil {
+		t.Errorf("Expected tracker failure")
+	}
+}
+
+func Test_HTTPAnnounceBadResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/error" {
+			http.Error(w, "d8:intervali900e5:peers0:e", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("d8:intervali900e5:peers"))
+		w.Write([]byte(strconv.Itoa(maxAnnounceResponse) + ":"))
+		w.Write(make([]byte, maxAnnounceResponse))
+		w.Write([]byte("e"))
+	}))
+	defer server.Close()
+
+	tracker := &HTTPTracker{URL: server.URL + "/error"}
+	if _, err := tracker.Announce(); err == nil || err.Error() != "Tracker answered 503 Service Unavailable" {
+		t.Errorf("Expected error for the status, got %v", err)
+	}
+	tracker.URL = server.URL + "/large"
+	if _, err := tracker.Announce(); err == nil || err.Error() != "Tracker response too large" {
+		t.Errorf("Expected error for the size, got %v", err)
+	}
+}
+
+func Test_unmarshallPeersList(t *testing.T) {
+	peers, err := unmarshallPeers([]byte("ld2:ip8:10.0.0.14:porti6881eed2:ip3:bad4:porti1eee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].IP.String() != "10.0.0.1" || peers[0].Port != 6881 {
+		t.Errorf("Unexpected peers %v", peers)
+	}
+}
+
+func Test_AnnounceUnknownEvent(t *testing.T) {
+	for _, event := range []int{-1, EVENT_NONE + 1} {
+		if _, err := (&HTTPTracker{URL: "http://tracker/announce", Event: event}).Announce(); err != errUnknownEvent {
+			t.Errorf("HTTP event %d: expected errUnknownEvent, got %v", event, err)
+		}
+		if _, err := (&UDPTracker{Event: event}).Announce(); err != errUnknownEvent {
+			t.Errorf("UDP event %d: expected errUnknownEvent, got %v", event, err)
+		}
+	}
+}
@@ -2,10 +2,11 @@ package tracker
 
 import (
 	"encoding/binary"
-	"log"
 	"math/rand"
 	"net"
 	"time"
+
+	"github.com/vaguilera/MiniTorrent/logging"
 )
 
 type connectionPacket struct {
@@ -69,6 +70,16 @@ type UDPTracker struct {
 	connectionID uint64
 	InfoHash     [20]byte
 	Length       uint64
+	Port         uint16 // listen port, DefaultPort if 0
+	Event        int    // EVENT_STARTED by default
+	Log          logging.Logger
+}
+
+func (t *UDPTracker) logger() logging.Logger {
+	if t.Log == nil {
+		return logging.Discard
+	}
+	return t.Log
 }
 
 func (t *UDPTracker) sendReceiveMessage(message interface{}) ([]byte, int, error) {
@@ -91,15 +102,17 @@ func (t *UDPTracker) sendReceiveMessage(message interface{}) ([]byte, int, error
 
 func (t *UDPTracker) Connect() (e error) {
 	s, err := net.ResolveUDPAddr("udp4", t.Host)
+	if err != nil {
+		return err
+	}
 	c, err := net.DialUDP("udp4", nil, s)
-	t.conn = c
-	t.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
-
 	if err != nil {
 		return err
 	}
+	t.conn = c
+	t.conn.SetReadDeadline(time.Now().Add(time.Second * 5))
 
-	log.Printf("Handshacking UDP server %s (%s)\n", t.Host, c.RemoteAddr().String())
+	t.logger().Debug("Connecting to UDP tracker", "addr", c.RemoteAddr().String())
 
 	handshake := &connectionPacket{
 		connectionID:  0x41727101980,
@@ -117,6 +130,9 @@ func (t *UDPTracker) Connect() (e error) {
 }
 
 func (t *UDPTracker) Announce() (peers []Peer, e error) {
+	if !validEvent(t.Event) {
+		return nil, errUnknownEvent
+	}
 
 	conn := &connectionPacket{
 		connectionID:  t.connectionID,
@@ -130,6 +146,11 @@ func (t *UDPTracker) Announce() (peers []Peer, e error) {
 	var exPayload [9]byte
 	copy(exPayload[:], "/announce")
 
+	port := t.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+
 	announce := announcePacket{
 		connection: *conn,
 		infoHash:   t.InfoHash,
@@ -137,11 +158,11 @@ func (t *UDPTracker) Announce() (peers []Peer, e error) {
 		downloaded: 0,
 		left:       t.Length,
 		uploaded:   0,
-		event:      2,
+		event:      udpEvents[t.Event],
 		ip:         0,
 		key:        rand.Uint32(),
 		numWant:    200,
-		port:       0x64ab,
+		port:       port,
 		extensions: 521,
 		expayload:  exPayload,
 	}
@@ -152,8 +173,15 @@ func (t *UDPTracker) Announce() (peers []Peer, e error) {
 	}
 
 	response := unmarshallAnnounce(buffer)
-	log.Printf("Tracker Answered with %d peers\n", len(response.Peers))
+	t.logger().Debug("Tracker answered", "peers", len(response.Peers))
 
 	return response.Peers, nil
 
 }
+
+// Close closes the connection with the tracker
+func (t *UDPTracker) Close() {
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
@@ -0,0 +1,607 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+const (
+	// targetDelay is the queuing delay LEDBAT aims at. The window grows
+	// while the delay is lower and shrinks while it is higher.
+	targetDelay     = 100 * time.Millisecond
+	maxCwndIncrease = 3000 // bytes per RTT
+	minWindow       = packetSize
+	initialWindow   = 4 * packetSize
+	maxWindow       = 1 << 20
+
+	recvBufferSize = 1 << 20
+	// maxInflight keeps the packets in flight within the selective acks of
+	// the peer
+	maxInflight = maxSackBytes * 8
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	maxSynTries    = 3
+	maxRetransmits = 8
+	keepAlive      = 29 * time.Second
+)
+
+var (
+	errClosed      = errors.New("Use of closed uTP connection")
+	errReset       = errors.New("uTP connection reset by peer")
+	errConnTimeout = errors.New("uTP connection timed out")
+)
+
+// timeoutError is returned when a deadline passes
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// outPacket is a packet waiting for its ack
+type outPacket struct {
+	typ           int
+	seqNr         uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+}
+
+// Conn is a uTP connection
+type Conn struct {
+	socket         *Socket
+	addr           net.Addr
+	key            connKey
+	recvID, sendID uint16
+
+	mu      sync.Mutex
+	changed chan struct{} // closed and replaced when the state changes
+	state   int
+	err     error // why the connection broke
+	closed  bool  // by Close
+	seqNr   uint16
+	ackNr   uint16 // last packet received in order
+
+	inflight   []*outPacket
+	curWindow  int     // bytes in flight
+	maxWindow  float64 // congestion window
+	peerWindow int
+	lastAck    uint16
+	dupAcks    int
+	lossSeq    uint16 // losses of packets sent before it don't shrink the window again
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	timeoutAt  time.Time // zero if nothing waits for an ack
+	retries    int       // timeouts in a row
+	lastSend   time.Time
+	replyDelay uint32 // timestamp difference to send back
+	delays     baseDelay
+
+	readBuf []byte
+	ooo     map[uint16][]byte // packets received out of order
+	finSeq  uint16
+	gotFin  bool
+	eof     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, addr net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		socket:     s,
+		addr:       addr,
+		key:        connKey{addr.String(), recvID},
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		maxWindow:  initialWindow,
+		peerWindow: recvBufferSize,
+		rto:        initialTimeout,
+	}
+}
+
+// broadcast wakes up the goroutines waiting for a change
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait releases the lock until the state changes or deadline passes
+func (c *Conn) wait(deadline time.Time) {
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+	if deadline.IsZero() {
+		<-changed
+		return
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-changed:
+	case <-timer.C:
+	}
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		switch {
+		case c.closed:
+			return 0, errClosed
+		case len(c.readBuf) > 0:
+			full := c.recvWindow() < packetSize
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			// tell the peer it can send again
+			if full && c.state != stateClosed {
+				c.sendState(time.Now())
+			}
+			return n, nil
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case expired(c.readDeadline):
+			return 0, timeoutError{}
+		}
+		c.wait(c.readDeadline)
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		switch {
+		case c.closed:
+			return n, errClosed
+		case c.err != nil:
+			return n, c.err
+		case expired(c.writeDeadline):
+			return n, timeoutError{}
+		}
+		size := len(b) - n
+		if size > maxPayload {
+			size = maxPayload
+		}
+		if c.canSend(size) {
+			c.sendData(ST_DATA, append([]byte(nil), b[n:n+size]...), time.Now())
+			n += size
+			continue
+		}
+		c.wait(c.writeDeadline)
+	}
+	return n, nil
+}
+
+// Close sends a FIN after the data written so far. The connection lingers
+// until the peer acks it.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	switch c.state {
+	case stateSynSent:
+		c.destroy()
+	case stateConnected:
+		c.state = stateFinSent
+		c.sendData(ST_FIN, nil, time.Now())
+	}
+	c.broadcast()
+	return nil
+}
+
+// LocalAddr returns the address of the socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+// RemoteAddr returns the UDP address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
+
+// canSend reports whether n more bytes fit in the windows. A packet can
+// always be sent if none is in flight.
+func (c *Conn) canSend(n int) bool {
+	if len(c.inflight) == 0 {
+		return true
+	}
+	window := int(c.maxWindow)
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+	return len(c.inflight) < maxInflight && c.curWindow+n <= window
+}
+
+func (c *Conn) recvWindow() int {
+	if free := recvBufferSize - len(c.readBuf); free > 0 {
+		return free
+	}
+	return 0
+}
+
+func (c *Conn) sendPacket(typ int, seqNr uint16, payload []byte, now time.Time) {
+	p := &packet{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDelay,
+		wndSize:       uint32(c.recvWindow()),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+		payload:       payload,
+	}
+	if typ == ST_SYN {
+		p.connID = c.recvID
+	} else {
+		p.sack = c.sack()
+	}
+	c.lastSend = now
+	c.socket.WriteTo(p.marshal(), c.addr)
+}
+
+// sendData sends a packet that takes a sequence number and waits for its ack
+func (c *Conn) sendData(typ int, payload []byte, now time.Time) {
+	op := &outPacket{typ: typ, seqNr: c.seqNr, payload: payload, sent: now, transmissions: 1}
+	c.seqNr++
+	c.inflight = append(c.inflight, op)
+	c.curWindow += len(payload)
+	if c.timeoutAt.IsZero() {
+		c.timeoutAt = now.Add(c.rto)
+	}
+	c.sendPacket(typ, op.seqNr, payload, now)
+}
+
+// sendState acks what we received
+func (c *Conn) sendState(now time.Time) {
+	c.sendPacket(ST_STATE, c.seqNr, nil, now)
+}
+
+func (c *Conn) resend(op *outPacket, now time.Time) {
+	op.transmissions++
+	op.sent = now
+	c.sendPacket(op.typ, op.seqNr, op.payload, now)
+}
+
+// sack returns the bitmask of the packets received after the missing
+// ackNr+1, nil if there are none
+func (c *Conn) sack() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	mask := make([]byte, maxSackBytes)
+	last := -1
+	for seq := range c.ooo {
+		i := int(seq - c.ackNr - 2)
+		if i < len(mask)*8 {
+			mask[i/8] |= 1 << (i % 8)
+			if i > last {
+				last = i
+			}
+		}
+	}
+	if last < 0 {
+		return nil
+	}
+	return mask[:(last/32+1)*4]
+}
+
+// sacked reports whether seq is selectively acked by p
+func sacked(p *packet, seq uint16) bool {
+	i := int(seq - p.ackNr - 2)
+	return i < len(p.sack)*8 && p.sack[i/8]&(1<<(i%8)) != 0
+}
+
+// receive handles a packet of the peer
+func (c *Conn) receive(p *packet, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	defer c.broadcast()
+	if p.typ == ST_RESET {
+		c.fail(errReset)
+		return
+	}
+	c.replyDelay = timestamp(now) - p.timestamp
+	c.peerWindow = int(p.wndSize)
+
+	if c.state == stateSynSent {
+		if p.typ != ST_STATE {
+			return
+		}
+		// the STATE doesn't take a sequence number, the first DATA has the
+		// same one
+		c.state = stateConnected
+		c.ackNr = p.seqNr - 1
+		c.retries = 0
+		c.rto = initialTimeout
+		c.timeoutAt = time.Time{}
+	}
+	c.processAck(p, now)
+	if p.typ == ST_DATA || p.typ == ST_FIN {
+		c.receiveData(p)
+		c.sendState(now)
+	}
+	if c.state == stateFinSent && len(c.inflight) == 0 {
+		c.destroy()
+	}
+}
+
+func (c *Conn) processAck(p *packet, now time.Time) {
+	// ignore acks of packets we didn't send
+	if seqLess(c.seqNr-1, p.ackNr) {
+		return
+	}
+	acked := 0
+	before := len(c.inflight)
+	rest := c.inflight[:0]
+	for _, op := range c.inflight {
+		if !seqLess(p.ackNr, op.seqNr) || sacked(p, op.seqNr) {
+			acked += len(op.payload)
+			c.curWindow -= len(op.payload)
+			// only packets sent once give an unambiguous round trip
+			if op.transmissions == 1 {
+				c.updateRTT(now.Sub(op.sent))
+			}
+			continue
+		}
+		rest = append(rest, op)
+	}
+	for i := len(rest); i < before; i++ {
+		c.inflight[i] = nil
+	}
+	c.inflight = rest
+
+	if len(c.inflight) < before {
+		c.retries = 0
+		c.dupAcks = 0
+		// progress ends the backoff of the timeouts
+		if c.rtt > 0 {
+			c.setTimeout()
+		}
+		c.timeoutAt = time.Time{}
+		if len(c.inflight) > 0 {
+			c.timeoutAt = now.Add(c.rto)
+		}
+		if p.timestampDiff != 0 && acked > 0 {
+			c.delays.add(p.timestampDiff, now)
+			delay := time.Duration(p.timestampDiff-c.delays.get()) * time.Microsecond
+			c.maxWindow = ledbat(c.maxWindow, acked, delay)
+		}
+	} else if p.typ == ST_STATE && p.ackNr == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			c.lost(c.inflight[0], now)
+		}
+	}
+	c.lastAck = p.ackNr
+
+	// a packet is lost once three sent after it were selectively acked
+	if p.sack == nil {
+		return
+	}
+	var seqs []uint16
+	for i := 0; i < len(p.sack)*8; i++ {
+		if p.sack[i/8]&(1<<(i%8)) != 0 {
+			seqs = append(seqs, p.ackNr+2+uint16(i))
+		}
+	}
+	// both are in order, and the sacked packets aren't in flight anymore
+	j := 0
+	for _, op := range c.inflight {
+		for j < len(seqs) && !seqLess(op.seqNr, seqs[j]) {
+			j++
+		}
+		if len(seqs)-j >= 3 && now.Sub(op.sent) > c.rtt {
+			c.lost(op, now)
+		}
+	}
+}
+
+// lost resends a packet, and shrinks the window once per window of packets
+func (c *Conn) lost(op *outPacket, now time.Time) {
+	if !seqLess(op.seqNr, c.lossSeq) {
+		c.maxWindow = math.Max(c.maxWindow/2, minWindow)
+		c.lossSeq = c.seqNr
+	}
+	c.resend(op, now)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = sample, sample/2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.setTimeout()
+}
+
+func (c *Conn) setTimeout() {
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+}
+
+func (c *Conn) receiveData(p *packet) {
+	if c.gotFin && seqLess(c.finSeq, p.seqNr) {
+		return
+	}
+	if p.typ == ST_FIN {
+		c.gotFin, c.finSeq = true, p.seqNr
+	}
+	switch distance := p.seqNr - c.ackNr; {
+	case distance == 1:
+		c.readBuf = append(c.readBuf, p.payload...)
+		c.ackNr++
+		for {
+			payload, ok := c.ooo[c.ackNr+1]
+			if !ok {
+				break
+			}
+			delete(c.ooo, c.ackNr+1)
+			c.readBuf = append(c.readBuf, payload...)
+			c.ackNr++
+		}
+	case distance > 1 && int(distance) <= maxSackBytes*8+1:
+		if c.ooo == nil {
+			c.ooo = make(map[uint16][]byte)
+		}
+		c.ooo[p.seqNr] = append([]byte(nil), p.payload...)
+	}
+	if c.gotFin && c.ackNr == c.finSeq {
+		c.eof = true
+	}
+}
+
+// tick resends what timed out and keeps idle connections alive
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if c.timeoutAt.IsZero() || now.Before(c.timeoutAt) {
+		if c.state == stateConnected && now.Sub(c.lastSend) > keepAlive {
+			c.sendState(now)
+		}
+		return
+	}
+	c.retries++
+	if c.state == stateSynSent && c.retries >= maxSynTries || c.retries > maxRetransmits {
+		c.fail(errConnTimeout)
+		c.broadcast()
+		return
+	}
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+	c.timeoutAt = now.Add(c.rto)
+	if c.state == stateSynSent {
+		c.sendPacket(ST_SYN, c.seqNr-1, nil, now)
+		return
+	}
+	c.maxWindow = minWindow
+	c.resend(c.inflight[0], now)
+}
+
+func (c *Conn) fail(err error) {
+	c.err = err
+	c.destroy()
+}
+
+// destroy forgets the connection
+func (c *Conn) destroy() {
+	c.state = stateClosed
+	c.timeoutAt = time.Time{}
+	c.socket.remove(c)
+}
+
+// ledbat returns the congestion window after acked bytes arrived with a
+// queuing delay of delay
+func ledbat(window float64, acked int, delay time.Duration) float64 {
+	offTarget := float64(targetDelay-delay) / float64(targetDelay)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+	windowFactor := float64(acked) / math.Max(window, float64(acked))
+	window += maxCwndIncrease * offTarget * windowFactor
+	return math.Min(math.Max(window, minWindow), maxWindow)
+}
+
+// baseDelay is the lowest delay of the last minutes, taken as the one of
+// the link without queues. The clocks of the peers needn't agree, as their
+// offset is in both the samples and the base delay.
+type baseDelay struct {
+	mins   [3]uint32 // of the current and the previous minutes
+	count  int
+	minute int64
+}
+
+func (b *baseDelay) add(sample uint32, now time.Time) {
+	minute := now.Unix() / 60
+	if b.count == 0 || minute != b.minute {
+		copy(b.mins[1:], b.mins[:])
+		b.mins[0] = sample
+		b.minute = minute
+		if b.count < len(b.mins) {
+			b.count++
+		}
+		return
+	}
+	if int32(sample-b.mins[0]) < 0 {
+		b.mins[0] = sample
+	}
+}
+
+func (b *baseDelay) get() uint32 {
+	min := b.mins[0]
+	for _, m := range b.mins[1:b.count] {
+		if int32(m-min) < 0 {
+			min = m
+		}
+	}
+	return min
+}
@@ -0,0 +1,295 @@
+package utp
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// tickInterval is how often the timeouts of the connections are checked
+const tickInterval = 50 * time.Millisecond
+
+const backlogSize = 32
+
+var errSocketClosed = errors.New("uTP socket closed")
+
+// connKey identifies a connection by the address of the peer and the id of
+// the packets it sends us
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes the uTP connections of a UDP socket. It accepts
+// incoming ones like a net.Listener.
+type Socket struct {
+	conn      net.PacketConn
+	mu        sync.Mutex
+	conns     map[connKey]*Conn
+	handler   func(packet []byte, addr net.Addr) // of the other protocols
+	backlog   chan *Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen opens a UDP socket for uTP, like Listen("udp", ":6881")
+func Listen(network, addr string) (*Socket, error) {
+	conn, err := net.ListenPacket(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP on conn, that belongs to the socket from now on
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:    conn,
+		conns:   make(map[connKey]*Conn),
+		backlog: make(chan *Conn, backlogSize),
+		closed:  make(chan struct{}),
+	}
+	go s.readPackets()
+	go s.tick()
+	return s
+}
+
+// HandlePackets sets the function called with the datagrams that aren't uTP,
+// so that another protocol can share the socket. They are dropped if it is
+// nil.
+func (s *Socket) HandlePackets(handler func(packet []byte, addr net.Addr)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handler = handler
+}
+
+// WriteTo sends a datagram, for the protocols sharing the socket
+func (s *Socket) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return s.conn.WriteTo(b, addr)
+}
+
+// Addr returns the address of the UDP socket
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for an incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.closed:
+		return nil, errSocketClosed
+	}
+}
+
+// Close closes the UDP socket and breaks its connections
+func (s *Socket) Close() error {
+	err := errSocketClosed
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+		s.mu.Lock()
+		conns := s.snapshot()
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			if c.state != stateClosed {
+				c.fail(errSocketClosed)
+				c.broadcast()
+			}
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+// Dial connects to a uTP peer
+func (s *Socket) Dial(addr string) (*Conn, error) {
+	return s.DialContext(context.Background(), addr)
+}
+
+// DialContext connects to a uTP peer, until ctx is done
+func (s *Socket) DialContext(ctx context.Context, addr string) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-s.closed:
+		return nil, errSocketClosed
+	default:
+	}
+
+	// the SYN says the id we receive with, we send with the next one
+	s.mu.Lock()
+	var c *Conn
+	for c == nil || s.conns[c.key] != nil {
+		id := uint16(rand.Intn(1 << 16))
+		c = newConn(s, raddr, id, id+1)
+	}
+	s.conns[c.key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.state = stateSynSent
+	c.seqNr = 2
+	c.lossSeq = c.seqNr
+	c.timeoutAt = now.Add(c.rto)
+	c.sendPacket(ST_SYN, 1, nil, now)
+	for c.state == stateSynSent {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+			c.mu.Lock()
+		case <-ctx.Done():
+			c.mu.Lock()
+			if c.state == stateSynSent {
+				c.destroy()
+				return nil, ctx.Err()
+			}
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+func (s *Socket) readPackets() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		s.dispatch(buf[:n], addr, time.Now())
+	}
+}
+
+// dispatch hands a datagram to its connection or to the other protocols
+func (s *Socket) dispatch(buf []byte, addr net.Addr, now time.Time) {
+	p, err := unmarshalPacket(buf)
+	s.mu.Lock()
+	if err != nil {
+		handler := s.handler
+		s.mu.Unlock()
+		if handler != nil {
+			handler(append([]byte(nil), buf...), addr)
+		}
+		return
+	}
+	host := addr.String()
+	c := s.conns[connKey{host, p.connID}]
+	switch p.typ {
+	case ST_SYN:
+		// a SYN we already answered, the id of its connection is the next one
+		c = s.conns[connKey{host, p.connID + 1}]
+	case ST_RESET:
+		if c == nil {
+			c = s.resetConn(host, p.connID)
+		}
+	}
+	s.mu.Unlock()
+
+	switch {
+	case p.typ == ST_SYN && c != nil:
+		c.mu.Lock()
+		if c.state != stateClosed {
+			c.sendState(now)
+		}
+		c.mu.Unlock()
+	case p.typ == ST_SYN:
+		s.accept(p, addr, now)
+	case c != nil:
+		c.receive(p, now)
+	case p.typ != ST_RESET:
+		reset := &packet{typ: ST_RESET, connID: p.connID, timestamp: timestamp(now), seqNr: uint16(rand.Intn(1 << 16)), ackNr: p.seqNr}
+		s.WriteTo(reset.marshal(), addr)
+	}
+}
+
+// resetConn finds the connection of a RESET that has the id we send with
+func (s *Socket) resetConn(host string, id uint16) *Conn {
+	for _, recvID := range []uint16{id - 1, id + 1} {
+		if c := s.conns[connKey{host, recvID}]; c != nil && c.sendID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// accept answers a SYN with a new connection, unless the backlog is full
+func (s *Socket) accept(syn *packet, addr net.Addr, now time.Time) {
+	c := newConn(s, addr, syn.connID+1, syn.connID)
+	c.state = stateConnected
+	c.seqNr = uint16(rand.Intn(1 << 16))
+	c.lossSeq = c.seqNr
+	c.ackNr = syn.seqNr
+	c.peerWindow = int(syn.wndSize)
+	c.replyDelay = timestamp(now) - syn.timestamp
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return
+	case s.backlog <- c:
+		s.conns[c.key] = c
+	default:
+		// the peer will retry
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	if c.state != stateClosed {
+		c.sendState(now)
+	}
+	c.mu.Unlock()
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns[c.key] == c {
+		delete(s.conns, c.key)
+	}
+}
+
+func (s *Socket) snapshot() []*Conn {
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := s.snapshot()
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		case <-s.closed:
+			return
+		}
+	}
+}
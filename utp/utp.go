@@ -0,0 +1,128 @@
+// Package utp implements the Micro Transport Protocol (BEP 29), a reliable
+// stream over UDP. Its LEDBAT congestion control backs off as soon as it
+// adds delay to the link, so that it yields to interactive traffic.
+//
+// A Socket is a net.Listener whose connections are net.Conn. It can share
+// its UDP port with other protocols, like the DHT, that get the datagrams
+// that aren't uTP.
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types
+const (
+	ST_DATA = iota
+	ST_FIN
+	ST_STATE
+	ST_RESET
+	ST_SYN
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+
+	// packetSize is the biggest datagram we send, that fits the MTU of most
+	// links
+	packetSize = 1400
+	maxPayload = packetSize - headerSize - 4 - 32
+
+	// maxSackBytes bounds the bitmask of selective acks, of 8 packets per
+	// byte
+	maxSackBytes = 32
+)
+
+var errInvalidPacket = errors.New("Invalid uTP packet")
+
+type packet struct {
+	typ           int
+	connID        uint16
+	timestamp     uint32 // microseconds
+	timestampDiff uint32 // microseconds
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	sack          []byte // bitmask of the packets received after ackNr+1
+	payload       []byte
+}
+
+func (p *packet) marshal() []byte {
+	size := headerSize + len(p.payload)
+	if p.sack != nil {
+		size += 2 + len(p.sack)
+	}
+	buf := make([]byte, size)
+	buf[0] = byte(p.typ<<4 | version)
+	binary.BigEndian.PutUint16(buf[2:4], p.connID)
+	binary.BigEndian.PutUint32(buf[4:8], p.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], p.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], p.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], p.seqNr)
+	binary.BigEndian.PutUint16(buf[18:20], p.ackNr)
+	i := headerSize
+	if p.sack != nil {
+		buf[1] = extSelectiveAck
+		buf[i+1] = byte(len(p.sack))
+		copy(buf[i+2:], p.sack)
+		i += 2 + len(p.sack)
+	}
+	copy(buf[i:], p.payload)
+	return buf
+}
+
+// isPacket reports whether a datagram looks like uTP, to tell it apart from
+// the ones of other protocols on the same socket, like the bencoded DHT
+// messages
+func isPacket(buf []byte) bool {
+	return len(buf) >= headerSize && buf[0]&0x0f == version && int(buf[0]>>4) <= ST_SYN && buf[1] <= 2
+}
+
+func unmarshalPacket(buf []byte) (*packet, error) {
+	if !isPacket(buf) {
+		return nil, errInvalidPacket
+	}
+	p := &packet{
+		typ:           int(buf[0] >> 4),
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:       binary.BigEndian.Uint32(buf[12:16]),
+		seqNr:         binary.BigEndian.Uint16(buf[16:18]),
+		ackNr:         binary.BigEndian.Uint16(buf[18:20]),
+	}
+	// a chain of extensions, each one saying the type of the next
+	ext := buf[1]
+	i := headerSize
+	for ext != 0 {
+		if len(buf) < i+2 || len(buf) < i+2+int(buf[i+1]) {
+			return nil, errInvalidPacket
+		}
+		next, length := buf[i], int(buf[i+1])
+		if ext == extSelectiveAck {
+			if length == 0 || length%4 != 0 {
+				return nil, errInvalidPacket
+			}
+			p.sack = buf[i+2 : i+2+length]
+		}
+		ext = next
+		i += 2 + length
+	}
+	p.payload = buf[i:]
+	return p, nil
+}
+
+// seqLess reports whether sequence number a comes before b, with wrapping
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// timestamp returns the time in microseconds, wrapping every 71 minutes
+func timestamp(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Microsecond))
+}
@@ -0,0 +1,270 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn is a loopback link that drops some datagrams and delays the
+// others, which reorders them
+type lossyConn struct {
+	net.PacketConn
+	mu       sync.Mutex
+	random   *rand.Rand
+	loss     float64
+	maxDelay time.Duration
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.random.Float64() < c.loss
+	delay := time.Duration(c.random.Int63n(int64(c.maxDelay) + 1))
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	buf := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(buf, addr)
+	})
+	return len(b), nil
+}
+
+func testSocket(t *testing.T, loss float64, maxDelay time.Duration, seed int64) *Socket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewSocket(&lossyConn{PacketConn: conn, random: rand.New(rand.NewSource(seed)), loss: loss, maxDelay: maxDelay})
+}
+
+// testConns connects two sockets and returns both ends
+func testConns(t *testing.T, client, server *Socket) (*Conn, net.Conn) {
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := server.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- c
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := client.DialContext(ctx, server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, <-accepted
+}
+
+func Test_packet(t *testing.T) {
+	p := &packet{typ: ST_STATE, connID: 7, timestamp: 1, timestampDiff: 2, wndSize: 3, seqNr: 4, ackNr: 5,
+		sack: []byte{1, 0, 0, 0x80}, payload: []byte("abc")}
+	got, err := unmarshalPacket(p.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.typ != p.typ || got.connID != 7 || got.timestamp != 1 || got.timestampDiff != 2 || got.wndSize != 3 ||
+		got.seqNr != 4 || got.ackNr != 5 || !bytes.Equal(got.sack, p.sack) || string(got.payload) != "abc" {
+		t.Errorf("Got %+v", got)
+	}
+	if !sacked(got, 7) || !sacked(got, 38) || sacked(got, 8) || sacked(got, 6) {
+		t.Errorf("Wrong selective acks")
+	}
+
+	for _, invalid := range [][]byte{
+		[]byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"), // DHT
+		make([]byte, 10),
+		append([]byte{ST_STATE<<4 | version, extSelectiveAck}, make([]byte, 19)...), // extension past the end
+	} {
+		if _, err := unmarshalPacket(invalid); err == nil {
+			t.Errorf("Expected error for %q", invalid)
+		}
+	}
+}
+
+func Test_ledbat(t *testing.T) {
+	window := float64(10 * packetSize)
+	if w := ledbat(window, packetSize, 0); w <= window {
+		t.Errorf("Window didn't grow without delay: %f", w)
+	}
+	if w := ledbat(window, packetSize, targetDelay); w != window {
+		t.Errorf("Window changed on target: %f", w)
+	}
+	if w := ledbat(window, packetSize, 2*targetDelay); w >= window {
+		t.Errorf("Window didn't shrink with delay: %f", w)
+	}
+	if w := ledbat(minWindow, packetSize, time.Minute); w != minWindow {
+		t.Errorf("Window below the minimum: %f", w)
+	}
+	// a whole window acked grows it by maxCwndIncrease
+	if w := ledbat(window, int(window), 0); w != window+maxCwndIncrease {
+		t.Errorf("Unexpected growth: %f", w-window)
+	}
+}
+
+func Test_baseDelay(t *testing.T) {
+	var b baseDelay
+	now := time.Unix(6000, 0)
+	b.add(5000, now)
+	b.add(3000, now.Add(time.Second))
+	b.add(4000, now.Add(time.Minute))
+	if base := b.get(); base != 3000 {
+		t.Errorf("Expected 3000, got %d", base)
+	}
+	// the old minimum is forgotten
+	b.add(4500, now.Add(2*time.Minute))
+	b.add(4200, now.Add(3*time.Minute))
+	if base := b.get(); base != 4000 {
+		t.Errorf("Expected 4000, got %d", base)
+	}
+}
+
+func Test_Transfer(t *testing.T) {
+	client := testSocket(t, 0.05, 5*time.Millisecond, 1)
+	defer client.Close()
+	server := testSocket(t, 0.05, 5*time.Millisecond, 2)
+	defer server.Close()
+	c, s := testConns(t, client, server)
+	c.SetDeadline(time.Now().Add(30 * time.Second))
+	s.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// the server echoes what it gets until the client closes
+	go func() {
+		io.Copy(s, s)
+		s.Close()
+	}()
+	data := make([]byte, 300000)
+	rand.New(rand.NewSource(3)).Read(data)
+	go c.Write(data)
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(c, echo); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Error("Echoed data doesn't match")
+	}
+	c.Close()
+}
+
+func Test_CloseEOF(t *testing.T) {
+	client := testSocket(t, 0, 0, 1)
+	defer client.Close()
+	server := testSocket(t, 0, 0, 2)
+	defer server.Close()
+	c, s := testConns(t, client, server)
+	c.Write([]byte("hello"))
+	c.Close()
+	if _, err := c.Write([]byte("x")); err == nil {
+		t.Error("Write after Close")
+	}
+
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := ioutil.ReadAll(s)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("Got %q %v", got, err)
+	}
+	s.Close()
+}
+
+func Test_Deadline(t *testing.T) {
+	client := testSocket(t, 0, 0, 1)
+	defer client.Close()
+	server := testSocket(t, 0, 0, 2)
+	defer server.Close()
+	c, s := testConns(t, client, server)
+	defer c.Close()
+	defer s.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Expected timeout, got %v", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	s.Write([]byte("x"))
+	if n, err := c.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("Read after deadline: %d %v", n, err)
+	}
+}
+
+func Test_DialTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	client := testSocket(t, 0, 0, 1)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := client.DialContext(ctx, silent.LocalAddr().String()); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline, got %v", err)
+	}
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.conns) != 0 {
+		t.Errorf("Failed connection not removed")
+	}
+}
+
+func Test_Reset(t *testing.T) {
+	client := testSocket(t, 0, 0, 1)
+	defer client.Close()
+	server := testSocket(t, 0, 0, 2)
+	c, _ := testConns(t, client, server)
+	defer c.Close()
+
+	// the server forgot the connection
+	server.Close()
+	restarted, err := net.ListenPacket("udp", server.Addr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	server = NewSocket(restarted)
+	defer server.Close()
+	c.Write([]byte("x"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != errReset {
+		t.Errorf("Expected reset, got %v", err)
+	}
+}
+
+func Test_SharedSocket(t *testing.T) {
+	client := testSocket(t, 0, 0, 1)
+	defer client.Close()
+	server := testSocket(t, 0, 0, 2)
+	defer server.Close()
+	packets := make(chan string, 1)
+	server.HandlePackets(func(packet []byte, addr net.Addr) {
+		packets <- string(packet)
+	})
+
+	c, s := testConns(t, client, server)
+	defer c.Close()
+	defer s.Close()
+	client.WriteTo([]byte("d1:y1:qe"), server.Addr())
+	c.Write([]byte("utp"))
+
+	buf := make([]byte, 3)
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(s, buf); err != nil || string(buf) != "utp" {
+		t.Errorf("Got %q %v", buf, err)
+	}
+	select {
+	case packet := <-packets:
+		if packet != "d1:y1:qe" {
+			t.Errorf("Got %q", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Other protocol didn't get its datagram")
+	}
+}